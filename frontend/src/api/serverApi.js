@@ -70,4 +70,13 @@ export const addJobToServer = async (serverId, jobId, jobData) => {
     body: JSON.stringify(jobData),
   });
   return response.json();
-};
\ No newline at end of file
+};
+export const subscribeFleet = (adminId, labels, onMessage) => {
+  const wsUrl = BASE_URL.replace(/^http/, 'ws');
+  const socket = new WebSocket(`${wsUrl}/admin/fleet/ws?user_id=${adminId}&labels=${labels.join(',')}`);
+  socket.onmessage = (event) => onMessage(JSON.parse(event.data));
+  return {
+    setLabels: (newLabels) => socket.send(JSON.stringify({ action: 'subscribe', labels: newLabels })),
+    close: () => socket.close(),
+  };
+};
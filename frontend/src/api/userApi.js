@@ -87,4 +87,9 @@ export const deletePayment = async (id, paymentId) => {
     method: 'DELETE',
   });
   return response.json();
-};
\ No newline at end of file
+};
+export const subscribeJobEvents = (userId, onEvent) => {
+  const source = new EventSource(`${BASE_URL}/jobs/events?user_id=${userId}`);
+  source.addEventListener('job', (event) => onEvent(JSON.parse(event.data)));
+  return () => source.close();
+};
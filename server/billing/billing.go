@@ -0,0 +1,239 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/moevm/nosql2h24-transcribtion/config"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/money"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Политики оплаты
+const (
+	PolicyPrepay      = "prepay"
+	PolicyPostpay     = "postpay"
+	PolicyCreditLimit = "credit_limit"
+)
+
+// StatusAwaitingPayment - статус задачи, которая ждёт оплаты и не назначается на сервер
+const StatusAwaitingPayment = "awaiting_payment"
+
+// Default - политика для пользователей без собственной
+var Default = models.BillingPolicy{Policy: PolicyPostpay}
+
+// Configure задаёт политику по умолчанию из конфигурации.
+func Configure(cfg config.Config) error {
+	policy := models.BillingPolicy{Policy: cfg.BillingPolicy}
+	if cfg.BillingCreditLimit != "" {
+		limit, err := money.Parse(cfg.BillingCreditLimit, cfg.DefaultCurrency)
+		if err != nil {
+			return fmt.Errorf("invalid credit limit: %w", err)
+		}
+		policy.CreditLimit = &limit
+	}
+	if err := Validate(policy); err != nil {
+		return err
+	}
+	Default = policy
+	return nil
+}
+
+// Validate проверяет политику: известное название и кредитный лимит для credit_limit.
+func Validate(policy models.BillingPolicy) error {
+	switch policy.Policy {
+	case PolicyPrepay, PolicyPostpay:
+		return nil
+	case PolicyCreditLimit:
+		if policy.CreditLimit == nil {
+			return errors.New("credit limit is required")
+		}
+		if err := policy.CreditLimit.Validate(); err != nil {
+			return err
+		}
+		if policy.CreditLimit.Amount < 0 {
+			return errors.New("credit limit must not be negative")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown billing policy %q", policy.Policy)
+	}
+}
+
+// For возвращает политику оплаты пользователя.
+func For(user models.User) models.BillingPolicy {
+	if user.Billing != nil {
+		return *user.Billing
+	}
+	return Default
+}
+
+// RequiresPrice сообщает, что задачи пользователя с этой политикой должны иметь цену.
+func RequiresPrice(policy models.BillingPolicy) bool {
+	return policy.Policy != PolicyPostpay
+}
+
+// ReservationTTL - время, через которое резерв кредита, не снятый Release (например, если сервис
+// упал между проверкой и сохранением задач), перестаёт учитываться.
+const ReservationTTL = time.Minute
+
+// ReservationsCollection - коллекция резервов кредита: по документу на пользователя и валюту
+// с суммой задач, которые пропущены Gate, но ещё не сохранены.
+const ReservationsCollection = "credit_reservations"
+
+// Gate решает, какие новые задачи пользователя ждут оплаты. Задача выполняется сразу, если
+// вместе с долгом (Outstanding) и резервом кредита она укладывается в баланс кошелька (и кредитный
+// лимит для credit_limit). Цена пропущенной задачи атомарно добавляется к резерву пользователя,
+// поэтому параллельные запросы не могут вместе превысить лимит, а один Gate можно использовать
+// для пакета задач. После сохранения задач резерв снимается вызовом Release.
+type Gate struct {
+	user     models.User
+	policy   models.BillingPolicy
+	reserved map[string]int64
+}
+
+func NewGate(user models.User) *Gate {
+	return &Gate{user: user, policy: For(user), reserved: map[string]int64{}}
+}
+
+// Admit возвращает true, если задача может сразу выполняться, и false, если она должна ждать оплаты.
+// Оплаченная задача проходит всегда.
+func (g *Gate) Admit(job models.Job) (bool, error) {
+	if !job.PaidAt.IsZero() || g.policy.Policy == PolicyPostpay {
+		return true, nil
+	}
+	if job.Price == nil {
+		return false, nil
+	}
+
+	// Цену в другой валюте с балансом и лимитом сравнить нельзя - такая задача ждёт оплаты
+	available := money.New(0, job.Price.Currency)
+	if g.user.Wallet != nil && g.user.Wallet.Balance.Currency == available.Currency {
+		available = g.user.Wallet.Balance
+	}
+	if g.policy.Policy == PolicyCreditLimit && g.policy.CreditLimit.Currency == available.Currency {
+		var err error
+		if available, err = available.Add(*g.policy.CreditLimit); err != nil {
+			return false, err
+		}
+	}
+	if !available.IsPositive() {
+		return false, nil
+	}
+
+	// Сначала резерв, потом долг: задача параллельного запроса сохраняется до снятия её резерва,
+	// поэтому она учтена хотя бы в одном из них
+	reserved, err := reserve(g.user.ID, available.Currency, job.Price.Amount)
+	if err != nil {
+		return false, err
+	}
+	outstanding, err := Outstanding(g.user.ID, available.Currency)
+	if err == nil {
+		outstanding, err = outstanding.Add(reserved)
+	}
+	if err != nil || outstanding.Amount > available.Amount {
+		if releaseErr := release(g.user.ID, available.Currency, job.Price.Amount); releaseErr != nil {
+			return false, releaseErr
+		}
+		if errors.Is(err, money.ErrOverflow) {
+			err = nil
+		}
+		return false, err
+	}
+	g.reserved[available.Currency] += job.Price.Amount
+	return true, nil
+}
+
+// Release снимает резерв кредита задач, пропущенных Admit. Вызывается после того, как задачи
+// сохранены (или не сохранены) - дальше их учитывает Outstanding.
+func (g *Gate) Release() {
+	for currency, amount := range g.reserved {
+		if err := release(g.user.ID, currency, amount); err != nil {
+			log.Printf("Error releasing credit reservation of user %v: %v", g.user.ID, err)
+		}
+		delete(g.reserved, currency)
+	}
+}
+
+// reserve атомарно добавляет amount к резерву пользователя в валюте currency и возвращает
+// резерв вместе с ним. Истёкший резерв перед этим обнуляется.
+func reserve(userID primitive.ObjectID, currency string, amount int64) (money.Money, error) {
+	now := time.Now()
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"reserved": bson.M{"$add": bson.A{
+			bson.M{"$cond": bson.A{bson.M{"$gt": bson.A{"$expires_at", now}}, "$reserved", 0}},
+			amount,
+		}},
+		"expires_at": now.Add(ReservationTTL),
+	}}}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var reservation struct {
+		Reserved int64 `bson:"reserved"`
+	}
+	filter := bson.M{"user_id": userID, "currency": currency}
+	collection := db.GetCollection(ReservationsCollection)
+	err := collection.FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&reservation)
+	if mongo.IsDuplicateKeyError(err) {
+		// Документ одновременно создал параллельный запрос - теперь он есть
+		err = collection.FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&reservation)
+	}
+	if err != nil {
+		return money.Money{}, err
+	}
+	return money.New(reservation.Reserved, currency), nil
+}
+
+// release уменьшает резерв пользователя на amount; резерв не становится отрицательным.
+func release(userID primitive.ObjectID, currency string, amount int64) error {
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"reserved": bson.M{"$max": bson.A{0, bson.M{"$subtract": bson.A{"$reserved", amount}}}},
+	}}}}
+	_, err := db.GetCollection(ReservationsCollection).UpdateOne(context.Background(),
+		bson.M{"user_id": userID, "currency": currency}, update)
+	return err
+}
+
+// Outstanding возвращает долг пользователя в валюте currency: сумму цен неоплаченных задач,
+// которые выполняются или выполнены, и несписанных доплат за оплаченные задачи.
+// Задачи с ошибкой и ждущие оплаты не учитываются.
+func Outstanding(userID primitive.ObjectID, currency string) (money.Money, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"user_id":        userID,
+			"price.currency": currency,
+			"$or": bson.A{
+				bson.M{"paid_at": bson.M{"$exists": false}},
+				bson.M{"surcharge": bson.M{"$exists": true}},
+			},
+			"status": bson.M{"$nin": []string{"failed", StatusAwaitingPayment}},
+		}}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "amount": bson.M{"$sum": bson.M{"$cond": bson.A{
+			bson.M{"$gt": bson.A{"$paid_at", nil}}, "$surcharge.amount", "$price.amount",
+		}}}}}},
+	}
+	cursor, err := db.GetCollection("jobs").Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return money.Money{}, err
+	}
+	var totals []struct {
+		Amount int64 `bson:"amount"`
+	}
+	if err := cursor.All(context.Background(), &totals); err != nil {
+		return money.Money{}, err
+	}
+
+	outstanding := money.New(0, currency)
+	if len(totals) > 0 {
+		outstanding.Amount = totals[0].Amount
+	}
+	return outstanding, nil
+}
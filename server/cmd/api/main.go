@@ -3,14 +3,35 @@ package main
 import (
 	"context"
 	"fmt"
+	"github.com/moevm/nosql2h24-transcribtion/billing"
 	"github.com/moevm/nosql2h24-transcribtion/config"
 	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/fleet"
+	"github.com/moevm/nosql2h24-transcribtion/handlers"
+	"github.com/moevm/nosql2h24-transcribtion/invoices"
+	"github.com/moevm/nosql2h24-transcribtion/notifications"
+	"github.com/moevm/nosql2h24-transcribtion/payments"
+	"github.com/moevm/nosql2h24-transcribtion/retention"
 	"github.com/moevm/nosql2h24-transcribtion/routes"
+	"github.com/moevm/nosql2h24-transcribtion/storage"
+	"github.com/moevm/nosql2h24-transcribtion/webhooks"
 	"log"
 	"net/http"
 	"time"
 )
 
+// jobStatusInterval - период обновления статусов задач и рассылки их прогресса
+const jobStatusInterval = 5 * time.Second
+
+// jobScheduleInterval - период проверки расписаний повторяющихся задач
+const jobScheduleInterval = 15 * time.Second
+
+// paymentCaptureInterval - период повторного списания авторизованных платежей
+const paymentCaptureInterval = time.Minute
+
+// paymentExpiryInterval - период отмены неоплаченных платежей
+const paymentExpiryInterval = 10 * time.Minute
+
 func main() {
 	cfg, err := config.LoadConfig()
 	if err != nil {
@@ -18,12 +39,40 @@ func main() {
 	}
 
 	client := db.InitConnection(&cfg)
+	handlers.ConfigureAuth(cfg)
+	handlers.ConfigureImport(cfg)
+	notifications.Configure(cfg)
+	storage.Configure(cfg.UploadDir)
+	retention.Configure(cfg)
+	if err := payments.Configure(cfg); err != nil {
+		log.Fatal("Could not configure payments ", err)
+	}
+	if err := billing.Configure(cfg); err != nil {
+		log.Fatal("Could not configure billing ", err)
+	}
 
 	if cfg.SeedDatabase {
 		db.SeedData(cfg, client)
 		log.Println("Seed data successfully")
 	}
 
+	if err := db.Migrate(cfg.DefaultCurrency); err != nil {
+		log.Fatal("Could not migrate database ", err)
+	}
+
+	if err := db.EnsureIndexes(); err != nil {
+		log.Fatal("Could not create indexes ", err)
+	}
+
+	go handlers.RunJobStatusUpdater(jobStatusInterval)
+	go handlers.RunJobSchedules(jobScheduleInterval)
+	go handlers.RunPaymentCaptures(paymentCaptureInterval)
+	go handlers.RunPaymentExpiry(paymentExpiryInterval)
+	go webhooks.RunRetries(db.GetCollection("webhooks"), db.GetCollection("webhook_deliveries"), webhooks.RetryInterval)
+	go retention.Run(retention.DefaultInterval)
+	go invoices.Run(invoices.DefaultInterval)
+	go fleet.Default.Run(db.GetCollection("servers"), db.GetCollection("jobs"), fleet.DefaultPollInterval, fleet.DefaultSnapshotInterval)
+
 	r := routes.NewRouter()
 
 	r.Get("/healthcheck", func(w http.ResponseWriter, r *http.Request) {
@@ -12,6 +12,44 @@ type Config struct {
 	Port         string `mapstructure:"PORT"`
 	DBName       string `mapstructure:"MONGODB_LOCAL_NAME"`
 	SeedDatabase bool   `mapstructure:"SEED_DATABASE"`
+
+	// Параметры SMTP для email-уведомлений. Если SMTP_HOST не задан, письма не отправляются.
+	SMTPHost     string `mapstructure:"SMTP_HOST"`
+	SMTPPort     string `mapstructure:"SMTP_PORT"`
+	SMTPUsername string `mapstructure:"SMTP_USERNAME"`
+	SMTPPassword string `mapstructure:"SMTP_PASSWORD"`
+	SMTPFrom     string `mapstructure:"SMTP_FROM"`
+
+	// Каталог для загруженных файлов (по умолчанию ./uploads)
+	UploadDir string `mapstructure:"UPLOAD_DIR"`
+
+	// Сроки хранения по умолчанию в днях: входные файлы и расшифровки (0 - бессрочно)
+	RetentionMediaDays      int `mapstructure:"RETENTION_MEDIA_DAYS"`
+	RetentionTranscriptDays int `mapstructure:"RETENTION_TRANSCRIPT_DAYS"`
+
+	// Валюта ISO 4217, в которой считаются старые платежи с ценой-строкой (по умолчанию USD)
+	DefaultCurrency string `mapstructure:"DEFAULT_CURRENCY"`
+
+	// Платёжный провайдер (по умолчанию mock), секрет подписи его уведомлений и адрес,
+	// на который тестовый провайдер отправляет уведомления
+	PaymentProvider      string `mapstructure:"PAYMENT_PROVIDER"`
+	PaymentWebhookSecret string `mapstructure:"PAYMENT_WEBHOOK_SECRET"`
+	PaymentCallbackURL   string `mapstructure:"PAYMENT_CALLBACK_URL"`
+
+	// Политика оплаты по умолчанию (prepay, postpay или credit_limit) и кредитный лимит
+	// в валюте DEFAULT_CURRENCY, например "50.00"
+	BillingPolicy      string `mapstructure:"BILLING_POLICY"`
+	BillingCreditLimit string `mapstructure:"BILLING_CREDIT_LIMIT"`
+
+	// Заглушка аутентификации только для разработки: пользователь запроса берётся из заголовка
+	// X-User-ID или параметра ?user_id= без проверки. Без неё запросы от имени пользователя
+	// отклоняются: эндпоинты /admin/*, потоки событий /jobs/events и WebSocket /admin/fleet/ws
+	// отвечают 401, пока не подключена настоящая аутентификация.
+	DevAuth bool `mapstructure:"DEV_AUTH"`
+
+	// Источник фронтенда (по умолчанию http://localhost:5173), с которого принимаются
+	// WebSocket-подключения
+	FrontendOrigin string `mapstructure:"FRONTEND_ORIGIN"`
 }
 
 func LoadConfig() (Config, error) {
@@ -23,11 +61,76 @@ func LoadConfig() (Config, error) {
 	if err != nil {
 		log.Fatal("Error parsing SEED_DATABASE")
 	}
+	retentionMediaDays, err := intEnv("RETENTION_MEDIA_DAYS", 7)
+	if err != nil {
+		log.Fatal("Error parsing RETENTION_MEDIA_DAYS")
+	}
+	retentionTranscriptDays, err := intEnv("RETENTION_TRANSCRIPT_DAYS", 365)
+	if err != nil {
+		log.Fatal("Error parsing RETENTION_TRANSCRIPT_DAYS")
+	}
+	defaultCurrency := os.Getenv("DEFAULT_CURRENCY")
+	if defaultCurrency == "" {
+		defaultCurrency = "USD"
+	}
+	paymentProvider := os.Getenv("PAYMENT_PROVIDER")
+	if paymentProvider == "" {
+		paymentProvider = "mock"
+	}
+	paymentCallbackURL := os.Getenv("PAYMENT_CALLBACK_URL")
+	if paymentCallbackURL == "" {
+		paymentCallbackURL = "http://localhost" + os.Getenv("PORT") + "/payments/webhooks/mock"
+	}
+	devAuth := false
+	if value := os.Getenv("DEV_AUTH"); value != "" {
+		devAuth, err = strconv.ParseBool(value)
+		if err != nil {
+			log.Fatal("Error parsing DEV_AUTH")
+		}
+	}
+	frontendOrigin := os.Getenv("FRONTEND_ORIGIN")
+	if frontendOrigin == "" {
+		frontendOrigin = "http://localhost:5173"
+	}
+	billingPolicy := os.Getenv("BILLING_POLICY")
+	if billingPolicy == "" {
+		billingPolicy = "postpay"
+	}
 	return Config{
 			DBUri:        os.Getenv("MONGODB_URI"),
 			Port:         os.Getenv("PORT"),
 			DBName:       os.Getenv("MONGODB_NAME"),
 			SeedDatabase: seedDatabase,
+			SMTPHost:     os.Getenv("SMTP_HOST"),
+			SMTPPort:     os.Getenv("SMTP_PORT"),
+			SMTPUsername: os.Getenv("SMTP_USERNAME"),
+			SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+			SMTPFrom:     os.Getenv("SMTP_FROM"),
+			UploadDir:    os.Getenv("UPLOAD_DIR"),
+
+			RetentionMediaDays:      retentionMediaDays,
+			RetentionTranscriptDays: retentionTranscriptDays,
+
+			DefaultCurrency: defaultCurrency,
+
+			PaymentProvider:      paymentProvider,
+			PaymentWebhookSecret: os.Getenv("PAYMENT_WEBHOOK_SECRET"),
+			PaymentCallbackURL:   paymentCallbackURL,
+
+			BillingPolicy:      billingPolicy,
+			BillingCreditLimit: os.Getenv("BILLING_CREDIT_LIMIT"),
+
+			DevAuth:        devAuth,
+			FrontendOrigin: frontendOrigin,
 		},
 		nil
 }
+
+// intEnv читает необязательную целочисленную переменную окружения.
+func intEnv(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
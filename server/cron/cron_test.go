@@ -0,0 +1,88 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"@every",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded", expr)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	// 2025-01-01 - среда
+	base := time.Date(2025, 1, 1, 10, 30, 45, 0, time.UTC)
+	tests := []struct {
+		expr  string
+		after time.Time
+		want  time.Time
+	}{
+		{"* * * * *", base, time.Date(2025, 1, 1, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", base, time.Date(2025, 1, 1, 10, 45, 0, 0, time.UTC)},
+		{"0-30/10 * * * *", base, time.Date(2025, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{"5/20 * * * *", base, time.Date(2025, 1, 1, 10, 45, 0, 0, time.UTC)},
+		{"0 9 * * *", base, time.Date(2025, 1, 2, 9, 0, 0, 0, time.UTC)},
+		{"0 9,18 * * *", base, time.Date(2025, 1, 1, 18, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2025, 1, 3, 12, 0, 0, 0, time.UTC), time.Date(2025, 1, 6, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", base, time.Date(2025, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", base, time.Date(2025, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{"@daily", base, time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", base, time.Date(2025, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", base, time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", base, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", base, time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2025, 1, 31, 12, 0, 0, 0, time.UTC), time.Date(2025, 3, 31, 0, 0, 0, 0, time.UTC)},
+		// Ограничены оба поля дня: подходит 15-е число или любой понедельник
+		{"0 0 15 * 1", base, time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC)},
+		{"0 0 2 * 1", base, time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)},
+		// Поле с шагом от "*" не ограничивает день: нужны нечётное число и понедельник
+		{"0 0 */2 * 1", base, time.Date(2025, 1, 13, 0, 0, 0, 0, time.UTC)},
+		// Нечётные числа, которые приходятся на выходные
+		{"0 0 1-31/2 * */6", base, time.Date(2025, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", base, time.Time{}},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.expr)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := s.Next(tt.after); !got.Equal(tt.want) {
+			t.Errorf("Next(%q, %v) = %v, want %v", tt.expr, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestNextTimezone(t *testing.T) {
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	if err != nil {
+		t.Skip("timezone database is not available")
+	}
+	s, err := Parse("0 9 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := time.Date(2025, 1, 1, 7, 0, 0, 0, time.UTC).In(moscow)
+	want := time.Date(2025, 1, 2, 6, 0, 0, 0, time.UTC)
+	if got := s.Next(after); !got.Equal(want) {
+		t.Errorf("Next = %v, want %v", got.UTC(), want)
+	}
+}
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// indexes - индексы, которые создаются при старте сервиса, по коллекциям
+var indexes = map[string][]mongo.IndexModel{
+	"job_events": {
+		{Keys: bson.D{{Key: "job_id", Value: 1}, {Key: "created_at", Value: 1}}},
+	},
+	"jobs": {
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "not_before", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "input_sha256", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "status", Value: 1}, {Key: "completed_at", Value: 1}}},
+	},
+	"uploads": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "path", Value: 1}}},
+	},
+	"schedules": {
+		{Keys: bson.D{{Key: "active", Value: 1}, {Key: "next_run_at", Value: 1}}},
+	},
+	"templates": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{Keys: bson.D{{Key: "organization", Value: 1}, {Key: "shared", Value: 1}}},
+	},
+	"payments": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "job_id", Value: 1}}},
+		// Не больше одного незавершённого (pending или authorized) платежа за задачу;
+		// у пополнений кошелька job_id нулевой, они в индекс не попадают
+		{
+			Keys: bson.D{{Key: "job_id", Value: 1}},
+			Options: options.Index().SetName("job_id_open_unique").SetUnique(true).SetPartialFilterExpression(bson.M{
+				"job_id":         bson.M{"$gt": primitive.NilObjectID},
+				"payment_status": bson.M{"$in": []string{"pending", "authorized"}},
+			}),
+		},
+		{Keys: bson.D{{Key: "payment_status", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "captured_at", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "provider", Value: 1}, {Key: "provider_intent_id", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"provider_intent_id": bson.M{"$exists": true}}),
+		},
+	},
+	"refunds": {
+		{Keys: bson.D{{Key: "payment_id", Value: 1}, {Key: "created_at", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "status", Value: 1}, {Key: "completed_at", Value: 1}}},
+		// Не больше одного предложенного возврата на платёж
+		{
+			Keys:    bson.D{{Key: "payment_id", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"status": "proposed"}),
+		},
+	},
+	"price_rules": {
+		{Keys: bson.D{{Key: "plan", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"plans": {
+		{Keys: bson.D{{Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"plan_usage": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "period_start", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"plan_slots": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"discounts": {
+		{Keys: bson.D{{Key: "code", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "active", Value: 1}, {Key: "created_at", Value: -1}}},
+	},
+	"discount_redemptions": {
+		{Keys: bson.D{{Key: "discount_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "payment_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	// Лимит использований промокода на пользователя соблюдается за счёт уникальности пары
+	"discount_usage": {
+		{Keys: bson.D{{Key: "discount_id", Value: 1}, {Key: "user_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"credit_reservations": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "currency", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"ledger_entries": {
+		{Keys: bson.D{{Key: "key", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "account", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "transaction_id", Value: 1}}},
+	},
+	"invoices": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "period_start", Value: 1}, {Key: "currency", Value: 1}}, Options: options.Index().SetUnique(true)},
+		// Номер присваивается уже сохранённому счёту, до этого поля нет
+		{
+			Keys:    bson.D{{Key: "number", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"number": bson.M{"$exists": true}}),
+		},
+	},
+	"notifications": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "read", Value: 1}, {Key: "created_at", Value: -1}}},
+	},
+}
+
+// EnsureIndexes создаёт недостающие индексы. Существующие индексы с теми же ключами не пересоздаются.
+func EnsureIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), ConnectionTimeout)
+	defer cancel()
+
+	for collection, models := range indexes {
+		if _, err := GetCollection(collection).Indexes().CreateMany(ctx, models); err != nil {
+			return err
+		}
+	}
+	return nil
+}
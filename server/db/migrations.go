@@ -0,0 +1,178 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/moevm/nosql2h24-transcribtion/money"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migrate приводит данные, сохранённые старыми версиями сервиса, к текущей схеме.
+// Миграции идемпотентны и выполняются при каждом старте.
+func Migrate(defaultCurrency string) error {
+	if !money.IsKnownCurrency(defaultCurrency) {
+		return fmt.Errorf("unknown default currency %q", defaultCurrency)
+	}
+	if err := migratePaymentPrices(defaultCurrency); err != nil {
+		return err
+	}
+	if err := migratePaymentStatuses(); err != nil {
+		return err
+	}
+	return migrateEmbeddedPayments()
+}
+
+// migratePaymentPrices переводит цены платежей из строк ("100.00") в money.Money
+// в валюте по умолчанию. Цена, которую не удалось разобрать, переносится в legacy_price,
+// а price становится нулевой суммой, чтобы платёж читался; такие платежи попадают в лог.
+func migratePaymentPrices(currency string) error {
+	ctx := context.Background()
+	usersCollection := GetCollection("users")
+
+	filter := bson.M{"payments.price": bson.M{"$type": "string"}}
+	cursor, err := usersCollection.Find(ctx, filter, options.Find().SetProjection(bson.M{"payments._id": 1, "payments.price": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	migrated := 0
+	for cursor.Next(ctx) {
+		var user struct {
+			ID       primitive.ObjectID `bson:"_id"`
+			Payments []struct {
+				ID    primitive.ObjectID `bson:"_id"`
+				Price bson.RawValue      `bson:"price"`
+			} `bson:"payments"`
+		}
+		if err := cursor.Decode(&user); err != nil {
+			return err
+		}
+
+		// Платежи с одной и той же строкой цены
+		byPrice := map[string][]string{}
+		var prices []string
+		for _, payment := range user.Payments {
+			if payment.Price.Type != bsontype.String {
+				continue
+			}
+			raw := payment.Price.StringValue()
+			if _, ok := byPrice[raw]; !ok {
+				prices = append(prices, raw)
+			}
+			byPrice[raw] = append(byPrice[raw], payment.ID.Hex())
+		}
+
+		for _, raw := range prices {
+			set := bson.M{}
+			price, err := money.Parse(raw, currency)
+			if err != nil {
+				log.Printf("Cannot migrate price %q of user %v payments %v, kept as legacy_price: %v",
+					raw, user.ID.Hex(), byPrice[raw], err)
+				price = money.New(0, currency)
+				set["payments.$[p].legacy_price"] = raw
+			}
+			set["payments.$[p].price"] = price
+			// Все платежи пользователя с той же строкой цены обновляются одним запросом
+			_, err = usersCollection.UpdateOne(ctx,
+				bson.M{"_id": user.ID},
+				bson.M{"$set": set},
+				options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"p.price": raw}}}),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		migrated++
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	if migrated > 0 {
+		log.Printf("Migrated payment prices of %d users to %s", migrated, currency)
+	}
+	return nil
+}
+
+// migratePaymentStatuses переименовывает статус completed, который раньше присылал клиент,
+// в captured из жизненного цикла платежей.
+func migratePaymentStatuses() error {
+	result, err := GetCollection("users").UpdateMany(context.Background(),
+		bson.M{"payments.payment_status": "completed"},
+		bson.M{"$set": bson.M{"payments.$[p].payment_status": "captured"}},
+		options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"p.payment_status": "completed"}}}),
+	)
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount > 0 {
+		log.Printf("Migrated completed payments of %d users to captured", result.ModifiedCount)
+	}
+	return nil
+}
+
+// migrateEmbeddedPayments переносит платежи из массива users.payments в коллекцию payments.
+// Платёж вставляется, только если его ещё нет, поэтому прерванную миграцию можно повторить;
+// массив удаляется из пользователя после переноса всех его платежей.
+func migrateEmbeddedPayments() error {
+	ctx := context.Background()
+	usersCollection := GetCollection("users")
+	paymentsCollection := GetCollection("payments")
+
+	cursor, err := usersCollection.Find(ctx,
+		bson.M{"payments": bson.M{"$exists": true}},
+		options.Find().SetProjection(bson.M{"payments": 1}),
+	)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	migrated := 0
+	for cursor.Next(ctx) {
+		var user struct {
+			ID       primitive.ObjectID `bson:"_id"`
+			Payments []bson.M           `bson:"payments"`
+		}
+		if err := cursor.Decode(&user); err != nil {
+			return err
+		}
+
+		for _, payment := range user.Payments {
+			paymentID, ok := payment["_id"]
+			if !ok {
+				paymentID = primitive.NewObjectID()
+			}
+			// _id вставляемого документа берётся из фильтра
+			delete(payment, "_id")
+			payment["user_id"] = user.ID
+			_, err := paymentsCollection.UpdateOne(ctx,
+				bson.M{"_id": paymentID},
+				bson.M{"$setOnInsert": payment},
+				options.Update().SetUpsert(true),
+			)
+			if err != nil {
+				return err
+			}
+			migrated++
+		}
+
+		if _, err := usersCollection.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$unset": bson.M{"payments": ""}}); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	if migrated > 0 {
+		log.Printf("Moved %d embedded payments to the payments collection", migrated)
+	}
+	return nil
+}
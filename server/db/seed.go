@@ -41,6 +41,7 @@ func SeedData(cfg config.Config, client *mongo.Client) {
 	var users []models.User
 	var jobs []models.Job
 	var servers []models.Server
+	var payments []models.Payment
 
 	if err := loadDataFromFile("db/seed_data/users.json", &users); err != nil {
 		log.Fatal("Error loading users data: ", err)
@@ -54,9 +55,14 @@ func SeedData(cfg config.Config, client *mongo.Client) {
 		log.Fatal("Error loading servers data: ", err)
 	}
 
+	if err := loadDataFromFile("db/seed_data/payments.json", &payments); err != nil {
+		log.Fatal("Error loading payments data: ", err)
+	}
+
 	usersCollection := client.Database(cfg.DBName).Collection("users")
 	jobsCollection := client.Database(cfg.DBName).Collection("jobs")
 	serversCollection := client.Database(cfg.DBName).Collection("servers")
+	paymentsCollection := client.Database(cfg.DBName).Collection("payments")
 
 	_, err := usersCollection.DeleteMany(ctx, map[string]interface{}{})
 	if err != nil {
@@ -71,6 +77,11 @@ func SeedData(cfg config.Config, client *mongo.Client) {
 		log.Fatal("Error deleting servers data: ", err)
 	}
 
+	_, err = paymentsCollection.DeleteMany(ctx, map[string]interface{}{})
+	if err != nil {
+		log.Fatal("Error deleting payments data: ", err)
+	}
+
 	for _, server := range servers {
 		_, err := serversCollection.InsertOne(ctx, server)
 		if err != nil {
@@ -92,5 +103,12 @@ func SeedData(cfg config.Config, client *mongo.Client) {
 		}
 	}
 
+	for _, payment := range payments {
+		_, err := paymentsCollection.InsertOne(ctx, payment)
+		if err != nil {
+			log.Fatal("Error inserting payment: ", err)
+		}
+	}
+
 	fmt.Println("Data seeded successfully!")
 }
@@ -0,0 +1,278 @@
+package discounts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/money"
+	"github.com/moevm/nosql2h24-transcribtion/pricing"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Коллекции промокодов, их использований и счётчиков использований по пользователям
+const (
+	Collection            = "discounts"
+	RedemptionsCollection = "discount_redemptions"
+	UsageCollection       = "discount_usage"
+)
+
+// Виды скидки
+const (
+	TypePercent = "percent"
+	TypeFixed   = "fixed"
+)
+
+var (
+	ErrNotFound         = errors.New("promo code not found")
+	ErrInactive         = errors.New("promo code is not active")
+	ErrExpired          = errors.New("promo code has expired")
+	ErrExhausted        = errors.New("promo code usage limit reached")
+	ErrUserLimit        = errors.New("promo code already used the maximum number of times")
+	ErrPlanNotAllowed   = errors.New("promo code is not available for this plan")
+	ErrCurrencyMismatch = errors.New("promo code is in a different currency")
+)
+
+// Normalize приводит промокод к виду, в котором он хранится: без пробелов по краям, заглавными буквами.
+func Normalize(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Validate проверяет промокод перед сохранением.
+func Validate(discount models.Discount) error {
+	if discount.Code == "" {
+		return errors.New("code is required")
+	}
+	if strings.ContainsAny(discount.Code, " \t\n") {
+		return errors.New("code must not contain spaces")
+	}
+	switch discount.Type {
+	case TypePercent:
+		if discount.Percent < 1 || discount.Percent > 100 {
+			return errors.New("percent must be between 1 and 100")
+		}
+		if discount.Amount != nil {
+			return errors.New("amount is not allowed for a percent discount")
+		}
+	case TypeFixed:
+		if discount.Amount == nil {
+			return errors.New("amount is required for a fixed discount")
+		}
+		if err := discount.Amount.Validate(); err != nil {
+			return err
+		}
+		if !discount.Amount.IsPositive() {
+			return errors.New("amount must be positive")
+		}
+		if discount.Percent != 0 {
+			return errors.New("percent is not allowed for a fixed discount")
+		}
+	default:
+		return fmt.Errorf("unknown discount type %q", discount.Type)
+	}
+	if discount.MaxUses < 0 || discount.MaxUsesPerUser < 0 {
+		return errors.New("usage limits must not be negative")
+	}
+	for _, plan := range discount.Plans {
+		if plan == "" {
+			return errors.New("plans must not be empty")
+		}
+	}
+	return nil
+}
+
+// Find возвращает промокод по коду.
+func Find(code string) (models.Discount, error) {
+	var discount models.Discount
+	err := db.GetCollection(Collection).FindOne(context.Background(), bson.M{"code": Normalize(code)}).Decode(&discount)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return models.Discount{}, ErrNotFound
+	}
+	return discount, err
+}
+
+// Check проверяет, что пользователь может применить промокод сейчас. Лимиты проверяются
+// по текущим счётчикам; атомарно они соблюдаются только при Redeem.
+func Check(discount models.Discount, user models.User, now time.Time) error {
+	if !discount.Active {
+		return ErrInactive
+	}
+	if !discount.ExpiresAt.IsZero() && !now.Before(discount.ExpiresAt) {
+		return ErrExpired
+	}
+	if len(discount.Plans) > 0 {
+		allowed := false
+		for _, plan := range discount.Plans {
+			if plan == user.Plan {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return ErrPlanNotAllowed
+		}
+	}
+	if discount.MaxUses > 0 && discount.Uses >= discount.MaxUses {
+		return ErrExhausted
+	}
+	if discount.MaxUsesPerUser > 0 {
+		var usage struct {
+			Uses int64 `bson:"uses"`
+		}
+		err := db.GetCollection(UsageCollection).FindOne(context.Background(),
+			bson.M{"discount_id": discount.ID, "user_id": user.ID}).Decode(&usage)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return err
+		}
+		if usage.Uses >= discount.MaxUsesPerUser {
+			return ErrUserLimit
+		}
+	}
+	return nil
+}
+
+// Amount возвращает скидку для цены price. Процентная скидка округляется до минимальной
+// единицы валюты; скидка не может превышать цену.
+func Amount(discount models.Discount, price money.Money) (money.Money, error) {
+	var amount money.Money
+	switch discount.Type {
+	case TypePercent:
+		scaled, err := price.Mul(discount.Percent)
+		if err != nil {
+			return money.Money{}, err
+		}
+		amount = money.New((scaled.Amount+50)/100, price.Currency)
+	case TypeFixed:
+		if discount.Amount.Currency != price.Currency {
+			return money.Money{}, ErrCurrencyMismatch
+		}
+		amount = *discount.Amount
+	default:
+		return money.Money{}, fmt.Errorf("unknown discount type %q", discount.Type)
+	}
+	if amount.Amount > price.Amount {
+		amount = price
+	}
+	return amount, nil
+}
+
+// ApplyToQuote добавляет в расчёт цены позицию со скидкой по промокоду.
+func ApplyToQuote(quote *pricing.Quote, discount models.Discount) error {
+	amount, err := Amount(discount, quote.Total)
+	if err != nil {
+		return err
+	}
+	line := money.New(-amount.Amount, amount.Currency)
+	quote.Lines = append(quote.Lines, pricing.Line{Item: pricing.ItemDiscount, Amount: line})
+	if quote.Total, err = quote.Total.Add(line); err != nil {
+		return err
+	}
+	quote.PromoCode = discount.Code
+	return nil
+}
+
+// Redeem атомарно занимает одно использование промокода для платежа и записывает его.
+// Сначала увеличивается счётчик пользователя (с условием на MaxUsesPerUser), затем общий
+// счётчик (с условием на MaxUses, срок и активность); при отказе занятое освобождается.
+func Redeem(discount models.Discount, userID primitive.ObjectID, payment models.Payment, amount money.Money) (models.DiscountRedemption, error) {
+	ctx := context.Background()
+	usageCollection := db.GetCollection(UsageCollection)
+	usageFilter := bson.M{"discount_id": discount.ID, "user_id": userID}
+
+	if discount.MaxUsesPerUser > 0 {
+		// При исчерпанном лимите документ не подходит под фильтр, и upsert нарушает уникальный индекс
+		filter := bson.M{"discount_id": discount.ID, "user_id": userID, "uses": bson.M{"$lt": discount.MaxUsesPerUser}}
+		_, err := usageCollection.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"uses": 1}}, options.Update().SetUpsert(true))
+		if err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				return models.DiscountRedemption{}, ErrUserLimit
+			}
+			return models.DiscountRedemption{}, err
+		}
+	} else {
+		_, err := usageCollection.UpdateOne(ctx, usageFilter, bson.M{"$inc": bson.M{"uses": 1}}, options.Update().SetUpsert(true))
+		if err != nil {
+			return models.DiscountRedemption{}, err
+		}
+	}
+	releaseUsage := func() {
+		if _, err := usageCollection.UpdateOne(ctx, usageFilter, bson.M{"$inc": bson.M{"uses": -1}}); err != nil {
+			log.Printf("Error releasing use of promo code %s by user %v: %v", discount.Code, userID, err)
+		}
+	}
+
+	now := time.Now()
+	filter := bson.M{
+		"_id":    discount.ID,
+		"active": true,
+		"$or":    bson.A{bson.M{"expires_at": bson.M{"$exists": false}}, bson.M{"expires_at": bson.M{"$gt": now}}},
+	}
+	if discount.MaxUses > 0 {
+		filter["uses"] = bson.M{"$lt": discount.MaxUses}
+	}
+	result, err := db.GetCollection(Collection).UpdateOne(ctx, filter,
+		bson.M{"$inc": bson.M{"uses": 1}, "$set": bson.M{"updated_at": now}})
+	if err != nil {
+		releaseUsage()
+		return models.DiscountRedemption{}, err
+	}
+	if result.MatchedCount == 0 {
+		releaseUsage()
+		return models.DiscountRedemption{}, ErrExhausted
+	}
+
+	redemption := models.DiscountRedemption{
+		ID:         primitive.NewObjectID(),
+		DiscountID: discount.ID,
+		Code:       discount.Code,
+		UserID:     userID,
+		PaymentID:  payment.ID,
+		JobID:      payment.JobID,
+		Amount:     amount,
+		CreatedAt:  now,
+	}
+	if _, err := db.GetCollection(RedemptionsCollection).InsertOne(ctx, redemption); err != nil {
+		if releaseErr := release(discount.ID, userID); releaseErr != nil {
+			log.Printf("Error releasing use of promo code %s by user %v: %v", discount.Code, userID, releaseErr)
+		}
+		return models.DiscountRedemption{}, err
+	}
+	return redemption, nil
+}
+
+// Release возвращает использование промокода, занятое несостоявшимся платежом.
+// Повторный вызов для того же платежа ничего не меняет.
+func Release(paymentID primitive.ObjectID) error {
+	var redemption models.DiscountRedemption
+	err := db.GetCollection(RedemptionsCollection).FindOneAndDelete(context.Background(),
+		bson.M{"payment_id": paymentID}).Decode(&redemption)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return release(redemption.DiscountID, redemption.UserID)
+}
+
+func release(discountID, userID primitive.ObjectID) error {
+	ctx := context.Background()
+	_, err := db.GetCollection(Collection).UpdateOne(ctx,
+		bson.M{"_id": discountID, "uses": bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{"uses": -1}, "$set": bson.M{"updated_at": time.Now()}})
+	if err != nil {
+		return err
+	}
+	_, err = db.GetCollection(UsageCollection).UpdateOne(ctx,
+		bson.M{"discount_id": discountID, "user_id": userID, "uses": bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{"uses": -1}})
+	return err
+}
@@ -0,0 +1,92 @@
+package discounts
+
+import (
+	"errors"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/money"
+	"github.com/moevm/nosql2h24-transcribtion/pricing"
+	"math"
+	"testing"
+)
+
+func TestAmount(t *testing.T) {
+	usd := func(amount int64) money.Money { return money.New(amount, "USD") }
+	percent := func(p int64) models.Discount { return models.Discount{Type: TypePercent, Percent: p} }
+	fixed := func(amount money.Money) models.Discount { return models.Discount{Type: TypeFixed, Amount: &amount} }
+	tests := []struct {
+		name     string
+		discount models.Discount
+		price    money.Money
+		want     money.Money
+		err      error
+	}{
+		{"percent", percent(10), usd(1000), usd(100), nil},
+		{"percent rounds half up", percent(10), usd(1005), usd(101), nil},
+		{"percent rounds up", percent(15), usd(333), usd(50), nil},
+		{"percent rounds down", percent(10), usd(1004), usd(100), nil},
+		{"full price", percent(100), usd(999), usd(999), nil},
+		{"percent of zero", percent(50), usd(0), usd(0), nil},
+		{"percent keeps currency", percent(50), money.New(1001, "JPY"), money.New(501, "JPY"), nil},
+		{"fixed", fixed(usd(250)), usd(1000), usd(250), nil},
+		{"fixed capped by price", fixed(usd(500)), usd(300), usd(300), nil},
+		{"fixed currency mismatch", fixed(money.New(100, "EUR")), usd(1000), money.Money{}, ErrCurrencyMismatch},
+		{"percent overflow", percent(50), usd(math.MaxInt64 / 10), money.Money{}, money.ErrOverflow},
+	}
+	for _, tt := range tests {
+		got, err := Amount(tt.discount, tt.price)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if _, err := Amount(models.Discount{Type: "bogus"}, usd(100)); err == nil {
+		t.Error("unknown discount type accepted")
+	}
+}
+
+func TestApplyToQuote(t *testing.T) {
+	quote := pricing.Quote{
+		Lines: []pricing.Line{{Item: pricing.ItemTranscription, Quantity: 3, Amount: money.New(300, "USD")}},
+		Total: money.New(300, "USD"),
+	}
+	if err := ApplyToQuote(&quote, models.Discount{Code: "HALF", Type: TypePercent, Percent: 50}); err != nil {
+		t.Fatalf("ApplyToQuote: %v", err)
+	}
+	if quote.Total != money.New(150, "USD") || quote.PromoCode != "HALF" {
+		t.Errorf("total %v, promo code %q", quote.Total, quote.PromoCode)
+	}
+	last := quote.Lines[len(quote.Lines)-1]
+	if last.Item != pricing.ItemDiscount || last.Amount != money.New(-150, "USD") {
+		t.Errorf("discount line %+v", last)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	usd := money.New(100, "USD")
+	zero := money.New(0, "USD")
+	tests := []struct {
+		name     string
+		discount models.Discount
+		valid    bool
+	}{
+		{"percent", models.Discount{Code: "SALE", Type: TypePercent, Percent: 20}, true},
+		{"fixed", models.Discount{Code: "MINUS1", Type: TypeFixed, Amount: &usd}, true},
+		{"no code", models.Discount{Type: TypePercent, Percent: 20}, false},
+		{"space in code", models.Discount{Code: "BIG SALE", Type: TypePercent, Percent: 20}, false},
+		{"percent over 100", models.Discount{Code: "SALE", Type: TypePercent, Percent: 101}, false},
+		{"percent with amount", models.Discount{Code: "SALE", Type: TypePercent, Percent: 20, Amount: &usd}, false},
+		{"fixed without amount", models.Discount{Code: "SALE", Type: TypeFixed}, false},
+		{"fixed zero", models.Discount{Code: "SALE", Type: TypeFixed, Amount: &zero}, false},
+		{"negative limit", models.Discount{Code: "SALE", Type: TypePercent, Percent: 20, MaxUses: -1}, false},
+		{"empty plan", models.Discount{Code: "SALE", Type: TypePercent, Percent: 20, Plans: []string{""}}, false},
+		{"unknown type", models.Discount{Code: "SALE", Type: "gift"}, false},
+	}
+	for _, tt := range tests {
+		if err := Validate(tt.discount); (err == nil) != tt.valid {
+			t.Errorf("%s: error = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
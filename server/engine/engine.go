@@ -0,0 +1,46 @@
+package engine
+
+import (
+	"context"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+)
+
+// Request - параметры расшифровки одной записи.
+// Hints - термины из словаря пользователя, которые движку стоит распознавать.
+// Diarization - нужно ли разделять сегменты по говорящим.
+type Request struct {
+	InputFile   string
+	Language    string
+	Hints       []string
+	Diarization bool
+}
+
+// Result - результат расшифровки. Speakers заполняется только при диаризации.
+type Result struct {
+	Language string
+	Segments []models.Segment
+	Speakers []models.Speaker
+}
+
+// Detection - результат определения языка записи.
+type Detection struct {
+	Language   string
+	Confidence float64
+}
+
+// AutoLanguage - значение source_language, при котором язык определяется движком.
+const AutoLanguage = "auto"
+
+// Engine - движок распознавания речи, которым пользуются воркеры.
+// DetectLanguage - облегчённый первый проход, который нужен до выбора сервера
+// для задач с неизвестным языком.
+type Engine interface {
+	Transcribe(ctx context.Context, req Request) (Result, error)
+	DetectLanguage(ctx context.Context, req Request) (Detection, error)
+}
+
+// Translator переводит сегменты расшифровки на другой язык.
+// Разбиение на сегменты и их время сохраняются.
+type Translator interface {
+	Translate(ctx context.Context, segments []models.Segment, sourceLanguage, targetLanguage string) ([]models.Segment, error)
+}
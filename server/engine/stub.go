@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"path/filepath"
+	"strings"
+)
+
+// StubSegmentCount и StubSegmentLength задают форму расшифровки, которую возвращает StubEngine.
+const (
+	StubSegmentCount  = 3
+	StubSegmentLength = 5.0
+)
+
+// StubSpeakerCount - число говорящих, между которыми StubEngine чередует сегменты при диаризации.
+const StubSpeakerCount = 2
+
+// StubEngine - детерминированная заглушка движка для локального запуска и тестов:
+// для одного и того же файла всегда возвращает одинаковые сегменты.
+type StubEngine struct{}
+
+func (StubEngine) Transcribe(ctx context.Context, req Request) (Result, error) {
+	name := filepath.Base(req.InputFile)
+	result := Result{Language: req.Language}
+	for i := 0; i < StubSegmentCount; i++ {
+		segment := models.Segment{
+			Start: float64(i) * StubSegmentLength,
+			End:   float64(i+1) * StubSegmentLength,
+			Text:  fmt.Sprintf("%s, part %d.", name, i+1),
+		}
+		if req.Diarization {
+			segment.Speaker = fmt.Sprintf("SPEAKER_%d", i%StubSpeakerCount+1)
+		}
+		result.Segments = append(result.Segments, segment)
+	}
+	if req.Diarization {
+		for i := 0; i < StubSpeakerCount && i < StubSegmentCount; i++ {
+			id := fmt.Sprintf("SPEAKER_%d", i+1)
+			result.Speakers = append(result.Speakers, models.Speaker{ID: id, Label: id})
+		}
+	}
+	return result, nil
+}
+
+// StubLanguages - коды языков, которые StubEngine ищет в имени файла.
+var StubLanguages = []string{"en", "es", "de", "fr", "it", "pt", "ru", "zh", "ja"}
+
+// DetectLanguage ищет код языка среди частей имени файла (например, interview_es.mp3).
+// Если код не найден, возвращает английский с низкой уверенностью.
+func (StubEngine) DetectLanguage(ctx context.Context, req Request) (Detection, error) {
+	name := strings.ToLower(filepath.Base(req.InputFile))
+	parts := strings.FieldsFunc(name, func(r rune) bool {
+		return r == '_' || r == '-' || r == '.' || r == ' '
+	})
+	for _, part := range parts {
+		for _, language := range StubLanguages {
+			if part == language {
+				return Detection{Language: language, Confidence: 0.95}, nil
+			}
+		}
+	}
+	return Detection{Language: "en", Confidence: 0.5}, nil
+}
+
+// StubTranslator - детерминированная заглушка переводчика: добавляет к тексту
+// каждого сегмента префикс с кодом целевого языка.
+type StubTranslator struct{}
+
+func (StubTranslator) Translate(ctx context.Context, segments []models.Segment, sourceLanguage, targetLanguage string) ([]models.Segment, error) {
+	translated := make([]models.Segment, len(segments))
+	for i, segment := range segments {
+		segment.Text = fmt.Sprintf("[%s] %s", targetLanguage, segment.Text)
+		translated[i] = segment
+	}
+	return translated, nil
+}
@@ -0,0 +1,99 @@
+package engine
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestStubEngineTranscribe(t *testing.T) {
+	tests := []struct {
+		name         string
+		req          Request
+		wantSpeakers []string
+	}{
+		{name: "plain", req: Request{InputFile: "/data/interview.mp3", Language: "en"}},
+		{name: "diarization", req: Request{InputFile: "call.wav", Language: "de", Diarization: true}, wantSpeakers: []string{"SPEAKER_1", "SPEAKER_2", "SPEAKER_1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := StubEngine{}.Transcribe(context.Background(), tt.req)
+			if err != nil {
+				t.Fatalf("Transcribe: %v", err)
+			}
+			if result.Language != tt.req.Language {
+				t.Errorf("language = %q, want %q", result.Language, tt.req.Language)
+			}
+			if len(result.Segments) != StubSegmentCount {
+				t.Fatalf("got %d segments, want %d", len(result.Segments), StubSegmentCount)
+			}
+			for i, segment := range result.Segments {
+				if segment.Start != float64(i)*StubSegmentLength || segment.End != float64(i+1)*StubSegmentLength {
+					t.Errorf("segment %d spans %v-%v", i, segment.Start, segment.End)
+				}
+				want := ""
+				if tt.wantSpeakers != nil {
+					want = tt.wantSpeakers[i]
+				}
+				if segment.Speaker != want {
+					t.Errorf("segment %d speaker = %q, want %q", i, segment.Speaker, want)
+				}
+			}
+			if tt.req.Diarization && len(result.Speakers) != StubSpeakerCount {
+				t.Errorf("got %d speakers, want %d", len(result.Speakers), StubSpeakerCount)
+			}
+			if !tt.req.Diarization && len(result.Speakers) != 0 {
+				t.Errorf("got speakers without diarization: %v", result.Speakers)
+			}
+
+			again, _ := StubEngine{}.Transcribe(context.Background(), tt.req)
+			if !reflect.DeepEqual(result, again) {
+				t.Error("stub engine is not deterministic")
+			}
+		})
+	}
+}
+
+func TestStubEngineDetectLanguage(t *testing.T) {
+	tests := []struct {
+		file       string
+		language   string
+		confidence float64
+	}{
+		{"interview_es.mp3", "es", 0.95},
+		{"/uploads/ru-meeting.wav", "ru", 0.95},
+		{"notes de.ogg", "de", 0.95},
+		{"podcast.mp3", "en", 0.5},
+		{"ESPANOL.mp3", "en", 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			detection, err := StubEngine{}.DetectLanguage(context.Background(), Request{InputFile: tt.file})
+			if err != nil {
+				t.Fatalf("DetectLanguage: %v", err)
+			}
+			if detection.Language != tt.language || detection.Confidence != tt.confidence {
+				t.Errorf("got %+v, want %s with %v", detection, tt.language, tt.confidence)
+			}
+		})
+	}
+}
+
+func TestStubTranslator(t *testing.T) {
+	source, _ := StubEngine{}.Transcribe(context.Background(), Request{InputFile: "a.mp3", Language: "en"})
+	translated, err := StubTranslator{}.Translate(context.Background(), source.Segments, "en", "fr")
+	if err != nil {
+		t.Fatalf("Translate: %v", err)
+	}
+	for i, segment := range translated {
+		if want := "[fr] " + source.Segments[i].Text; segment.Text != want {
+			t.Errorf("segment %d = %q, want %q", i, segment.Text, want)
+		}
+		if segment.Start != source.Segments[i].Start || segment.End != source.Segments[i].End {
+			t.Errorf("segment %d timing changed", i)
+		}
+	}
+	if source.Segments[0].Text != "a.mp3, part 1." {
+		t.Errorf("source segments were modified: %q", source.Segments[0].Text)
+	}
+}
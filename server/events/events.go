@@ -0,0 +1,174 @@
+package events
+
+import (
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// JobEvent - изменение состояния задачи, которое рассылается подписчикам.
+// ID монотонно возрастает и используется клиентами как Last-Event-ID.
+type JobEvent struct {
+	ID       int64              `json:"id"`
+	JobID    primitive.ObjectID `json:"job_id"`
+	UserID   primitive.ObjectID `json:"user_id"`
+	ParentID primitive.ObjectID `json:"parent_id,omitempty"`
+	Status   string             `json:"status"`
+	Progress int                `json:"progress"`
+	ETA      time.Time          `json:"eta"`
+	Time     time.Time          `json:"time"`
+}
+
+// Размеры буферов по умолчанию
+const (
+	DefaultHistorySize    = 1000
+	DefaultSubscriberSize = 64
+)
+
+// Broker хранит последние события в памяти и рассылает новые подписчикам.
+// Одинаковые подряд идущие состояния задачи не публикуются повторно.
+type Broker struct {
+	mu          sync.Mutex
+	nextID      int64
+	history     []JobEvent
+	historySize int
+	subscribers map[*subscriber]struct{}
+	last        map[primitive.ObjectID]JobEvent
+}
+
+type subscriber struct {
+	ch     chan JobEvent
+	filter func(JobEvent) bool
+}
+
+// Jobs - брокер событий задач, общий для всего сервиса.
+var Jobs = NewBroker(DefaultHistorySize)
+
+// NewBroker создаёт брокер, помнящий historySize последних событий.
+// Нумерация начинается с текущего времени, чтобы после перезапуска сервиса
+// идентификаторы не повторялись.
+func NewBroker(historySize int) *Broker {
+	return &Broker{
+		nextID:      time.Now().UnixMilli() * 1000,
+		historySize: historySize,
+		subscribers: map[*subscriber]struct{}{},
+		last:        map[primitive.ObjectID]JobEvent{},
+	}
+}
+
+// PublishJob публикует текущее состояние задачи: статус, процент выполнения и оценку окончания.
+func PublishJob(job models.Job) {
+	Jobs.Publish(FromJob(job, time.Now()))
+}
+
+// FromJob строит событие по состоянию задачи на момент now.
+func FromJob(job models.Job, now time.Time) JobEvent {
+	return JobEvent{
+		JobID:    job.ID,
+		UserID:   job.UserID,
+		ParentID: job.ParentID,
+		Status:   job.Status,
+		Progress: Progress(job, now),
+		ETA:      job.EstimatedFinishDatetime,
+		Time:     now,
+	}
+}
+
+// Progress оценивает процент выполнения задачи по времени создания и ожидаемому окончанию.
+func Progress(job models.Job, now time.Time) int {
+	switch job.Status {
+	case "completed":
+		return 100
+	case "pending", "in_progress":
+	default:
+		return 0
+	}
+	// Отложенная задача и задача после определения языка начинают выполняться позже создания
+	start := job.CreatedAt
+	if !job.StartedAt.IsZero() {
+		start = job.StartedAt
+	}
+	total := job.EstimatedFinishDatetime.Sub(start)
+	if total <= 0 {
+		return 0
+	}
+	progress := int(now.Sub(start) * 100 / total)
+	if progress < 0 {
+		return 0
+	}
+	// 100% выставляется только после фактического завершения
+	if progress > 99 {
+		return 99
+	}
+	return progress
+}
+
+// Publish присваивает событию номер, сохраняет его в истории и рассылает подписчикам.
+// Подписчик, не успевающий читать события, отключается - он может переподключиться
+// с Last-Event-ID и получить пропущенное из истории.
+func (b *Broker) Publish(event JobEvent) JobEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if last, ok := b.last[event.JobID]; ok && last.Status == event.Status && last.Progress == event.Progress {
+		return last
+	}
+
+	b.nextID++
+	event.ID = b.nextID
+	if event.Status == "completed" || event.Status == "failed" {
+		delete(b.last, event.JobID)
+	} else {
+		b.last[event.JobID] = event
+	}
+
+	b.history = append(b.history, event)
+	if len(b.history) > b.historySize {
+		b.history = b.history[len(b.history)-b.historySize:]
+	}
+
+	for s := range b.subscribers {
+		if s.filter != nil && !s.filter(event) {
+			continue
+		}
+		select {
+		case s.ch <- event:
+		default:
+			delete(b.subscribers, s)
+			close(s.ch)
+		}
+	}
+	return event
+}
+
+// Subscribe подписывается на события, удовлетворяющие filter.
+// Если lastEventID найден в истории, возвращаются пропущенные после него события
+// и resumed = true. Иначе клиенту нужно заново получить текущее состояние.
+func (b *Broker) Subscribe(lastEventID int64, filter func(JobEvent) bool) (missed []JobEvent, resumed bool, ch <-chan JobEvent, cancel func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if lastEventID > 0 && len(b.history) > 0 && b.history[0].ID <= lastEventID+1 {
+		resumed = true
+		for _, event := range b.history {
+			if event.ID > lastEventID && (filter == nil || filter(event)) {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	s := &subscriber{ch: make(chan JobEvent, DefaultSubscriberSize), filter: filter}
+	b.subscribers[s] = struct{}{}
+
+	cancel = func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[s]; ok {
+			delete(b.subscribers, s)
+			close(s.ch)
+		}
+	}
+	return missed, resumed, s.ch, cancel
+}
@@ -0,0 +1,109 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"strings"
+)
+
+// Поддерживаемые форматы выгрузки расшифровки
+const (
+	FormatTXT  = "txt"
+	FormatSRT  = "srt"
+	FormatVTT  = "vtt"
+	FormatJSON = "json"
+)
+
+// Render формирует файл расшифровки в указанном формате.
+// Возвращает содержимое файла и его Content-Type.
+// Если в расшифровке есть говорящие, каждый сегмент подписывается их текущим именем.
+func Render(transcript models.Transcript, format string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	labels := speakerLabels(transcript)
+
+	switch format {
+	case FormatTXT, "":
+		for _, segment := range transcript.Segments {
+			if label := labels[segment.Speaker]; label != "" {
+				buf.WriteString(label + ": ")
+			}
+			buf.WriteString(segment.Text)
+			buf.WriteString("\n")
+		}
+		return buf.Bytes(), "text/plain; charset=utf-8", nil
+	case FormatSRT:
+		for i, segment := range transcript.Segments {
+			text := segment.Text
+			if label := labels[segment.Speaker]; label != "" {
+				text = label + ": " + text
+			}
+			fmt.Fprintf(&buf, "%d\n%s --> %s\n%s\n\n", i+1,
+				timestamp(segment.Start, ","), timestamp(segment.End, ","), text)
+		}
+		return buf.Bytes(), "application/x-subrip; charset=utf-8", nil
+	case FormatVTT:
+		buf.WriteString("WEBVTT\n\n")
+		for _, segment := range transcript.Segments {
+			text := segment.Text
+			if label := labels[segment.Speaker]; label != "" {
+				text = "<v " + label + ">" + text
+			}
+			fmt.Fprintf(&buf, "%s --> %s\n%s\n\n",
+				timestamp(segment.Start, "."), timestamp(segment.End, "."), text)
+		}
+		return buf.Bytes(), "text/vtt; charset=utf-8", nil
+	case FormatJSON:
+		type jsonSegment struct {
+			models.Segment
+			SpeakerLabel string `json:"speaker_label,omitempty"`
+		}
+		type jsonTranscript struct {
+			models.Transcript
+			Segments []jsonSegment `json:"segments"`
+		}
+		out := jsonTranscript{Transcript: transcript, Segments: []jsonSegment{}}
+		for _, segment := range transcript.Segments {
+			out.Segments = append(out.Segments, jsonSegment{Segment: segment, SpeakerLabel: labels[segment.Speaker]})
+		}
+		data, err := json.Marshal(out)
+		if err != nil {
+			return nil, "", err
+		}
+		return data, "application/json", nil
+	default:
+		return nil, "", fmt.Errorf("unsupported format %q", format)
+	}
+}
+
+// FileName возвращает имя файла для выгрузки расшифровки.
+func FileName(transcript models.Transcript, format string) string {
+	if format == "" {
+		format = FormatTXT
+	}
+	return fmt.Sprintf("%s.%s.%s", transcript.JobID.Hex(), strings.ToLower(transcript.Language), format)
+}
+
+// timestamp форматирует время в виде ЧЧ:ММ:СС<sep>ммм
+func timestamp(seconds float64, sep string) string {
+	total := int64(seconds*1000 + 0.5)
+	ms := total % 1000
+	s := (total / 1000) % 60
+	m := (total / 60000) % 60
+	h := total / 3600000
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", h, m, s, sep, ms)
+}
+
+// speakerLabels сопоставляет идентификаторы говорящих с их отображаемыми именами.
+func speakerLabels(transcript models.Transcript) map[string]string {
+	labels := make(map[string]string, len(transcript.Speakers))
+	for _, speaker := range transcript.Speakers {
+		label := speaker.Label
+		if label == "" {
+			label = speaker.ID
+		}
+		labels[speaker.ID] = label
+	}
+	return labels
+}
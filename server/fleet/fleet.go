@@ -0,0 +1,197 @@
+package fleet
+
+import (
+	"context"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ServerState - состояние сервера, которое видит панель администратора.
+type ServerState struct {
+	ID                  string    `json:"id"`
+	Hostname            string    `json:"hostname"`
+	Status              string    `json:"status"`
+	Labels              []string  `json:"labels"`
+	CurrentJobs         int       `json:"current_jobs"`
+	Load                float64   `json:"load"`
+	LastHeartbeatAt     time.Time `json:"last_heartbeat_at"`
+	HeartbeatAgeSeconds float64   `json:"heartbeat_age_seconds"`
+}
+
+// QueueState - число незавершённых задач по статусам.
+type QueueState map[string]int
+
+// Snapshot - полное состояние парка серверов и очереди задач.
+type Snapshot struct {
+	Servers map[string]ServerState
+	Queue   QueueState
+	Time    time.Time
+}
+
+// Message - сообщение, отправляемое подписчику: полный снимок или изменения с прошлого сообщения.
+type Message struct {
+	Type    string        `json:"type"`
+	Servers []ServerState `json:"servers,omitempty"`
+	Removed []string      `json:"removed,omitempty"`
+	Queue   QueueState    `json:"queue,omitempty"`
+	Time    time.Time     `json:"time"`
+}
+
+// Типы сообщений
+const (
+	MessageSnapshot = "snapshot"
+	MessageDiff     = "diff"
+)
+
+// Collect читает текущее состояние серверов и очереди задач.
+func Collect(serversCollection, jobsCollection *mongo.Collection) (Snapshot, error) {
+	now := time.Now()
+	snapshot := Snapshot{Servers: map[string]ServerState{}, Queue: QueueState{}, Time: now}
+
+	cursor, err := serversCollection.Find(context.Background(), bson.M{})
+	if err != nil {
+		return Snapshot{}, err
+	}
+	var servers []models.Server
+	if err := cursor.All(context.Background(), &servers); err != nil {
+		return Snapshot{}, err
+	}
+	for _, server := range servers {
+		state := serverState(server)
+		snapshot.Servers[state.ID] = state
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"status": bson.M{"$nin": []string{"completed", "failed"}}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$status", "count": bson.M{"$sum": 1}}}},
+	}
+	cursor, err = jobsCollection.Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	var groups []struct {
+		Status string `bson:"_id"`
+		Count  int    `bson:"count"`
+	}
+	if err := cursor.All(context.Background(), &groups); err != nil {
+		return Snapshot{}, err
+	}
+	for _, group := range groups {
+		snapshot.Queue[group.Status] = group.Count
+	}
+
+	return snapshot, nil
+}
+
+// serverState переводит документ сервера в состояние для панели. Число задач берётся
+// из current_jobs, откуда задача убирается при завершении.
+func serverState(server models.Server) ServerState {
+	state := ServerState{
+		ID:              server.ID.Hex(),
+		Hostname:        server.Hostname,
+		Status:          server.Status,
+		Labels:          server.Labels,
+		CurrentJobs:     len(server.CurrentJobs),
+		Load:            server.Load,
+		LastHeartbeatAt: server.LastHeartbeat,
+	}
+	if state.Labels == nil {
+		state.Labels = []string{}
+	}
+	return state
+}
+
+// Filter оставляет серверы, у которых есть хотя бы одна из меток. Пустой список меток - все серверы.
+func (s Snapshot) Filter(labels []string) Snapshot {
+	if len(labels) == 0 {
+		return s
+	}
+	filtered := Snapshot{Servers: map[string]ServerState{}, Queue: s.Queue, Time: s.Time}
+	for id, server := range s.Servers {
+		if hasAnyLabel(server.Labels, labels) {
+			filtered.Servers[id] = server
+		}
+	}
+	return filtered
+}
+
+// FullMessage формирует сообщение с полным снимком.
+func (s Snapshot) FullMessage() Message {
+	msg := Message{Type: MessageSnapshot, Servers: []ServerState{}, Queue: s.Queue, Time: s.Time}
+	for _, server := range s.Servers {
+		msg.Servers = append(msg.Servers, withAge(server, s.Time))
+	}
+	return msg
+}
+
+// DiffMessage формирует сообщение с изменениями относительно prev.
+// Возраст heartbeat растёт сам по себе и изменением не считается.
+// Если изменений нет, возвращает false.
+func DiffMessage(prev, next Snapshot) (Message, bool) {
+	msg := Message{Type: MessageDiff, Time: next.Time}
+	for id, server := range next.Servers {
+		old, ok := prev.Servers[id]
+		if !ok || !sameState(old, server) {
+			msg.Servers = append(msg.Servers, withAge(server, next.Time))
+		}
+	}
+	for id := range prev.Servers {
+		if _, ok := next.Servers[id]; !ok {
+			msg.Removed = append(msg.Removed, id)
+		}
+	}
+	if !sameQueue(prev.Queue, next.Queue) {
+		msg.Queue = next.Queue
+		if msg.Queue == nil {
+			msg.Queue = QueueState{}
+		}
+	}
+	changed := len(msg.Servers) > 0 || len(msg.Removed) > 0 || msg.Queue != nil
+	return msg, changed
+}
+
+func withAge(server ServerState, now time.Time) ServerState {
+	if !server.LastHeartbeatAt.IsZero() {
+		server.HeartbeatAgeSeconds = now.Sub(server.LastHeartbeatAt).Seconds()
+	}
+	return server
+}
+
+func sameState(a, b ServerState) bool {
+	if a.Hostname != b.Hostname || a.Status != b.Status || a.CurrentJobs != b.CurrentJobs ||
+		a.Load != b.Load || !a.LastHeartbeatAt.Equal(b.LastHeartbeatAt) || len(a.Labels) != len(b.Labels) {
+		return false
+	}
+	for i := range a.Labels {
+		if a.Labels[i] != b.Labels[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameQueue(a, b QueueState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for status, count := range a {
+		if b[status] != count {
+			return false
+		}
+	}
+	return true
+}
+
+func hasAnyLabel(serverLabels, labels []string) bool {
+	for _, label := range labels {
+		for _, serverLabel := range serverLabels {
+			if serverLabel == label {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package fleet
+
+import (
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func snapshotOf(now time.Time, servers ...models.Server) Snapshot {
+	snapshot := Snapshot{Servers: map[string]ServerState{}, Queue: QueueState{}, Time: now}
+	for _, server := range servers {
+		state := serverState(server)
+		snapshot.Servers[state.ID] = state
+	}
+	return snapshot
+}
+
+func TestCurrentJobsAfterJobFinished(t *testing.T) {
+	now := time.Now()
+	finished, running := primitive.NewObjectID(), primitive.NewObjectID()
+	server := models.Server{
+		ID:            primitive.NewObjectID(),
+		Hostname:      "worker-1",
+		Status:        "online",
+		CurrentJobs:   []primitive.ObjectID{finished, running},
+		LastHeartbeat: now,
+	}
+	before := snapshotOf(now, server)
+	if got := before.Servers[server.ID.Hex()].CurrentJobs; got != 2 {
+		t.Fatalf("current_jobs before finish = %d, want 2", got)
+	}
+
+	// Так документ сервера выглядит после завершения задачи (schedul.FinishJobOnServer)
+	server.CurrentJobs = []primitive.ObjectID{running}
+	server.CompletedJobs = []primitive.ObjectID{finished}
+	after := snapshotOf(now, server)
+	if got := after.Servers[server.ID.Hex()].CurrentJobs; got != 1 {
+		t.Fatalf("current_jobs after finish = %d, want 1", got)
+	}
+
+	msg, changed := DiffMessage(before, after)
+	if !changed || len(msg.Servers) != 1 {
+		t.Fatalf("diff after finish = %+v (changed %v), want one server", msg, changed)
+	}
+	if msg.Servers[0].CurrentJobs != 1 {
+		t.Errorf("diff current_jobs = %d, want 1", msg.Servers[0].CurrentJobs)
+	}
+}
+
+func TestServerStateLabels(t *testing.T) {
+	state := serverState(models.Server{ID: primitive.NewObjectID()})
+	if state.Labels == nil || len(state.Labels) != 0 {
+		t.Errorf("labels = %#v, want empty list", state.Labels)
+	}
+	if state.CurrentJobs != 0 {
+		t.Errorf("current_jobs = %d, want 0", state.CurrentJobs)
+	}
+}
@@ -0,0 +1,139 @@
+package fleet
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Интервалы по умолчанию: опрос базы и рассылка полного снимка, по которому
+// переподключившиеся или пропустившие сообщения клиенты восстанавливают состояние.
+const (
+	DefaultPollInterval     = 2 * time.Second
+	DefaultSnapshotInterval = 30 * time.Second
+	clientBufferSize        = 16
+)
+
+// Client - подписчик панели мониторинга. Сообщения для него появляются в Send;
+// если клиент не успевает их читать, канал закрывается и клиент отключается.
+type Client struct {
+	Send   chan Message
+	labels []string
+	last   Snapshot
+}
+
+// Hub периодически собирает состояние парка и рассылает подписчикам изменения
+// с учётом их фильтров по меткам серверов.
+type Hub struct {
+	mu         sync.Mutex
+	clients    map[*Client]struct{}
+	current    Snapshot
+	hasCurrent bool
+}
+
+// Default - хаб, общий для всего сервиса.
+var Default = NewHub()
+
+func NewHub() *Hub {
+	return &Hub{clients: map[*Client]struct{}{}}
+}
+
+// Register подключает клиента с фильтром по меткам и сразу отправляет ему полный снимок,
+// если состояние уже собрано.
+func (h *Hub) Register(labels []string) *Client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c := &Client{Send: make(chan Message, clientBufferSize), labels: labels}
+	h.clients[c] = struct{}{}
+	if h.hasCurrent {
+		h.sendSnapshot(c)
+	}
+	return c
+}
+
+// Unregister отключает клиента.
+func (h *Hub) Unregister(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(c)
+}
+
+// SetLabels меняет фильтр клиента и отправляет ему полный снимок по новому фильтру.
+func (h *Hub) SetLabels(c *Client, labels []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	c.labels = labels
+	if h.hasCurrent {
+		h.sendSnapshot(c)
+	}
+}
+
+// Run опрашивает базу каждые pollInterval и рассылает изменения;
+// каждые snapshotInterval всем клиентам уходит полный снимок.
+func (h *Hub) Run(serversCollection, jobsCollection *mongo.Collection, pollInterval, snapshotInterval time.Duration) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	lastFull := time.Time{}
+
+	for now := range ticker.C {
+		snapshot, err := Collect(serversCollection, jobsCollection)
+		if err != nil {
+			log.Printf("Error collecting fleet state: %v", err)
+			continue
+		}
+		full := now.Sub(lastFull) >= snapshotInterval
+		if full {
+			lastFull = now
+		}
+		h.broadcast(snapshot, full)
+	}
+}
+
+func (h *Hub) broadcast(snapshot Snapshot, full bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.current = snapshot
+	h.hasCurrent = true
+
+	for c := range h.clients {
+		if full {
+			h.sendSnapshot(c)
+			continue
+		}
+		next := snapshot.Filter(c.labels)
+		msg, changed := DiffMessage(c.last, next)
+		if !changed {
+			continue
+		}
+		c.last = next
+		h.send(c, msg)
+	}
+}
+
+func (h *Hub) sendSnapshot(c *Client) {
+	c.last = h.current.Filter(c.labels)
+	h.send(c, c.last.FullMessage())
+}
+
+func (h *Hub) send(c *Client, msg Message) {
+	select {
+	case c.Send <- msg:
+	default:
+		h.remove(c)
+	}
+}
+
+func (h *Hub) remove(c *Client) {
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		close(c.Send)
+	}
+}
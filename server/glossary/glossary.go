@@ -0,0 +1,127 @@
+package glossary
+
+import (
+	"errors"
+	"fmt"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Validate проверяет словарь перед сохранением.
+func Validate(g models.Glossary) error {
+	if strings.TrimSpace(g.Name) == "" {
+		return errors.New("name is required")
+	}
+	for i, term := range g.Terms {
+		if strings.TrimSpace(term.Term) == "" {
+			return fmt.Errorf("term %d is empty", i+1)
+		}
+	}
+	for i, rule := range g.Rules {
+		if strings.TrimSpace(rule.From) == "" {
+			return fmt.Errorf("rule %d has empty 'from'", i+1)
+		}
+	}
+	return nil
+}
+
+// Hints возвращает подсказки для движка: термины и их произношения.
+func Hints(g models.Glossary) []string {
+	var hints []string
+	for _, term := range g.Terms {
+		hints = append(hints, term.Term)
+		if term.Pronunciation != "" {
+			hints = append(hints, term.Pronunciation)
+		}
+	}
+	return hints
+}
+
+// Apply выполняет детерминированный проход замен по сегментам: сначала правила
+// в порядке их объявления, затем замена вариантов написания терминов на сами термины.
+// Заменяются только целые слова. Исходные сегменты не изменяются.
+func Apply(g models.Glossary, segments []models.Segment) []models.Segment {
+	var replacements []replacement
+	for _, rule := range g.Rules {
+		replacements = append(replacements, newReplacement(rule.From, rule.To, rule.CaseSensitive))
+	}
+	for _, term := range g.Terms {
+		for _, variant := range term.Variants {
+			if strings.TrimSpace(variant) == "" {
+				continue
+			}
+			replacements = append(replacements, newReplacement(variant, term.Term, false))
+		}
+	}
+
+	result := make([]models.Segment, len(segments))
+	for i, segment := range segments {
+		for _, r := range replacements {
+			segment.Text = r.apply(segment.Text)
+		}
+		result[i] = segment
+	}
+	return result
+}
+
+type replacement struct {
+	pattern *regexp.Regexp
+	to      string
+}
+
+func newReplacement(from, to string, caseSensitive bool) replacement {
+	expr := regexp.QuoteMeta(strings.TrimSpace(from))
+	if !caseSensitive {
+		expr = "(?i)" + expr
+	}
+	return replacement{pattern: regexp.MustCompile(expr), to: to}
+}
+
+// apply заменяет вхождения, которые являются целыми словами. Границы слов проверяются по
+// буквам и цифрам Unicode: \b в RE2 знает только ASCII и не находит кириллические термины
+// и термины, которые начинаются или заканчиваются знаком (например, "C++").
+func (r replacement) apply(text string) string {
+	var b strings.Builder
+	last := 0
+	for offset := 0; offset < len(text); {
+		loc := r.pattern.FindStringIndex(text[offset:])
+		if loc == nil || loc[0] == loc[1] {
+			break
+		}
+		start, end := offset+loc[0], offset+loc[1]
+		if isWordBoundary(text, start, end) {
+			b.WriteString(text[last:start])
+			b.WriteString(r.to)
+			last, offset = end, end
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(text[start:])
+		offset = start + size
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// isWordBoundary сообщает, что text[start:end] не продолжает соседние слова.
+func isWordBoundary(text string, start, end int) bool {
+	if start > 0 {
+		before, _ := utf8.DecodeLastRuneInString(text[:start])
+		if isWordRune(before) {
+			return false
+		}
+	}
+	if end < len(text) {
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if isWordRune(after) {
+			return false
+		}
+	}
+	return true
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.M, r)
+}
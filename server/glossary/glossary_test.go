@@ -0,0 +1,46 @@
+package glossary
+
+import (
+	"testing"
+
+	"github.com/moevm/nosql2h24-transcribtion/models"
+)
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name string
+		rule models.ReplacementRule
+		text string
+		want string
+	}{
+		{"ascii word", models.ReplacementRule{From: "kubernetes", To: "Kubernetes"}, "we run kubernetes daily", "we run Kubernetes daily"},
+		{"part of a word", models.ReplacementRule{From: "net", To: "NET"}, "network net", "network NET"},
+		{"cyrillic", models.ReplacementRule{From: "кубер", To: "Kubernetes"}, "Кубер и кубер, но не куберы", "Kubernetes и Kubernetes, но не куберы"},
+		{"cyrillic inside a word", models.ReplacementRule{From: "ток", To: "TOK"}, "поток ток", "поток TOK"},
+		{"trailing punctuation", models.ReplacementRule{From: "си плюс плюс", To: "C++"}, "пишем на си плюс плюс.", "пишем на C++."},
+		{"term with symbols", models.ReplacementRule{From: "C++", To: "C++17"}, "C++ and C++, not C++x", "C++17 and C++17, not C++x"},
+		{"adjacent matches", models.ReplacementRule{From: "ok", To: "OK"}, "ok ok ok", "OK OK OK"},
+		{"case sensitive", models.ReplacementRule{From: "Go", To: "Golang", CaseSensitive: true}, "Go go GO", "Golang go GO"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := models.Glossary{Rules: []models.ReplacementRule{tt.rule}}
+			got := Apply(g, []models.Segment{{Text: tt.text}})
+			if got[0].Text != tt.want {
+				t.Errorf("got %q, want %q", got[0].Text, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyTermVariants(t *testing.T) {
+	g := models.Glossary{Terms: []models.GlossaryTerm{{Term: "PostgreSQL", Variants: []string{"постгрес", "postgres"}}}}
+	segments := []models.Segment{{Text: "Постгрес и postgres"}}
+	got := Apply(g, segments)
+	if got[0].Text != "PostgreSQL и PostgreSQL" {
+		t.Errorf("got %q", got[0].Text)
+	}
+	if segments[0].Text != "Постгрес и postgres" {
+		t.Error("source segments were modified")
+	}
+}
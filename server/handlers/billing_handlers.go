@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/moevm/nosql2h24-transcribtion/billing"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/money"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"net/http"
+	"time"
+)
+
+// BillingState - действующая политика оплаты пользователя и его текущий долг по кредитному лимиту
+type BillingState struct {
+	models.BillingPolicy
+	Outstanding *money.Money `json:"outstanding,omitempty"`
+}
+
+// GET /users/{id}/billing
+
+// Действующая политика оплаты пользователя. Для кредитного лимита в outstanding - сумма
+// неоплаченных выполняемых и выполненных задач.
+func GetUserBilling(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var user models.User
+	err = db.GetCollection("users").FindOne(context.Background(), bson.M{"_id": userID}).Decode(&user)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching user", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	state, err := billingState(user)
+	if err != nil {
+		http.Error(w, "Error calculating outstanding amount", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+/*
+PUT /users/{id}/billing?user_id={adminID}
+{
+	"policy": "credit_limit",
+	"credit_limit": {"amount": 5000, "currency": "USD"}
+}
+
+Политика оплаты задач: prepay - задача ждёт в статусе awaiting_payment, пока платёж за неё
+(POST /users/{id}/payments с job_id) не списан, если её не покрывает баланс кошелька;
+postpay - задачи выполняются сразу; credit_limit - сразу выполняются, пока сумма
+неоплаченных задач не превышает баланс кошелька плюс лимит.
+Меняет только администратор. Тело null возвращает политику по умолчанию.
+Задачи, которые по новой политике можно выполнять, сразу уходят в работу.
+*/
+
+func UpdateUserBilling(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var policy *models.BillingPolicy
+	if err := render.DecodeJSON(r.Body, &policy); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if policy != nil {
+		if err := billing.Validate(*policy); err != nil {
+			http.Error(w, "Invalid billing policy: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if policy.Policy != billing.PolicyCreditLimit {
+			policy.CreditLimit = nil
+		}
+	}
+
+	update := bson.M{"$set": bson.M{"billing": policy, "updated_at": time.Now()}}
+	if policy == nil {
+		update = bson.M{"$unset": bson.M{"billing": ""}, "$set": bson.M{"updated_at": time.Now()}}
+	}
+	result, err := db.GetCollection("users").UpdateOne(context.Background(), bson.M{"_id": userID}, update)
+	if err != nil {
+		http.Error(w, "Error updating billing policy", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if err := releaseAwaitingJobs(userID); err != nil {
+		log.Printf("Error releasing jobs of user %v awaiting payment: %v", userID, err)
+	}
+
+	state, err := billingState(models.User{ID: userID, Billing: policy})
+	if err != nil {
+		http.Error(w, "Error calculating outstanding amount", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+func billingState(user models.User) (BillingState, error) {
+	state := BillingState{BillingPolicy: billing.For(user)}
+	if state.Policy == billing.PolicyCreditLimit {
+		outstanding, err := billing.Outstanding(user.ID, state.CreditLimit.Currency)
+		if err != nil {
+			return BillingState{}, err
+		}
+		state.Outstanding = &outstanding
+	}
+	return state, nil
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/engine"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/timeline"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Политики обработки повторно загруженного файла
+const (
+	DedupReuse     = "reuse"
+	DedupAsk       = "ask"
+	DedupReprocess = "reprocess"
+)
+
+func isDedupPolicy(policy string) bool {
+	return policy == DedupReuse || policy == DedupAsk || policy == DedupReprocess
+}
+
+// dedupPolicy возвращает политику для запроса: параметр ?dedup= важнее настройки пользователя.
+func dedupPolicy(r *http.Request, userID primitive.ObjectID) (string, error) {
+	if policy := r.URL.Query().Get("dedup"); policy != "" {
+		if !isDedupPolicy(policy) {
+			return "", errors.New("Invalid dedup parameter")
+		}
+		return policy, nil
+	}
+
+	var user models.User
+	err := db.GetCollection("users").FindOne(context.Background(), bson.M{"_id": userID}).Decode(&user)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return "", err
+	}
+	if user.DedupPolicy == "" {
+		return DedupAsk, nil
+	}
+	return user.DedupPolicy, nil
+}
+
+// findDuplicateJob заполняет хеш входного файла задачи по загрузкам пользователя и ищет
+// его завершённую задачу с тем же файлом и теми же параметрами. При политике reprocess
+// и для файлов, загруженных не через /uploads, дубликаты не ищутся.
+func findDuplicateJob(job *models.Job, policy string) (*models.Job, error) {
+	// Хеш вычисляет только сервис при загрузке, переданному клиентом значению не доверяем
+	job.InputSHA256 = ""
+	var upload models.Upload
+	err := db.GetCollection("uploads").FindOne(context.Background(),
+		bson.M{"user_id": job.UserID, "path": job.InputFile},
+	).Decode(&upload)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	job.InputSHA256 = upload.SHA256
+
+	if policy == DedupReprocess {
+		return nil, nil
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "updated_at", Value: -1}})
+	cursor, err := db.GetCollection("jobs").Find(context.Background(), bson.M{
+		"user_id":               job.UserID,
+		"input_sha256":          job.InputSHA256,
+		"status":                "completed",
+		"parent_id":             bson.M{"$exists": false},
+		"reused_from_job_id":    bson.M{"$exists": false},
+		"transcripts_purged_at": bson.M{"$exists": false},
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []models.Job
+	if err := cursor.All(context.Background(), &candidates); err != nil {
+		return nil, err
+	}
+
+	for _, candidate := range candidates {
+		if !sameJobOptions(*job, candidate) {
+			continue
+		}
+		// Результат, полученный до изменения или удаления словаря, переиспользовать нельзя
+		if !job.GlossaryID.IsZero() {
+			g, err := jobGlossary(*job)
+			if err != nil {
+				return nil, err
+			}
+			if g == nil || g.UpdatedAt.After(candidate.UpdatedAt) {
+				continue
+			}
+		}
+		return &candidate, nil
+	}
+	return nil, nil
+}
+
+// sameJobOptions сравнивает параметры обработки новой задачи с уже выполненной.
+// Для "auto" подходит любой язык: у выполненной задачи он уже определён.
+func sameJobOptions(job, original models.Job) bool {
+	if job.SourceLanguage != engine.AutoLanguage && !strings.EqualFold(job.SourceLanguage, original.SourceLanguage) {
+		return false
+	}
+	if job.Diarization != original.Diarization || job.GlossaryID != original.GlossaryID {
+		return false
+	}
+	if len(job.TargetLanguages) != len(original.TargetLanguages) || len(job.Steps) != len(original.Steps) {
+		return false
+	}
+	for _, language := range job.TargetLanguages {
+		found := false
+		for _, other := range original.TargetLanguages {
+			if strings.EqualFold(language, other) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for i := range job.Steps {
+		if job.Steps[i].Type != original.Steps[i].Type {
+			return false
+		}
+	}
+	return true
+}
+
+// reuseJobResult сохраняет новую задачу сразу выполненной, со ссылкой на результат original.
+// Расшифровки не копируются: GET /jobs/{id}/transcripts отдаёт расшифровки исходной задачи.
+func reuseJobResult(job *models.Job, original models.Job) error {
+	now := time.Now()
+	job.Status = "completed"
+	job.ReusedFromJobID = original.ID
+	job.HostID = primitive.NilObjectID
+	job.SourceLanguage = original.SourceLanguage
+	job.DetectedLanguage = original.DetectedLanguage
+	job.LanguageConfidence = original.LanguageConfidence
+	job.Steps = original.Steps
+	job.StartedAt = now
+	job.EstimatedFinishDatetime = now
+	job.CompletedAt = now
+	job.Progress = 100
+	job.UpdatedAt = now
+
+	if _, err := db.GetCollection("jobs").InsertOne(context.Background(), job); err != nil {
+		return errors.New("Error saving job")
+	}
+	if err := addJobsToUser(db.GetCollection("users"), job.UserID, []primitive.ObjectID{job.ID}); err != nil {
+		return errors.New("Error updating user jobs")
+	}
+
+	jobSubmitted(*job)
+	timeline.Record(job.ID, timeline.Reused, primitive.NilObjectID, timeline.Details{"original_job_id": original.ID})
+	jobFinished(*job)
+	return nil
+}
+
+// duplicateConflict отвечает на запрос с политикой ask: клиент может повторить запрос
+// с ?dedup=reuse, чтобы получить готовый результат, или с ?dedup=reprocess.
+func duplicateConflict(w http.ResponseWriter, original models.Job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":           "This file has already been transcribed with the same options",
+		"original_job_id": original.ID,
+		"original_job":    original,
+		"options":         []string{DedupReuse, DedupReprocess},
+	})
+}
+
+// resultJobID возвращает задачу, под которой хранятся расшифровки: для задачи,
+// переиспользовавшей результат, - исходную задачу.
+func resultJobID(jobID primitive.ObjectID) (primitive.ObjectID, error) {
+	var job models.Job
+	err := db.GetCollection("jobs").FindOne(context.Background(), bson.M{"_id": jobID}).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return jobID, nil
+	}
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	if !job.ReusedFromJobID.IsZero() {
+		return job.ReusedFromJobID, nil
+	}
+	return jobID, nil
+}
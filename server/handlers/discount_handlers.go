@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/discounts"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// GET /admin/discounts?user_id={adminID}&active=true
+
+// Промокоды с числом использований, новые сверху
+func GetDiscounts(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	filter := bson.M{}
+	if value := r.URL.Query().Get("active"); value != "" {
+		active, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "Invalid active parameter", http.StatusBadRequest)
+			return
+		}
+		filter["active"] = active
+	}
+
+	cursor, err := db.GetCollection(discounts.Collection).Find(context.Background(), filter,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		http.Error(w, "Error fetching discounts", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	result := []models.Discount{}
+	if err := cursor.All(context.Background(), &result); err != nil {
+		http.Error(w, "Error decoding discounts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+/*
+POST /admin/discounts?user_id={adminID}
+{
+	"code": "SPRING10",
+	"description": "Spring campaign",
+	"type": "percent",
+	"percent": 10,
+	"expires_at": "2025-06-01T00:00:00Z",
+	"max_uses": 500,
+	"max_uses_per_user": 1,
+	"plans": ["basic", "pro"],
+	"active": true
+}
+
+Фиксированная скидка: "type": "fixed", "amount": {"amount": 500, "currency": "USD"} - применяется
+только к ценам в той же валюте. Код хранится заглавными буквами и вводится без учёта регистра.
+Промокод применяется в POST /jobs/quote и при создании платежа за задачу (POST /users/{id}/payments).
+*/
+
+func CreateDiscount(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var discount models.Discount
+	if err := render.DecodeJSON(r.Body, &discount); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	discount.Code = discounts.Normalize(discount.Code)
+	if err := discounts.Validate(discount); err != nil {
+		http.Error(w, "Invalid discount: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	discount.ID = primitive.NewObjectID()
+	discount.Uses = 0
+	discount.CreatedAt = time.Now()
+	discount.UpdatedAt = discount.CreatedAt
+
+	if _, err := db.GetCollection(discounts.Collection).InsertOne(context.Background(), discount); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			http.Error(w, "Promo code already exists", http.StatusConflict)
+		} else {
+			http.Error(w, "Error saving discount", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(discount)
+}
+
+// GET /admin/discounts/{discount_id}?user_id={adminID}
+func GetDiscount(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	discountID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "discount_id"))
+	if err != nil {
+		http.Error(w, "Invalid discount ID", http.StatusBadRequest)
+		return
+	}
+
+	var discount models.Discount
+	err = db.GetCollection(discounts.Collection).FindOne(context.Background(), bson.M{"_id": discountID}).Decode(&discount)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Discount not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching discount", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(discount)
+}
+
+// PUT /admin/discounts/{discount_id}?user_id={adminID}
+
+// Заменяет настройки промокода, тело запроса как у POST /admin/discounts. Число использований
+// сохраняется; уменьшение max_uses ниже него только запрещает новые использования.
+func UpdateDiscount(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	discountID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "discount_id"))
+	if err != nil {
+		http.Error(w, "Invalid discount ID", http.StatusBadRequest)
+		return
+	}
+
+	var discount models.Discount
+	if err := render.DecodeJSON(r.Body, &discount); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	discount.Code = discounts.Normalize(discount.Code)
+	if err := discounts.Validate(discount); err != nil {
+		http.Error(w, "Invalid discount: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	set := bson.M{
+		"code":              discount.Code,
+		"description":       discount.Description,
+		"type":              discount.Type,
+		"max_uses":          discount.MaxUses,
+		"max_uses_per_user": discount.MaxUsesPerUser,
+		"plans":             discount.Plans,
+		"active":            discount.Active,
+		"updated_at":        time.Now(),
+	}
+	unset := bson.M{}
+	if discount.Type == discounts.TypePercent {
+		set["percent"] = discount.Percent
+		unset["amount"] = ""
+	} else {
+		set["amount"] = discount.Amount
+		unset["percent"] = ""
+	}
+	if discount.ExpiresAt.IsZero() {
+		unset["expires_at"] = ""
+	} else {
+		set["expires_at"] = discount.ExpiresAt
+	}
+
+	var updated models.Discount
+	err = db.GetCollection(discounts.Collection).FindOneAndUpdate(context.Background(),
+		bson.M{"_id": discountID},
+		bson.M{"$set": set, "$unset": unset},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			http.Error(w, "Discount not found", http.StatusNotFound)
+		case mongo.IsDuplicateKeyError(err):
+			http.Error(w, "Promo code already exists", http.StatusConflict)
+		default:
+			http.Error(w, "Error updating discount", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// DELETE /admin/discounts/{discount_id}?user_id={adminID}
+
+// Удаляет промокод. Скидки в уже созданных платежах и история использований сохраняются.
+func DeleteDiscount(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	discountID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "discount_id"))
+	if err != nil {
+		http.Error(w, "Invalid discount ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.GetCollection(discounts.Collection).DeleteOne(context.Background(), bson.M{"_id": discountID})
+	if err != nil {
+		http.Error(w, "Error deleting discount", http.StatusInternalServerError)
+		return
+	}
+	if result.DeletedCount == 0 {
+		http.Error(w, "Discount not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /admin/discounts/{discount_id}/redemptions?user_id={adminID}&page=1&page_size=20
+
+// Использования промокода, новые сверху: пользователь, платёж и сумма скидки
+func GetDiscountRedemptions(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	discountID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "discount_id"))
+	if err != nil {
+		http.Error(w, "Invalid discount ID", http.StatusBadRequest)
+		return
+	}
+	pageNum, pageSize, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cursor, err := db.GetCollection(discounts.RedemptionsCollection).Find(context.Background(),
+		bson.M{"discount_id": discountID},
+		options.Find().
+			SetSort(bson.D{{Key: "created_at", Value: -1}}).
+			SetSkip((pageNum-1)*pageSize).
+			SetLimit(pageSize),
+	)
+	if err != nil {
+		http.Error(w, "Error fetching redemptions", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	result := []models.DiscountRedemption{}
+	if err := cursor.All(context.Background(), &result); err != nil {
+		http.Error(w, "Error decoding redemptions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func writeDiscountError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, discounts.ErrExhausted), errors.Is(err, discounts.ErrUserLimit):
+		http.Error(w, "Cannot apply promo code: "+err.Error(), http.StatusConflict)
+	case errors.Is(err, discounts.ErrNotFound), errors.Is(err, discounts.ErrInactive), errors.Is(err, discounts.ErrExpired),
+		errors.Is(err, discounts.ErrPlanNotAllowed), errors.Is(err, discounts.ErrCurrencyMismatch):
+		http.Error(w, "Invalid promo code: "+err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "Error applying promo code", http.StatusInternalServerError)
+	}
+}
@@ -4,20 +4,51 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/moevm/nosql2h24-transcribtion/config"
 	"github.com/moevm/nosql2h24-transcribtion/db"
 	"github.com/moevm/nosql2h24-transcribtion/models"
 	"go.mongodb.org/mongo-driver/mongo"
 	"io"
 	"net/http"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// importCurrency - валюта, в которой импортируются цены платежей старого формата
+var importCurrency = "USD"
+
+// ConfigureImport задаёт валюту по умолчанию для импорта старых выгрузок.
+func ConfigureImport(cfg config.Config) {
+	importCurrency = cfg.DefaultCurrency
+}
+
+// legacyUser - пользователь из выгрузки старого формата, где платежи хранились внутри пользователя.
+type legacyUser struct {
+	ID       primitive.ObjectID `json:"id"`
+	Payments []legacyPayment    `json:"payments"`
+}
+
+// legacyPayment - платёж старого формата с ценой-строкой. Он сохраняется внутрь пользователя
+// как раньше, а переносит его в коллекцию payments db.Migrate.
+type legacyPayment struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Price         string             `bson:"price" json:"price"`
+	PaymentMethod string             `bson:"payment_method" json:"payment_method"`
+	PaymentStatus string             `bson:"payment_status" json:"payment_status"`
+	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt     time.Time          `bson:"updated_at" json:"updated_at"`
+	JobID         primitive.ObjectID `bson:"job_id" json:"job_id"`
+}
+
 // Структура для экспорта/импорта данных
 type SystemData struct {
 	Users   []models.User   `json:"users"`
 	Servers []models.Server `json:"servers"`
 	Jobs    []models.Job    `json:"jobs"`
+	// Платежи хранятся в отдельной коллекции, а не внутри пользователей
+	Payments []models.Payment `json:"payments,omitempty"`
 }
 
 // Экспорт данных
@@ -25,6 +56,7 @@ func ExportData(w http.ResponseWriter, r *http.Request) {
 	usersCollection := db.GetCollection("users")
 	serversCollection := db.GetCollection("servers")
 	jobsCollection := db.GetCollection("jobs")
+	paymentsCollection := db.GetCollection("payments")
 
 	var systemData SystemData
 
@@ -73,6 +105,21 @@ func ExportData(w http.ResponseWriter, r *http.Request) {
 	}
 	systemData.Jobs = jobs
 
+	// Получение данных из коллекции payments
+	paymentsCursor, err := paymentsCollection.Find(context.Background(), bson.M{})
+	if err != nil {
+		http.Error(w, "Error exporting payments: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer paymentsCursor.Close(context.Background())
+
+	var payments []models.Payment
+	if err := paymentsCursor.All(context.Background(), &payments); err != nil {
+		http.Error(w, "Error decoding payments: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	systemData.Payments = payments
+
 	// Отправка данных в формате JSON
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -99,10 +146,20 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// В старых выгрузках платежи лежат внутри пользователей и в SystemData не попадают
+	var legacy struct {
+		Users []legacyUser `json:"users"`
+	}
+	if err := json.Unmarshal(body, &legacy); err != nil {
+		http.Error(w, "Error parsing legacy payments: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Коллекции для работы с MongoDB
 	usersCollection := db.GetCollection("users")
 	serversCollection := db.GetCollection("servers")
 	jobsCollection := db.GetCollection("jobs")
+	paymentsCollection := db.GetCollection("payments")
 
 	// Очистка всех коллекций
 	clearCollection := func(collection *mongo.Collection, collectionName string) error {
@@ -126,6 +183,10 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err := clearCollection(paymentsCollection, "payments"); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	// Функция для вставки данных в коллекцию
 	insertMany := func(collection *mongo.Collection, data interface{}, collectionName string) error {
@@ -144,6 +205,10 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 			for _, job := range v {
 				dataSlice = append(dataSlice, job)
 			}
+		case []models.Payment:
+			for _, payment := range v {
+				dataSlice = append(dataSlice, payment)
+			}
 		default:
 			return fmt.Errorf("unsupported data type for %s", collectionName)
 		}
@@ -168,6 +233,33 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if len(systemData.Payments) > 0 {
+		if err := insertMany(paymentsCollection, systemData.Payments, "payments"); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Платежи старого формата возвращаются внутрь пользователей и переносятся миграцией,
+	// как при обновлении базы
+	legacyPayments := 0
+	for _, user := range legacy.Users {
+		if len(user.Payments) == 0 {
+			continue
+		}
+		_, err := usersCollection.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"payments": user.Payments}})
+		if err != nil {
+			http.Error(w, "Error importing payments: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		legacyPayments += len(user.Payments)
+	}
+	if legacyPayments > 0 {
+		if err := db.Migrate(importCurrency); err != nil {
+			http.Error(w, "Error migrating payments: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 
 	// Ответ об успешном импорте данных
 	w.WriteHeader(http.StatusOK)
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/events"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// sseKeepAlive - период отправки комментария-пинга, чтобы прокси не закрывали соединение
+const sseKeepAlive = 15 * time.Second
+
+// GET /jobs/events?user_id={userID}
+
+// Поток Server-Sent Events с изменениями статуса, процентом выполнения и ETA задач.
+// Пользователь получает события только своих задач, администратор - всех задач.
+// При переподключении браузер сам передаёт заголовок Last-Event-ID и получает пропущенные события;
+// если они уже вытеснены из истории, сначала присылается текущее состояние незавершённых задач.
+/*
+id: 1734001234567001
+event: job
+data: {"id":1734001234567001,"job_id":"...","user_id":"...","status":"pending","progress":40,"eta":"...","time":"..."}
+*/
+func StreamJobsEvents(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	filter := func(event events.JobEvent) bool {
+		return isAdmin(user) || event.UserID == user.ID
+	}
+
+	snapshot := func() ([]models.Job, error) {
+		query := bson.M{"status": bson.M{"$nin": []string{"completed", "failed"}}}
+		if !isAdmin(user) {
+			query["user_id"] = user.ID
+		}
+		var jobs []models.Job
+		cursor, err := db.GetCollection("jobs").Find(context.Background(), query)
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close(context.Background())
+		err = cursor.All(context.Background(), &jobs)
+		return jobs, err
+	}
+
+	streamJobEvents(w, r, filter, snapshot)
+}
+
+// GET /jobs/{id}/events?user_id={userID}
+
+// Поток Server-Sent Events по одной задаче (для конвейера - включая события его шагов).
+func StreamJobEvents(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	jobID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+
+	var job models.Job
+	err = db.GetCollection("jobs").FindOne(context.Background(), bson.M{"_id": jobID}).Decode(&job)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Job not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching job", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !isAdmin(user) && job.UserID != user.ID {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	filter := func(event events.JobEvent) bool {
+		return event.JobID == jobID || event.ParentID == jobID
+	}
+
+	snapshot := func() ([]models.Job, error) {
+		var current models.Job
+		err := db.GetCollection("jobs").FindOne(context.Background(), bson.M{"_id": jobID}).Decode(&current)
+		return []models.Job{current}, err
+	}
+
+	streamJobEvents(w, r, filter, snapshot)
+}
+
+// streamJobEvents отправляет клиенту события брокера до закрытия соединения.
+func streamJobEvents(w http.ResponseWriter, r *http.Request, filter func(events.JobEvent) bool, snapshot func() ([]models.Job, error)) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var lastID int64
+	if lastEventID != "" {
+		var err error
+		lastID, err = strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	missed, resumed, ch, cancel := events.Jobs.Subscribe(lastID, filter)
+	defer cancel()
+
+	// Если продолжить с места обрыва нельзя, присылаем текущее состояние задач.
+	// Такие события не имеют номера и не меняют Last-Event-ID клиента.
+	var initial []models.Job
+	if !resumed {
+		var err error
+		initial, err = snapshot()
+		if err != nil {
+			http.Error(w, "Error fetching jobs", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	now := time.Now()
+	for _, job := range initial {
+		writeJobEvent(w, events.FromJob(job, now))
+	}
+	for _, event := range missed {
+		writeJobEvent(w, event)
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			writeJobEvent(w, event)
+			flusher.Flush()
+		case <-ticker.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func writeJobEvent(w http.ResponseWriter, event events.JobEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	if event.ID > 0 {
+		fmt.Fprintf(w, "id: %d\n", event.ID)
+	}
+	fmt.Fprintf(w, "event: job\ndata: %s\n\n", data)
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/moevm/nosql2h24-transcribtion/fleet"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsPongTimeout  = 60 * time.Second
+	wsPingInterval = 30 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: checkOrigin,
+}
+
+// checkOrigin принимает WebSocket-подключения только с фронтенда (FRONTEND_ORIGIN): браузер
+// передаёт куки и параметры пользователя с любой страницы, поэтому чужой сайт не должен
+// подключаться от имени администратора. Запросы без Origin приходят не из браузера.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	return frontendOrigin != "" && strings.EqualFold(strings.TrimSuffix(origin, "/"), strings.TrimSuffix(frontendOrigin, "/"))
+}
+
+// GET /admin/fleet/ws?user_id={adminID}&labels=gpu,eu
+
+// WebSocket для панели администратора. Сразу после подключения приходит полный снимок
+// ({"type": "snapshot", "servers": [...], "queue": {...}}), затем только изменения
+// ({"type": "diff", "servers": [...изменившиеся], "removed": [...], "queue": {...}}).
+// Полный снимок повторяется периодически, чтобы клиент мог восстановить состояние.
+// Фильтр по меткам можно сменить сообщением {"action": "subscribe", "labels": ["gpu"]}.
+// Подключение принимается только с FRONTEND_ORIGIN и только при DEV_AUTH=true, иначе ответ 401.
+func FleetMonitor(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !isAdmin(user) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Error upgrading fleet connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	client := fleet.Default.Register(parseLabels(r.URL.Query().Get("labels")))
+	defer fleet.Default.Unregister(client)
+
+	// Чтение сообщений клиента: смена фильтра и обработка pong
+	go func() {
+		conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+		})
+		for {
+			var request struct {
+				Action string   `json:"action"`
+				Labels []string `json:"labels"`
+			}
+			if err := conn.ReadJSON(&request); err != nil {
+				fleet.Default.Unregister(client)
+				return
+			}
+			if request.Action == "subscribe" {
+				fleet.Default.SetLabels(client, request.Labels)
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case msg, ok := <-client.Send:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsWriteTimeout))
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func parseLabels(value string) []string {
+	var labels []string
+	for _, label := range strings.Split(value, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
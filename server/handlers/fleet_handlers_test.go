@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	frontendOrigin = "http://localhost:5173"
+	defer func() { frontendOrigin = "" }()
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://localhost:5173", true},
+		{"http://LOCALHOST:5173/", true},
+		{"http://localhost:8080", false},
+		{"https://evil.example.com", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/admin/fleet/ws", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := checkOrigin(r); got != tt.want {
+			t.Errorf("checkOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/glossary"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"net/http"
+	"time"
+)
+
+// GET /users/{id}/glossaries
+
+// Ответ - массив словарей пользователя
+func GetUserGlossaries(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	cursor, err := db.GetCollection("glossaries").Find(context.Background(), bson.M{"user_id": userID})
+	if err != nil {
+		http.Error(w, "Error fetching glossaries", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	glossaries := []models.Glossary{}
+	if err := cursor.All(context.Background(), &glossaries); err != nil {
+		http.Error(w, "Error decoding glossaries", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(glossaries)
+}
+
+// GET /users/{id}/glossaries/{glossary_id}
+func GetUserGlossary(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	glossaryID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "glossary_id"))
+	if err != nil {
+		http.Error(w, "Invalid glossary ID", http.StatusBadRequest)
+		return
+	}
+
+	g, err := findUserGlossary(userID, glossaryID)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Glossary not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching glossary", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(g)
+}
+
+/*
+POST /users/{id}/glossaries
+
+	{
+		"name": "Company names",
+		"terms": [
+			{"term": "Kubernetes", "pronunciation": "koo-ber-net-ees", "variants": ["cooper netties"]}
+		],
+		"rules": [
+			{"from": "moevm", "to": "MOEVM", "case_sensitive": false}
+		]
+	}
+*/
+func CreateUserGlossary(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var g models.Glossary
+	if err := render.DecodeJSON(r.Body, &g); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if err := glossary.Validate(g); err != nil {
+		http.Error(w, "Invalid glossary: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	g.ID = primitive.NewObjectID()
+	g.UserID = userID
+	g.CreatedAt = time.Now()
+	g.UpdatedAt = g.CreatedAt
+	if g.Terms == nil {
+		g.Terms = []models.GlossaryTerm{}
+	}
+	if g.Rules == nil {
+		g.Rules = []models.ReplacementRule{}
+	}
+
+	_, err = db.GetCollection("glossaries").InsertOne(context.Background(), g)
+	if err != nil {
+		http.Error(w, "Error saving glossary", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(g)
+}
+
+// PUT /users/{id}/glossaries/{glossary_id}
+// Тело запроса такое же, как при создании; термины и правила заменяются целиком.
+func UpdateUserGlossary(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	glossaryID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "glossary_id"))
+	if err != nil {
+		http.Error(w, "Invalid glossary ID", http.StatusBadRequest)
+		return
+	}
+
+	var g models.Glossary
+	if err := render.DecodeJSON(r.Body, &g); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if err := glossary.Validate(g); err != nil {
+		http.Error(w, "Invalid glossary: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if g.Terms == nil {
+		g.Terms = []models.GlossaryTerm{}
+	}
+	if g.Rules == nil {
+		g.Rules = []models.ReplacementRule{}
+	}
+
+	filter := bson.M{"_id": glossaryID, "user_id": userID}
+	update := bson.M{"$set": bson.M{
+		"name":       g.Name,
+		"terms":      g.Terms,
+		"rules":      g.Rules,
+		"updated_at": time.Now(),
+	}}
+
+	result, err := db.GetCollection("glossaries").UpdateOne(context.Background(), filter, update)
+	if err != nil {
+		http.Error(w, "Error updating glossary", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "Glossary not found", http.StatusNotFound)
+		return
+	}
+
+	updated, err := findUserGlossary(userID, glossaryID)
+	if err != nil {
+		http.Error(w, "Error fetching updated glossary", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// DELETE /users/{id}/glossaries/{glossary_id}
+func DeleteUserGlossary(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	glossaryID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "glossary_id"))
+	if err != nil {
+		http.Error(w, "Invalid glossary ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.GetCollection("glossaries").DeleteOne(context.Background(), bson.M{"_id": glossaryID, "user_id": userID})
+	if err != nil {
+		http.Error(w, "Error deleting glossary", http.StatusInternalServerError)
+		return
+	}
+	if result.DeletedCount == 0 {
+		http.Error(w, "Glossary not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func findUserGlossary(userID, glossaryID primitive.ObjectID) (models.Glossary, error) {
+	var g models.Glossary
+	err := db.GetCollection("glossaries").FindOne(context.Background(),
+		bson.M{"_id": glossaryID, "user_id": userID},
+	).Decode(&g)
+	return g, err
+}
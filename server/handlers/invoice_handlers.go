@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/invoices"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// GET /users/{id}/invoices
+
+// Счета пользователя, последние периоды сверху
+func GetUserInvoices(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "period_start", Value: -1}, {Key: "currency", Value: 1}})
+	cursor, err := db.GetCollection(invoices.Collection).Find(context.Background(), bson.M{"user_id": userID}, opts)
+	if err != nil {
+		http.Error(w, "Error fetching invoices", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	result := []models.Invoice{}
+	if err := cursor.All(context.Background(), &result); err != nil {
+		http.Error(w, "Error decoding invoices", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+/*
+POST /users/{id}/invoices
+{
+	"period": "2024-11"
+}
+
+Выставляет счета за завершившийся месяц (по одному на валюту) и возвращает их. Счета за прошедший
+месяц выставляются и автоматически; уже выставленный счёт не пересоздаётся и возвращается как есть.
+Если в периоде не было ни выполненных задач, ни платежей - 404.
+*/
+
+func GenerateUserInvoices(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Period string `json:"period"`
+	}
+	if err := render.DecodeJSON(r.Body, &request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	month, err := invoices.ParsePeriod(request.Period)
+	if err != nil {
+		http.Error(w, "Invalid period, expected YYYY-MM", http.StatusBadRequest)
+		return
+	}
+
+	count, err := db.GetCollection("users").CountDocuments(context.Background(), bson.M{"_id": userID})
+	if err != nil {
+		http.Error(w, "Error fetching user", http.StatusInternalServerError)
+		return
+	}
+	if count == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	result, err := invoices.Generate(userID, month, time.Now())
+	if err != nil {
+		if errors.Is(err, invoices.ErrPeriodNotEnded) {
+			http.Error(w, "Billing period has not ended yet", http.StatusBadRequest)
+		} else {
+			http.Error(w, "Error generating invoices", http.StatusInternalServerError)
+		}
+		return
+	}
+	if len(result) == 0 {
+		http.Error(w, "Nothing to invoice in this period", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// GET /users/{id}/invoices/{invoice_id}?format=json|pdf|csv
+
+// Счёт пользователя: JSON-документ (по умолчанию) или файл PDF/CSV
+func GetUserInvoice(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	invoiceID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "invoice_id"))
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	var invoice models.Invoice
+	err = db.GetCollection(invoices.Collection).FindOne(context.Background(),
+		bson.M{"_id": invoiceID, "user_id": userID},
+	).Decode(&invoice)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Invoice not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching invoice", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" || format == invoices.FormatJSON {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(invoice)
+		return
+	}
+
+	data, contentType, err := invoices.Render(invoice, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(invoice.Number+"."+format))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,304 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/export"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/timeline"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// GET /jobs/{id}/transcripts
+
+// Ответ - список расшифровок задачи (исходный язык и языки перевода) со ссылками на скачивание
+/*
+[
+	{
+		"language": "en",
+		"original": true,
+		"segments": 3,
+		"download_url": "/jobs/650e7c3f5f1e4e0001a0bdf3/transcripts/en"
+	}
+]
+*/
+func GetJobTranscripts(w http.ResponseWriter, r *http.Request) {
+	jobID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+	// Задача могла переиспользовать результат другой задачи с тем же файлом
+	resultID, err := resultJobID(jobID)
+	if err != nil {
+		http.Error(w, "Error fetching job", http.StatusInternalServerError)
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "original", Value: -1}, {Key: "language", Value: 1}})
+	cursor, err := db.GetCollection("transcripts").Find(context.Background(), bson.M{"job_id": resultID}, opts)
+	if err != nil {
+		http.Error(w, "Error fetching transcripts", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	var transcripts []models.Transcript
+	if err := cursor.All(context.Background(), &transcripts); err != nil {
+		http.Error(w, "Error decoding transcripts", http.StatusInternalServerError)
+		return
+	}
+
+	type transcriptInfo struct {
+		Language    string `json:"language"`
+		Original    bool   `json:"original"`
+		Segments    int    `json:"segments"`
+		DownloadURL string `json:"download_url"`
+	}
+	result := []transcriptInfo{}
+	for _, transcript := range transcripts {
+		result = append(result, transcriptInfo{
+			Language:    transcript.Language,
+			Original:    transcript.Original,
+			Segments:    len(transcript.Segments),
+			DownloadURL: "/jobs/" + jobID.Hex() + "/transcripts/" + transcript.Language,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// GET /jobs/{id}/transcripts/{language}?format=txt|srt|vtt|json
+
+// Отдаёт расшифровку задачи на указанном языке в виде файла (по умолчанию txt)
+func DownloadJobTranscript(w http.ResponseWriter, r *http.Request) {
+	jobID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+	// Задача могла переиспользовать результат другой задачи с тем же файлом
+	resultID, err := resultJobID(jobID)
+	if err != nil {
+		http.Error(w, "Error fetching job", http.StatusInternalServerError)
+		return
+	}
+	language := chi.URLParam(r, "language")
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = export.FormatTXT
+	}
+
+	var transcript models.Transcript
+	err = db.GetCollection("transcripts").FindOne(context.Background(),
+		bson.M{"job_id": resultID, "language": language},
+	).Decode(&transcript)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Transcript not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching transcript", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	data, contentType, err := export.Render(transcript, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timeline.Record(jobID, timeline.Downloaded, primitive.NilObjectID, timeline.Details{
+		"language": transcript.Language,
+		"format":   format,
+	})
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(export.FileName(transcript, format)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// GET /jobs/{id}/timeline
+
+// Журнал событий задачи в хронологическом порядке
+/*
+[
+	{
+		"id": "673a1f0c5f1e4e0001a0be01",
+		"job_id": "650e7c3f5f1e4e0001a0bdf3",
+		"type": "assigned",
+		"server_id": "650e7c3f5f1e4e0001a0bd01",
+		"details": {"hostname": "gpu-node-1"},
+		"created_at": "2024-11-17T10:00:00Z"
+	}
+]
+*/
+func GetJobTimeline(w http.ResponseWriter, r *http.Request) {
+	jobID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+
+	err = db.GetCollection("jobs").FindOne(context.Background(), bson.M{"_id": jobID}).Err()
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Job not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching job", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := db.GetCollection(timeline.Collection).Find(context.Background(), bson.M{"job_id": jobID}, opts)
+	if err != nil {
+		http.Error(w, "Error fetching timeline", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	timelineEvents := []models.TimelineEvent{}
+	if err := cursor.All(context.Background(), &timelineEvents); err != nil {
+		http.Error(w, "Error decoding timeline", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(timelineEvents)
+}
+
+// GET /jobs/{id}/speakers
+
+// Ответ - список говорящих из исходной расшифровки задачи
+func GetJobSpeakers(w http.ResponseWriter, r *http.Request) {
+	jobID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+	// Задача могла переиспользовать результат другой задачи с тем же файлом
+	resultID, err := resultJobID(jobID)
+	if err != nil {
+		http.Error(w, "Error fetching job", http.StatusInternalServerError)
+		return
+	}
+
+	var transcript models.Transcript
+	err = db.GetCollection("transcripts").FindOne(context.Background(),
+		bson.M{"job_id": resultID, "original": true},
+	).Decode(&transcript)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Transcript not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching transcript", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	speakers := transcript.Speakers
+	if speakers == nil {
+		speakers = []models.Speaker{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(speakers)
+}
+
+/*
+PUT /jobs/{id}/speakers
+
+Переименовывает говорящих сразу во всех расшифровках задачи (исходной и переводах).
+Ключ - идентификатор кластера, значение - новое имя:
+{
+	"SPEAKER_1": "Interviewer",
+	"SPEAKER_2": "Guest"
+}
+
+Ответ - обновлённый список говорящих
+*/
+
+func RenameJobSpeakers(w http.ResponseWriter, r *http.Request) {
+	jobID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+	// Задача могла переиспользовать результат другой задачи с тем же файлом
+	resultID, err := resultJobID(jobID)
+	if err != nil {
+		http.Error(w, "Error fetching job", http.StatusInternalServerError)
+		return
+	}
+
+	var labels map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&labels); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if len(labels) == 0 {
+		http.Error(w, "No speakers to rename", http.StatusBadRequest)
+		return
+	}
+
+	transcriptsCollection := db.GetCollection("transcripts")
+
+	var transcript models.Transcript
+	err = transcriptsCollection.FindOne(context.Background(),
+		bson.M{"job_id": resultID, "original": true},
+	).Decode(&transcript)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Transcript not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching transcript", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	known := map[string]bool{}
+	for _, speaker := range transcript.Speakers {
+		known[speaker.ID] = true
+	}
+	for id, label := range labels {
+		if !known[id] {
+			http.Error(w, "Unknown speaker: "+id, http.StatusBadRequest)
+			return
+		}
+		if label == "" {
+			http.Error(w, "Speaker label must not be empty", http.StatusBadRequest)
+			return
+		}
+	}
+
+	for i, speaker := range transcript.Speakers {
+		if label, ok := labels[speaker.ID]; ok {
+			transcript.Speakers[i].Label = label
+		}
+	}
+
+	// Список говорящих одинаков во всех расшифровках задачи, поэтому заменяется целиком
+	_, err = transcriptsCollection.UpdateMany(context.Background(),
+		bson.M{"job_id": resultID},
+		bson.M{"$set": bson.M{"speakers": transcript.Speakers, "updated_at": time.Now()}},
+	)
+	if err != nil {
+		http.Error(w, "Error renaming speakers", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transcript.Speakers)
+}
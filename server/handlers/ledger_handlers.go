@@ -0,0 +1,361 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/ledger"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/money"
+	"github.com/moevm/nosql2h24-transcribtion/pricing"
+	"github.com/moevm/nosql2h24-transcribtion/timeline"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Balance - баланс кошелька пользователя и его сверка с журналом
+type Balance struct {
+	Wallet    *models.Wallet `json:"wallet"`
+	LedgerSum money.Money    `json:"ledger_sum"`
+	Balanced  bool           `json:"balanced"`
+}
+
+// GET /users/{id}/balance
+
+// Баланс предоплаченного кошелька. ledger_sum - сумма записей кошелька в журнале,
+// balanced = false означает расхождение баланса с журналом.
+func GetUserBalance(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var user models.User
+	err = db.GetCollection("users").FindOne(context.Background(), bson.M{"_id": userID}).Decode(&user)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching user", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	reconciliation, err := ledger.Reconcile(user)
+	if err != nil {
+		http.Error(w, "Error reconciling balance", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Balance{
+		Wallet:    user.Wallet,
+		LedgerSum: reconciliation.LedgerSum,
+		Balanced:  reconciliation.Balanced,
+	})
+}
+
+// GET /users/{id}/ledger?type=job_charge&page=1&page_size=20
+
+// Записи кошелька пользователя в журнале, новые сверху. Пополнения положительны, списания отрицательны.
+func GetUserLedger(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	queryParams := r.URL.Query()
+	filter := bson.M{"user_id": userID, "account": ledger.AccountWallet}
+	if entryType := queryParams.Get("type"); entryType != "" {
+		filter["type"] = entryType
+	}
+
+	var pageNum, pageSize int64 = 1, 20
+	if page := queryParams.Get("page"); page != "" {
+		pageNum, err = strconv.ParseInt(page, 10, 64)
+		if err != nil || pageNum <= 0 {
+			http.Error(w, "Invalid page parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if size := queryParams.Get("page_size"); size != "" {
+		pageSize, err = strconv.ParseInt(size, 10, 64)
+		if err != nil || pageSize <= 0 {
+			http.Error(w, "Invalid page_size parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip((pageNum - 1) * pageSize).
+		SetLimit(pageSize)
+	cursor, err := db.GetCollection(ledger.Collection).Find(context.Background(), filter, opts)
+	if err != nil {
+		http.Error(w, "Error fetching ledger", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	result := []models.LedgerEntry{}
+	if err := cursor.All(context.Background(), &result); err != nil {
+		http.Error(w, "Error decoding ledger", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+/*
+POST /users/{id}/ledger/adjustments?user_id={adminID}
+{
+	"amount": {"amount": -500, "currency": "USD"},
+	"description": "Compensation reversal"
+}
+
+Ручная корректировка баланса администратором: положительная сумма зачисляется,
+отрицательная списывается. Баланс не может стать отрицательным (409).
+*/
+
+func AdjustUserBalance(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Amount      money.Money `json:"amount"`
+		Description string      `json:"description"`
+	}
+	if err := render.DecodeJSON(r.Body, &request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if err := request.Amount.Validate(); err != nil {
+		http.Error(w, "Invalid amount currency: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Amount.IsZero() {
+		http.Error(w, "Amount must not be zero", http.StatusBadRequest)
+		return
+	}
+	if request.Description == "" {
+		http.Error(w, "Description is required", http.StatusBadRequest)
+		return
+	}
+
+	transactionID, err := ledger.Adjust(userID, request.Amount, request.Description)
+	if err != nil {
+		switch {
+		case errors.Is(err, ledger.ErrUserNotFound):
+			http.Error(w, "User not found", http.StatusNotFound)
+		case errors.Is(err, ledger.ErrNoWallet), errors.Is(err, ledger.ErrInsufficientFunds), errors.Is(err, ledger.ErrCurrencyMismatch):
+			http.Error(w, "Cannot adjust balance: "+err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, "Error adjusting balance", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if request.Amount.IsPositive() {
+		if err := releaseAwaitingJobs(userID); err != nil {
+			log.Printf("Error releasing jobs of user %v awaiting payment: %v", userID, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]primitive.ObjectID{"transaction_id": transactionID})
+}
+
+// GET /admin/ledger/reconcile?user_id={adminID}
+
+// Сверка всех кошельков с журналом. Возвращает только пользователей, у которых баланс
+// не совпадает с суммой записей; пустой список - расхождений нет.
+func ReconcileLedger(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	mismatches, err := ledger.ReconcileAll()
+	if err != nil {
+		http.Error(w, "Error reconciling ledger", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mismatches)
+}
+
+// chargeJob списывает с кошелька стоимость выполненной задачи по фактической длительности записи
+// (MediaSeconds, см. mediaSeconds).
+// Задача без кошелька или с недостаточным балансом остаётся неоплаченной. Цена оплаченной заранее
+// задачи тоже пересчитывается: если запись длиннее заявленной, разница доплачивается (chargeSurcharge).
+func chargeJob(job models.Job) {
+	if job.Status != "completed" {
+		return
+	}
+	seconds := job.MediaSeconds
+	if seconds == 0 {
+		return
+	}
+
+	var user models.User
+	if err := db.GetCollection("users").FindOne(context.Background(), bson.M{"_id": job.UserID}).Decode(&user); err != nil {
+		log.Printf("Error fetching user %v to charge job %v: %v", job.UserID, job.ID, err)
+		return
+	}
+
+	declared := job.Price
+	job.DurationSeconds = seconds
+	quote, err := pricing.QuoteJob(user, job)
+	if err != nil {
+		log.Printf("Error pricing job %v: %v", job.ID, err)
+		return
+	}
+	if !job.PaidAt.IsZero() {
+		chargeSurcharge(user, job, declared, seconds, quote.Total)
+		return
+	}
+
+	jobsCollection := db.GetCollection("jobs")
+	_, err = jobsCollection.UpdateOne(context.Background(), bson.M{"_id": job.ID}, bson.M{
+		"$set": bson.M{"media_seconds": seconds, "price": quote.Total, "updated_at": time.Now()},
+	})
+	if err != nil {
+		log.Printf("Error updating price of job %v: %v", job.ID, err)
+		return
+	}
+	if user.Wallet == nil {
+		return
+	}
+
+	transactionID, err := ledger.ChargeJob(user.ID, job.ID, quote.Total)
+	if err != nil {
+		if !errors.Is(err, ledger.ErrDuplicate) {
+			log.Printf("Job %v is left unpaid: %v", job.ID, err)
+		}
+		return
+	}
+
+	now := time.Now()
+	_, err = jobsCollection.UpdateOne(context.Background(), bson.M{"_id": job.ID}, bson.M{
+		"$set": bson.M{"ledger_transaction_id": transactionID, "paid_at": now, "updated_at": now},
+	})
+	if err != nil {
+		log.Printf("Error marking job %v as paid: %v", job.ID, err)
+	}
+	timeline.Record(job.ID, timeline.Charged, primitive.NilObjectID, timeline.Details{
+		"transaction_id": transactionID,
+		"amount":         quote.Total,
+		"media_seconds":  seconds,
+	})
+}
+
+// chargeSurcharge пересчитывает цену оплаченной задачи по фактической длительности. Если цена
+// выросла, разница сохраняется в surcharge задачи и списывается с кошелька; без кошелька
+// или при нехватке средств она остаётся долгом пользователя и попадает в счёт за месяц.
+// Если запись оказалась короче, оплаченная цена не меняется.
+func chargeSurcharge(user models.User, job models.Job, declared *money.Money, seconds float64, actual money.Money) {
+	jobsCollection := db.GetCollection("jobs")
+	now := time.Now()
+	if declared == nil || declared.Currency != actual.Currency || actual.Amount <= declared.Amount {
+		_, err := jobsCollection.UpdateOne(context.Background(), bson.M{"_id": job.ID},
+			bson.M{"$set": bson.M{"media_seconds": seconds, "updated_at": now}})
+		if err != nil {
+			log.Printf("Error updating media seconds of job %v: %v", job.ID, err)
+		}
+		return
+	}
+
+	surcharge, err := actual.Sub(*declared)
+	if err != nil {
+		log.Printf("Error calculating surcharge of job %v: %v", job.ID, err)
+		return
+	}
+	// Условие на media_seconds не даёт начислить доплату дважды
+	result, err := jobsCollection.UpdateOne(context.Background(),
+		bson.M{"_id": job.ID, "media_seconds": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"media_seconds": seconds, "price": actual, "surcharge": surcharge, "updated_at": now}},
+	)
+	if err != nil {
+		log.Printf("Error saving surcharge of job %v: %v", job.ID, err)
+		return
+	}
+	if result.ModifiedCount == 0 || user.Wallet == nil {
+		return
+	}
+
+	transactionID, err := ledger.ChargeSurcharge(user.ID, job.ID, surcharge)
+	if err != nil {
+		if !errors.Is(err, ledger.ErrDuplicate) {
+			log.Printf("Surcharge of job %v is left unpaid: %v", job.ID, err)
+		}
+		return
+	}
+	_, err = jobsCollection.UpdateOne(context.Background(), bson.M{"_id": job.ID},
+		bson.M{"$unset": bson.M{"surcharge": ""}, "$set": bson.M{"updated_at": time.Now()}})
+	if err != nil {
+		log.Printf("Error marking surcharge of job %v as paid: %v", job.ID, err)
+	}
+	timeline.Record(job.ID, timeline.Charged, primitive.NilObjectID, timeline.Details{
+		"transaction_id": transactionID,
+		"amount":         surcharge,
+		"media_seconds":  seconds,
+		"surcharge":      true,
+	})
+}
+
+// mediaSeconds возвращает фактическую длительность записи по исходной расшифровке задачи,
+// а если расшифровки нет - длительность, указанную при создании задачи.
+func mediaSeconds(job models.Job) (float64, error) {
+	var transcript models.Transcript
+	err := db.GetCollection("transcripts").FindOne(context.Background(),
+		originalTranscriptFilter(job),
+		options.FindOne().SetProjection(bson.M{"segments.end": 1}),
+	).Decode(&transcript)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, err
+	}
+	return transcriptSeconds(transcript, job.DurationSeconds), nil
+}
+
+// originalTranscriptFilter выбирает исходную расшифровку задачи. Шаги конвейера сохраняют
+// расшифровки от имени самого конвейера, повторно использованная задача - от имени исходной.
+func originalTranscriptFilter(job models.Job) bson.M {
+	resultID := job.ID
+	if !job.ReusedFromJobID.IsZero() {
+		resultID = job.ReusedFromJobID
+	}
+	return bson.M{"job_id": resultID, "original": true}
+}
+
+// transcriptSeconds возвращает конец последнего сегмента расшифровки или declared, если сегментов нет.
+func transcriptSeconds(transcript models.Transcript, declared float64) float64 {
+	seconds := 0.0
+	for _, segment := range transcript.Segments {
+		if segment.End > seconds {
+			seconds = segment.End
+		}
+	}
+	if seconds == 0 {
+		return declared
+	}
+	return seconds
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/money"
+	"github.com/moevm/nosql2h24-transcribtion/pricing"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPipelineChargedByItsTranscript(t *testing.T) {
+	first, second := primitive.NewObjectID(), primitive.NewObjectID()
+	parent := models.Job{
+		ID:              primitive.NewObjectID(),
+		DurationSeconds: 60,
+		Steps: []models.PipelineStep{
+			{Type: "transcription", JobID: first},
+			{Type: "translation", JobID: second},
+		},
+	}
+	// Шаги конвейера сохраняют расшифровку от имени конвейера
+	transcript := models.Transcript{
+		JobID:    parent.ID,
+		Original: true,
+		Segments: []models.Segment{{Start: 0, End: 300}, {Start: 300, End: 610}},
+	}
+
+	want := bson.M{"job_id": parent.ID, "original": true}
+	if got := originalTranscriptFilter(parent); !reflect.DeepEqual(got, want) {
+		t.Fatalf("originalTranscriptFilter() = %v, want %v", got, want)
+	}
+	if transcript.JobID != want["job_id"] {
+		t.Fatalf("transcript of job %v does not match the filter", transcript.JobID)
+	}
+
+	seconds := transcriptSeconds(transcript, parent.DurationSeconds)
+	if seconds != 610 {
+		t.Fatalf("transcriptSeconds() = %v, want 610", seconds)
+	}
+	parent.DurationSeconds = seconds
+	quote, err := pricing.Calculate(pricing.DefaultRule, parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 11 начатых минут по 0.10 USD
+	if quote.Total != money.New(110, "USD") {
+		t.Errorf("charged %v, want 1.10 USD", quote.Total)
+	}
+}
+
+func TestOriginalTranscriptFilterOfReusedJob(t *testing.T) {
+	source := primitive.NewObjectID()
+	job := models.Job{ID: primitive.NewObjectID(), ReusedFromJobID: source}
+	want := bson.M{"job_id": source, "original": true}
+	if got := originalTranscriptFilter(job); !reflect.DeepEqual(got, want) {
+		t.Errorf("originalTranscriptFilter() = %v, want %v", got, want)
+	}
+}
+
+func TestTranscriptSecondsFallsBackToDeclared(t *testing.T) {
+	if got := transcriptSeconds(models.Transcript{}, 42); got != 42 {
+		t.Errorf("transcriptSeconds() = %v, want 42", got)
+	}
+}
@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/notifications"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// GET /users/{id}/notifications?unread=true&page=1&page_size=20
+
+// Входящие уведомления пользователя, новые сверху
+func GetUserNotifications(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	queryParams := r.URL.Query()
+	filter := bson.M{"user_id": userID}
+	if unread := queryParams.Get("unread"); unread != "" {
+		onlyUnread, err := strconv.ParseBool(unread)
+		if err != nil {
+			http.Error(w, "Invalid unread parameter", http.StatusBadRequest)
+			return
+		}
+		if onlyUnread {
+			filter["read"] = false
+		}
+	}
+
+	var pageNum, pageSize int64 = 1, 20
+	if page := queryParams.Get("page"); page != "" {
+		pageNum, err = strconv.ParseInt(page, 10, 64)
+		if err != nil || pageNum <= 0 {
+			http.Error(w, "Invalid page parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if size := queryParams.Get("page_size"); size != "" {
+		pageSize, err = strconv.ParseInt(size, 10, 64)
+		if err != nil || pageSize <= 0 {
+			http.Error(w, "Invalid page_size parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetSkip((pageNum - 1) * pageSize).
+		SetLimit(pageSize)
+	cursor, err := db.GetCollection("notifications").Find(context.Background(), filter, opts)
+	if err != nil {
+		http.Error(w, "Error fetching notifications", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	result := []models.Notification{}
+	if err := cursor.All(context.Background(), &result); err != nil {
+		http.Error(w, "Error decoding notifications", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// POST /users/{id}/notifications/{notification_id}/read
+func MarkNotificationRead(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	notificationID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "notification_id"))
+	if err != nil {
+		http.Error(w, "Invalid notification ID", http.StatusBadRequest)
+		return
+	}
+
+	// Повторная отметка не меняет время прочтения
+	collection := db.GetCollection("notifications")
+	_, err = collection.UpdateOne(context.Background(),
+		bson.M{"_id": notificationID, "user_id": userID, "read": false},
+		bson.M{"$set": bson.M{"read": true, "read_at": time.Now()}},
+	)
+	if err != nil {
+		http.Error(w, "Error updating notification", http.StatusInternalServerError)
+		return
+	}
+
+	var notification models.Notification
+	err = collection.FindOne(context.Background(), bson.M{"_id": notificationID, "user_id": userID}).Decode(&notification)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Notification not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching notification", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notification)
+}
+
+// POST /users/{id}/notifications/read-all
+
+// Отмечает прочитанными все уведомления пользователя. Ответ - {"updated": 3}
+func MarkAllNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.GetCollection("notifications").UpdateMany(context.Background(),
+		bson.M{"user_id": userID, "read": false},
+		bson.M{"$set": bson.M{"read": true, "read_at": time.Now()}},
+	)
+	if err != nil {
+		http.Error(w, "Error updating notifications", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"updated": result.ModifiedCount})
+}
+
+// GET /users/{id}/notification-preferences
+func GetNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var user models.User
+	err = db.GetCollection("users").FindOne(context.Background(), bson.M{"_id": userID}).Decode(&user)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching user", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notifications.Preferences(user))
+}
+
+/*
+PUT /users/{id}/notification-preferences
+{
+	"in_app": true,
+	"email": false,
+	"disabled_types": ["payment_failed"]
+}
+
+Типы уведомлений: job_completed, job_failed, payment_failed. Поля необязательны:
+не переданные настройки остаются прежними. Ответ - настройки после изменения.
+*/
+
+func UpdateNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		InApp         *bool     `json:"in_app"`
+		Email         *bool     `json:"email"`
+		DisabledTypes *[]string `json:"disabled_types"`
+	}
+	if err := render.DecodeJSON(r.Body, &request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if request.DisabledTypes != nil {
+		for _, notificationType := range *request.DisabledTypes {
+			if !notifications.IsKnownType(notificationType) {
+				http.Error(w, "Unknown notification type: "+notificationType, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	usersCollection := db.GetCollection("users")
+	var user models.User
+	err = usersCollection.FindOne(context.Background(), bson.M{"_id": userID}).Decode(&user)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching user", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	prefs := notifications.Preferences(user)
+	if request.InApp != nil {
+		prefs.InApp = *request.InApp
+	}
+	if request.Email != nil {
+		prefs.Email = *request.Email
+	}
+	if request.DisabledTypes != nil {
+		prefs.DisabledTypes = *request.DisabledTypes
+	}
+
+	_, err = usersCollection.UpdateOne(context.Background(),
+		bson.M{"_id": userID},
+		bson.M{"$set": bson.M{"notification_preferences": prefs, "updated_at": time.Now()}},
+	)
+	if err != nil {
+		http.Error(w, "Error updating notification preferences", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
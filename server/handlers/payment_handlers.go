@@ -0,0 +1,471 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/ledger"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/money"
+	"github.com/moevm/nosql2h24-transcribtion/payments"
+	"github.com/moevm/nosql2h24-transcribtion/timeline"
+	"github.com/moevm/nosql2h24-transcribtion/webhooks"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// GET /payments?user_id={adminID}&customer_id=...&job_id=...&status=captured&provider=mock&from=2024-11-01&to=2024-12-01&page=1&page_size=20
+
+// Платежи всех пользователей для администратора, новые сверху. Все фильтры необязательны:
+// customer_id - владелец платежа, from/to - границы даты создания в формате YYYY-MM-DD (to не включается).
+func GetPayments(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	queryParams := r.URL.Query()
+	filter := bson.M{}
+	for param, field := range map[string]string{"customer_id": "user_id", "job_id": "job_id"} {
+		if value := queryParams.Get(param); value != "" {
+			id, err := primitive.ObjectIDFromHex(value)
+			if err != nil {
+				http.Error(w, "Invalid "+param+" parameter", http.StatusBadRequest)
+				return
+			}
+			filter[field] = id
+		}
+	}
+	if status := queryParams.Get("status"); status != "" {
+		filter["payment_status"] = status
+	}
+	if provider := queryParams.Get("provider"); provider != "" {
+		filter["provider"] = provider
+	}
+	created := bson.M{}
+	for param, operator := range map[string]string{"from": "$gte", "to": "$lt"} {
+		if value := queryParams.Get(param); value != "" {
+			date, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				http.Error(w, "Invalid "+param+" parameter", http.StatusBadRequest)
+				return
+			}
+			created[operator] = date
+		}
+	}
+	if len(created) > 0 {
+		filter["created_at"] = created
+	}
+
+	pageNum, pageSize, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetSkip((pageNum - 1) * pageSize).
+		SetLimit(pageSize)
+	cursor, err := db.GetCollection(payments.Collection).Find(context.Background(), filter, opts)
+	if err != nil {
+		http.Error(w, "Error fetching payments", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	result := []models.Payment{}
+	if err := cursor.All(context.Background(), &result); err != nil {
+		http.Error(w, "Error decoding payments", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// GET /users/{id}/payments?page=1&page_size=20
+
+// Платежи пользователя, новые сверху
+func GetUserPayments(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	pageNum, pageSize, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetSkip((pageNum - 1) * pageSize).
+		SetLimit(pageSize)
+	cursor, err := db.GetCollection(payments.Collection).Find(context.Background(), bson.M{"user_id": userID}, opts)
+	if err != nil {
+		http.Error(w, "Error fetching payments", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	result := []models.Payment{}
+	if err := cursor.All(context.Background(), &result); err != nil {
+		http.Error(w, "Error decoding payments", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// POST /payments/webhooks/{provider}
+
+// Уведомления платёжного провайдера о смене статуса платежа. Повторное уведомление о том же
+// статусе принимается без изменений, недопустимый переход отклоняется с 409.
+func PaymentProviderWebhook(w http.ResponseWriter, r *http.Request) {
+	provider, ok := payments.Get(chi.URLParam(r, "provider"))
+	if !ok {
+		http.Error(w, "Unknown payment provider", http.StatusNotFound)
+		return
+	}
+
+	event, err := provider.ParseWebhook(r)
+	if err != nil {
+		if errors.Is(err, payments.ErrInvalidSignature) {
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		} else {
+			http.Error(w, "Invalid webhook payload", http.StatusBadRequest)
+		}
+		return
+	}
+
+	payment, err := findPaymentByIntent(provider.Name(), event.IntentID)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Payment not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching payment", http.StatusInternalServerError)
+		}
+		return
+	}
+	// Возвраты ведутся отдельными документами и меняют статус платежа по мере выполнения
+	if event.RefundID != "" || event.Status == payments.StatusRefunded {
+		if err := refundEvent(payment, event); err != nil {
+			switch {
+			case errors.Is(err, mongo.ErrNoDocuments):
+				http.Error(w, "Refund not found", http.StatusNotFound)
+			case errors.Is(err, errNotRefundable), errors.Is(err, errRefundTooLarge), errors.Is(err, errNoProvider),
+				errors.Is(err, money.ErrCurrencyMismatch), errors.Is(err, ledger.ErrInsufficientFunds):
+				http.Error(w, "Refund does not match payment: "+err.Error(), http.StatusConflict)
+			default:
+				http.Error(w, "Error updating refund", http.StatusInternalServerError)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	// Авторизуется и списывается вся сумма платежа
+	if event.Status != payments.StatusFailed && event.Amount != payment.Price {
+		http.Error(w, "Amount does not match payment", http.StatusConflict)
+		return
+	}
+
+	payment, changed, err := transitionPayment(payment.UserID, payment.ID, event.Status, event.Reason)
+	if err != nil {
+		if errors.Is(err, payments.ErrInvalidTransition) {
+			http.Error(w, "Cannot change payment status from "+payment.PaymentStatus+" to "+event.Status, http.StatusConflict)
+		} else {
+			http.Error(w, "Error updating payment", http.StatusInternalServerError)
+		}
+		return
+	}
+	if changed {
+		paymentChanged(payment.UserID, payment)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+POST /payments/mock/{intent_id}/confirm
+{
+	"approve": true
+}
+
+Страница оплаты тестового провайдера: подтверждает (по умолчанию) или отклоняет оплату.
+Провайдер отправляет уведомление в POST /payments/webhooks/mock, ответ - платёж после него.
+Списание авторизованного платежа приходит отдельным уведомлением чуть позже.
+*/
+
+func ConfirmMockPayment(w http.ResponseWriter, r *http.Request) {
+	provider, _ := payments.Get(payments.MockName)
+	mock, ok := provider.(*payments.MockProvider)
+	if !ok {
+		http.Error(w, "Mock payment provider is not enabled", http.StatusNotFound)
+		return
+	}
+
+	request := struct {
+		Approve *bool `json:"approve"`
+	}{}
+	if err := render.DecodeJSON(r.Body, &request); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	approve := request.Approve == nil || *request.Approve
+
+	intentID := chi.URLParam(r, "intent_id")
+	payment, err := findPaymentByIntent(payments.MockName, intentID)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Payment not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching payment", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := mock.Confirm(intentID, payment.Price, approve); err != nil {
+		http.Error(w, "Error confirming payment: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	payment, err = findUserPayment(payment.UserID, payment.ID)
+	if err != nil {
+		http.Error(w, "Error fetching payment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payment)
+}
+
+// paymentStatusTimes - поле времени, которое отмечается при переходе в статус
+var paymentStatusTimes = map[string]string{
+	payments.StatusAuthorized: "authorized_at",
+	payments.StatusCaptured:   "captured_at",
+	payments.StatusRefunded:   "refunded_at",
+}
+
+// transitionPayment атомарно переводит платёж в статус status, если переход допустим.
+// Если платёж уже в этом статусе, возвращает его с changed = false.
+func transitionPayment(userID, paymentID primitive.ObjectID, status, reason string) (payment models.Payment, changed bool, err error) {
+	now := time.Now()
+	set := bson.M{
+		"payment_status": status,
+		"updated_at":     now,
+	}
+	if field, ok := paymentStatusTimes[status]; ok {
+		set[field] = now
+	}
+	if reason != "" {
+		set["failure_reason"] = reason
+	}
+
+	filter := bson.M{
+		"_id":            paymentID,
+		"user_id":        userID,
+		"payment_status": bson.M{"$in": payments.Sources(status)},
+	}
+	result, err := db.GetCollection(payments.Collection).UpdateOne(context.Background(), filter, bson.M{"$set": set})
+	if err != nil {
+		return models.Payment{}, false, err
+	}
+
+	payment, err = findUserPayment(userID, paymentID)
+	if err != nil {
+		return models.Payment{}, false, err
+	}
+	if result.ModifiedCount == 0 {
+		if payment.PaymentStatus == status {
+			return payment, false, nil
+		}
+		return payment, false, payments.ErrInvalidTransition
+	}
+	return payment, true, nil
+}
+
+// paymentChanged выполняет действия после смены статуса платежа: авторизованный платёж
+// списывается; после списания задача отмечается оплаченной (платёж без задачи пополняет
+// кошелёк), ждавшие оплаты задачи уходят в работу и отправляется webhook; о неудаче
+// приходит уведомление.
+func paymentChanged(userID primitive.ObjectID, payment models.Payment) {
+	if !payment.JobID.IsZero() {
+		timeline.Record(payment.JobID, timeline.PaymentUpdated, primitive.NilObjectID, timeline.Details{
+			"payment_id": payment.ID,
+			"status":     payment.PaymentStatus,
+		})
+	}
+
+	switch payment.PaymentStatus {
+	case payments.StatusAuthorized:
+		go capturePayment(payment)
+	case payments.StatusCaptured:
+		if !payment.JobID.IsZero() {
+			if err := markJobPaid(userID, payment); err != nil {
+				log.Printf("Error marking job %v as paid: %v", payment.JobID, err)
+			}
+			if _, err := ledger.CapturePayment(payment); err != nil && !errors.Is(err, ledger.ErrDuplicate) {
+				log.Printf("Error recording payment %v in ledger: %v", payment.ID, err)
+			}
+		} else if _, err := ledger.TopUp(userID, payment); err != nil && !errors.Is(err, ledger.ErrDuplicate) {
+			log.Printf("Error topping up wallet of user %v with payment %v: %v", userID, payment.ID, err)
+		}
+		if err := releaseAwaitingJobs(userID); err != nil {
+			log.Printf("Error releasing jobs of user %v awaiting payment: %v", userID, err)
+		}
+		err := webhooks.Dispatch(db.GetCollection("webhooks"), db.GetCollection("webhook_deliveries"), userID, webhooks.EventPaymentSucceeded, payment)
+		if err != nil {
+			log.Printf("Error dispatching %s for payment %v: %v", webhooks.EventPaymentSucceeded, payment.ID, err)
+		}
+	case payments.StatusFailed:
+		paymentFailed(userID, payment)
+	}
+}
+
+// markJobPaid отмечает задачу оплаченной списанным платежом.
+func markJobPaid(userID primitive.ObjectID, payment models.Payment) error {
+	_, err := db.GetCollection("jobs").UpdateOne(context.Background(),
+		bson.M{"_id": payment.JobID, "user_id": userID},
+		bson.M{"$set": bson.M{"payment_id": payment.ID, "paid_at": payment.CapturedAt, "updated_at": time.Now()}},
+	)
+	return err
+}
+
+// RunPaymentCaptures периодически повторяет списание платежей, которые остались авторизованными:
+// запрос к провайдеру мог не дойти или сервис мог упасть до его отправки.
+func RunPaymentCaptures(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := captureStalePayments(interval); err != nil {
+			log.Printf("Error capturing authorized payments: %v", err)
+		}
+	}
+}
+
+// captureStalePayments повторяет списание платежей, авторизованных раньше, чем age назад.
+func captureStalePayments(age time.Duration) error {
+	cursor, err := db.GetCollection(payments.Collection).Find(context.Background(), bson.M{
+		"payment_status": payments.StatusAuthorized,
+		"authorized_at":  bson.M{"$lte": time.Now().Add(-age)},
+	}, options.Find().SetLimit(100))
+	if err != nil {
+		return err
+	}
+	var stale []models.Payment
+	if err := cursor.All(context.Background(), &stale); err != nil {
+		return err
+	}
+	for _, payment := range stale {
+		capturePayment(payment)
+	}
+	return nil
+}
+
+// RunPaymentExpiry периодически отменяет платежи, которые не были оплачены за payments.PendingTTL,
+// чтобы брошенные платежи не занимали использования промокодов.
+func RunPaymentExpiry(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := expirePendingPayments(time.Now().Add(-payments.PendingTTL)); err != nil {
+			log.Printf("Error expiring pending payments: %v", err)
+		}
+	}
+}
+
+// expirePendingPayments отменяет платежи, созданные раньше before и так и не оплаченные.
+func expirePendingPayments(before time.Time) error {
+	cursor, err := db.GetCollection(payments.Collection).Find(context.Background(), bson.M{
+		"payment_status": payments.StatusPending,
+		"created_at":     bson.M{"$lt": before},
+	}, options.Find().SetLimit(100))
+	if err != nil {
+		return err
+	}
+	var stale []models.Payment
+	if err := cursor.All(context.Background(), &stale); err != nil {
+		return err
+	}
+	for _, payment := range stale {
+		canceled, changed, err := transitionPayment(payment.UserID, payment.ID, payments.StatusCanceled, "expired")
+		if err != nil {
+			// Платёж успели оплатить или отменить
+			if !errors.Is(err, payments.ErrInvalidTransition) {
+				log.Printf("Error expiring payment %v: %v", payment.ID, err)
+			}
+			continue
+		}
+		if changed {
+			paymentCanceled(canceled)
+		}
+	}
+	return nil
+}
+
+// capturePayment просит провайдера списать авторизованный платёж; результат придёт уведомлением.
+// Неудачное списание повторяет RunPaymentCaptures.
+func capturePayment(payment models.Payment) {
+	provider, ok := payments.Get(payment.Provider)
+	if !ok {
+		log.Printf("Cannot capture payment %v: unknown provider %q", payment.ID, payment.Provider)
+		return
+	}
+	if err := provider.Capture(payment.ProviderIntentID, payment.Price); err != nil {
+		log.Printf("Error capturing payment %v: %v", payment.ID, err)
+	}
+}
+
+// findUserPayment возвращает платёж пользователя.
+func findUserPayment(userID, paymentID primitive.ObjectID) (models.Payment, error) {
+	var payment models.Payment
+	err := db.GetCollection(payments.Collection).FindOne(context.Background(),
+		bson.M{"_id": paymentID, "user_id": userID},
+	).Decode(&payment)
+	return payment, err
+}
+
+// findPaymentByIntent находит платёж по намерению оплаты у провайдера.
+func findPaymentByIntent(provider, intentID string) (models.Payment, error) {
+	var payment models.Payment
+	err := db.GetCollection(payments.Collection).FindOne(context.Background(),
+		bson.M{"provider": provider, "provider_intent_id": intentID},
+	).Decode(&payment)
+	return payment, err
+}
+
+// pageParams разбирает параметры постраничного вывода page и page_size (по умолчанию 1 и 20).
+func pageParams(r *http.Request) (int64, int64, error) {
+	queryParams := r.URL.Query()
+	var pageNum, pageSize int64 = 1, 20
+	if page := queryParams.Get("page"); page != "" {
+		var err error
+		pageNum, err = strconv.ParseInt(page, 10, 64)
+		if err != nil || pageNum <= 0 {
+			return 0, 0, errors.New("Invalid page parameter")
+		}
+	}
+	if size := queryParams.Get("page_size"); size != "" {
+		var err error
+		pageSize, err = strconv.ParseInt(size, 10, 64)
+		if err != nil || pageSize <= 0 {
+			return 0, 0, errors.New("Invalid page_size parameter")
+		}
+	}
+	return pageNum, pageSize, nil
+}
@@ -0,0 +1,348 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/plans"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/http"
+	"time"
+)
+
+// GET /plans
+
+// Тарифные планы, от дешёвых к дорогим
+func GetPlans(w http.ResponseWriter, r *http.Request) {
+	cursor, err := db.GetCollection(plans.Collection).Find(context.Background(), bson.M{},
+		options.Find().SetSort(bson.D{{Key: "monthly_price.amount", Value: 1}, {Key: "name", Value: 1}}))
+	if err != nil {
+		http.Error(w, "Error fetching plans", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	result := []models.Plan{}
+	if err := cursor.All(context.Background(), &result); err != nil {
+		http.Error(w, "Error decoding plans", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+/*
+POST /admin/plans?user_id={adminID}
+{
+	"name": "pro",
+	"description": "For small teams",
+	"monthly_price": {"amount": 4900, "currency": "USD"},
+	"included_minutes": 1200,
+	"max_concurrency": 5,
+	"priority_tier": "express",
+	"retention": {"media_days": 30, "transcript_days": 730}
+}
+
+included_minutes - минуты записи в месяц (календарный, UTC), max_concurrency - задачи в работе
+одновременно; 0 - без ограничения. priority_tier - приоритет задач плана, если он не указан
+в задаче. retention - сроки хранения для пользователей плана без собственных.
+Цены задач плана задаются правилом цены с тем же plan (POST /admin/price-rules).
+monthly_price - справочная цена подписки для витрины: в счета она не попадает и не списывается.
+*/
+
+func CreatePlan(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var plan models.Plan
+	if err := render.DecodeJSON(r.Body, &plan); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if err := plans.Validate(plan); err != nil {
+		http.Error(w, "Invalid plan: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	plan.ID = primitive.NewObjectID()
+	plan.CreatedAt = time.Now()
+	plan.UpdatedAt = plan.CreatedAt
+
+	if _, err := db.GetCollection(plans.Collection).InsertOne(context.Background(), plan); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			http.Error(w, "Plan with this name already exists", http.StatusConflict)
+		} else {
+			http.Error(w, "Error saving plan", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(plan)
+}
+
+// PUT /admin/plans/{plan_id}?user_id={adminID}
+
+// Заменяет план целиком, тело запроса как у POST /admin/plans. Имя плана менять нельзя (400),
+// потому что по нему план привязан к пользователям и правилу цены.
+func UpdatePlan(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	planID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "plan_id"))
+	if err != nil {
+		http.Error(w, "Invalid plan ID", http.StatusBadRequest)
+		return
+	}
+
+	var plan models.Plan
+	if err := render.DecodeJSON(r.Body, &plan); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if err := plans.Validate(plan); err != nil {
+		http.Error(w, "Invalid plan: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	set := bson.M{
+		"description":      plan.Description,
+		"monthly_price":    plan.MonthlyPrice,
+		"included_minutes": plan.IncludedMinutes,
+		"max_concurrency":  plan.MaxConcurrency,
+		"priority_tier":    plan.PriorityTier,
+		"updated_at":       time.Now(),
+	}
+	update := bson.M{"$set": set}
+	if plan.Retention != nil {
+		set["retention"] = plan.Retention
+	} else {
+		update["$unset"] = bson.M{"retention": ""}
+	}
+
+	plansCollection := db.GetCollection(plans.Collection)
+	var stored models.Plan
+	if err := plansCollection.FindOne(context.Background(), bson.M{"_id": planID}).Decode(&stored); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Plan not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching plan", http.StatusInternalServerError)
+		}
+		return
+	}
+	if plan.Name != stored.Name {
+		http.Error(w, "Plan name cannot be changed", http.StatusBadRequest)
+		return
+	}
+
+	var updated models.Plan
+	err = plansCollection.FindOneAndUpdate(context.Background(),
+		bson.M{"_id": planID},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Plan not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error updating plan", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// DELETE /admin/plans/{plan_id}?user_id={adminID}
+
+// Удаляет план, на котором нет пользователей (иначе 409).
+func DeletePlan(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	planID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "plan_id"))
+	if err != nil {
+		http.Error(w, "Invalid plan ID", http.StatusBadRequest)
+		return
+	}
+
+	plansCollection := db.GetCollection(plans.Collection)
+	var plan models.Plan
+	if err := plansCollection.FindOne(context.Background(), bson.M{"_id": planID}).Decode(&plan); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Plan not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching plan", http.StatusInternalServerError)
+		}
+		return
+	}
+	subscribers, err := db.GetCollection("users").CountDocuments(context.Background(), bson.M{"plan": plan.Name})
+	if err != nil {
+		http.Error(w, "Error counting plan users", http.StatusInternalServerError)
+		return
+	}
+	if subscribers > 0 {
+		http.Error(w, "Plan has users, move them to another plan first", http.StatusConflict)
+		return
+	}
+
+	if _, err := plansCollection.DeleteOne(context.Background(), bson.M{"_id": planID}); err != nil {
+		http.Error(w, "Error deleting plan", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+PUT /users/{id}/plan?user_id={adminID}
+{
+	"plan": "pro"
+}
+
+Подключает пользователю тарифный план из GET /plans; "plan": "" отключает план.
+Меняет только администратор. Ответ - использование по новому плану, как у GET /users/{id}/usage.
+*/
+
+func UpdateUserPlan(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Plan string `json:"plan"`
+	}
+	if err := render.DecodeJSON(r.Body, &request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	plan, err := plans.Find(request.Plan)
+	if err != nil {
+		http.Error(w, "Error fetching plan", http.StatusInternalServerError)
+		return
+	}
+	if request.Plan != "" && plan == nil {
+		http.Error(w, "Plan "+request.Plan+" not found", http.StatusBadRequest)
+		return
+	}
+
+	update := bson.M{"$set": bson.M{"plan": request.Plan, "updated_at": time.Now()}}
+	if request.Plan == "" {
+		update = bson.M{"$unset": bson.M{"plan": ""}, "$set": bson.M{"updated_at": time.Now()}}
+	}
+	var user models.User
+	err = db.GetCollection("users").FindOneAndUpdate(context.Background(), bson.M{"_id": userID}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&user)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error updating plan", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	usage, err := plans.UsageFor(user, plan, time.Now())
+	if err != nil {
+		http.Error(w, "Error calculating usage", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+/*
+GET /users/{id}/usage
+
+Использование тарифного плана в текущем расчётном периоде (календарный месяц, UTC):
+{
+	"plan": "pro",
+	"period_start": "2024-12-01T00:00:00Z",
+	"period_end": "2025-01-01T00:00:00Z",
+	"monthly_price": {"amount": 4900, "currency": "USD"},
+	"included_minutes": 1200,
+	"used_minutes": 830,
+	"reserved_minutes": 95,
+	"remaining_minutes": 275,
+	"active_jobs": 2,
+	"max_concurrency": 5
+}
+
+used_minutes - начатые минуты выполненных в периоде задач, reserved_minutes - заявленные минуты
+задач, которые ещё не выполнены. Без ограничения квоты remaining_minutes отсутствует.
+*/
+
+func GetUserUsage(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var user models.User
+	err = db.GetCollection("users").FindOne(context.Background(), bson.M{"_id": userID}).Decode(&user)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching user", http.StatusInternalServerError)
+		}
+		return
+	}
+	plan, err := plans.Find(user.Plan)
+	if err != nil {
+		http.Error(w, "Error fetching plan", http.StatusInternalServerError)
+		return
+	}
+
+	usage, err := plans.UsageFor(user, plan, time.Now())
+	if err != nil {
+		http.Error(w, "Error calculating usage", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+// userQuota возвращает квоту тарифного плана пользователя для создания новых задач.
+func userQuota(userID primitive.ObjectID) (*plans.Quota, error) {
+	var user models.User
+	err := db.GetCollection("users").FindOne(context.Background(), bson.M{"_id": userID},
+		options.FindOne().SetProjection(bson.M{"plan": 1}),
+	).Decode(&user)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+	return plans.NewQuota(user, time.Now())
+}
+
+// quotaStatus возвращает HTTP-статус отказа в создании задачи по тарифному плану.
+func quotaStatus(err error) int {
+	switch {
+	case errors.Is(err, plans.ErrQuotaExceeded):
+		return http.StatusForbidden
+	case errors.Is(err, plans.ErrConcurrencyLimit):
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/discounts"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/pricing"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/http"
+	"time"
+)
+
+/*
+POST /jobs/quote
+X-User-ID: 650e812f5f1e4e0001a0be01
+
+{
+	"duration_seconds": 1830,
+	"target_languages": ["es", "de"],
+	"diarization": true,
+	"priority": "express",
+	"promo_code": "SPRING10"
+}
+
+Предварительный расчёт цены задачи по тарифному плану пользователя. Задача не создаётся.
+Необязательный promo_code добавляет позицию discount; использование промокода при расчёте
+не учитывается - оно занимается при создании платежа.
+Ответ:
+{
+	"plan": "pro",
+	"priority": "express",
+	"minutes": 31,
+	"lines": [
+		{"item": "transcription", "quantity": 31, "amount": {"amount": 310, "currency": "USD"}},
+		{"item": "translation", "quantity": 62, "amount": {"amount": 310, "currency": "USD"}},
+		{"item": "diarization", "quantity": 31, "amount": {"amount": 62, "currency": "USD"}},
+		{"item": "priority", "amount": {"amount": 341, "currency": "USD"}},
+		{"item": "discount", "amount": {"amount": -102, "currency": "USD"}}
+	],
+	"total": {"amount": 921, "currency": "USD"},
+	"promo_code": "SPRING10"
+}
+*/
+
+func QuoteJob(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		models.Job
+		PromoCode string `json:"promo_code"`
+	}
+	if err := render.DecodeJSON(r.Body, &request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	job := request.Job
+	if job.DurationSeconds <= 0 {
+		http.Error(w, "Duration must be positive", http.StatusBadRequest)
+		return
+	}
+	if !pricing.IsKnownPriority(job.Priority) {
+		http.Error(w, "Unknown priority: "+job.Priority, http.StatusBadRequest)
+		return
+	}
+
+	quote, err := pricing.QuoteJob(user, job)
+	if err != nil {
+		http.Error(w, "Error calculating quote: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if request.PromoCode != "" {
+		discount, err := discounts.Find(request.PromoCode)
+		if err == nil {
+			err = discounts.Check(discount, user, time.Now())
+		}
+		if err == nil {
+			err = discounts.ApplyToQuote(&quote, discount)
+		}
+		if err != nil {
+			writeDiscountError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quote)
+}
+
+// GET /admin/price-rules
+
+// Правила цены всех тарифных планов. Если правил нет, действует встроенное правило по умолчанию.
+func GetPriceRules(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	cursor, err := db.GetCollection("price_rules").Find(context.Background(), bson.M{},
+		options.Find().SetSort(bson.D{{Key: "plan", Value: 1}}))
+	if err != nil {
+		http.Error(w, "Error fetching price rules", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	rules := []models.PriceRule{}
+	if err := cursor.All(context.Background(), &rules); err != nil {
+		http.Error(w, "Error decoding price rules", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+/*
+POST /admin/price-rules
+{
+	"plan": "pro",
+	"per_minute": {"amount": 8, "currency": "USD"},
+	"translation_per_minute": {"amount": 4, "currency": "USD"},
+	"diarization_per_minute": {"amount": 2, "currency": "USD"},
+	"minimum": {"amount": 50, "currency": "USD"},
+	"priority_markups": {"express": 50, "urgent": 100}
+}
+
+Цены указываются за начатую минуту записи в минимальных единицах валюты. Для каждого плана
+может быть одно правило; правило с пустым plan действует для остальных планов.
+*/
+
+func CreatePriceRule(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var rule models.PriceRule
+	if err := render.DecodeJSON(r.Body, &rule); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if err := pricing.ValidateRule(rule); err != nil {
+		http.Error(w, "Invalid price rule: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rule.ID = primitive.NewObjectID()
+	rule.CreatedAt = time.Now()
+	rule.UpdatedAt = rule.CreatedAt
+
+	_, err := db.GetCollection("price_rules").InsertOne(context.Background(), rule)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			http.Error(w, "Price rule for this plan already exists", http.StatusConflict)
+		} else {
+			http.Error(w, "Error saving price rule", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+// PUT /admin/price-rules/{rule_id}
+
+// Заменяет правило целиком, тело запроса как у POST /admin/price-rules.
+// Цены уже созданных задач не пересчитываются.
+func UpdatePriceRule(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	ruleID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "rule_id"))
+	if err != nil {
+		http.Error(w, "Invalid price rule ID", http.StatusBadRequest)
+		return
+	}
+
+	var rule models.PriceRule
+	if err := render.DecodeJSON(r.Body, &rule); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if err := pricing.ValidateRule(rule); err != nil {
+		http.Error(w, "Invalid price rule: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var updated models.PriceRule
+	err = db.GetCollection("price_rules").FindOneAndUpdate(context.Background(),
+		bson.M{"_id": ruleID},
+		bson.M{"$set": bson.M{
+			"plan":                   rule.Plan,
+			"per_minute":             rule.PerMinute,
+			"translation_per_minute": rule.TranslationPerMinute,
+			"diarization_per_minute": rule.DiarizationPerMinute,
+			"minimum":                rule.Minimum,
+			"priority_markups":       rule.PriorityMarkups,
+			"updated_at":             time.Now(),
+		}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			http.Error(w, "Price rule not found", http.StatusNotFound)
+		case mongo.IsDuplicateKeyError(err):
+			http.Error(w, "Price rule for this plan already exists", http.StatusConflict)
+		default:
+			http.Error(w, "Error updating price rule", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// DELETE /admin/price-rules/{rule_id}
+func DeletePriceRule(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	ruleID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "rule_id"))
+	if err != nil {
+		http.Error(w, "Invalid price rule ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.GetCollection("price_rules").DeleteOne(context.Background(), bson.M{"_id": ruleID})
+	if err != nil {
+		http.Error(w, "Error deleting price rule", http.StatusInternalServerError)
+		return
+	}
+	if result.DeletedCount == 0 {
+		http.Error(w, "Price rule not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
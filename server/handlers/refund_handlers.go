@@ -0,0 +1,600 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/ledger"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/money"
+	"github.com/moevm/nosql2h24-transcribtion/payments"
+	"github.com/moevm/nosql2h24-transcribtion/timeline"
+	"github.com/moevm/nosql2h24-transcribtion/webhooks"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+var (
+	errNotRefundable  = errors.New("payment cannot be refunded")
+	errRefundTooLarge = errors.New("refund exceeds the refundable amount")
+	errNoProvider     = errors.New("payment has no provider to refund through")
+)
+
+/*
+POST /payments/{id}/refunds?user_id={adminID}
+{
+	"amount": {"amount": 2500, "currency": "USD"},
+	"reason": "Poor audio quality"
+}
+
+Возврат списанного платежа администратором. Без amount возвращается весь остаток платежа;
+несколько частичных возвратов в сумме не могут превысить цену платежа. Возврат пополнения
+кошелька сразу списывается с баланса (409, если его не хватает). Запрос уходит провайдеру,
+результат приходит уведомлением: платёж становится partially_refunded или refunded.
+*/
+
+func CreateRefund(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	paymentID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid payment ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Amount *money.Money `json:"amount"`
+		Reason string       `json:"reason"`
+	}
+	if err := render.DecodeJSON(r.Body, &request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if request.Reason == "" {
+		http.Error(w, "Reason is required", http.StatusBadRequest)
+		return
+	}
+
+	var payment models.Payment
+	err = db.GetCollection(payments.Collection).FindOne(context.Background(), bson.M{"_id": paymentID}).Decode(&payment)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Payment not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching payment", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	amount := refundable(payment)
+	if request.Amount != nil {
+		amount = *request.Amount
+	}
+	refund, err := startRefund(payment, amount, request.Reason, payments.RefundSourceManual)
+	if err != nil {
+		writeRefundError(w, err)
+		return
+	}
+	refund, err = executeRefund(payment, refund)
+	if err != nil {
+		http.Error(w, "Error refunding payment: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(refund)
+}
+
+// GET /payments/{id}/refunds?user_id={adminID}
+
+// Возвраты платежа, включая предложенные и отклонённые, в порядке создания
+func GetPaymentRefunds(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	paymentID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid payment ID", http.StatusBadRequest)
+		return
+	}
+
+	findRefunds(w, bson.M{"payment_id": paymentID}, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+}
+
+// GET /refunds?user_id={adminID}&status=proposed&page=1&page_size=20
+
+// Возвраты всех платежей, новые сверху. Предложенные возвраты (status=proposed) ждут решения администратора.
+func GetRefunds(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	filter := bson.M{}
+	if status := r.URL.Query().Get("status"); status != "" {
+		filter["status"] = status
+	}
+	pageNum, pageSize, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	findRefunds(w, filter, options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetSkip((pageNum-1)*pageSize).
+		SetLimit(pageSize))
+}
+
+/*
+POST /refunds/{refund_id}/approve?user_id={adminID}
+{
+	"amount": {"amount": 1000, "currency": "USD"}
+}
+
+Выполняет предложенный возврат. Сумму можно уменьшить (тело необязательно).
+Предложение получает статус approved и ссылку approved_refund_id на созданный возврат.
+*/
+
+func ApproveRefund(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	refundID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "refund_id"))
+	if err != nil {
+		http.Error(w, "Invalid refund ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Amount *money.Money `json:"amount"`
+	}
+	if err := render.DecodeJSON(r.Body, &request); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	// Предложение одобряется до выполнения, чтобы его нельзя было одобрить дважды
+	refundsCollection := db.GetCollection(payments.RefundsCollection)
+	var proposal models.Refund
+	err = refundsCollection.FindOneAndUpdate(context.Background(),
+		bson.M{"_id": refundID, "status": payments.RefundProposed},
+		bson.M{"$set": bson.M{"status": payments.RefundApproved, "updated_at": time.Now()}},
+	).Decode(&proposal)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Proposed refund not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching refund", http.StatusInternalServerError)
+		}
+		return
+	}
+	restore := func() {
+		_, err := refundsCollection.UpdateOne(context.Background(), bson.M{"_id": proposal.ID},
+			bson.M{"$set": bson.M{"status": payments.RefundProposed, "updated_at": time.Now()}})
+		if err != nil {
+			log.Printf("Error restoring refund proposal %v: %v", proposal.ID, err)
+		}
+	}
+
+	payment, err := findUserPayment(proposal.UserID, proposal.PaymentID)
+	if err != nil {
+		restore()
+		http.Error(w, "Error fetching payment", http.StatusInternalServerError)
+		return
+	}
+	amount := proposal.Amount
+	if request.Amount != nil {
+		if request.Amount.Currency != amount.Currency || request.Amount.Amount > amount.Amount {
+			restore()
+			http.Error(w, "Amount must not exceed the proposed "+amount.String(), http.StatusBadRequest)
+			return
+		}
+		amount = *request.Amount
+	}
+
+	refund, err := startRefund(payment, amount, proposal.Reason, proposal.Source)
+	if err != nil {
+		restore()
+		writeRefundError(w, err)
+		return
+	}
+	// Одобренное предложение остаётся в истории со ссылкой на выполняемый возврат
+	_, err = refundsCollection.UpdateOne(context.Background(), bson.M{"_id": proposal.ID},
+		bson.M{"$set": bson.M{"approved_refund_id": refund.ID, "completed_at": time.Now(), "updated_at": time.Now()}})
+	if err != nil {
+		log.Printf("Error linking refund proposal %v to refund %v: %v", proposal.ID, refund.ID, err)
+	}
+	refund, err = executeRefund(payment, refund)
+	if err != nil {
+		http.Error(w, "Error refunding payment: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(refund)
+}
+
+/*
+POST /refunds/{refund_id}/reject?user_id={adminID}
+{
+	"reason": "Job was rerun successfully"
+}
+
+Отклоняет предложенный возврат.
+*/
+
+func RejectRefund(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	refundID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "refund_id"))
+	if err != nil {
+		http.Error(w, "Invalid refund ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Reason string `json:"reason"`
+	}
+	if err := render.DecodeJSON(r.Body, &request); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	set := bson.M{"status": payments.RefundRejected, "updated_at": time.Now(), "completed_at": time.Now()}
+	if request.Reason != "" {
+		set["failure_reason"] = request.Reason
+	}
+	var refund models.Refund
+	err = db.GetCollection(payments.RefundsCollection).FindOneAndUpdate(context.Background(),
+		bson.M{"_id": refundID, "status": payments.RefundProposed},
+		bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&refund)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Proposed refund not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error rejecting refund", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(refund)
+}
+
+func findRefunds(w http.ResponseWriter, filter bson.M, opts *options.FindOptions) {
+	cursor, err := db.GetCollection(payments.RefundsCollection).Find(context.Background(), filter, opts)
+	if err != nil {
+		http.Error(w, "Error fetching refunds", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	result := []models.Refund{}
+	if err := cursor.All(context.Background(), &result); err != nil {
+		http.Error(w, "Error decoding refunds", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func writeRefundError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNotRefundable), errors.Is(err, errRefundTooLarge), errors.Is(err, errNoProvider),
+		errors.Is(err, ledger.ErrInsufficientFunds), errors.Is(err, ledger.ErrNoWallet), errors.Is(err, ledger.ErrCurrencyMismatch):
+		http.Error(w, "Cannot refund payment: "+err.Error(), http.StatusConflict)
+	case errors.Is(err, money.ErrCurrencyMismatch), errors.Is(err, money.ErrInvalidAmount):
+		http.Error(w, "Invalid refund amount: "+err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "Error refunding payment", http.StatusInternalServerError)
+	}
+}
+
+// refundable возвращает сумму платежа, которую ещё можно вернуть.
+func refundable(payment models.Payment) money.Money {
+	amount := payment.Price
+	for _, taken := range []*money.Money{payment.Refunded, payment.RefundPending} {
+		if taken != nil {
+			amount.Amount -= taken.Amount
+		}
+	}
+	return amount
+}
+
+// startRefund резервирует сумму возврата на платеже и сохраняет возврат в статусе pending.
+// Возврат пополнения сразу списывается с кошелька, чтобы деньги нельзя было потратить повторно.
+func startRefund(payment models.Payment, amount money.Money, reason, source string) (models.Refund, error) {
+	if payment.PaymentStatus != payments.StatusCaptured && payment.PaymentStatus != payments.StatusPartiallyRefunded {
+		return models.Refund{}, errNotRefundable
+	}
+	if _, ok := payments.Get(payment.Provider); !ok {
+		return models.Refund{}, errNoProvider
+	}
+	if err := amount.Validate(); err != nil {
+		return models.Refund{}, err
+	}
+	if amount.Currency != payment.Price.Currency {
+		return models.Refund{}, money.ErrCurrencyMismatch
+	}
+	if !amount.IsPositive() {
+		return models.Refund{}, money.ErrInvalidAmount
+	}
+
+	paymentsCollection := db.GetCollection(payments.Collection)
+	now := time.Now()
+	result, err := paymentsCollection.UpdateOne(context.Background(), bson.M{
+		"_id":            payment.ID,
+		"payment_status": bson.M{"$in": payments.Sources(payments.StatusRefunded)},
+		"$expr": bson.M{"$lte": bson.A{
+			bson.M{"$add": bson.A{
+				bson.M{"$ifNull": bson.A{"$refunded.amount", 0}},
+				bson.M{"$ifNull": bson.A{"$refund_pending.amount", 0}},
+				amount.Amount,
+			}},
+			"$price.amount",
+		}},
+	}, bson.M{
+		"$inc": bson.M{"refund_pending.amount": amount.Amount},
+		"$set": bson.M{"refund_pending.currency": amount.Currency, "updated_at": now},
+	})
+	if err != nil {
+		return models.Refund{}, err
+	}
+	if result.MatchedCount == 0 {
+		return models.Refund{}, errRefundTooLarge
+	}
+
+	refund := models.Refund{
+		ID:        primitive.NewObjectID(),
+		PaymentID: payment.ID,
+		UserID:    payment.UserID,
+		JobID:     payment.JobID,
+		Amount:    amount,
+		Reason:    reason,
+		Status:    payments.RefundPending,
+		Source:    source,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if payment.JobID.IsZero() {
+		refund.LedgerTransactionID, err = ledger.RefundPayment(payment, refund.ID, amount, reason)
+		if err != nil {
+			releaseRefund(payment.ID, amount)
+			return models.Refund{}, err
+		}
+	}
+
+	if _, err := db.GetCollection(payments.RefundsCollection).InsertOne(context.Background(), refund); err != nil {
+		releaseRefund(payment.ID, amount)
+		if payment.JobID.IsZero() {
+			if _, err := ledger.ReverseRefund(payment, refund.ID, amount); err != nil {
+				log.Printf("Error reversing refund %v in ledger: %v", refund.ID, err)
+			}
+		}
+		return models.Refund{}, err
+	}
+	return refund, nil
+}
+
+// executeRefund отправляет возврат провайдеру и возвращает его актуальное состояние:
+// тестовый провайдер присылает уведомление ещё до ответа.
+func executeRefund(payment models.Payment, refund models.Refund) (models.Refund, error) {
+	provider, _ := payments.Get(payment.Provider)
+	if err := provider.Refund(payment.ProviderIntentID, refund.ID.Hex(), refund.Amount); err != nil {
+		failRefund(refund.ID, err.Error())
+		return models.Refund{}, err
+	}
+
+	err := db.GetCollection(payments.RefundsCollection).FindOne(context.Background(), bson.M{"_id": refund.ID}).Decode(&refund)
+	return refund, err
+}
+
+// releaseRefund снимает резерв невыполненного возврата с платежа.
+func releaseRefund(paymentID primitive.ObjectID, amount money.Money) {
+	_, err := db.GetCollection(payments.Collection).UpdateOne(context.Background(),
+		bson.M{"_id": paymentID},
+		bson.M{"$inc": bson.M{"refund_pending.amount": -amount.Amount}, "$set": bson.M{"updated_at": time.Now()}},
+	)
+	if err != nil {
+		log.Printf("Error releasing refund reserve of payment %v: %v", paymentID, err)
+	}
+}
+
+// refundEvent обрабатывает уведомление провайдера о возврате. Возврат, начатый у самого
+// провайдера (без RefundID), записывается как новый возврат.
+func refundEvent(payment models.Payment, event payments.Event) error {
+	if event.RefundID == "" {
+		if event.Status != payments.StatusRefunded {
+			return nil
+		}
+		refund, err := startRefund(payment, event.Amount, "refunded at provider", payments.RefundSourceProvider)
+		if err != nil {
+			return err
+		}
+		return completeRefund(refund.ID)
+	}
+
+	refundID, err := primitive.ObjectIDFromHex(event.RefundID)
+	if err != nil {
+		return mongo.ErrNoDocuments
+	}
+	var refund models.Refund
+	err = db.GetCollection(payments.RefundsCollection).FindOne(context.Background(),
+		bson.M{"_id": refundID, "payment_id": payment.ID},
+	).Decode(&refund)
+	if err != nil {
+		return err
+	}
+	if event.Status == payments.StatusRefunded {
+		if event.Amount != refund.Amount {
+			return errRefundTooLarge
+		}
+		return completeRefund(refund.ID)
+	}
+	failRefund(refund.ID, event.Reason)
+	return nil
+}
+
+// completeRefund отмечает возврат выполненным: сумма переходит из резерва в возвращённую,
+// платёж становится partially_refunded или refunded, возврат платежа за задачу уменьшает выручку.
+func completeRefund(refundID primitive.ObjectID) error {
+	now := time.Now()
+	var refund models.Refund
+	err := db.GetCollection(payments.RefundsCollection).FindOneAndUpdate(context.Background(),
+		bson.M{"_id": refundID, "status": payments.RefundPending},
+		bson.M{"$set": bson.M{"status": payments.RefundSucceeded, "completed_at": now, "updated_at": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&refund)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// Повторное уведомление
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	paymentsCollection := db.GetCollection(payments.Collection)
+	var payment models.Payment
+	err = paymentsCollection.FindOneAndUpdate(context.Background(),
+		bson.M{"_id": refund.PaymentID},
+		bson.M{
+			"$inc": bson.M{"refund_pending.amount": -refund.Amount.Amount, "refunded.amount": refund.Amount.Amount},
+			"$set": bson.M{"refunded.currency": refund.Amount.Currency, "refunded_at": now, "updated_at": now},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&payment)
+	if err != nil {
+		return err
+	}
+	status := payments.StatusPartiallyRefunded
+	if payment.Refunded.Amount >= payment.Price.Amount {
+		status = payments.StatusRefunded
+	}
+	_, err = paymentsCollection.UpdateOne(context.Background(),
+		bson.M{"_id": payment.ID, "payment_status": bson.M{"$in": payments.Sources(status)}},
+		bson.M{"$set": bson.M{"payment_status": status}},
+	)
+	if err != nil {
+		return err
+	}
+	payment.PaymentStatus = status
+
+	if !payment.JobID.IsZero() {
+		transactionID, err := ledger.RefundPayment(payment, refund.ID, refund.Amount, refund.Reason)
+		if err != nil && !errors.Is(err, ledger.ErrDuplicate) {
+			log.Printf("Error recording refund %v in ledger: %v", refund.ID, err)
+		} else if err == nil {
+			refund.LedgerTransactionID = transactionID
+			_, err = db.GetCollection(payments.RefundsCollection).UpdateOne(context.Background(),
+				bson.M{"_id": refund.ID}, bson.M{"$set": bson.M{"ledger_transaction_id": transactionID}})
+			if err != nil {
+				log.Printf("Error updating refund %v: %v", refund.ID, err)
+			}
+		}
+		timeline.Record(payment.JobID, timeline.PaymentUpdated, primitive.NilObjectID, timeline.Details{
+			"payment_id": payment.ID,
+			"status":     payment.PaymentStatus,
+			"refund_id":  refund.ID,
+			"amount":     refund.Amount,
+		})
+	}
+
+	err = webhooks.Dispatch(db.GetCollection("webhooks"), db.GetCollection("webhook_deliveries"), payment.UserID, webhooks.EventPaymentRefunded, refund)
+	if err != nil {
+		log.Printf("Error dispatching %s for refund %v: %v", webhooks.EventPaymentRefunded, refund.ID, err)
+	}
+	return nil
+}
+
+// failRefund отмечает возврат невыполненным и снимает резерв; списанное с кошелька возвращается.
+func failRefund(refundID primitive.ObjectID, reason string) {
+	now := time.Now()
+	var refund models.Refund
+	err := db.GetCollection(payments.RefundsCollection).FindOneAndUpdate(context.Background(),
+		bson.M{"_id": refundID, "status": payments.RefundPending},
+		bson.M{"$set": bson.M{"status": payments.RefundFailed, "failure_reason": reason, "completed_at": now, "updated_at": now}},
+	).Decode(&refund)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Printf("Error failing refund %v: %v", refundID, err)
+		}
+		return
+	}
+
+	releaseRefund(refund.PaymentID, refund.Amount)
+	if !refund.LedgerTransactionID.IsZero() {
+		payment := models.Payment{ID: refund.PaymentID, UserID: refund.UserID}
+		if _, err := ledger.ReverseRefund(payment, refund.ID, refund.Amount); err != nil {
+			log.Printf("Error reversing refund %v in ledger: %v", refund.ID, err)
+		}
+	}
+}
+
+// proposeRefund предлагает вернуть остаток платежа за задачу, которая не была выполнена
+// (завершилась ошибкой или удалена). Возврат выполняется после одобрения администратором.
+func proposeRefund(job models.Job, source string) {
+	if job.PaymentID.IsZero() {
+		return
+	}
+	payment, err := findUserPayment(job.UserID, job.PaymentID)
+	if err != nil {
+		log.Printf("Error fetching payment %v of job %v: %v", job.PaymentID, job.ID, err)
+		return
+	}
+	if payment.PaymentStatus != payments.StatusCaptured && payment.PaymentStatus != payments.StatusPartiallyRefunded {
+		return
+	}
+	amount := refundable(payment)
+	if !amount.IsPositive() {
+		return
+	}
+
+	reason := "job failed"
+	if source == payments.RefundSourceJobCanceled {
+		reason = "job canceled"
+	}
+	now := time.Now()
+	refund := models.Refund{
+		ID:        primitive.NewObjectID(),
+		PaymentID: payment.ID,
+		UserID:    payment.UserID,
+		JobID:     job.ID,
+		Amount:    amount,
+		Reason:    reason,
+		Status:    payments.RefundProposed,
+		Source:    source,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	// Одно открытое предложение на платёж
+	result, err := db.GetCollection(payments.RefundsCollection).UpdateOne(context.Background(),
+		bson.M{"payment_id": payment.ID, "status": payments.RefundProposed},
+		bson.M{"$setOnInsert": refund},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		log.Printf("Error proposing refund of payment %v: %v", payment.ID, err)
+		return
+	}
+	if result.UpsertedCount > 0 {
+		timeline.Record(job.ID, timeline.RefundProposed, primitive.NilObjectID, timeline.Details{
+			"refund_id":  refund.ID,
+			"payment_id": payment.ID,
+			"amount":     amount,
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/retention"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// GET /users/{id}/retention
+
+// Действующие сроки хранения данных пользователя
+func GetUserRetention(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var user models.User
+	err = db.GetCollection("users").FindOne(context.Background(), bson.M{"_id": userID}).Decode(&user)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching user", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(retention.For(user))
+}
+
+/*
+PUT /users/{id}/retention
+{
+	"media_days": 7,
+	"transcript_days": 365
+}
+
+Через media_days дней после завершения задачи удаляется её входной файл, через transcript_days -
+расшифровки. 0 - хранить бессрочно. Тело null возвращает сроки тарифного плана пользователя,
+а если в плане они не заданы - сроки по умолчанию.
+*/
+
+func UpdateUserRetention(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var policy *models.RetentionPolicy
+	if err := render.DecodeJSON(r.Body, &policy); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if policy != nil && (policy.MediaDays < 0 || policy.TranscriptDays < 0) {
+		http.Error(w, "Retention days must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	update := bson.M{"$set": bson.M{"retention": policy, "updated_at": time.Now()}}
+	if policy == nil {
+		update = bson.M{"$unset": bson.M{"retention": ""}, "$set": bson.M{"updated_at": time.Now()}}
+	}
+	var user models.User
+	err = db.GetCollection("users").FindOneAndUpdate(context.Background(), bson.M{"_id": userID}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&user)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error updating retention", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(retention.For(user))
+}
+
+// GET /admin/purges/upcoming?user_id={adminID}&days=7
+
+// Удаления данных в ближайшие days дней (по умолчанию 7) по всем пользователям, в порядке наступления.
+// Просроченные, но ещё не выполненные удаления тоже попадают в отчёт.
+/*
+[
+	{
+		"job_id": "650e7c3f5f1e4e0001a0bdf3",
+		"user_id": "650e7c3f5f1e4e0001a0bd11",
+		"title": "Interview",
+		"kind": "media",
+		"purge_at": "2024-11-27T06:00:30Z"
+	}
+]
+*/
+func GetUpcomingPurges(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	days := 7
+	if value := r.URL.Query().Get("days"); value != "" {
+		var err error
+		days, err = strconv.Atoi(value)
+		if err != nil || days < 0 {
+			http.Error(w, "Invalid days parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	purges, err := retention.Upcoming(time.Now(), time.Duration(days)*24*time.Hour)
+	if err != nil {
+		http.Error(w, "Error fetching upcoming purges", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(purges)
+}
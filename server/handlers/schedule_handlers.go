@@ -0,0 +1,369 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/moevm/nosql2h24-transcribtion/cron"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/plans"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"net/http"
+	"time"
+)
+
+// GET /users/{id}/schedules
+func GetUserSchedules(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	cursor, err := db.GetCollection("schedules").Find(context.Background(), bson.M{"user_id": userID})
+	if err != nil {
+		http.Error(w, "Error fetching schedules", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	schedules := []models.JobSchedule{}
+	if err := cursor.All(context.Background(), &schedules); err != nil {
+		http.Error(w, "Error decoding schedules", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedules)
+}
+
+// GET /users/{id}/schedules/{schedule_id}
+func GetUserSchedule(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	scheduleID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "schedule_id"))
+	if err != nil {
+		http.Error(w, "Invalid schedule ID", http.StatusBadRequest)
+		return
+	}
+
+	var schedule models.JobSchedule
+	err = db.GetCollection("schedules").FindOne(context.Background(), bson.M{"_id": scheduleID, "user_id": userID}).Decode(&schedule)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Schedule not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching schedule", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedule)
+}
+
+/*
+POST /users/{id}/schedules
+{
+	"name": "Weekly podcast",
+	"cron": "0 9 * * 1",
+	"timezone": "Europe/Moscow",
+	"job": {
+		"title": "Podcast episode",
+		"status": "pending",
+		"source_language": "ru",
+		"file_format": "mp3",
+		"description": "Weekly podcast recording",
+		"input_file": "/recordings/podcast/latest.mp3",
+		"output_file": "podcast.txt",
+		"target_languages": ["en"]
+	}
+}
+
+cron - выражение из пяти полей (минута, час, день месяца, месяц, день недели) или @daily, @weekly и т.п.,
+timezone - часовой пояс IANA (по умолчанию UTC). По расписанию из шаблона job создаётся новая задача,
+как через POST /users/{id}/jobs; у созданных задач заполнено schedule_id. Если сервис был остановлен,
+пропущенные запуски не повторяются: создаётся одна задача, и расписание продолжается с текущего момента.
+*/
+
+func CreateUserSchedule(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	schedule := models.JobSchedule{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	schedule.ID = primitive.NewObjectID()
+	schedule.UserID = userID
+	schedule.CreatedAt = now
+	schedule.UpdatedAt = now
+	if status, err := prepareSchedule(&schedule, now); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	_, err = db.GetCollection("schedules").InsertOne(context.Background(), schedule)
+	if err != nil {
+		http.Error(w, "Error saving schedule", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(schedule)
+}
+
+// PUT /users/{id}/schedules/{schedule_id}
+
+// Заменяет расписание целиком (формат как в POST). "active": false приостанавливает расписание,
+// "active": true возобновляет; без active расписание остаётся в прежнем состоянии.
+func UpdateUserSchedule(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	scheduleID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "schedule_id"))
+	if err != nil {
+		http.Error(w, "Invalid schedule ID", http.StatusBadRequest)
+		return
+	}
+
+	schedulesCollection := db.GetCollection("schedules")
+	var stored models.JobSchedule
+	err = schedulesCollection.FindOne(context.Background(), bson.M{"_id": scheduleID, "user_id": userID}).Decode(&stored)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Schedule not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching schedule", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	schedule := models.JobSchedule{Active: stored.Active}
+	if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	schedule.UserID = userID
+	if status, err := prepareSchedule(&schedule, now); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	set := bson.M{
+		"name":       schedule.Name,
+		"cron":       schedule.Cron,
+		"timezone":   schedule.Timezone,
+		"job":        schedule.Job,
+		"active":     schedule.Active,
+		"updated_at": now,
+	}
+	update := bson.M{"$set": set}
+	if schedule.NextRunAt.IsZero() {
+		update["$unset"] = bson.M{"next_run_at": ""}
+	} else {
+		set["next_run_at"] = schedule.NextRunAt
+	}
+
+	var updated models.JobSchedule
+	err = schedulesCollection.FindOneAndUpdate(context.Background(),
+		bson.M{"_id": scheduleID, "user_id": userID},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Schedule not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error updating schedule", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// DELETE /users/{id}/schedules/{schedule_id}
+
+// Уже созданные по расписанию задачи не удаляются.
+func DeleteUserSchedule(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	scheduleID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "schedule_id"))
+	if err != nil {
+		http.Error(w, "Invalid schedule ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.GetCollection("schedules").DeleteOne(context.Background(), bson.M{"_id": scheduleID, "user_id": userID})
+	if err != nil {
+		http.Error(w, "Error deleting schedule", http.StatusInternalServerError)
+		return
+	}
+	if result.DeletedCount == 0 {
+		http.Error(w, "Schedule not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// prepareSchedule проверяет расписание и шаблон задачи и вычисляет время следующего запуска.
+// Возвращает HTTP-код ошибки.
+func prepareSchedule(schedule *models.JobSchedule, now time.Time) (int, error) {
+	if schedule.Name == "" {
+		return http.StatusBadRequest, errors.New("Schedule name is required")
+	}
+
+	// Шаблон проверяется на копии: служебные поля задачи заполняются только при запуске
+	schedule.Job.NotBefore = time.Time{}
+	template := schedule.Job
+	if err := newUserJob(schedule.UserID, &template); err != nil {
+		return http.StatusBadRequest, errors.New("Invalid job template: " + err.Error())
+	}
+	if !template.GlossaryID.IsZero() {
+		if _, err := findUserGlossary(schedule.UserID, template.GlossaryID); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return http.StatusBadRequest, errors.New("Glossary not found")
+			}
+			return http.StatusInternalServerError, errors.New("Error fetching glossary")
+		}
+	}
+
+	next, err := nextScheduleRun(*schedule, now)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if next.IsZero() {
+		return http.StatusBadRequest, errors.New("Cron expression never fires")
+	}
+	schedule.NextRunAt = time.Time{}
+	if schedule.Active {
+		schedule.NextRunAt = next
+	}
+	return 0, nil
+}
+
+// nextScheduleRun возвращает время первого запуска расписания после after.
+func nextScheduleRun(schedule models.JobSchedule, after time.Time) (time.Time, error) {
+	expr, err := cron.Parse(schedule.Cron)
+	if err != nil {
+		return time.Time{}, errors.New("Invalid cron expression: " + err.Error())
+	}
+	location := time.UTC
+	if schedule.Timezone != "" {
+		location, err = time.LoadLocation(schedule.Timezone)
+		if err != nil {
+			return time.Time{}, errors.New("Invalid timezone: " + schedule.Timezone)
+		}
+	}
+	return expr.Next(after.In(location)).UTC(), nil
+}
+
+// RunJobSchedules периодически создаёт задачи по наступившим расписаниям.
+func RunJobSchedules(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := runDueSchedules(db.GetCollection("schedules")); err != nil {
+			log.Printf("Error running job schedules: %v", err)
+		}
+	}
+}
+
+func runDueSchedules(schedulesCollection *mongo.Collection) error {
+	now := time.Now()
+	cursor, err := schedulesCollection.Find(context.Background(), bson.M{
+		"active":      true,
+		"next_run_at": bson.M{"$lte": now},
+	})
+	if err != nil {
+		return err
+	}
+	var schedules []models.JobSchedule
+	if err := cursor.All(context.Background(), &schedules); err != nil {
+		return err
+	}
+
+	for _, schedule := range schedules {
+		// Расписание, у которого больше нет запусков, останавливается
+		next, err := nextScheduleRun(schedule, now)
+		if err != nil {
+			log.Printf("Error computing next run of schedule %v: %v", schedule.ID, err)
+		}
+
+		// Запуск закрепляется сдвигом next_run_at; если его уже сдвинули, расписание пропускается
+		set := bson.M{"last_run_at": now, "updated_at": now}
+		claim := bson.M{"$set": set}
+		if next.IsZero() {
+			claim["$unset"] = bson.M{"next_run_at": ""}
+		} else {
+			set["next_run_at"] = next
+		}
+		result, err := schedulesCollection.UpdateOne(context.Background(),
+			bson.M{"_id": schedule.ID, "next_run_at": schedule.NextRunAt},
+			claim,
+		)
+		if err != nil {
+			log.Printf("Error updating schedule %v: %v", schedule.ID, err)
+			continue
+		}
+		if result.ModifiedCount == 0 {
+			continue
+		}
+
+		job := schedule.Job
+		job.ScheduleID = schedule.ID
+		outcome := bson.M{"last_error": ""}
+		err = newUserJob(schedule.UserID, &job)
+		var quota *plans.Quota
+		if err == nil {
+			if quota, err = userQuota(schedule.UserID); err == nil {
+				err = quota.Reserve(job, time.Now())
+			}
+		}
+		if err == nil {
+			err = submitUserJob(&job)
+		}
+		if quota != nil {
+			quota.Release()
+		}
+		if err != nil {
+			log.Printf("Error creating job for schedule %v: %v", schedule.ID, err)
+			outcome["last_error"] = err.Error()
+		} else {
+			outcome["last_job_id"] = job.ID
+		}
+
+		_, err = schedulesCollection.UpdateOne(context.Background(), bson.M{"_id": schedule.ID}, bson.M{"$set": outcome})
+		if err != nil {
+			log.Printf("Error updating schedule %v: %v", schedule.ID, err)
+		}
+	}
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/go-chi/render"
 	"github.com/moevm/nosql2h24-transcribtion/db"
 	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/timeline"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -192,7 +193,9 @@ PATCH /servers/607f1f77bcf86cd799439011
 	  "status": "inactive",
 	  "cpu_info": "Intel Xeon E5",
 	  "gpu_info": "NVIDIA Tesla",
-	  "ram_size_gb": 64
+	  "ram_size_gb": 64,
+	  "languages": ["en", "es"],
+	  "labels": ["gpu", "eu"]
 	}
 */
 func PatchServer(w http.ResponseWriter, r *http.Request) {
@@ -234,6 +237,12 @@ func PatchServer(w http.ResponseWriter, r *http.Request) {
 	if patchData.RAMSizeGB != 0 {
 		update["ram_size_gb"] = patchData.RAMSizeGB
 	}
+	if len(patchData.Languages) > 0 {
+		update["languages"] = patchData.Languages
+	}
+	if len(patchData.Labels) > 0 {
+		update["labels"] = patchData.Labels
+	}
 
 	if len(update) == 0 {
 		http.Error(w, "No fields to update", http.StatusBadRequest)
@@ -316,11 +325,6 @@ func GetServerCurrentJobs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	jobsCollection := db.GetCollection("jobs")
-	err = UpdateJobsStatus(jobsCollection)
-	if err != nil {
-		http.Error(w, "Error while updating jobs", http.StatusInternalServerError)
-		return
-	}
 	cursor, err := jobsCollection.Find(context.Background(), bson.M{"_id": bson.M{"$in": server.CurrentJobs}})
 	if err != nil {
 		http.Error(w, "Error fetching current jobs", http.StatusInternalServerError)
@@ -358,11 +362,6 @@ func GetServerCompletedJobs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	jobsCollection := db.GetCollection("jobs")
-	err = UpdateJobsStatus(jobsCollection)
-	if err != nil {
-		http.Error(w, "Error while updating jobs", http.StatusInternalServerError)
-		return
-	}
 	cursor, err := jobsCollection.Find(context.Background(), bson.M{"_id": bson.M{"$in": server.CompletedJobs}})
 	if err != nil {
 		http.Error(w, "Error fetching completed jobs", http.StatusInternalServerError)
@@ -413,10 +412,24 @@ func AddJobToServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// При переназначении задача снимается со старого сервера
+	previousHost := job.HostID
+	if !previousHost.IsZero() && previousHost != serverIDObj {
+		_, err = serversCollection.UpdateOne(
+			context.Background(),
+			bson.M{"_id": previousHost},
+			bson.M{"$pull": bson.M{"current_jobs": jobIDObj}},
+		)
+		if err != nil {
+			http.Error(w, "Error removing job from previous server", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	_, err = serversCollection.UpdateOne(
 		context.Background(),
 		bson.M{"_id": serverIDObj},
-		bson.M{"$push": bson.M{"current_jobs": jobIDObj}},
+		bson.M{"$addToSet": bson.M{"current_jobs": jobIDObj}},
 	)
 	if err != nil {
 		http.Error(w, "Error adding job to server", http.StatusInternalServerError)
@@ -433,7 +446,64 @@ func AddJobToServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	switch {
+	case previousHost.IsZero():
+		timeline.Record(jobIDObj, timeline.Assigned, serverIDObj, timeline.Details{"hostname": server.Hostname})
+	case previousHost != serverIDObj:
+		timeline.Record(jobIDObj, timeline.Reassigned, serverIDObj, timeline.Details{
+			"hostname":      server.Hostname,
+			"previous_host": previousHost,
+		})
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"message": "Job successfully added to server"})
 }
+
+/*
+POST /servers/{id}/heartbeat
+Сервер периодически сообщает, что он жив, и свою текущую загрузку (0..1).
+
+	{
+	  "load": 0.42
+	}
+*/
+func ServerHeartbeat(w http.ResponseWriter, r *http.Request) {
+	serverID := chi.URLParam(r, "id")
+	objectID, err := primitive.ObjectIDFromHex(serverID)
+	if err != nil {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+
+	var heartbeat struct {
+		Load float64 `json:"load"`
+	}
+	if err := render.DecodeJSON(r.Body, &heartbeat); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if heartbeat.Load < 0 {
+		http.Error(w, "Load must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.GetCollection("servers").UpdateOne(context.Background(),
+		bson.M{"_id": objectID},
+		bson.M{"$set": bson.M{
+			"last_heartbeat_at": time.Now(),
+			"load":              heartbeat.Load,
+		}},
+	)
+	if err != nil {
+		http.Error(w, "Error saving heartbeat", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "Server not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
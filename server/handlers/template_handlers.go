@@ -0,0 +1,395 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/pipeline"
+	"github.com/moevm/nosql2h24-transcribtion/plans"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io"
+	"net/http"
+	"time"
+)
+
+// GET /users/{id}/templates
+
+// Шаблоны пользователя и общие шаблоны его организации
+func GetUserTemplates(w http.ResponseWriter, r *http.Request) {
+	user, ok := templateUser(w, r)
+	if !ok {
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	cursor, err := db.GetCollection("templates").Find(context.Background(), visibleTemplatesFilter(user), opts)
+	if err != nil {
+		http.Error(w, "Error fetching templates", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	templates := []models.JobTemplate{}
+	if err := cursor.All(context.Background(), &templates); err != nil {
+		http.Error(w, "Error decoding templates", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templates)
+}
+
+// GET /users/{id}/templates/{template_id}
+func GetUserTemplate(w http.ResponseWriter, r *http.Request) {
+	user, ok := templateUser(w, r)
+	if !ok {
+		return
+	}
+	template, ok := visibleTemplate(w, r, user)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(template)
+}
+
+/*
+POST /users/{id}/templates
+{
+	"name": "Interview, RU -> EN",
+	"description": "Interviews recorded in the studio",
+	"shared": true,
+	"defaults": {
+		"title": "Interview",
+		"status": "pending",
+		"source_language": "ru",
+		"file_format": "wav",
+		"description": "Studio interview",
+		"output_file": "interview.txt",
+		"target_languages": ["en"],
+		"glossary_id": "673a1f0c5f1e4e0001a0be10",
+		"requirements": ["gpu"],
+		"diarization": true
+	}
+}
+
+Заполнять все поля задачи в defaults не обязательно: недостающие передаются при создании задачи.
+Шаблон с "shared": true видят и используют все пользователи организации владельца
+(поле organization пользователя), изменять и удалять его может только владелец.
+*/
+
+func CreateUserTemplate(w http.ResponseWriter, r *http.Request) {
+	user, ok := templateUser(w, r)
+	if !ok {
+		return
+	}
+
+	var template models.JobTemplate
+	if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	template.ID = primitive.NewObjectID()
+	template.UserID = user.ID
+	template.Organization = user.Organization
+	template.CreatedAt = now
+	template.UpdatedAt = now
+	if status, err := validateTemplate(template); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	_, err := db.GetCollection("templates").InsertOne(context.Background(), template)
+	if err != nil {
+		http.Error(w, "Error saving template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(template)
+}
+
+// PUT /users/{id}/templates/{template_id}
+
+// Заменяет шаблон целиком (формат как в POST). Доступно только владельцу.
+func UpdateUserTemplate(w http.ResponseWriter, r *http.Request) {
+	user, ok := templateUser(w, r)
+	if !ok {
+		return
+	}
+	templateID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "template_id"))
+	if err != nil {
+		http.Error(w, "Invalid template ID", http.StatusBadRequest)
+		return
+	}
+
+	var template models.JobTemplate
+	if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	template.UserID = user.ID
+	if status, err := validateTemplate(template); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var updated models.JobTemplate
+	err = db.GetCollection("templates").FindOneAndUpdate(context.Background(),
+		bson.M{"_id": templateID, "user_id": user.ID},
+		bson.M{"$set": bson.M{
+			"name":         template.Name,
+			"description":  template.Description,
+			"shared":       template.Shared,
+			"organization": user.Organization,
+			"defaults":     template.Defaults,
+			"updated_at":   time.Now(),
+		}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Template not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error updating template", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// DELETE /users/{id}/templates/{template_id}
+func DeleteUserTemplate(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	templateID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "template_id"))
+	if err != nil {
+		http.Error(w, "Invalid template ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.GetCollection("templates").DeleteOne(context.Background(), bson.M{"_id": templateID, "user_id": userID})
+	if err != nil {
+		http.Error(w, "Error deleting template", http.StatusInternalServerError)
+		return
+	}
+	if result.DeletedCount == 0 {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+POST /users/{id}/templates/{template_id}/jobs
+{
+	"title": "Interview with John",
+	"input_file": "/uploads/interview-john.wav"
+}
+
+Создаёт задачу из шаблона: поля из тела запроса заменяют значения шаблона, остальные
+берутся из defaults. Итоговая задача проверяется и запускается как в POST /users/{id}/jobs.
+Если статус не задан ни в шаблоне, ни в запросе, задача создаётся в статусе pending.
+*/
+
+func CreateJobFromTemplate(w http.ResponseWriter, r *http.Request) {
+	user, ok := templateUser(w, r)
+	if !ok {
+		return
+	}
+	template, ok := visibleTemplate(w, r, user)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	// Поля, переданные в запросе, перезаписывают значения шаблона
+	job := template.Defaults
+	job.TargetLanguages = append([]string(nil), template.Defaults.TargetLanguages...)
+	job.Requirements = append([]string(nil), template.Defaults.Requirements...)
+	job.Steps = append([]models.PipelineStep(nil), template.Defaults.Steps...)
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &job); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+	}
+	if job.Status == "" {
+		job.Status = "pending"
+	}
+	job.TemplateID = template.ID
+
+	if err := newUserJob(user.ID, &job); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	quota, err := plans.NewQuota(user, time.Now())
+	if err != nil {
+		http.Error(w, "Error checking plan quota", http.StatusInternalServerError)
+		return
+	}
+	defer quota.Release()
+	if err := quota.Reserve(job, time.Now()); err != nil {
+		http.Error(w, err.Error(), quotaStatus(err))
+		return
+	}
+
+	if !job.GlossaryID.IsZero() {
+		if _, err := findUserGlossary(glossaryOwner(job), job.GlossaryID); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				http.Error(w, "Glossary not found", http.StatusBadRequest)
+			} else {
+				http.Error(w, "Error fetching glossary", http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+
+	policy, err := dedupPolicy(r, user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	original, err := findDuplicateJob(&job, policy)
+	if err != nil {
+		http.Error(w, "Error checking for duplicate input", http.StatusInternalServerError)
+		return
+	}
+	if original != nil && policy == DedupAsk {
+		duplicateConflict(w, *original)
+		return
+	}
+
+	if original != nil {
+		err = reuseJobResult(&job, *original)
+	} else {
+		err = submitUserJob(&job)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(job)
+}
+
+// glossaryOwner возвращает владельца словаря задачи. Задача из общего шаблона
+// может использовать словарь владельца шаблона.
+func glossaryOwner(job models.Job) primitive.ObjectID {
+	if job.TemplateID.IsZero() {
+		return job.UserID
+	}
+	var template models.JobTemplate
+	err := db.GetCollection("templates").FindOne(context.Background(), bson.M{"_id": job.TemplateID}).Decode(&template)
+	if err != nil || template.Defaults.GlossaryID != job.GlossaryID {
+		return job.UserID
+	}
+	return template.UserID
+}
+
+func validateTemplate(template models.JobTemplate) (int, error) {
+	if template.Name == "" {
+		return http.StatusBadRequest, errors.New("Template name is required")
+	}
+
+	defaults := template.Defaults
+	for _, language := range defaults.TargetLanguages {
+		if language == "" {
+			return http.StatusBadRequest, errors.New("Target languages must not be empty")
+		}
+	}
+	for _, label := range defaults.Requirements {
+		if label == "" {
+			return http.StatusBadRequest, errors.New("Requirements must not be empty")
+		}
+	}
+	if len(defaults.Steps) > 0 {
+		if err := pipeline.Validate(defaults.Steps); err != nil {
+			return http.StatusBadRequest, errors.New("Invalid pipeline: " + err.Error())
+		}
+	}
+	if !defaults.GlossaryID.IsZero() {
+		if _, err := findUserGlossary(template.UserID, defaults.GlossaryID); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return http.StatusBadRequest, errors.New("Glossary not found")
+			}
+			return http.StatusInternalServerError, errors.New("Error fetching glossary")
+		}
+	}
+	return 0, nil
+}
+
+// templateUser загружает пользователя из URL; при ошибке сам отвечает клиенту.
+func templateUser(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return models.User{}, false
+	}
+
+	var user models.User
+	err = db.GetCollection("users").FindOne(context.Background(), bson.M{"_id": userID}).Decode(&user)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching user", http.StatusInternalServerError)
+		}
+		return models.User{}, false
+	}
+	return user, true
+}
+
+// visibleTemplate загружает шаблон из URL, если он доступен пользователю; при ошибке сам отвечает клиенту.
+func visibleTemplate(w http.ResponseWriter, r *http.Request, user models.User) (models.JobTemplate, bool) {
+	templateID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "template_id"))
+	if err != nil {
+		http.Error(w, "Invalid template ID", http.StatusBadRequest)
+		return models.JobTemplate{}, false
+	}
+
+	filter := bson.M{"$and": []bson.M{{"_id": templateID}, visibleTemplatesFilter(user)}}
+	var template models.JobTemplate
+	err = db.GetCollection("templates").FindOne(context.Background(), filter).Decode(&template)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Template not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching template", http.StatusInternalServerError)
+		}
+		return models.JobTemplate{}, false
+	}
+	return template, true
+}
+
+// visibleTemplatesFilter - собственные шаблоны пользователя и общие шаблоны его организации.
+func visibleTemplatesFilter(user models.User) bson.M {
+	own := bson.M{"user_id": user.ID}
+	if user.Organization == "" {
+		return own
+	}
+	return bson.M{"$or": []bson.M{own, {"shared": true, "organization": user.Organization}}}
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// maxUploadSize - наибольший размер загружаемого файла
+const maxUploadSize = 2 << 30
+
+/*
+POST /users/{id}/uploads
+multipart/form-data, поле "file"
+
+Сохраняет файл и вычисляет его SHA-256. Полученный path передаётся в input_file при создании задачи:
+{
+	"id": "673a1f0c5f1e4e0001a0be20",
+	"user_id": "650e7c3f5f1e4e0001a0bd11",
+	"file_name": "episode-42.mp3",
+	"path": "uploads/9f86d081884c7d65....mp3",
+	"size": 52428800,
+	"sha256": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+	"created_at": "2024-11-20T06:00:00Z"
+}
+*/
+
+func UploadUserFile(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	err = db.GetCollection("users").FindOne(context.Background(), bson.M{"_id": userID}).Err()
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching user", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "File is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	path, size, sum, err := storage.Save(file, header.Filename)
+	if err != nil {
+		log.Printf("Error storing upload: %v", err)
+		http.Error(w, "Error saving file", http.StatusInternalServerError)
+		return
+	}
+
+	upload := models.Upload{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		FileName:  filepath.Base(header.Filename),
+		Path:      path,
+		Size:      size,
+		SHA256:    sum,
+		CreatedAt: time.Now(),
+	}
+	_, err = db.GetCollection("uploads").InsertOne(context.Background(), upload)
+	if err != nil {
+		http.Error(w, "Error saving upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(upload)
+}
+
+// GET /users/{id}/uploads
+
+// Загруженные файлы пользователя, новые сверху
+func GetUserUploads(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := db.GetCollection("uploads").Find(context.Background(), bson.M{"user_id": userID}, opts)
+	if err != nil {
+		http.Error(w, "Error fetching uploads", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	uploads := []models.Upload{}
+	if err := cursor.All(context.Background(), &uploads); err != nil {
+		http.Error(w, "Error decoding uploads", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(uploads)
+}
@@ -7,9 +7,22 @@ import (
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
+	"github.com/moevm/nosql2h24-transcribtion/billing"
 	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/discounts"
+	"github.com/moevm/nosql2h24-transcribtion/engine"
+	"github.com/moevm/nosql2h24-transcribtion/events"
 	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/money"
+	"github.com/moevm/nosql2h24-transcribtion/notifications"
+	"github.com/moevm/nosql2h24-transcribtion/payments"
+	"github.com/moevm/nosql2h24-transcribtion/pipeline"
+	"github.com/moevm/nosql2h24-transcribtion/plans"
+	"github.com/moevm/nosql2h24-transcribtion/pricing"
 	"github.com/moevm/nosql2h24-transcribtion/scheduler"
+	"github.com/moevm/nosql2h24-transcribtion/timeline"
+	"github.com/moevm/nosql2h24-transcribtion/webhooks"
+	"github.com/moevm/nosql2h24-transcribtion/worker"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -219,6 +232,9 @@ Content-Type: application/json
 "email": "new_email@example.com",
 "permissions": "admin"
 }
+
+Организацию ("organization") меняет только администратор; "organization": "" убирает её.
+Без поля organization организация пользователя не меняется.
 */
 
 func UpdateUser(w http.ResponseWriter, r *http.Request) {
@@ -230,25 +246,41 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var updatedUser models.User
-	if err := render.DecodeJSON(r.Body, &updatedUser); err != nil {
+	var request userUpdateRequest
+	if err := render.DecodeJSON(r.Body, &request); err != nil {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
+	updatedUser := request.User
 
 	if updatedUser.Username == "" && updatedUser.Email == "" && updatedUser.Permissions == "" {
 		http.Error(w, "No fields to update", http.StatusBadRequest)
 		return
 	}
+	if !request.canSetOrganization(w, r) {
+		return
+	}
+	if updatedUser.Email != "" {
+		if _, err := notifications.ParseAddress(updatedUser.Email); err != nil {
+			http.Error(w, "Invalid email", http.StatusBadRequest)
+			return
+		}
+	}
 	filter := bson.M{"_id": objectID}
 
-	update := bson.M{
-		"$set": bson.M{
-			"username":    updatedUser.Username,
-			"email":       updatedUser.Email,
-			"permissions": updatedUser.Permissions,
-			"updated_at":  time.Now(),
-		},
+	set := bson.M{
+		"username":    updatedUser.Username,
+		"email":       updatedUser.Email,
+		"permissions": updatedUser.Permissions,
+		"updated_at":  time.Now(),
+	}
+	update := bson.M{"$set": set}
+	if request.Organization != nil {
+		if *request.Organization == "" {
+			update["$unset"] = bson.M{"organization": ""}
+		} else {
+			set["organization"] = *request.Organization
+		}
 	}
 
 	_, err = db.GetCollection("users").UpdateOne(context.Background(), filter, update)
@@ -269,21 +301,31 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(user)
 }
 
+// userUpdateRequest - тело PUT и PATCH /users/{id}. Organization - указатель, чтобы отличить
+// отсутствующее поле от пустого: без поля организация пользователя не меняется.
+type userUpdateRequest struct {
+	models.User
+	Organization *string `json:"organization"`
+}
+
+// canSetOrganization разрешает менять организацию только администратору: по ней пользователю
+// открываются общие шаблоны организации. Если поля нет в запросе, проверка не нужна.
+func (request userUpdateRequest) canSetOrganization(w http.ResponseWriter, r *http.Request) bool {
+	if request.Organization == nil {
+		return true
+	}
+	return requireAdmin(w, r)
+}
+
 // PATCH /users/5fcbf22b923e992dcebf6f1a
-// В теле запроса клиент может отправить те поля пользователя, которые он хочет обновить (например, username, email, permissions, payments, jobs).
+// В теле запроса клиент может отправить те поля пользователя, которые он хочет обновить (например, username, email, permissions, jobs).
 // Важно, что только те поля, которые не пустые, будут включены в обновление.
+// Организацию (organization) может указать только администратор.
 /*
 {
     "username": "john_doe_updated",
     "email": "john.doe.updated@example.com",
     "permissions": "admin",
-    "payments": [
-        {
-            "payment_id": "12345",
-            "amount": 100,
-            "currency": "USD"
-        }
-    ],
     "jobs": [
         "5fcbf22b923e992dcebf6f1b"
     ]
@@ -298,11 +340,15 @@ func PatchUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid user ID format", http.StatusBadRequest)
 		return
 	}
-	var patchUser models.User
-	if err := render.DecodeJSON(r.Body, &patchUser); err != nil {
+	var request userUpdateRequest
+	if err := render.DecodeJSON(r.Body, &request); err != nil {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
+	if !request.canSetOrganization(w, r) {
+		return
+	}
+	patchUser := request.User
 	filter := bson.M{"_id": objectID}
 	updateFields := bson.M{}
 
@@ -310,17 +356,28 @@ func PatchUser(w http.ResponseWriter, r *http.Request) {
 		updateFields["username"] = patchUser.Username
 	}
 	if patchUser.Email != "" {
+		if _, err := notifications.ParseAddress(patchUser.Email); err != nil {
+			http.Error(w, "Invalid email", http.StatusBadRequest)
+			return
+		}
 		updateFields["email"] = patchUser.Email
 	}
 	if patchUser.Permissions != "" {
 		updateFields["permissions"] = patchUser.Permissions
 	}
-	if len(patchUser.Payments) > 0 {
-		updateFields["payments"] = patchUser.Payments
-	}
 	if len(patchUser.Jobs) > 0 {
 		updateFields["jobs"] = patchUser.Jobs
 	}
+	if request.Organization != nil && *request.Organization != "" {
+		updateFields["organization"] = *request.Organization
+	}
+	if patchUser.DedupPolicy != "" {
+		if !isDedupPolicy(patchUser.DedupPolicy) {
+			http.Error(w, "Invalid dedup_policy", http.StatusBadRequest)
+			return
+		}
+		updateFields["dedup_policy"] = patchUser.DedupPolicy
+	}
 
 	if len(updateFields) == 0 {
 		http.Error(w, "No fields to update", http.StatusBadRequest)
@@ -379,6 +436,10 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing required fields", http.StatusBadRequest)
 		return
 	}
+	if _, err := notifications.ParseAddress(newUser.Email); err != nil {
+		http.Error(w, "Invalid email", http.StatusBadRequest)
+		return
+	}
 
 	if newUser.Permissions == "" {
 		newUser.Permissions = "user" // по умолчанию
@@ -440,12 +501,8 @@ func GetUserJobs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Статусы задач обновляет RunJobStatusUpdater, за изменениями можно следить через GET /jobs/events
 	jobsCollection := db.GetCollection("jobs")
-	err = UpdateJobsStatus(jobsCollection)
-	if err != nil {
-		http.Error(w, "Error while updating jobs", http.StatusInternalServerError)
-		return
-	}
 	var jobs []models.Job
 	cursor, err := jobsCollection.Find(context.Background(), bson.M{"_id": bson.M{"$in": user.Jobs}})
 	if err != nil {
@@ -471,7 +528,49 @@ POST /users/{userID}/jobs
   "file_format": "pdf",
   "description": "Translate a document from English to Spanish.",
   "input_file": "input_file_path.pdf",
-  "output_file": "output_file_path.pdf"
+  "output_file": "output_file_path.pdf",
+  "target_languages": ["es", "de"]
+}
+
+После расшифровки воркер переводит результат на каждый язык из target_languages,
+расшифровки доступны через GET /jobs/{id}/transcripts.
+
+Если язык записи неизвестен, передаётся "source_language": "auto": задача получает статус
+detecting_language, а после определения языка назначается на сервер, поддерживающий этот язык.
+
+Словарь пользователя подключается полем "glossary_id" (см. /users/{id}/glossaries).
+"requirements": ["gpu"] - метки, которые должны быть у сервера, выполняющего задачу.
+"diarization": true включает разметку говорящих, переименовать их можно через PUT /jobs/{id}/speakers.
+
+"duration_seconds": 1830 и "priority": "express" (standard, express или urgent) задают цену задачи:
+она рассчитывается при создании (поле price) по тарифному плану пользователя, предварительный
+расчёт - POST /jobs/quote. Без длительности цена не рассчитывается. Без priority задача получает
+приоритет тарифного плана.
+
+Тарифный план ограничивает минуты записи в месяц и число задач в работе (GET /users/{id}/usage):
+задача, которая не укладывается в квоту, отклоняется с 403, сверх лимита параллельных задач - с 429.
+Если политика оплаты пользователя (GET /users/{id}/billing) требует оплаты до выполнения,
+длительность обязательна, а задача ждёт в статусе awaiting_payment, пока платёж за неё не списан.
+
+Отложенная задача: "not_before": "2024-11-20T06:00:00Z" - до этого времени задача находится
+в статусе scheduled и на сервер не назначается. Повторяющиеся задачи - см. /users/{id}/schedules.
+
+Если input_file - файл, загруженный через POST /users/{id}/uploads, и такой же файл с теми же
+параметрами уже расшифрован, поведение задаётся параметром ?dedup= (по умолчанию - dedup_policy
+пользователя, а если она не задана - ask):
+  - reuse: задача сразу создаётся выполненной со ссылкой reused_from_job_id на готовый результат;
+  - ask: ответ 409 с original_job_id, запрос можно повторить с ?dedup=reuse или ?dedup=reprocess;
+  - reprocess: файл обрабатывается заново.
+
+Конвейер из нескольких шагов (каждый шаг запускается после завершения предыдущего,
+результат шага становится входным файлом следующего):
+{
+  ...
+  "steps": [
+    {"type": "transcription"},
+    {"type": "translation"},
+    {"type": "summarization"}
+  ]
 }
 */
 
@@ -489,66 +588,54 @@ func AddUserJob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	const FinishDatetime = 30
-
-	job.ID = primitive.NewObjectID()
-	job.UserID = id
-	job.CreatedAt = time.Now()
-	job.UpdatedAt = job.CreatedAt
-	job.EstimatedFinishDatetime = time.Now().Add(FinishDatetime * time.Second)
-
-	if job.Title == "" || job.Status == "" || job.SourceLanguage == "" || job.FileFormat == "" || job.Description == "" || job.InputFile == "" || job.OutputFile == "" {
-		http.Error(w, "All fields are required", http.StatusBadRequest)
+	if err := newUserJob(id, &job); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	serversCollection := db.GetCollection("servers")
-	jobsCollection := db.GetCollection("jobs")
-	usersCollection := db.GetCollection("users")
-
-	servers, err := schedul.GetServers(serversCollection)
+	quota, err := userQuota(id)
 	if err != nil {
-		http.Error(w, "Error fetching servers: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Error checking plan quota", http.StatusInternalServerError)
 		return
 	}
-
-	selectedServer, err := schedul.SelectServerWithMinJobs(servers)
-	if err != nil {
-		http.Error(w, "Error selecting server: "+err.Error(), http.StatusInternalServerError)
+	defer quota.Release()
+	if err := quota.Reserve(job, time.Now()); err != nil {
+		http.Error(w, err.Error(), quotaStatus(err))
 		return
 	}
 
-	job.HostID = selectedServer.ID
-	if err := schedul.AddJobToServer(serversCollection, selectedServer.ID, job.ID); err != nil {
-		http.Error(w, "Error adding job to server: "+err.Error(), http.StatusInternalServerError)
-		return
+	if !job.GlossaryID.IsZero() {
+		if _, err := findUserGlossary(id, job.GlossaryID); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				http.Error(w, "Glossary not found", http.StatusBadRequest)
+			} else {
+				http.Error(w, "Error fetching glossary", http.StatusInternalServerError)
+			}
+			return
+		}
 	}
 
-	_, err = jobsCollection.InsertOne(context.Background(), job)
+	policy, err := dedupPolicy(r, id)
 	if err != nil {
-		http.Error(w, "Error saving job", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	var user models.User
-	err = usersCollection.FindOne(context.Background(), bson.M{"_id": id}).Decode(&user)
+	original, err := findDuplicateJob(&job, policy)
 	if err != nil {
-		http.Error(w, "Error fetching user", http.StatusInternalServerError)
+		http.Error(w, "Error checking for duplicate input", http.StatusInternalServerError)
+		return
+	}
+	if original != nil && policy == DedupAsk {
+		duplicateConflict(w, *original)
 		return
 	}
 
-	if user.Jobs == nil {
-		user.Jobs = []primitive.ObjectID{job.ID}
+	if original != nil {
+		err = reuseJobResult(&job, *original)
 	} else {
-		user.Jobs = append(user.Jobs, job.ID)
+		err = submitUserJob(&job)
 	}
-
-	_, err = usersCollection.UpdateOne(context.Background(),
-		bson.M{"_id": id},
-		bson.M{"$set": bson.M{"jobs": user.Jobs}},
-	)
 	if err != nil {
-		http.Error(w, "Error updating user jobs", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -557,182 +644,1388 @@ func AddUserJob(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(job)
 }
 
-// DELETE /users/{id}/jobs/{job_id}
-func DeleteUserJob(w http.ResponseWriter, r *http.Request) {
-	userID := chi.URLParam(r, "id")
-	jobID := chi.URLParam(r, "jobId")
+// newUserJob заполняет служебные поля новой задачи пользователя и проверяет её поля.
+func newUserJob(userID primitive.ObjectID, job *models.Job) error {
+	job.ID = primitive.NewObjectID()
+	job.UserID = userID
+	job.CreatedAt = time.Now()
+	job.UpdatedAt = job.CreatedAt
+	job.EstimatedFinishDatetime = time.Now().Add(jobDuration)
 
-	userObjectID, err := primitive.ObjectIDFromHex(userID)
-	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
+	if job.Title == "" || job.Status == "" || job.SourceLanguage == "" || job.FileFormat == "" || job.Description == "" || job.InputFile == "" || job.OutputFile == "" {
+		return errors.New("All fields are required")
 	}
 
-	jobObjectID, err := primitive.ObjectIDFromHex(jobID)
+	for _, language := range job.TargetLanguages {
+		if language == "" {
+			return errors.New("Target languages must not be empty")
+		}
+	}
+	for _, label := range job.Requirements {
+		if label == "" {
+			return errors.New("Requirements must not be empty")
+		}
+	}
+
+	if len(job.Steps) > 0 {
+		if err := pipeline.Validate(job.Steps); err != nil {
+			return errors.New("Invalid pipeline: " + err.Error())
+		}
+	}
+
+	if job.DurationSeconds < 0 {
+		return errors.New("Duration must not be negative")
+	}
+	if !pricing.IsKnownPriority(job.Priority) {
+		return errors.New("Unknown priority: " + job.Priority)
+	}
+	if err := priceJob(job); err != nil {
+		return errors.New("Error pricing job: " + err.Error())
+	}
+	return nil
+}
+
+// priceJob рассчитывает цену задачи по тарифному плану её владельца. Задача без приоритета
+// получает приоритет плана. Цена, переданная клиентом, не принимается; без длительности задача
+// остаётся без цены, если только политика оплаты пользователя не требует цены у каждой задачи.
+func priceJob(job *models.Job) error {
+	job.Price = nil
+	job.PaymentID = primitive.NilObjectID
+	job.PaidAt = time.Time{}
+
+	var user models.User
+	err := db.GetCollection("users").FindOne(context.Background(), bson.M{"_id": job.UserID},
+		options.FindOne().SetProjection(bson.M{"plan": 1, "billing": 1}),
+	).Decode(&user)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+	if job.Priority == "" {
+		plan, err := plans.Find(user.Plan)
+		if err != nil {
+			return err
+		}
+		if plan != nil {
+			job.Priority = plan.PriorityTier
+		}
+	}
+	if job.DurationSeconds == 0 {
+		if billing.RequiresPrice(billing.For(user)) {
+			return errors.New("duration_seconds is required: jobs are paid before processing")
+		}
+		return nil
+	}
+
+	quote, err := pricing.QuoteJob(user, *job)
 	if err != nil {
-		http.Error(w, "Invalid job ID", http.StatusBadRequest)
-		return
+		return err
 	}
+	job.Price = &quote.Total
+	return nil
+}
 
+// submitUserJob сохраняет проверенную задачу, добавляет её пользователю и отправляет в работу:
+// задача, которую по политике оплаты нужно сначала оплатить, ждёт в awaiting_payment,
+// отложенная задача ждёт наступления not_before, конвейер запускает первый шаг, задача
+// с "auto" ждёт определения языка, остальные сразу назначаются на сервер.
+func submitUserJob(job *models.Job) error {
+	serversCollection := db.GetCollection("servers")
 	jobsCollection := db.GetCollection("jobs")
-	_, err = jobsCollection.DeleteOne(context.Background(), bson.M{"_id": jobObjectID})
+	usersCollection := db.GetCollection("users")
+
+	var user models.User
+	if err := usersCollection.FindOne(context.Background(), bson.M{"_id": job.UserID}).Decode(&user); err != nil {
+		return errors.New("Error fetching user")
+	}
+	gate := billing.NewGate(user)
+	defer gate.Release()
+	admitted, err := gate.Admit(*job)
 	if err != nil {
-		http.Error(w, "Error deleting job", http.StatusInternalServerError)
-		return
+		return errors.New("Error checking billing: " + err.Error())
 	}
 
-	usersCollection := db.GetCollection("users")
-	_, err = usersCollection.UpdateOne(context.Background(),
-		bson.M{"_id": userObjectID},
-		bson.M{"$pull": bson.M{"jobs": jobObjectID}},
+	switch {
+	case !admitted:
+		// Задачу отправит в работу releaseAwaitingJobs после списания платежа, до тех пор
+		// она не занимает место в лимите параллельных задач
+		job.Status = billing.StatusAwaitingPayment
+		job.HostID = primitive.NilObjectID
+		releaseSlot(*job)
+
+		if _, err := jobsCollection.InsertOne(context.Background(), job); err != nil {
+			return errors.New("Error saving job")
+		}
+
+	case job.NotBefore.After(time.Now()):
+		// Задачу отправит в работу releaseScheduledJobs
+		job.Status = "scheduled"
+		job.HostID = primitive.NilObjectID
+		job.EstimatedFinishDatetime = job.NotBefore.Add(jobDuration)
+
+		if _, err := jobsCollection.InsertOne(context.Background(), job); err != nil {
+			return errors.New("Error saving job")
+		}
+
+	// Задача с шагами - это конвейер: сама она на сервер не назначается,
+	// вместо этого по очереди создаются дочерние задачи для каждого шага.
+	case len(job.Steps) > 0:
+		pipeline.Prepare(job)
+
+		if _, err := jobsCollection.InsertOne(context.Background(), job); err != nil {
+			return errors.New("Error saving job")
+		}
+
+		if err := pipeline.Start(jobsCollection, serversCollection, job); err != nil {
+			// Конвейер уже сохранён, поэтому он завершается ошибкой, а не остаётся без шагов:
+			// finishJob возвращает его минуты в квоту плана
+			if err := addJobsToUser(usersCollection, job.UserID, []primitive.ObjectID{job.ID}); err != nil {
+				log.Printf("Error updating jobs of user %v: %v", job.UserID, err)
+			}
+			jobSubmitted(*job)
+			if err := finishJob(jobsCollection, serversCollection, *job, "failed"); err != nil {
+				log.Printf("Error updating job %v: %v", job.ID, err)
+			}
+			job.Status = "failed"
+			return errors.New("Error starting pipeline: " + err.Error())
+		}
+
+	default:
+		// Язык определяется облегчённым первым проходом, сервер под язык выбирается после него
+		if job.SourceLanguage == engine.AutoLanguage {
+			job.Status = "detecting_language"
+		} else if err := schedul.ScheduleJob(serversCollection, job); err != nil {
+			return errors.New("Error scheduling job: " + err.Error())
+		}
+
+		if _, err := jobsCollection.InsertOne(context.Background(), job); err != nil {
+			return errors.New("Error saving job")
+		}
+	}
+
+	if err := addJobsToUser(usersCollection, job.UserID, []primitive.ObjectID{job.ID}); err != nil {
+		return errors.New("Error updating user jobs")
+	}
+
+	jobSubmitted(*job)
+	return nil
+}
+
+// addJobsToUser дописывает задачи в список задач пользователя.
+// Поле jobs у нового пользователя может быть null, поэтому вместо $push - конкатенация.
+func addJobsToUser(usersCollection *mongo.Collection, userID primitive.ObjectID, jobIDs []primitive.ObjectID) error {
+	result, err := usersCollection.UpdateOne(context.Background(),
+		bson.M{"_id": userID},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"jobs": bson.M{"$concatArrays": bson.A{bson.M{"$ifNull": bson.A{"$jobs", bson.A{}}}, jobIDs}},
+		}}}},
 	)
-	if err != nil {
-		http.Error(w, "Error updating user jobs", http.StatusInternalServerError)
-		return
+	if err == nil && result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
 	}
+	return err
+}
 
-	w.WriteHeader(http.StatusNoContent)
+// jobSubmitted рассылает событие о новой задаче и записывает её создание в журнал.
+func jobSubmitted(job models.Job) {
+	events.PublishJob(job)
+
+	details := timeline.Details{"title": job.Title}
+	if !job.ScheduleID.IsZero() {
+		details["schedule_id"] = job.ScheduleID
+	}
+	timeline.Record(job.ID, timeline.Created, primitive.NilObjectID, details)
+
+	if job.Status == billing.StatusAwaitingPayment {
+		timeline.Record(job.ID, timeline.AwaitingPayment, primitive.NilObjectID, timeline.Details{"price": job.Price})
+	}
+	if job.Status == "scheduled" {
+		timeline.Record(job.ID, timeline.Scheduled, primitive.NilObjectID, timeline.Details{"not_before": job.NotBefore})
+	}
+	if !job.HostID.IsZero() {
+		timeline.Record(job.ID, timeline.Assigned, job.HostID, nil)
+	}
 }
 
-/*
-Запрос:
-POST /users/60d09c875d3b3c6b8d85a681/payments
-Content-Type: application/json
+// maxBatchJobs - наибольшее число задач в одном пакетном запросе
+const maxBatchJobs = 500
 
-Тело запроса:
+// BatchJobResult - результат создания одной задачи пакета
+type BatchJobResult struct {
+	Index  int         `json:"index"`
+	Status int         `json:"status"`
+	Job    *models.Job `json:"job,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+/*
+POST /users/{id}/jobs/batch
 {
-	"price": "100.00",
-	"payment_method": "credit_card",
-	"payment_status": "completed",
-	"job_id": "60d09c875d3b3c6b8d85a683"
+  "jobs": [
+    { ...задача в формате POST /users/{id}/jobs... },
+    { ... }
+  ]
 }
 
-Ответ:
+Все задачи проверяются заранее, серверы читаются один раз и распределяются между задачами
+пакета равномерно, задачи сохраняются пакетной записью. Ошибка в одной задаче не мешает
+создать остальные: в ответе для каждой задачи (по её индексу в запросе) указан свой статус.
+Код ответа - 201, если созданы все задачи, 207, если часть, и 400, если ни одной.
 {
-	"id": "60d09c875d3b3c6b8d85a685",
-	"price": "100.00",
-	"payment_method": "credit_card",
-	"payment_status": "completed",
-	"created_at": "2024-12-08T12:00:00Z",
-	"updated_at": "2024-12-08T12:00:00Z",
-	"job_id": "60d09c875d3b3c6b8d85a683"
+  "created": 1,
+  "failed": 1,
+  "results": [
+    {"index": 0, "status": 201, "job": { ... }},
+    {"index": 1, "status": 400, "error": "All fields are required"}
+  ]
 }
+
+Конвейеры из пакета запускаются так же, как при создании по одной; конвейер, первый шаг
+которого запустить не удалось, остаётся в статусе failed и получает в результатах статус 500
+вместе с задачей. Повторно загруженные
+файлы обрабатываются по политике ?dedup= (см. POST /users/{id}/jobs); при политике ask такая
+задача получает в результатах статус 409.
 */
 
-func AddPayment(w http.ResponseWriter, r *http.Request) {
-	userID := chi.URLParam(r, "id")
-	objectID, err := primitive.ObjectIDFromHex(userID)
+func AddUserJobsBatch(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
 	if err != nil {
-		http.Error(w, "Invalid user ID format", http.StatusBadRequest)
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
 		return
 	}
 
-	var payment models.Payment
-	if err := render.DecodeJSON(r.Body, &payment); err != nil {
+	var request struct {
+		Jobs []json.RawMessage `json:"jobs"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
-
-	payment.CreatedAt = time.Now()
-	payment.UpdatedAt = time.Now()
-
-	filter := bson.M{"_id": objectID}
-
-	update := bson.M{
-		"$push": bson.M{
-			"payments": payment,
-		},
+	if len(request.Jobs) == 0 {
+		http.Error(w, "At least one job is required", http.StatusBadRequest)
+		return
 	}
-
-	_, err = db.GetCollection("users").UpdateOne(context.Background(), filter, update)
-	if err != nil {
-		http.Error(w, "Error adding payment", http.StatusInternalServerError)
+	if len(request.Jobs) > maxBatchJobs {
+		http.Error(w, "Too many jobs in batch, maximum is "+strconv.Itoa(maxBatchJobs), http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(payment)
-}
-
-// DELETE /users/60d09c875d3b3c6b8d85a681/payments/60d09c875d3b3c6b8d85a685
-func DeletePayment(w http.ResponseWriter, r *http.Request) {
-	userID := chi.URLParam(r, "id")
-	paymentID := chi.URLParam(r, "payment_id")
+	serversCollection := db.GetCollection("servers")
+	jobsCollection := db.GetCollection("jobs")
+	usersCollection := db.GetCollection("users")
 
-	objectID, err := primitive.ObjectIDFromHex(userID)
+	var user models.User
+	err = usersCollection.FindOne(context.Background(), bson.M{"_id": id}).Decode(&user)
 	if err != nil {
-		http.Error(w, "Invalid user ID format", http.StatusBadRequest)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching user", http.StatusInternalServerError)
+		}
 		return
 	}
 
-	paymentObjectID, err := primitive.ObjectIDFromHex(paymentID)
+	policy, err := dedupPolicy(r, id)
 	if err != nil {
-		http.Error(w, "Invalid payment ID format", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	filter := bson.M{"_id": objectID}
-	update := bson.M{
-		"$pull": bson.M{
-			"payments": bson.M{"_id": paymentObjectID},
-		},
-	}
-
-	_, err = db.GetCollection("users").UpdateOne(context.Background(), filter, update)
+	// Квота тарифного плана расходуется задачами пакета по порядку
+	quota, err := plans.NewQuota(user, time.Now())
 	if err != nil {
-		http.Error(w, "Error deleting payment", http.StatusInternalServerError)
+		http.Error(w, "Error checking plan quota", http.StatusInternalServerError)
 		return
 	}
+	defer quota.Release()
 
-	w.WriteHeader(http.StatusNoContent)
-}
-
-func UpdateJobsStatus(jobsCollection *mongo.Collection) error {
-	filter := bson.M{
-		"status": bson.M{"$ne": "completed"},
-	}
-
-	cursor, err := jobsCollection.Find(context.Background(), filter)
-	if err != nil {
-		return err
+	// Результат с ненулевым Status - задача уже обработана (ошибка или переиспользованный результат)
+	results := make([]BatchJobResult, len(request.Jobs))
+	jobs := make([]models.Job, len(request.Jobs))
+	fail := func(i, status int, message string) {
+		results[i] = BatchJobResult{Index: i, Status: status, Error: message}
 	}
-	defer cursor.Close(context.Background())
-
-	currentTime := time.Now()
 
-	// Пробегаем по задачам.
-	for cursor.Next(context.Background()) {
-		var job struct {
-			ID                      interface{} `bson:"_id"`
-			EstimatedFinishDatetime time.Time   `bson:"estimated_finish_datetime"`
-			Status                  string      `bson:"status"`
+	// Проверка всех задач до обращения к серверам
+	glossaries := map[primitive.ObjectID]error{}
+	for i, raw := range request.Jobs {
+		results[i] = BatchJobResult{Index: i}
+		if err := json.Unmarshal(raw, &jobs[i]); err != nil {
+			fail(i, http.StatusBadRequest, "Invalid input")
+			continue
 		}
-
-		if err := cursor.Decode(&job); err != nil {
-			log.Printf("Error decoding job: %v", err)
+		if err := newUserJob(id, &jobs[i]); err != nil {
+			fail(i, http.StatusBadRequest, err.Error())
 			continue
 		}
-
-		// Если задача выполнена, обновляем её статус.
-		if job.EstimatedFinishDatetime.Before(currentTime) && job.Status != "completed" {
-			update := bson.M{
-				"$set": bson.M{
-					"status":     "completed",
-					"updated_at": currentTime,
-				},
+		if glossaryID := jobs[i].GlossaryID; !glossaryID.IsZero() {
+			glossaryErr, checked := glossaries[glossaryID]
+			if !checked {
+				_, glossaryErr = findUserGlossary(id, glossaryID)
+				glossaries[glossaryID] = glossaryErr
 			}
-
-			_, err := jobsCollection.UpdateOne(context.Background(), bson.M{"_id": job.ID}, update)
-			if err != nil {
-				log.Printf("Error updating job %v: %v", job.ID, err)
+			if errors.Is(glossaryErr, mongo.ErrNoDocuments) {
+				fail(i, http.StatusBadRequest, "Glossary not found")
+				continue
+			} else if glossaryErr != nil {
+				fail(i, http.StatusInternalServerError, "Error fetching glossary")
 				continue
 			}
-			log.Printf("Updated job %v to completed", job.ID)
+		}
+		if err := quota.Reserve(jobs[i], time.Now()); err != nil {
+			fail(i, quotaStatus(err), err.Error())
+			continue
+		}
+
+		original, err := findDuplicateJob(&jobs[i], policy)
+		switch {
+		case err != nil:
+			fail(i, http.StatusInternalServerError, "Error checking for duplicate input")
+		case original != nil && policy == DedupAsk:
+			fail(i, http.StatusConflict, "This file has already been transcribed with the same options, original job "+original.ID.Hex())
+		case original != nil:
+			if err := reuseJobResult(&jobs[i], *original); err != nil {
+				fail(i, http.StatusInternalServerError, err.Error())
+			} else {
+				results[i] = BatchJobResult{Index: i, Status: http.StatusCreated, Job: &jobs[i]}
+			}
 		}
 	}
-	if err := cursor.Err(); err != nil {
-		return err
-	}
-	return nil
+
+	// Распределение по серверам: конвейеры назначают свои шаги сами при запуске,
+	// задачи с автоопределением языка - после определения. Если серверы прочитать не удалось,
+	// отказ получают только задачи, которым нужен сервер.
+	var planner *schedul.Planner
+	var serversErr error
+	var planned []int
+	gate := billing.NewGate(user)
+	defer gate.Release()
+	for i := range jobs {
+		if results[i].Status != 0 {
+			continue
+		}
+		job := &jobs[i]
+		admitted, err := gate.Admit(*job)
+		if err != nil {
+			fail(i, http.StatusInternalServerError, "Error checking billing")
+			continue
+		}
+		switch {
+		case !admitted:
+			job.Status = billing.StatusAwaitingPayment
+			job.HostID = primitive.NilObjectID
+			releaseSlot(*job)
+		case job.NotBefore.After(time.Now()):
+			job.Status = "scheduled"
+			job.HostID = primitive.NilObjectID
+			job.EstimatedFinishDatetime = job.NotBefore.Add(jobDuration)
+		case len(job.Steps) > 0:
+			pipeline.Prepare(job)
+		case job.SourceLanguage == engine.AutoLanguage:
+			job.Status = "detecting_language"
+		default:
+			if planner == nil && serversErr == nil {
+				var servers []models.Server
+				servers, serversErr = schedul.GetServers(serversCollection)
+				if serversErr == nil {
+					planner = schedul.NewPlanner(servers)
+				}
+			}
+			if serversErr != nil {
+				fail(i, http.StatusInternalServerError, "Error scheduling job: "+serversErr.Error())
+				continue
+			}
+			if err := planner.Assign(job); err != nil {
+				fail(i, http.StatusUnprocessableEntity, "Error scheduling job: "+err.Error())
+				continue
+			}
+			planned = append(planned, i)
+		}
+	}
+
+	// Назначения сохраняются до вставки задач: задача без записи на сервере не должна попасть в базу
+	if planner != nil && len(planned) > 0 {
+		if err := planner.Commit(serversCollection); err != nil {
+			log.Printf("Error assigning batch jobs to servers: %v", err)
+			if err := schedul.RemoveJobsFromServers(serversCollection, batchJobs(jobs, planned)); err != nil {
+				log.Printf("Error reverting batch job assignments: %v", err)
+			}
+			for _, i := range planned {
+				fail(i, http.StatusInternalServerError, "Error assigning job to server")
+			}
+		}
+	}
+
+	var documents []interface{}
+	var indexes []int
+	for i := range jobs {
+		if results[i].Status == 0 {
+			documents = append(documents, jobs[i])
+			indexes = append(indexes, i)
+		}
+	}
+
+	if len(documents) > 0 {
+		// Неупорядоченная вставка: ошибка одной задачи не останавливает остальные
+		_, err = jobsCollection.InsertMany(context.Background(), documents, options.InsertMany().SetOrdered(false))
+		var bulkErr mongo.BulkWriteException
+		if errors.As(err, &bulkErr) {
+			var unsaved []int
+			for _, writeErr := range bulkErr.WriteErrors {
+				i := indexes[writeErr.Index]
+				fail(i, http.StatusInternalServerError, "Error saving job")
+				if !jobs[i].HostID.IsZero() {
+					unsaved = append(unsaved, i)
+				}
+			}
+			if planner != nil && len(unsaved) > 0 {
+				if err := schedul.RemoveJobsFromServers(serversCollection, batchJobs(jobs, unsaved)); err != nil {
+					log.Printf("Error reverting batch job assignments: %v", err)
+				}
+			}
+		} else if err != nil {
+			if planner != nil && len(planned) > 0 {
+				if err := schedul.RemoveJobsFromServers(serversCollection, batchJobs(jobs, planned)); err != nil {
+					log.Printf("Error reverting batch job assignments: %v", err)
+				}
+			}
+			http.Error(w, "Error saving jobs", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Задачи, сохранённые в базе, добавляются пользователю, даже если конвейер не запустился
+	var created []primitive.ObjectID
+	for i := range jobs {
+		if results[i].Status != 0 {
+			continue
+		}
+		created = append(created, jobs[i].ID)
+	}
+
+	if len(created) > 0 {
+		if err := addJobsToUser(usersCollection, id, created); err != nil {
+			http.Error(w, "Error updating user jobs", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	allClientErrors := true
+	succeeded := 0
+	for i := range jobs {
+		if results[i].Error != "" {
+			if results[i].Status >= http.StatusInternalServerError {
+				allClientErrors = false
+			}
+			continue
+		}
+		if results[i].Status != 0 {
+			succeeded++
+			continue
+		}
+		job := jobs[i]
+		if len(job.Steps) > 0 && job.Status != "scheduled" && job.Status != billing.StatusAwaitingPayment {
+			if err := pipeline.Start(jobsCollection, serversCollection, &job); err != nil {
+				// Конвейер уже сохранён, поэтому он завершается ошибкой, а не остаётся без шагов
+				log.Printf("Error starting pipeline %v: %v", job.ID, err)
+				jobSubmitted(job)
+				if err := finishJob(jobsCollection, serversCollection, job, "failed"); err != nil {
+					log.Printf("Error updating job %v: %v", job.ID, err)
+				}
+				job.Status = "failed"
+				results[i] = BatchJobResult{Index: i, Status: http.StatusInternalServerError, Job: &job, Error: "Error starting pipeline: " + err.Error()}
+				allClientErrors = false
+				continue
+			}
+		}
+		results[i].Status = http.StatusCreated
+		results[i].Job = &job
+		succeeded++
+		jobSubmitted(job)
+	}
+
+	status := http.StatusMultiStatus
+	switch {
+	case succeeded == len(jobs):
+		status = http.StatusCreated
+	case succeeded == 0 && allClientErrors:
+		status = http.StatusBadRequest
+	case succeeded == 0:
+		status = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"created": succeeded,
+		"failed":  len(jobs) - succeeded,
+		"results": results,
+	})
+}
+
+// batchJobs возвращает задачи пакета с указанными индексами.
+func batchJobs(jobs []models.Job, indexes []int) []models.Job {
+	result := make([]models.Job, 0, len(indexes))
+	for _, i := range indexes {
+		result = append(result, jobs[i])
+	}
+	return result
+}
+
+// DELETE /users/{id}/jobs/{job_id}
+func DeleteUserJob(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "id")
+	jobID := chi.URLParam(r, "jobId")
+
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	jobObjectID, err := primitive.ObjectIDFromHex(jobID)
+	if err != nil {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+
+	jobsCollection := db.GetCollection("jobs")
+	var job models.Job
+	err = jobsCollection.FindOneAndDelete(context.Background(), bson.M{"_id": jobObjectID}).Decode(&job)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, "Error deleting job", http.StatusInternalServerError)
+		return
+	}
+	// Оплаченная, но не выполненная задача отменена - администратору предлагается возврат,
+	// её минуты возвращаются в квоту плана
+	if err == nil && job.Status != "completed" {
+		proposeRefund(job, payments.RefundSourceJobCanceled)
+		if err := plans.ReleaseJob(job); err != nil {
+			log.Printf("Error releasing quota of job %v: %v", job.ID, err)
+		}
+	}
+
+	// Вместе с конвейером удаляются и задачи его шагов, а серверы освобождают их и саму задачу
+	var steps []models.Job
+	cursor, err := jobsCollection.Find(context.Background(),
+		bson.M{"parent_id": jobObjectID},
+		options.Find().SetProjection(bson.M{"_id": 1, "host_id": 1}),
+	)
+	if err == nil {
+		err = cursor.All(context.Background(), &steps)
+	}
+	if err != nil {
+		http.Error(w, "Error fetching pipeline steps", http.StatusInternalServerError)
+		return
+	}
+	_, err = jobsCollection.DeleteMany(context.Background(), bson.M{"parent_id": jobObjectID})
+	if err != nil {
+		http.Error(w, "Error deleting pipeline steps", http.StatusInternalServerError)
+		return
+	}
+	if err := schedul.RemoveJobsFromServers(db.GetCollection("servers"), append(steps, job)); err != nil {
+		log.Printf("Error releasing servers of job %v: %v", jobObjectID, err)
+	}
+
+	usersCollection := db.GetCollection("users")
+	_, err = usersCollection.UpdateOne(context.Background(),
+		bson.M{"_id": userObjectID},
+		bson.M{"$pull": bson.M{"jobs": jobObjectID}},
+	)
+	if err != nil {
+		http.Error(w, "Error updating user jobs", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+Запрос:
+POST /users/60d09c875d3b3c6b8d85a681/payments
+Content-Type: application/json
+
+Тело запроса:
+{
+	"payment_method": "credit_card",
+	"job_id": "60d09c875d3b3c6b8d85a683"
+}
+
+Для платежа за задачу цена берётся из задачи (рассчитанная при создании, а если её нет -
+по текущим правилам); переданная клиентом цена должна с ней совпадать. Платёж без задачи
+пополняет кошелёк (GET /users/{id}/balance), цена для него обязательна:
+"price": {"amount": 10000, "currency": "USD"} - сумма в минимальных единицах валюты
+(10000 = 100.00 USD), валюта - код ISO 4217.
+
+Необязательный "promo_code" уменьшает цену платежа за задачу: price в ответе - цена со скидкой,
+discount - код, сумма скидки и исходная цена. Использование промокода возвращается, если платёж
+отменён или не прошёл.
+
+Платёж создаётся в статусе pending у платёжного провайдера, статус от клиента не принимается.
+Пока по задаче есть незавершённый (pending или authorized) платёж, новый не создаётся (409):
+его нужно оплатить или отменить.
+Покупатель подтверждает оплату по checkout_url, дальше статус меняют уведомления провайдера
+(POST /payments/webhooks/{provider}): pending -> authorized -> captured -> refunded,
+отказ - failed. Авторизованный платёж списывается автоматически.
+
+Ответ:
+{
+	"id": "60d09c875d3b3c6b8d85a685",
+	"user_id": "60d09c875d3b3c6b8d85a681",
+	"price": {"amount": 10000, "currency": "USD"},
+	"payment_method": "credit_card",
+	"payment_status": "pending",
+	"created_at": "2024-12-08T12:00:00Z",
+	"updated_at": "2024-12-08T12:00:00Z",
+	"job_id": "60d09c875d3b3c6b8d85a683",
+	"provider": "mock",
+	"provider_intent_id": "mock_pi_60d09c875d3b3c6b8d85a685",
+	"checkout_url": "/payments/mock/mock_pi_60d09c875d3b3c6b8d85a685/confirm"
+}
+*/
+
+func AddPayment(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "id")
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		http.Error(w, "Invalid user ID format", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		models.Payment
+		PromoCode string `json:"promo_code"`
+	}
+	if err := render.DecodeJSON(r.Body, &request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	payment := request.Payment
+	payment.Discount = nil
+	if !payment.JobID.IsZero() {
+		price, status, err := jobPrice(objectID, payment.JobID)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if !payment.Price.IsZero() && payment.Price != price {
+			http.Error(w, "Price does not match job price "+price.String(), http.StatusBadRequest)
+			return
+		}
+		payment.Price = price
+
+		// Второй незавершённый платёж за ту же задачу списал бы её цену дважды
+		var open models.Payment
+		err = db.GetCollection(payments.Collection).FindOne(context.Background(), bson.M{
+			"job_id":         payment.JobID,
+			"payment_status": bson.M{"$in": payments.OpenStatuses},
+		}).Decode(&open)
+		if err == nil {
+			http.Error(w, "Job already has an open payment "+open.ID.Hex(), http.StatusConflict)
+			return
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Error fetching job payments", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var user models.User
+	err = db.GetCollection("users").FindOne(context.Background(), bson.M{"_id": objectID},
+		options.FindOne().SetProjection(bson.M{"plan": 1}),
+	).Decode(&user)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching user", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var discount models.Discount
+	if request.PromoCode != "" {
+		if payment.JobID.IsZero() {
+			http.Error(w, "Promo codes apply to job payments only", http.StatusBadRequest)
+			return
+		}
+		discount, err = discounts.Find(request.PromoCode)
+		if err == nil {
+			err = discounts.Check(discount, user, time.Now())
+		}
+		var amount money.Money
+		if err == nil {
+			amount, err = discounts.Amount(discount, payment.Price)
+		}
+		if err != nil {
+			writeDiscountError(w, err)
+			return
+		}
+		if amount == payment.Price {
+			http.Error(w, "Promo code covers the whole price: discounted price must be positive", http.StatusBadRequest)
+			return
+		}
+		payment.Discount = &models.AppliedDiscount{
+			DiscountID:    discount.ID,
+			Code:          discount.Code,
+			Amount:        amount,
+			OriginalPrice: payment.Price,
+		}
+		if payment.Price, err = payment.Price.Sub(amount); err != nil {
+			http.Error(w, "Error applying promo code", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := validatePayment(payment); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	payment.ID = primitive.NewObjectID()
+	payment.UserID = objectID
+	payment.CreatedAt = time.Now()
+	payment.UpdatedAt = time.Now()
+	payment.PaymentStatus = payments.StatusPending
+	payment.Provider = payments.Default.Name()
+	payment.FailureReason = ""
+	payment.AuthorizedAt, payment.CapturedAt, payment.RefundedAt = time.Time{}, time.Time{}, time.Time{}
+	payment.Refunded, payment.RefundPending = nil, nil
+
+	// Использование промокода занимается до обращения к провайдеру и освобождается, если платёж не создан
+	if payment.Discount != nil {
+		if _, err := discounts.Redeem(discount, objectID, payment, payment.Discount.Amount); err != nil {
+			writeDiscountError(w, err)
+			return
+		}
+	}
+	releaseDiscount := func() {
+		if err := discounts.Release(payment.ID); err != nil {
+			log.Printf("Error releasing promo code of payment %v: %v", payment.ID, err)
+		}
+	}
+
+	intent, err := payments.Default.CreateIntent(payment)
+	if err != nil {
+		releaseDiscount()
+		http.Error(w, "Error creating payment intent: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	payment.ProviderIntentID = intent.ID
+	payment.CheckoutURL = intent.CheckoutURL
+
+	if _, err := db.GetCollection(payments.Collection).InsertOne(context.Background(), payment); err != nil {
+		releaseDiscount()
+		if mongo.IsDuplicateKeyError(err) {
+			http.Error(w, "Job already has an open payment", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Error adding payment", http.StatusInternalServerError)
+		return
+	}
+
+	if !payment.JobID.IsZero() {
+		timeline.Record(payment.JobID, timeline.PaymentLinked, primitive.NilObjectID, timeline.Details{
+			"payment_id": payment.ID,
+			"price":      payment.Price,
+			"status":     payment.PaymentStatus,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(payment)
+}
+
+// DELETE /users/60d09c875d3b3c6b8d85a681/payments/60d09c875d3b3c6b8d85a685
+
+// Отменяет неоплаченный (pending) платёж. Платёж не удаляется, а остаётся в истории в статусе
+// canceled; платёж, по которому уже двигались деньги, отменить нельзя (409).
+func DeletePayment(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "id")
+	paymentID := chi.URLParam(r, "payment_id")
+
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		http.Error(w, "Invalid user ID format", http.StatusBadRequest)
+		return
+	}
+
+	paymentObjectID, err := primitive.ObjectIDFromHex(paymentID)
+	if err != nil {
+		http.Error(w, "Invalid payment ID format", http.StatusBadRequest)
+		return
+	}
+
+	payment, changed, err := transitionPayment(objectID, paymentObjectID, payments.StatusCanceled, "")
+	if err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			http.Error(w, "Payment not found", http.StatusNotFound)
+		case errors.Is(err, payments.ErrInvalidTransition):
+			http.Error(w, "Cannot cancel "+payment.PaymentStatus+" payment", http.StatusConflict)
+		default:
+			http.Error(w, "Error canceling payment", http.StatusInternalServerError)
+		}
+		return
+	}
+	if changed {
+		paymentCanceled(payment)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// paymentCanceled возвращает использование промокода отменённого платежа и отмечает отмену
+// в истории задачи.
+func paymentCanceled(payment models.Payment) {
+	if payment.Discount != nil {
+		if err := discounts.Release(payment.ID); err != nil {
+			log.Printf("Error releasing promo code of payment %v: %v", payment.ID, err)
+		}
+	}
+	if !payment.JobID.IsZero() {
+		timeline.Record(payment.JobID, timeline.PaymentUpdated, primitive.NilObjectID, timeline.Details{
+			"payment_id": payment.ID,
+			"status":     payment.PaymentStatus,
+		})
+	}
+}
+
+// jobDuration - оценка времени выполнения задачи
+const jobDuration = 30 * time.Second
+
+// RunJobStatusUpdater периодически обновляет статусы задач и рассылает их прогресс
+// подписчикам GET /jobs/events, чтобы клиентам не приходилось опрашивать список задач.
+func RunJobStatusUpdater(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := releaseScheduledJobs(db.GetCollection("jobs"), db.GetCollection("servers")); err != nil {
+			log.Printf("Error releasing scheduled jobs: %v", err)
+		}
+		if err := UpdateJobsStatus(db.GetCollection("jobs")); err != nil {
+			log.Printf("Error updating jobs status: %v", err)
+		}
+	}
+}
+
+// releaseScheduledJobs отправляет в работу отложенные задачи, время которых наступило.
+// Задачи сверх лимита параллельных задач плана остаются отложенными до следующей проверки.
+func releaseScheduledJobs(jobsCollection, serversCollection *mongo.Collection) error {
+	cursor, err := jobsCollection.Find(context.Background(), bson.M{
+		"status":     "scheduled",
+		"not_before": bson.M{"$lte": time.Now()},
+	}, options.Find().SetSort(bson.D{{Key: "not_before", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	var jobs []models.Job
+	if err := cursor.All(context.Background(), &jobs); err != nil {
+		return err
+	}
+
+	dispatcher := plans.NewDispatcher()
+	for i := range jobs {
+		allowed, err := dispatcher.Allow(jobs[i])
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			continue
+		}
+		if err := releaseJob(jobsCollection, serversCollection, &jobs[i], "scheduled"); err != nil {
+			log.Printf("Error releasing job %v: %v", jobs[i].ID, err)
+			releaseSlot(jobs[i])
+		}
+	}
+	return nil
+}
+
+// releaseAwaitingJobs отправляет в работу задачи пользователя, ждущие оплаты, которые
+// теперь можно выполнять: оплаченные или укладывающиеся в кредитный лимит. Старые - первыми.
+// Задачи сверх лимита параллельных задач плана откладываются (holdJob) и уходят в работу
+// через releaseScheduledJobs, когда место освободится.
+func releaseAwaitingJobs(userID primitive.ObjectID) error {
+	jobsCollection := db.GetCollection("jobs")
+	serversCollection := db.GetCollection("servers")
+
+	var user models.User
+	if err := db.GetCollection("users").FindOne(context.Background(), bson.M{"_id": userID}).Decode(&user); err != nil {
+		return err
+	}
+
+	cursor, err := jobsCollection.Find(context.Background(),
+		bson.M{"user_id": userID, "status": billing.StatusAwaitingPayment},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}),
+	)
+	if err != nil {
+		return err
+	}
+	var jobs []models.Job
+	if err := cursor.All(context.Background(), &jobs); err != nil {
+		return err
+	}
+
+	gate := billing.NewGate(user)
+	defer gate.Release()
+	dispatcher := plans.NewDispatcher()
+	for i := range jobs {
+		admitted, err := gate.Admit(jobs[i])
+		if err != nil {
+			return err
+		}
+		if !admitted {
+			continue
+		}
+		// Отложенная задача место не занимает - releaseJob оставит её ждать not_before
+		if !jobs[i].NotBefore.After(time.Now()) {
+			allowed, err := dispatcher.Allow(jobs[i])
+			if err != nil {
+				return err
+			}
+			if !allowed {
+				if err := holdJob(jobsCollection, jobs[i]); err != nil {
+					log.Printf("Error holding job %v: %v", jobs[i].ID, err)
+				}
+				continue
+			}
+		}
+		if err := releaseJob(jobsCollection, serversCollection, &jobs[i], billing.StatusAwaitingPayment); err != nil {
+			log.Printf("Error releasing job %v: %v", jobs[i].ID, err)
+			releaseSlot(jobs[i])
+		}
+	}
+	return nil
+}
+
+// releaseSlot освобождает место задачи, которая не попала в работу, в лимите параллельных задач плана.
+func releaseSlot(job models.Job) {
+	if err := plans.ReleaseSlot(job); err != nil {
+		log.Printf("Error releasing concurrency slot of job %v: %v", job.ID, err)
+	}
+}
+
+// holdJob переводит допущенную к выполнению задачу, ждавшую оплаты, в отложенные: место
+// по лимиту параллельных задач плана занято, и её отправит в работу releaseScheduledJobs.
+func holdJob(jobsCollection *mongo.Collection, job models.Job) error {
+	now := time.Now()
+	_, err := jobsCollection.UpdateOne(context.Background(),
+		bson.M{"_id": job.ID, "status": billing.StatusAwaitingPayment},
+		bson.M{"$set": bson.M{"status": "scheduled", "not_before": now, "updated_at": now}},
+	)
+	return err
+}
+
+// releaseJob отправляет в работу задачу из статуса from (отложенную или ждавшую оплаты)
+// так же, как submitUserJob - новую. Если подходящего сервера нет, задача завершается с ошибкой.
+func releaseJob(jobsCollection, serversCollection *mongo.Collection, job *models.Job, from string) error {
+	now := time.Now()
+	job.UpdatedAt = now
+	job.EstimatedFinishDatetime = now.Add(jobDuration)
+	set := bson.M{}
+
+	switch {
+	case job.NotBefore.After(now):
+		// Оплаченная отложенная задача дальше ждёт not_before
+		job.Status = "scheduled"
+		job.EstimatedFinishDatetime = job.NotBefore.Add(jobDuration)
+	case len(job.Steps) > 0:
+		pipeline.Prepare(job)
+		set["steps"] = job.Steps
+	case job.SourceLanguage == engine.AutoLanguage:
+		job.Status = "detecting_language"
+	default:
+		if err := schedul.ScheduleJob(serversCollection, job); err != nil {
+			if finishErr := finishJob(jobsCollection, serversCollection, *job, "failed"); finishErr != nil {
+				log.Printf("Error updating job %v: %v", job.ID, finishErr)
+			}
+			return err
+		}
+		job.Status = "pending"
+	}
+
+	set["status"] = job.Status
+	set["host_id"] = job.HostID
+	set["estimated_finish_datetime"] = job.EstimatedFinishDatetime
+	set["updated_at"] = now
+	// Условие на статус защищает от повторного запуска, если задачу успели удалить или изменить
+	result, err := jobsCollection.UpdateOne(context.Background(),
+		bson.M{"_id": job.ID, "status": from},
+		bson.M{"$set": set},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		if !job.HostID.IsZero() {
+			_, err = serversCollection.UpdateOne(context.Background(),
+				bson.M{"_id": job.HostID},
+				bson.M{"$pull": bson.M{"current_jobs": job.ID}},
+			)
+		}
+		return err
+	}
+
+	events.PublishJob(*job)
+	if job.Status == "scheduled" {
+		timeline.Record(job.ID, timeline.Scheduled, primitive.NilObjectID, timeline.Details{"not_before": job.NotBefore})
+		return nil
+	}
+
+	if len(job.Steps) > 0 {
+		if err := pipeline.Start(jobsCollection, serversCollection, job); err != nil {
+			if finishErr := finishJob(jobsCollection, serversCollection, *job, "failed"); finishErr != nil {
+				log.Printf("Error updating job %v: %v", job.ID, finishErr)
+			}
+			return err
+		}
+	}
+	timeline.Record(job.ID, timeline.Released, primitive.NilObjectID, nil)
+	if !job.HostID.IsZero() {
+		timeline.Record(job.ID, timeline.Assigned, job.HostID, nil)
+	}
+	return nil
+}
+
+func UpdateJobsStatus(jobsCollection *mongo.Collection) error {
+	// Родительские задачи конвейеров завершаются вместе с последним шагом
+	filter := bson.M{
+		"status":  bson.M{"$nin": []string{"completed", "failed", "scheduled", billing.StatusAwaitingPayment}},
+		"steps.0": bson.M{"$exists": false},
+	}
+
+	cursor, err := jobsCollection.Find(context.Background(), filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	currentTime := time.Now()
+	serversCollection := db.GetCollection("servers")
+	transcriptsCollection := db.GetCollection("transcripts")
+
+	// Пробегаем по задачам.
+	for cursor.Next(context.Background()) {
+		var job models.Job
+
+		if err := cursor.Decode(&job); err != nil {
+			log.Printf("Error decoding job: %v", err)
+			continue
+		}
+
+		if job.Status == "detecting_language" {
+			if err := detectJobLanguage(jobsCollection, serversCollection, &job); err != nil {
+				log.Printf("Error detecting language for job %v: %v", job.ID, err)
+			}
+			continue
+		}
+
+		// Если задача выполнена, воркер сохраняет расшифровку и переводы, затем обновляем её статус.
+		if job.EstimatedFinishDatetime.Before(currentTime) && job.Status != "completed" {
+			status := "completed"
+			g, err := jobGlossary(job)
+			if err == nil {
+				err = worker.Process(context.Background(), transcriptsCollection, job, g)
+			}
+			if err != nil {
+				log.Printf("Error processing job %v: %v", job.ID, err)
+				status = "failed"
+			}
+
+			if err := finishJob(jobsCollection, serversCollection, job, status); err != nil {
+				log.Printf("Error updating job %v: %v", job.ID, err)
+			}
+			continue
+		}
+
+		// Задача ещё выполняется - рассылаем текущий прогресс (повторы брокер отбрасывает)
+		if !job.HostID.IsZero() {
+			if err := trackJobProgress(jobsCollection, &job, currentTime); err != nil {
+				log.Printf("Error updating progress of job %v: %v", job.ID, err)
+			}
+		}
+		events.PublishJob(job)
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// detectJobLanguage определяет язык задачи с source_language "auto" и только после этого
+// выбирает сервер, поддерживающий обнаруженный язык. Для шага конвейера язык
+// сохраняется и в родительской задаче, чтобы следующие шаги его унаследовали.
+func detectJobLanguage(jobsCollection, serversCollection *mongo.Collection, job *models.Job) error {
+	detection, err := worker.DetectLanguage(context.Background(), *job)
+	if err != nil {
+		if finishErr := finishJob(jobsCollection, serversCollection, *job, "failed"); finishErr != nil {
+			log.Printf("Error updating job %v: %v", job.ID, finishErr)
+		}
+		return err
+	}
+
+	job.SourceLanguage = detection.Language
+	job.DetectedLanguage = detection.Language
+	job.LanguageConfidence = detection.Confidence
+	timeline.Record(job.ID, timeline.LanguageDetected, primitive.NilObjectID, timeline.Details{
+		"language":   detection.Language,
+		"confidence": detection.Confidence,
+	})
+
+	// Язык сохраняется до выбора сервера, чтобы не определять его повторно
+	now := time.Now()
+	languageFields := bson.M{
+		"source_language":     job.SourceLanguage,
+		"detected_language":   job.DetectedLanguage,
+		"language_confidence": job.LanguageConfidence,
+		"updated_at":          now,
+	}
+	if _, err := jobsCollection.UpdateOne(context.Background(), bson.M{"_id": job.ID}, bson.M{"$set": languageFields}); err != nil {
+		return err
+	}
+	if !job.ParentID.IsZero() {
+		if _, err := jobsCollection.UpdateOne(context.Background(), bson.M{"_id": job.ParentID}, bson.M{"$set": languageFields}); err != nil {
+			return err
+		}
+	}
+
+	// Если подходящего сервера нет, задача завершается с ошибкой, как и в releaseJob
+	if err := schedul.ScheduleJob(serversCollection, job); err != nil {
+		if finishErr := finishJob(jobsCollection, serversCollection, *job, "failed"); finishErr != nil {
+			log.Printf("Error updating job %v: %v", job.ID, finishErr)
+		}
+		return err
+	}
+
+	_, err = jobsCollection.UpdateOne(context.Background(), bson.M{"_id": job.ID}, bson.M{"$set": bson.M{
+		"status":                    "pending",
+		"host_id":                   job.HostID,
+		"estimated_finish_datetime": now.Add(jobDuration),
+	}})
+	if err != nil {
+		return err
+	}
+	timeline.Record(job.ID, timeline.Assigned, job.HostID, nil)
+
+	job.Status = "pending"
+	job.EstimatedFinishDatetime = now.Add(jobDuration)
+	events.PublishJob(*job)
+	return nil
+}
+
+// jobGlossary загружает словарь, выбранный для задачи, или возвращает nil, если словарь не задан
+// или уже удалён: задача с удалённым словарём выполняется без него.
+func jobGlossary(job models.Job) (*models.Glossary, error) {
+	if job.GlossaryID.IsZero() {
+		return nil, nil
+	}
+	g, err := findUserGlossary(glossaryOwner(job), job.GlossaryID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		log.Printf("Glossary %v of job %v not found, processing without it", job.GlossaryID.Hex(), job.ID.Hex())
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// progressStep - шаг прогресса в процентах, прохождение которого записывается в журнал задачи
+const progressStep = 25
+
+// trackJobProgress при первом обнаружении задачи на сервере переводит её в in_progress,
+// а затем сохраняет прогресс и записывает в журнал прохождение каждых progressStep процентов.
+func trackJobProgress(jobsCollection *mongo.Collection, job *models.Job, now time.Time) error {
+	set := bson.M{}
+	started := job.StartedAt.IsZero()
+	if started {
+		job.StartedAt = now
+		job.Status = "in_progress"
+		set["started_at"] = now
+		set["status"] = job.Status
+	}
+
+	progress := events.Progress(*job, now)
+	milestone := progress/progressStep > job.Progress/progressStep
+	if milestone {
+		set["progress"] = progress
+	}
+	job.Progress = progress
+
+	if len(set) == 0 {
+		return nil
+	}
+	set["updated_at"] = now
+	_, err := jobsCollection.UpdateOne(context.Background(), bson.M{"_id": job.ID}, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+
+	if started {
+		timeline.Record(job.ID, timeline.Started, job.HostID, nil)
+	}
+	if milestone {
+		timeline.Record(job.ID, timeline.Progress, job.HostID, timeline.Details{"progress": progress})
+	}
+	return nil
+}
+
+// finishJob сохраняет итоговый статус задачи (completed или failed), рассылает событие
+// и продвигает конвейер, если задача - его шаг.
+func finishJob(jobsCollection, serversCollection *mongo.Collection, job models.Job, status string) error {
+	now := time.Now()
+	update := bson.M{
+		"$set": bson.M{
+			"status":       status,
+			"completed_at": now,
+			"updated_at":   now,
+		},
+	}
+
+	_, err := jobsCollection.UpdateOne(context.Background(), bson.M{"_id": job.ID}, update)
+	if err != nil {
+		return err
+	}
+	log.Printf("Updated job %v to %s", job.ID, status)
+
+	if err := schedul.FinishJobOnServer(serversCollection, job, status == "completed"); err != nil {
+		log.Printf("Error releasing server of job %v: %v", job.ID, err)
+	}
+
+	job.Status = status
+	job.CompletedAt = now
+	events.PublishJob(job)
+	if status == "completed" {
+		timeline.Record(job.ID, timeline.Completed, job.HostID, nil)
+	} else {
+		timeline.Record(job.ID, timeline.Failed, job.HostID, nil)
+	}
+
+	// Для шага конвейера итоговым считается состояние родительской задачи
+	var parent *models.Job
+	if status == "completed" {
+		parent, err = pipeline.OnJobCompleted(jobsCollection, serversCollection, job)
+	} else {
+		parent, err = pipeline.OnJobFailed(jobsCollection, job)
+	}
+	if err != nil {
+		log.Printf("Error advancing pipeline for job %v: %v", job.ID, err)
+	}
+	if parent != nil {
+		if parent.Status == "completed" {
+			timeline.Record(parent.ID, timeline.Completed, primitive.NilObjectID, nil)
+		} else {
+			timeline.Record(parent.ID, timeline.Failed, primitive.NilObjectID, nil)
+		}
+		jobFinished(*parent)
+	} else if job.ParentID.IsZero() {
+		jobFinished(job)
+	}
+	return nil
+}
+
+// jobFinished выполняет действия после окончательного завершения задачи (или всего конвейера):
+// отправляет события на webhook пользователя.
+func jobFinished(job models.Job) {
+	if job.Status == "completed" {
+		seconds, err := mediaSeconds(job)
+		if err != nil {
+			log.Printf("Error measuring media of job %v: %v", job.ID, err)
+		}
+		job.MediaSeconds = seconds
+		chargeJob(job)
+		if err := plans.SettleJob(job); err != nil {
+			log.Printf("Error settling quota of job %v: %v", job.ID, err)
+		}
+	}
+	if job.Status == "failed" {
+		proposeRefund(job, payments.RefundSourceJobFailed)
+		if err := plans.ReleaseJob(job); err != nil {
+			log.Printf("Error releasing quota of job %v: %v", job.ID, err)
+		}
+	}
+
+	event := webhooks.EventJobCompleted
+	if job.Status == "failed" {
+		event = webhooks.EventJobFailed
+	}
+	err := webhooks.Dispatch(db.GetCollection("webhooks"), db.GetCollection("webhook_deliveries"), job.UserID, event, job)
+	if err != nil {
+		log.Printf("Error dispatching %s for job %v: %v", event, job.ID, err)
+	}
+
+	notificationType := notifications.TypeJobCompleted
+	if job.Status == "failed" {
+		notificationType = notifications.TypeJobFailed
+	}
+	err = notifications.Notify(db.GetCollection("users"), db.GetCollection("notifications"), job.UserID, notificationType, notifications.Data{
+		"job_id": job.ID.Hex(),
+		"title":  job.Title,
+	})
+	if err != nil {
+		log.Printf("Error sending %s notification for job %v: %v", notificationType, job.ID, err)
+	}
+}
+
+// validatePayment проверяет цену платежа: известная валюта и положительная сумма.
+func validatePayment(payment models.Payment) error {
+	if err := payment.Price.Validate(); err != nil {
+		return errors.New("Invalid price currency: " + err.Error())
+	}
+	if !payment.Price.IsPositive() {
+		return errors.New("Price amount must be positive")
+	}
+	return nil
+}
+
+// jobPrice возвращает цену задачи пользователя для платежа: сохранённую при создании задачи
+// или рассчитанную по текущим правилам. Вторым значением возвращается HTTP-статус ошибки.
+func jobPrice(userID, jobID primitive.ObjectID) (money.Money, int, error) {
+	var job models.Job
+	err := db.GetCollection("jobs").FindOne(context.Background(), bson.M{"_id": jobID, "user_id": userID}).Decode(&job)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return money.Money{}, http.StatusNotFound, errors.New("Job not found")
+		}
+		return money.Money{}, http.StatusInternalServerError, errors.New("Error fetching job")
+	}
+	if !job.PaidAt.IsZero() {
+		return money.Money{}, http.StatusConflict, errors.New("Job is already paid")
+	}
+	if job.Price != nil {
+		return *job.Price, 0, nil
+	}
+
+	var user models.User
+	if err := db.GetCollection("users").FindOne(context.Background(), bson.M{"_id": userID}).Decode(&user); err != nil {
+		return money.Money{}, http.StatusInternalServerError, errors.New("Error fetching user")
+	}
+	quote, err := pricing.QuoteJob(user, job)
+	if err != nil {
+		if errors.Is(err, pricing.ErrUnknownDuration) {
+			return money.Money{}, http.StatusBadRequest, errors.New("Cannot price job: duration is unknown")
+		}
+		return money.Money{}, http.StatusInternalServerError, errors.New("Error pricing job")
+	}
+	return quote.Total, 0, nil
+}
+
+// paymentFailed возвращает использование промокода и уведомляет пользователя о неудачном платеже.
+func paymentFailed(userID primitive.ObjectID, payment models.Payment) {
+	if payment.Discount != nil {
+		if err := discounts.Release(payment.ID); err != nil {
+			log.Printf("Error releasing promo code of payment %v: %v", payment.ID, err)
+		}
+	}
+	data := notifications.Data{
+		"payment_id":     payment.ID.Hex(),
+		"price":          payment.Price.String(),
+		"payment_method": payment.PaymentMethod,
+	}
+	if !payment.JobID.IsZero() {
+		data["job_id"] = payment.JobID.Hex()
+	}
+	err := notifications.Notify(db.GetCollection("users"), db.GetCollection("notifications"), userID, notifications.TypePaymentFailed, data)
+	if err != nil {
+		log.Printf("Error sending %s notification for payment %v: %v", notifications.TypePaymentFailed, payment.ID, err)
+	}
 }
@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/webhooks"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// GET /users/{id}/webhooks
+func GetUserWebhooks(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	cursor, err := db.GetCollection("webhooks").Find(context.Background(), bson.M{"user_id": userID})
+	if err != nil {
+		http.Error(w, "Error fetching webhooks", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	hooks := []models.Webhook{}
+	if err := cursor.All(context.Background(), &hooks); err != nil {
+		http.Error(w, "Error decoding webhooks", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hooks)
+}
+
+/*
+POST /users/{id}/webhooks
+{
+	"url": "https://example.com/hooks/transcription",
+	"events": ["job.completed", "job.failed", "payment.succeeded"]
+}
+
+Адрес должен быть http или https и указывать на публичный узел: loopback, частные сети
+и link-local отклоняются, в том числе если имя узла разрешается в такой адрес. При отправке
+адрес проверяется снова. Если secret не передан, он генерируется. Секрет возвращается только в ответе на создание,
+в остальных ответах его нет. Каждый запрос на webhook
+содержит заголовки X-Webhook-Event, X-Webhook-Delivery, X-Webhook-Timestamp и
+X-Webhook-Signature: sha256=HMAC-SHA256(secret, "<timestamp>.<тело запроса>").
+*/
+
+func CreateUserWebhook(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var request webhookRequest
+	if err := render.DecodeJSON(r.Body, &request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	hook := models.Webhook{URL: request.URL, Events: request.Events, Secret: request.Secret}
+	if err := validateWebhook(hook); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if hook.Secret == "" {
+		hook.Secret, err = webhooks.NewSecret()
+		if err != nil {
+			http.Error(w, "Error generating secret", http.StatusInternalServerError)
+			return
+		}
+	}
+	hook.ID = primitive.NewObjectID()
+	hook.UserID = userID
+	hook.Active = true
+	hook.CreatedAt = time.Now()
+	hook.UpdatedAt = hook.CreatedAt
+
+	_, err = db.GetCollection("webhooks").InsertOne(context.Background(), hook)
+	if err != nil {
+		http.Error(w, "Error saving webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		models.Webhook
+		Secret string `json:"secret"`
+	}{hook, hook.Secret})
+}
+
+/*
+PUT /users/{id}/webhooks/{webhook_id}
+{
+	"url": "https://example.com/hooks/transcription",
+	"events": ["job.completed"],
+	"active": false
+}
+
+Поля active и secret необязательны: без них webhook остаётся в прежнем состоянии и со старым секретом.
+*/
+
+func UpdateUserWebhook(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	webhookID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "webhook_id"))
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	var request webhookRequest
+	if err := render.DecodeJSON(r.Body, &request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if err := validateWebhook(models.Webhook{URL: request.URL, Events: request.Events}); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	set := bson.M{
+		"url":        request.URL,
+		"events":     request.Events,
+		"updated_at": time.Now(),
+	}
+	if request.Active != nil {
+		set["active"] = *request.Active
+	}
+	if request.Secret != "" {
+		set["secret"] = request.Secret
+	}
+
+	var updated models.Webhook
+	err = db.GetCollection("webhooks").FindOneAndUpdate(context.Background(),
+		bson.M{"_id": webhookID, "user_id": userID},
+		bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error updating webhook", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// DELETE /users/{id}/webhooks/{webhook_id}
+func DeleteUserWebhook(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	webhookID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "webhook_id"))
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.GetCollection("webhooks").DeleteOne(context.Background(), bson.M{"_id": webhookID, "user_id": userID})
+	if err != nil {
+		http.Error(w, "Error deleting webhook", http.StatusInternalServerError)
+		return
+	}
+	if result.DeletedCount == 0 {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /users/{id}/webhooks/{webhook_id}/deliveries?status=failed&page=1&page_size=20
+
+// Журнал доставок webhook, новые сверху
+func GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	webhookID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "webhook_id"))
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	queryParams := r.URL.Query()
+	filter := bson.M{"webhook_id": webhookID, "user_id": userID}
+	if status := queryParams.Get("status"); status != "" {
+		filter["status"] = status
+	}
+
+	var pageNum, pageSize int64 = 1, 20
+	if page := queryParams.Get("page"); page != "" {
+		pageNum, err = strconv.ParseInt(page, 10, 64)
+		if err != nil || pageNum <= 0 {
+			http.Error(w, "Invalid page parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if size := queryParams.Get("page_size"); size != "" {
+		pageSize, err = strconv.ParseInt(size, 10, 64)
+		if err != nil || pageSize <= 0 {
+			http.Error(w, "Invalid page_size parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetSkip((pageNum - 1) * pageSize).
+		SetLimit(pageSize)
+	cursor, err := db.GetCollection("webhook_deliveries").Find(context.Background(), filter, opts)
+	if err != nil {
+		http.Error(w, "Error fetching deliveries", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	deliveries := []models.WebhookDelivery{}
+	if err := cursor.All(context.Background(), &deliveries); err != nil {
+		http.Error(w, "Error decoding deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// POST /users/{id}/webhooks/{webhook_id}/deliveries/{delivery_id}/redeliver
+
+// Повторно отправляет доставку (в том числе успешную или исчерпавшую попытки) и возвращает её
+// результат. Отправка добавляется в историю попыток доставки с отметкой manual.
+func RedeliverWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	webhookID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "webhook_id"))
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+	deliveryID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "delivery_id"))
+	if err != nil {
+		http.Error(w, "Invalid delivery ID", http.StatusBadRequest)
+		return
+	}
+
+	var hook models.Webhook
+	err = db.GetCollection("webhooks").FindOne(context.Background(), bson.M{"_id": webhookID, "user_id": userID}).Decode(&hook)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching webhook", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	deliveriesCollection := db.GetCollection("webhook_deliveries")
+	var delivery models.WebhookDelivery
+	err = deliveriesCollection.FindOne(context.Background(), bson.M{"_id": deliveryID, "webhook_id": webhookID}).Decode(&delivery)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, "Delivery not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching delivery", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	delivery, err = webhooks.Redeliver(deliveriesCollection, hook, delivery)
+	if err != nil {
+		http.Error(w, "Error saving delivery", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(delivery)
+}
+
+// webhookRequest - тело POST и PUT /users/{id}/webhooks. Секрет принимается только во входящих
+// запросах, поэтому в models.Webhook он не сериализуется в JSON.
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+	Active *bool    `json:"active"`
+}
+
+func validateWebhook(hook models.Webhook) error {
+	if err := webhooks.ValidateURL(hook.URL); err != nil {
+		return errors.New("Invalid webhook URL: " + err.Error())
+	}
+	if len(hook.Events) == 0 {
+		return errors.New("At least one event is required")
+	}
+	for _, event := range hook.Events {
+		if !webhooks.IsKnownEvent(event) {
+			return errors.New("Unknown event: " + event)
+		}
+	}
+	return nil
+}
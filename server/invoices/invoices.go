@@ -0,0 +1,315 @@
+package invoices
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/money"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collection - коллекция счетов
+const Collection = "invoices"
+
+// DefaultInterval - период проверки, выставлены ли счета за прошедший месяц
+const DefaultInterval = time.Hour
+
+// Типы строк счёта
+const (
+	LineJob      = "job"
+	LinePayment  = "payment"
+	LineRefund   = "refund"
+	LineDiscount = "discount"
+)
+
+var (
+	// ErrPeriodNotEnded - счёт за текущий или будущий период выставить нельзя
+	ErrPeriodNotEnded = errors.New("billing period has not ended yet")
+	ErrInvalidPeriod  = errors.New("invalid billing period, expected YYYY-MM")
+)
+
+// Period возвращает границы расчётного месяца [start, end) в UTC.
+func Period(month time.Time) (time.Time, time.Time) {
+	start := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// ParsePeriod разбирает месяц в формате YYYY-MM.
+func ParsePeriod(value string) (time.Time, error) {
+	month, err := time.Parse("2006-01", value)
+	if err != nil {
+		return time.Time{}, ErrInvalidPeriod
+	}
+	return month, nil
+}
+
+// Run раз в interval выставляет счета всем пользователям за прошедший месяц.
+// Уже выставленные счета не создаются повторно, поэтому пропущенный из-за простоя месяц
+// будет обработан при следующем запуске.
+func Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		// AddDate(0, -1, 0) 31 марта дал бы 3 марта, поэтому месяц считается от первого числа
+		utc := now.UTC()
+		previous := time.Date(utc.Year(), utc.Month()-1, 1, 0, 0, 0, 0, time.UTC)
+		if err := GenerateAll(previous, now); err != nil {
+			log.Printf("Error generating invoices: %v", err)
+		}
+	}
+}
+
+// GenerateAll выставляет счета за месяц month всем пользователям, у которых в нём были начисления или платежи.
+func GenerateAll(month, now time.Time) error {
+	cursor, err := db.GetCollection("users").Find(context.Background(), bson.M{},
+		options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var users []models.User
+	if err := cursor.All(context.Background(), &users); err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if _, err := Generate(user.ID, month, now); err != nil {
+			log.Printf("Error generating invoices of user %v for %s: %v", user.ID, month.Format("2006-01"), err)
+		}
+	}
+	return nil
+}
+
+// Generate выставляет пользователю счета за месяц month - по одному на каждую валюту, в которой
+// были начисления или платежи. Для валют, по которым счёт уже выставлен, возвращается существующий.
+func Generate(userID primitive.ObjectID, month, now time.Time) ([]models.Invoice, error) {
+	start, end := Period(month)
+	if end.After(now) {
+		return nil, ErrPeriodNotEnded
+	}
+
+	lines, err := collectLines(userID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	currencies := []string{}
+	for currency := range lines {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+
+	invoices := []models.Invoice{}
+	for _, currency := range currencies {
+		invoice, err := issue(userID, start, end, currency, lines[currency])
+		if err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, invoice)
+	}
+	return invoices, nil
+}
+
+// issue сохраняет счёт и присваивает ему очередной номер. Если счёт за период и валюту уже есть
+// (в том числе выставленный параллельно), возвращает его. Номер выдаётся только после того, как
+// счёт сохранён, поэтому проигравший параллельный запрос не оставляет пропуска в нумерации.
+func issue(userID primitive.ObjectID, start, end time.Time, currency string, lines []models.InvoiceLine) (models.Invoice, error) {
+	collection := db.GetCollection(Collection)
+	filter := bson.M{"user_id": userID, "period_start": start, "currency": currency}
+
+	var existing models.Invoice
+	err := collection.FindOne(context.Background(), filter).Decode(&existing)
+	if err == nil {
+		return number(existing)
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return models.Invoice{}, err
+	}
+
+	invoice := models.Invoice{
+		ID:          primitive.NewObjectID(),
+		UserID:      userID,
+		PeriodStart: start,
+		PeriodEnd:   end,
+		Currency:    currency,
+		Lines:       lines,
+		Charges:     money.New(0, currency),
+		Payments:    money.New(0, currency),
+		CreatedAt:   time.Now(),
+	}
+	for _, line := range lines {
+		switch line.Type {
+		case LinePayment, LineRefund:
+			// Сумма строки возврата отрицательная - она уменьшает зачтённые платежи
+			invoice.Payments, err = invoice.Payments.Add(line.Amount)
+		default:
+			// Скидка тоже отрицательная и уменьшает начисления
+			invoice.Charges, err = invoice.Charges.Add(line.Amount)
+		}
+		if err != nil {
+			return models.Invoice{}, err
+		}
+	}
+	if invoice.AmountDue, err = invoice.Charges.Sub(invoice.Payments); err != nil {
+		return models.Invoice{}, err
+	}
+
+	if _, err := collection.InsertOne(context.Background(), invoice); err != nil {
+		if !mongo.IsDuplicateKeyError(err) {
+			return models.Invoice{}, err
+		}
+		if err := collection.FindOne(context.Background(), filter).Decode(&existing); err != nil {
+			return models.Invoice{}, err
+		}
+		return number(existing)
+	}
+	return number(invoice)
+}
+
+// number присваивает номер сохранённому счёту без номера. Счёт остаётся без номера, только если
+// сервис упал сразу после его сохранения; номер тогда выдаётся при следующем обращении к счёту.
+func number(invoice models.Invoice) (models.Invoice, error) {
+	if invoice.Number != "" {
+		return invoice, nil
+	}
+	number, err := nextNumber(invoice.PeriodStart.Year())
+	if err != nil {
+		return models.Invoice{}, err
+	}
+	collection := db.GetCollection(Collection)
+	result, err := collection.UpdateOne(context.Background(),
+		bson.M{"_id": invoice.ID, "number": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"number": number}},
+	)
+	if err != nil {
+		return models.Invoice{}, err
+	}
+	if result.ModifiedCount == 0 {
+		// Номер успел присвоить параллельный запрос
+		err = collection.FindOne(context.Background(), bson.M{"_id": invoice.ID}).Decode(&invoice)
+		return invoice, err
+	}
+	invoice.Number = number
+	return invoice, nil
+}
+
+// nextNumber атомарно выдаёт следующий номер счёта. Нумерация ведётся отдельно для каждого года.
+func nextNumber(year int) (string, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := db.GetCollection("counters").FindOneAndUpdate(context.Background(),
+		bson.M{"_id": fmt.Sprintf("invoice-%d", year)},
+		bson.M{"$inc": bson.M{"seq": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("INV-%d-%06d", year, counter.Seq), nil
+}
+
+// collectLines собирает строки счетов за период по валютам: выполненные задачи с ценой
+// (без шагов конвейера - оплачивается родительская задача), списанные платежи со скидками по промокодам
+// и выполненные возвраты.
+func collectLines(userID primitive.ObjectID, start, end time.Time) (map[string][]models.InvoiceLine, error) {
+	lines := map[string][]models.InvoiceLine{}
+
+	cursor, err := db.GetCollection("jobs").Find(context.Background(), bson.M{
+		"user_id":      userID,
+		"status":       "completed",
+		"completed_at": bson.M{"$gte": start, "$lt": end},
+		"price":        bson.M{"$exists": true},
+		"parent_id":    bson.M{"$exists": false},
+	}, options.Find().SetSort(bson.D{{Key: "completed_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var jobs []models.Job
+	if err := cursor.All(context.Background(), &jobs); err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		seconds := job.MediaSeconds
+		if seconds == 0 {
+			seconds = job.DurationSeconds
+		}
+		lines[job.Price.Currency] = append(lines[job.Price.Currency], models.InvoiceLine{
+			Type:        LineJob,
+			Date:        job.CompletedAt,
+			Description: job.Title,
+			Quantity:    math.Ceil(seconds / 60),
+			Amount:      *job.Price,
+			JobID:       job.ID,
+		})
+	}
+
+	cursor, err = db.GetCollection("payments").Find(context.Background(), bson.M{
+		"user_id":     userID,
+		"captured_at": bson.M{"$gte": start, "$lt": end},
+	}, options.Find().SetSort(bson.D{{Key: "captured_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var payments []models.Payment
+	if err := cursor.All(context.Background(), &payments); err != nil {
+		return nil, err
+	}
+	for _, payment := range payments {
+		description := "Payment (" + payment.PaymentMethod + ")"
+		if payment.JobID.IsZero() {
+			description = "Wallet top-up (" + payment.PaymentMethod + ")"
+		}
+		lines[payment.Price.Currency] = append(lines[payment.Price.Currency], models.InvoiceLine{
+			Type:        LinePayment,
+			Date:        payment.CapturedAt,
+			Description: description,
+			Amount:      payment.Price,
+			PaymentID:   payment.ID,
+		})
+		// Скидка по промокоду уменьшает начисление за задачу
+		if payment.Discount != nil {
+			lines[payment.Price.Currency] = append(lines[payment.Price.Currency], models.InvoiceLine{
+				Type:        LineDiscount,
+				Date:        payment.CapturedAt,
+				Description: "Promo code " + payment.Discount.Code,
+				Amount:      money.New(-payment.Discount.Amount.Amount, payment.Discount.Amount.Currency),
+				JobID:       payment.JobID,
+				PaymentID:   payment.ID,
+			})
+		}
+	}
+
+	cursor, err = db.GetCollection("refunds").Find(context.Background(), bson.M{
+		"user_id":      userID,
+		"status":       "succeeded",
+		"completed_at": bson.M{"$gte": start, "$lt": end},
+	}, options.Find().SetSort(bson.D{{Key: "completed_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var refunds []models.Refund
+	if err := cursor.All(context.Background(), &refunds); err != nil {
+		return nil, err
+	}
+	for _, refund := range refunds {
+		lines[refund.Amount.Currency] = append(lines[refund.Amount.Currency], models.InvoiceLine{
+			Type:        LineRefund,
+			Date:        refund.CompletedAt,
+			Description: "Refund (" + refund.Reason + ")",
+			Amount:      money.New(-refund.Amount.Amount, refund.Amount.Currency),
+			JobID:       refund.JobID,
+			PaymentID:   refund.PaymentID,
+		})
+	}
+	return lines, nil
+}
@@ -0,0 +1,192 @@
+package invoices
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/money"
+	"strconv"
+	"strings"
+)
+
+// Форматы выгрузки счёта
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+	FormatPDF  = "pdf"
+)
+
+// Render формирует файл счёта в формате CSV или PDF.
+// Возвращает содержимое файла и его Content-Type.
+func Render(invoice models.Invoice, format string) ([]byte, string, error) {
+	switch format {
+	case FormatCSV:
+		data, err := renderCSV(invoice)
+		return data, "text/csv; charset=utf-8", err
+	case FormatPDF:
+		return renderPDF(invoice), "application/pdf", nil
+	default:
+		return nil, "", fmt.Errorf("unsupported format %q", format)
+	}
+}
+
+func renderCSV(invoice models.Invoice) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+
+	records := [][]string{
+		{"invoice", invoice.Number},
+		{"period", invoice.PeriodStart.Format("2006-01-02"), invoice.PeriodEnd.AddDate(0, 0, -1).Format("2006-01-02")},
+		{},
+		{"date", "type", "description", "minutes", "amount", "currency"},
+	}
+	for _, line := range invoice.Lines {
+		minutes := ""
+		if line.Quantity > 0 {
+			minutes = strconv.FormatFloat(line.Quantity, 'f', -1, 64)
+		}
+		records = append(records, []string{
+			line.Date.Format("2006-01-02"),
+			line.Type,
+			line.Description,
+			minutes,
+			line.Amount.Decimal(),
+			line.Amount.Currency,
+		})
+	}
+	records = append(records,
+		[]string{},
+		[]string{"charges", invoice.Charges.Decimal(), invoice.Currency},
+		[]string{"payments", invoice.Payments.Decimal(), invoice.Currency},
+		[]string{"amount_due", invoice.AmountDue.Decimal(), invoice.Currency},
+	)
+
+	if err := writer.WriteAll(records); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Параметры страницы PDF: A4, моноширинный шрифт, чтобы колонки выравнивались пробелами
+const (
+	pdfPageWidth    = 595
+	pdfPageHeight   = 842
+	pdfMargin       = 50
+	pdfFontSize     = 8
+	pdfLineHeight   = 12
+	pdfLinesPerPage = (pdfPageHeight - 2*pdfMargin) / pdfLineHeight
+)
+
+// renderPDF формирует простой PDF без внешних зависимостей: текстовые строки шрифтом Courier.
+// Стандартный шрифт поддерживает только Latin-1, остальные символы заменяются на "?".
+func renderPDF(invoice models.Invoice) []byte {
+	text := []string{
+		"INVOICE " + invoice.Number,
+		"",
+		"Customer: " + invoice.UserID.Hex(),
+		"Period:   " + invoice.PeriodStart.Format("2006-01-02") + " - " + invoice.PeriodEnd.AddDate(0, 0, -1).Format("2006-01-02"),
+		"Issued:   " + invoice.CreatedAt.Format("2006-01-02"),
+		"",
+		fmt.Sprintf("%-10s  %-8s  %-46s  %7s  %14s", "Date", "Type", "Description", "Minutes", "Amount"),
+		strings.Repeat("-", 93),
+	}
+	for _, line := range invoice.Lines {
+		minutes := ""
+		if line.Quantity > 0 {
+			minutes = strconv.FormatFloat(line.Quantity, 'f', -1, 64)
+		}
+		// Платежи уменьшают сумму к оплате, возвраты - увеличивают
+		amount := line.Amount.Decimal()
+		if line.Type == LinePayment || line.Type == LineRefund {
+			amount = negate(line.Amount).Decimal()
+		}
+		text = append(text, fmt.Sprintf("%-10s  %-8s  %-46s  %7s  %14s",
+			line.Date.Format("2006-01-02"), line.Type, truncate(line.Description, 46), minutes, amount))
+	}
+	text = append(text,
+		strings.Repeat("-", 93),
+		fmt.Sprintf("%77s  %14s", "Charges", invoice.Charges.Decimal()),
+		fmt.Sprintf("%77s  %14s", "Payments", negate(invoice.Payments).Decimal()),
+		fmt.Sprintf("%77s  %14s", "Amount due ("+invoice.Currency+")", invoice.AmountDue.Decimal()),
+	)
+
+	var pages [][]string
+	for len(text) > pdfLinesPerPage {
+		pages = append(pages, text[:pdfLinesPerPage])
+		text = text[pdfLinesPerPage:]
+	}
+	pages = append(pages, text)
+
+	// Объекты: 1 - каталог, 2 - дерево страниц, 3 - шрифт, далее по паре (страница, содержимое)
+	var objects []string
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>",
+	)
+	for i, lines := range pages {
+		var content bytes.Buffer
+		fmt.Fprintf(&content, "BT /F1 %d Tf %d TL %d %d Td\n", pdfFontSize, pdfLineHeight, pdfMargin, pdfPageHeight-pdfMargin)
+		for _, line := range lines {
+			content.WriteString("(" + pdfString(line) + ") Tj T*\n")
+		}
+		content.WriteString("ET")
+
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+				pdfPageWidth, pdfPageHeight, 5+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()),
+		)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+// pdfString экранирует строку для строкового литерала PDF в кодировке WinAnsi.
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 32 && r < 127:
+			b.WriteRune(r)
+		case r >= 160 && r <= 255:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-3]) + "..."
+}
+
+func negate(m money.Money) money.Money {
+	return money.New(-m.Amount, m.Currency)
+}
@@ -0,0 +1,438 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/money"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collection - коллекция журнала. Записи только добавляются.
+const Collection = "ledger_entries"
+
+// Счета. Счёт кошелька ведётся отдельно для каждого пользователя (поле user_id записи).
+const (
+	AccountWallet      = "wallet"
+	AccountCash        = "cash"
+	AccountRevenue     = "revenue"
+	AccountAdjustments = "adjustments"
+)
+
+// Типы проводок
+const (
+	TypeTopUp      = "topup"
+	TypeJobCharge  = "job_charge"
+	TypeRefund     = "refund"
+	TypeAdjustment = "adjustment"
+	TypePayment    = "payment"
+)
+
+var (
+	ErrNoWallet          = errors.New("wallet is empty")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrCurrencyMismatch  = errors.New("wallet currency mismatch")
+	ErrUserNotFound      = errors.New("user not found")
+	// ErrDuplicate - проводка с тем же ключом уже есть, повторно она не создаётся
+	ErrDuplicate = errors.New("transaction already posted")
+)
+
+// Posting - проводка: Amount зачисляется на счёт Account (отрицательная сумма списывается),
+// противоположная сумма записывается на счёт Counter. Пустой Account - кошелёк пользователя UserID.
+type Posting struct {
+	UserID      primitive.ObjectID
+	Type        string
+	Amount      money.Money
+	Account     string
+	Counter     string
+	JobID       primitive.ObjectID
+	PaymentID   primitive.ObjectID
+	Description string
+	Key         string
+}
+
+// Post записывает проводку в журнал. Для проводки по кошельку баланс меняется атомарно,
+// списание больше баланса отклоняется. Повтор проводки с тем же ключом отклоняется до изменения
+// баланса. Баланс меняется первым; если запись в журнал не удалась, изменение баланса отменяется
+// встречным, а уже сохранённые записи - сторнирующими (см. reverse). Записи журнала не удаляются,
+// расхождение, оставшееся после сбоя между шагами, покажет Reconcile.
+func Post(posting Posting) (primitive.ObjectID, error) {
+	if err := posting.Amount.Validate(); err != nil {
+		return primitive.NilObjectID, err
+	}
+	if posting.Amount.IsZero() {
+		return primitive.NilObjectID, errors.New("amount must not be zero")
+	}
+
+	if posting.Account == "" {
+		posting.Account = AccountWallet
+	}
+
+	entriesCollection := db.GetCollection(Collection)
+	if posting.Key != "" {
+		count, err := entriesCollection.CountDocuments(context.Background(), bson.M{"key": posting.Key}, options.Count().SetLimit(1))
+		if err != nil {
+			return primitive.NilObjectID, err
+		}
+		if count > 0 {
+			return primitive.NilObjectID, ErrDuplicate
+		}
+	}
+
+	wallet := posting.Account == AccountWallet
+	if wallet {
+		if err := changeBalance(posting.UserID, posting.Amount); err != nil {
+			return primitive.NilObjectID, err
+		}
+	}
+
+	now := time.Now()
+	transactionID := primitive.NewObjectID()
+	entries := []interface{}{
+		models.LedgerEntry{
+			ID:            primitive.NewObjectID(),
+			TransactionID: transactionID,
+			Account:       posting.Account,
+			UserID:        posting.UserID,
+			Type:          posting.Type,
+			Amount:        posting.Amount,
+			JobID:         posting.JobID,
+			PaymentID:     posting.PaymentID,
+			Description:   posting.Description,
+			Key:           posting.Key,
+			CreatedAt:     now,
+		},
+		models.LedgerEntry{
+			ID:            primitive.NewObjectID(),
+			TransactionID: transactionID,
+			Account:       posting.Counter,
+			Type:          posting.Type,
+			Amount:        posting.Amount.Neg(),
+			JobID:         posting.JobID,
+			PaymentID:     posting.PaymentID,
+			Description:   posting.Description,
+			CreatedAt:     now,
+		},
+	}
+	_, err := entriesCollection.InsertMany(context.Background(), entries)
+	if err == nil {
+		return transactionID, nil
+	}
+
+	if wallet {
+		if revertErr := changeBalance(posting.UserID, posting.Amount.Neg()); revertErr != nil {
+			log.Printf("Error reverting wallet balance of user %v: %v", posting.UserID, revertErr)
+		}
+	}
+	// Ключ записан на первой записи, поэтому при одновременном повторе не вставляется ни одна запись
+	if mongo.IsDuplicateKeyError(err) {
+		return primitive.NilObjectID, ErrDuplicate
+	}
+	// Вставка по порядку могла сохранить только первую запись
+	if reverseErr := reverse(transactionID); reverseErr != nil {
+		log.Printf("Error reversing entries of transaction %v: %v", transactionID, reverseErr)
+	}
+	return primitive.NilObjectID, err
+}
+
+// reverse сторнирует сохранённые записи проводки, которую не удалось провести до конца:
+// добавляет записи с противоположными суммами в отдельной проводке со ссылкой reversal_of
+// и освобождает ключ идемпотентности, чтобы проводку можно было повторить.
+func reverse(transactionID primitive.ObjectID) error {
+	entriesCollection := db.GetCollection(Collection)
+	cursor, err := entriesCollection.Find(context.Background(), bson.M{"transaction_id": transactionID})
+	if err != nil {
+		return err
+	}
+	var saved []models.LedgerEntry
+	if err := cursor.All(context.Background(), &saved); err != nil {
+		return err
+	}
+	if len(saved) == 0 {
+		return nil
+	}
+
+	reversals := reversalEntries(saved, primitive.NewObjectID(), time.Now())
+	if _, err := entriesCollection.InsertMany(context.Background(), reversals); err != nil {
+		return err
+	}
+	_, err = entriesCollection.UpdateMany(context.Background(),
+		bson.M{"transaction_id": transactionID, "key": bson.M{"$exists": true}},
+		bson.M{"$rename": bson.M{"key": "reversed_key"}},
+	)
+	return err
+}
+
+// reversalEntries возвращает сторнирующие записи для записей проводки.
+func reversalEntries(entries []models.LedgerEntry, transactionID primitive.ObjectID, now time.Time) []interface{} {
+	reversals := make([]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		reversals = append(reversals, models.LedgerEntry{
+			ID:            primitive.NewObjectID(),
+			TransactionID: transactionID,
+			Account:       entry.Account,
+			UserID:        entry.UserID,
+			Type:          entry.Type,
+			Amount:        entry.Amount.Neg(),
+			JobID:         entry.JobID,
+			PaymentID:     entry.PaymentID,
+			Description:   "reversal of a failed posting",
+			ReversalOf:    entry.TransactionID,
+			CreatedAt:     now,
+		})
+	}
+	return reversals
+}
+
+// TopUp зачисляет на кошелёк списанный платёж.
+func TopUp(userID primitive.ObjectID, payment models.Payment) (primitive.ObjectID, error) {
+	return Post(Posting{
+		UserID:    userID,
+		Type:      TypeTopUp,
+		Amount:    payment.Price,
+		Counter:   AccountCash,
+		PaymentID: payment.ID,
+		Key:       TypeTopUp + ":" + payment.ID.Hex(),
+	})
+}
+
+// CapturePayment записывает выручку от списанного платежа за задачу.
+func CapturePayment(payment models.Payment) (primitive.ObjectID, error) {
+	return Post(Posting{
+		UserID:    payment.UserID,
+		Type:      TypePayment,
+		Amount:    payment.Price,
+		Account:   AccountRevenue,
+		Counter:   AccountCash,
+		JobID:     payment.JobID,
+		PaymentID: payment.ID,
+		Key:       TypePayment + ":" + payment.ID.Hex(),
+	})
+}
+
+// RefundPayment записывает возврат части или всего платежа. Возврат платежа за задачу уменьшает
+// выручку, возврат пополнения списывается с кошелька (если баланса не хватает - ErrInsufficientFunds).
+func RefundPayment(payment models.Payment, refundID primitive.ObjectID, amount money.Money, reason string) (primitive.ObjectID, error) {
+	posting := Posting{
+		UserID:      payment.UserID,
+		Type:        TypeRefund,
+		Amount:      amount.Neg(),
+		Counter:     AccountCash,
+		JobID:       payment.JobID,
+		PaymentID:   payment.ID,
+		Description: reason,
+		Key:         TypeRefund + ":" + refundID.Hex(),
+	}
+	if !payment.JobID.IsZero() {
+		posting.Account = AccountRevenue
+	}
+	return Post(posting)
+}
+
+// ReverseRefund возвращает на кошелёк сумму возврата пополнения, который провайдер не выполнил.
+func ReverseRefund(payment models.Payment, refundID primitive.ObjectID, amount money.Money) (primitive.ObjectID, error) {
+	return Post(Posting{
+		UserID:      payment.UserID,
+		Type:        TypeRefund,
+		Amount:      amount,
+		Counter:     AccountCash,
+		PaymentID:   payment.ID,
+		Description: "refund failed",
+		Key:         TypeRefund + ":" + refundID.Hex() + ":reversal",
+	})
+}
+
+// ChargeJob списывает с кошелька стоимость задачи. Каждая задача списывается не больше одного раза.
+func ChargeJob(userID, jobID primitive.ObjectID, amount money.Money) (primitive.ObjectID, error) {
+	return Post(Posting{
+		UserID:  userID,
+		Type:    TypeJobCharge,
+		Amount:  amount.Neg(),
+		Counter: AccountRevenue,
+		JobID:   jobID,
+		Key:     TypeJobCharge + ":" + jobID.Hex(),
+	})
+}
+
+// ChargeSurcharge списывает с кошелька доплату за оплаченную задачу, фактическая длительность
+// которой больше заявленной. Доплата по задаче списывается не больше одного раза.
+func ChargeSurcharge(userID, jobID primitive.ObjectID, amount money.Money) (primitive.ObjectID, error) {
+	return Post(Posting{
+		UserID:      userID,
+		Type:        TypeJobCharge,
+		Amount:      amount.Neg(),
+		Counter:     AccountRevenue,
+		JobID:       jobID,
+		Description: "surcharge for actual duration",
+		Key:         TypeJobCharge + ":" + jobID.Hex() + ":surcharge",
+	})
+}
+
+// Adjust корректирует баланс вручную (положительная сумма зачисляется, отрицательная списывается).
+func Adjust(userID primitive.ObjectID, amount money.Money, description string) (primitive.ObjectID, error) {
+	return Post(Posting{
+		UserID:      userID,
+		Type:        TypeAdjustment,
+		Amount:      amount,
+		Counter:     AccountAdjustments,
+		Description: description,
+	})
+}
+
+// changeBalance атомарно прибавляет amount к балансу. Кошелёк создаётся при первом зачислении
+// в валюте этого зачисления; баланс не может стать отрицательным.
+func changeBalance(userID primitive.ObjectID, amount money.Money) error {
+	usersCollection := db.GetCollection("users")
+	now := time.Now()
+
+	if amount.IsPositive() {
+		_, err := usersCollection.UpdateOne(context.Background(),
+			bson.M{"_id": userID, "wallet": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"wallet": models.Wallet{Balance: money.New(0, amount.Currency), UpdatedAt: now}}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	filter := bson.M{"_id": userID, "wallet.balance.currency": amount.Currency}
+	if !amount.IsPositive() {
+		filter["wallet.balance.amount"] = bson.M{"$gte": -amount.Amount}
+	}
+	result, err := usersCollection.UpdateOne(context.Background(), filter, bson.M{
+		"$inc": bson.M{"wallet.balance.amount": amount.Amount},
+		"$set": bson.M{"wallet.updated_at": now},
+	})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount > 0 {
+		return nil
+	}
+
+	var user models.User
+	if err := usersCollection.FindOne(context.Background(), bson.M{"_id": userID}).Decode(&user); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrUserNotFound
+		}
+		return err
+	}
+	switch {
+	case user.Wallet == nil:
+		return ErrNoWallet
+	case user.Wallet.Balance.Currency != amount.Currency:
+		return ErrCurrencyMismatch
+	default:
+		return ErrInsufficientFunds
+	}
+}
+
+// Reconciliation - сверка баланса кошелька с суммой его записей в журнале.
+type Reconciliation struct {
+	UserID    primitive.ObjectID `json:"user_id"`
+	Balance   money.Money        `json:"balance"`
+	LedgerSum money.Money        `json:"ledger_sum"`
+	Balanced  bool               `json:"balanced"`
+}
+
+// Reconcile сверяет баланс кошелька пользователя с суммой записей его кошелька в журнале.
+func Reconcile(user models.User) (Reconciliation, error) {
+	sums, err := walletSums(bson.M{"user_id": user.ID})
+	if err != nil {
+		return Reconciliation{}, err
+	}
+	return reconcile(user, sums[user.ID]), nil
+}
+
+// ReconcileAll сверяет кошельки всех пользователей и возвращает только расхождения.
+func ReconcileAll() ([]Reconciliation, error) {
+	sums, err := walletSums(bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	userIDs := []primitive.ObjectID{}
+	for userID := range sums {
+		userIDs = append(userIDs, userID)
+	}
+
+	// Пользователи с кошельком и пользователи, у которых есть записи, но нет кошелька
+	cursor, err := db.GetCollection("users").Find(context.Background(), bson.M{
+		"$or": []bson.M{{"wallet": bson.M{"$exists": true}}, {"_id": bson.M{"$in": userIDs}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var users []models.User
+	if err := cursor.All(context.Background(), &users); err != nil {
+		return nil, err
+	}
+
+	mismatches := []Reconciliation{}
+	for _, user := range users {
+		if result := reconcile(user, sums[user.ID]); !result.Balanced {
+			mismatches = append(mismatches, result)
+		}
+	}
+	return mismatches, nil
+}
+
+// reconcile сравнивает баланс с суммами записей кошелька по валютам.
+func reconcile(user models.User, sums map[string]int64) Reconciliation {
+	result := Reconciliation{UserID: user.ID}
+	if user.Wallet != nil {
+		result.Balance = user.Wallet.Balance
+	}
+	currency := result.Balance.Currency
+	for sumCurrency := range sums {
+		if currency == "" {
+			currency = sumCurrency
+		}
+	}
+	result.Balance.Currency = currency
+	result.LedgerSum = money.New(sums[currency], currency)
+	// Записи в другой валюте, чем кошелёк, - тоже расхождение
+	result.Balanced = result.Balance == result.LedgerSum && len(sums) <= 1
+	return result
+}
+
+// walletSums суммирует записи кошельков по пользователям и валютам.
+func walletSums(match bson.M) (map[primitive.ObjectID]map[string]int64, error) {
+	match["account"] = AccountWallet
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    bson.M{"user_id": "$user_id", "currency": "$amount.currency"},
+			"amount": bson.M{"$sum": "$amount.amount"},
+		}}},
+	}
+	cursor, err := db.GetCollection(Collection).Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		ID struct {
+			UserID   primitive.ObjectID `bson:"user_id"`
+			Currency string             `bson:"currency"`
+		} `bson:"_id"`
+		Amount int64 `bson:"amount"`
+	}
+	if err := cursor.All(context.Background(), &groups); err != nil {
+		return nil, err
+	}
+
+	sums := map[primitive.ObjectID]map[string]int64{}
+	for _, group := range groups {
+		if sums[group.ID.UserID] == nil {
+			sums[group.ID.UserID] = map[string]int64{}
+		}
+		sums[group.ID.UserID][group.ID.Currency] = group.Amount
+	}
+	return sums, nil
+}
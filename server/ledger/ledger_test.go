@@ -0,0 +1,46 @@
+package ledger
+
+import (
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/money"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestReversalEntries(t *testing.T) {
+	failed := primitive.NewObjectID()
+	userID := primitive.NewObjectID()
+	entries := []models.LedgerEntry{
+		{ID: primitive.NewObjectID(), TransactionID: failed, Account: AccountWallet, UserID: userID, Type: TypeJobCharge, Amount: money.New(-250, "USD"), Key: "job_charge:1"},
+		{ID: primitive.NewObjectID(), TransactionID: failed, Account: AccountRevenue, Type: TypeJobCharge, Amount: money.New(250, "USD")},
+	}
+
+	reversal := primitive.NewObjectID()
+	now := time.Now()
+	reversals := reversalEntries(entries, reversal, now)
+	if len(reversals) != len(entries) {
+		t.Fatalf("got %d reversal entries, want %d", len(reversals), len(entries))
+	}
+	for i, r := range reversals {
+		entry := r.(models.LedgerEntry)
+		if entry.TransactionID != reversal || entry.ReversalOf != failed {
+			t.Errorf("entry %d: transaction %v reversing %v, want %v reversing %v", i, entry.TransactionID, entry.ReversalOf, reversal, failed)
+		}
+		if sum, _ := entry.Amount.Add(entries[i].Amount); !sum.IsZero() {
+			t.Errorf("entry %d: amount %v does not cancel %v", i, entry.Amount, entries[i].Amount)
+		}
+		if entry.Account != entries[i].Account || entry.UserID != entries[i].UserID || entry.Type != entries[i].Type {
+			t.Errorf("entry %d: posted to %s/%v as %s, want %s/%v as %s", i, entry.Account, entry.UserID, entry.Type,
+				entries[i].Account, entries[i].UserID, entries[i].Type)
+		}
+		// Ключ остаётся свободным для повтора проводки
+		if entry.Key != "" {
+			t.Errorf("entry %d: reversal has key %q", i, entry.Key)
+		}
+		if entry.ID == entries[i].ID || !entry.CreatedAt.Equal(now) {
+			t.Errorf("entry %d: reversal must be a new entry", i)
+		}
+	}
+}
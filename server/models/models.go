@@ -1,6 +1,7 @@
 package models
 
 import (
+	"github.com/moevm/nosql2h24-transcribtion/money"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"time"
 )
@@ -14,18 +15,80 @@ type User struct {
 	CreatedAt    time.Time            `bson:"created_at" json:"created_at"`
 	UpdatedAt    time.Time            `bson:"updated_at" json:"updated_at"`
 	LastLoginAt  time.Time            `bson:"last_login_at" json:"last_login_at"`
-	Payments     []Payment            `bson:"payments" json:"payments"`
 	Jobs         []primitive.ObjectID `bson:"jobs" json:"jobs"`
+	Organization string               `bson:"organization,omitempty" json:"organization,omitempty"`
+	// Что делать с повторно загруженным файлом: reuse, ask (по умолчанию) или reprocess
+	DedupPolicy string `bson:"dedup_policy,omitempty" json:"dedup_policy,omitempty"`
+	// Сроки хранения данных пользователя; nil - значения по умолчанию из конфигурации
+	Retention *RetentionPolicy `bson:"retention,omitempty" json:"retention,omitempty"`
+	// Тарифный план: по нему выбирается правило цены, а если план есть в коллекции plans -
+	// ещё и месячная квота минут, лимит параллельных задач и сроки хранения; пусто - без плана
+	Plan string `bson:"plan,omitempty" json:"plan,omitempty"`
+	// Когда нужно платить за задачи; nil - политика по умолчанию из конфигурации
+	Billing *BillingPolicy `bson:"billing,omitempty" json:"billing,omitempty"`
+	// Предоплаченный баланс; nil - кошелёк ещё не пополнялся
+	Wallet *Wallet `bson:"wallet,omitempty" json:"wallet,omitempty"`
+
+	// Настройки уведомлений; nil - значения по умолчанию (все уведомления включены)
+	NotificationPreferences *NotificationPreferences `bson:"notification_preferences,omitempty" json:"notification_preferences,omitempty"`
+}
+
+// NotificationPreferences - каналы уведомлений пользователя и отключённые типы уведомлений.
+type NotificationPreferences struct {
+	InApp         bool     `bson:"in_app" json:"in_app"`
+	Email         bool     `bson:"email" json:"email"`
+	DisabledTypes []string `bson:"disabled_types,omitempty" json:"disabled_types,omitempty"`
 }
 
+// Payment - платёж пользователя, хранится в коллекции payments. Платежи не удаляются:
+// отменённый платёж остаётся в статусе canceled.
 type Payment struct {
 	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
-	Price         string             `bson:"price" json:"price"`
+	UserID        primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Price         money.Money        `bson:"price" json:"price"`
 	PaymentMethod string             `bson:"payment_method" json:"payment_method"`
 	PaymentStatus string             `bson:"payment_status" json:"payment_status"`
 	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
 	UpdatedAt     time.Time          `bson:"updated_at" json:"updated_at"`
 	JobID         primitive.ObjectID `bson:"job_id" json:"job_id"`
+	// Платёжный провайдер и намерение оплаты у него; статус меняется только по его уведомлениям
+	Provider         string    `bson:"provider,omitempty" json:"provider,omitempty"`
+	ProviderIntentID string    `bson:"provider_intent_id,omitempty" json:"provider_intent_id,omitempty"`
+	CheckoutURL      string    `bson:"checkout_url,omitempty" json:"checkout_url,omitempty"`
+	FailureReason    string    `bson:"failure_reason,omitempty" json:"failure_reason,omitempty"`
+	AuthorizedAt     time.Time `bson:"authorized_at,omitempty" json:"authorized_at,omitempty"`
+	CapturedAt       time.Time `bson:"captured_at,omitempty" json:"captured_at,omitempty"`
+	RefundedAt       time.Time `bson:"refunded_at,omitempty" json:"refunded_at,omitempty"`
+	// Сумма выполненных возвратов и возвратов, которые ещё обрабатывает провайдер
+	Refunded      *money.Money `bson:"refunded,omitempty" json:"refunded,omitempty"`
+	RefundPending *money.Money `bson:"refund_pending,omitempty" json:"refund_pending,omitempty"`
+	// Скидка по промокоду; Price - цена уже со скидкой
+	Discount *AppliedDiscount `bson:"discount,omitempty" json:"discount,omitempty"`
+	// Цена-строка старой версии, которую не удалось разобрать при миграции; Price тогда нулевая
+	LegacyPrice string `bson:"legacy_price,omitempty" json:"legacy_price,omitempty"`
+}
+
+// Refund - возврат всего платежа или его части. Предложенный (proposed) возврат создаётся
+// автоматически, когда оплаченная задача завершилась ошибкой или удалена, и выполняется
+// только после одобрения администратором.
+type Refund struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	PaymentID primitive.ObjectID `bson:"payment_id" json:"payment_id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	JobID     primitive.ObjectID `bson:"job_id,omitempty" json:"job_id,omitempty"`
+	Amount    money.Money        `bson:"amount" json:"amount"`
+	Reason    string             `bson:"reason" json:"reason"`
+	// proposed, approved, pending, succeeded, failed или rejected
+	Status string `bson:"status" json:"status"`
+	// Возврат, которым выполняется одобренное предложение
+	ApprovedRefundID primitive.ObjectID `bson:"approved_refund_id,omitempty" json:"approved_refund_id,omitempty"`
+	// Откуда возврат: manual (администратор), job_failed, job_canceled или provider
+	Source              string             `bson:"source" json:"source"`
+	FailureReason       string             `bson:"failure_reason,omitempty" json:"failure_reason,omitempty"`
+	LedgerTransactionID primitive.ObjectID `bson:"ledger_transaction_id,omitempty" json:"ledger_transaction_id,omitempty"`
+	CreatedAt           time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt           time.Time          `bson:"updated_at" json:"updated_at"`
+	CompletedAt         time.Time          `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
 }
 
 type Job struct {
@@ -34,6 +97,9 @@ type Job struct {
 	Title                   string             `bson:"title" json:"title"`
 	Status                  string             `bson:"status" json:"status"`
 	SourceLanguage          string             `bson:"source_language" json:"source_language"`
+	TargetLanguages         []string           `bson:"target_languages,omitempty" json:"target_languages,omitempty"`
+	DetectedLanguage        string             `bson:"detected_language,omitempty" json:"detected_language,omitempty"`
+	LanguageConfidence      float64            `bson:"language_confidence,omitempty" json:"language_confidence,omitempty"`
 	FileFormat              string             `bson:"file_format" json:"file_format"`
 	Description             string             `bson:"description" json:"description"`
 	InputFile               string             `bson:"input_file" json:"input_file"`
@@ -42,6 +108,361 @@ type Job struct {
 	UpdatedAt               time.Time          `bson:"updated_at" json:"updated_at"`
 	EstimatedFinishDatetime time.Time          `bson:"estimated_finish_datetime" json:"estimated_finish_datetime"`
 	HostID                  primitive.ObjectID `bson:"host_id" json:"host_id"`
+	Type                    string             `bson:"type,omitempty" json:"type,omitempty"`
+	ParentID                primitive.ObjectID `bson:"parent_id,omitempty" json:"parent_id,omitempty"`
+	StepIndex               int                `bson:"step_index,omitempty" json:"step_index,omitempty"`
+	Steps                   []PipelineStep     `bson:"steps,omitempty" json:"steps,omitempty"`
+	GlossaryID              primitive.ObjectID `bson:"glossary_id,omitempty" json:"glossary_id,omitempty"`
+	Diarization             bool               `bson:"diarization,omitempty" json:"diarization,omitempty"`
+	StartedAt               time.Time          `bson:"started_at,omitempty" json:"started_at,omitempty"`
+	Progress                int                `bson:"progress,omitempty" json:"progress"`
+	NotBefore               time.Time          `bson:"not_before,omitempty" json:"not_before,omitempty"`
+	ScheduleID              primitive.ObjectID `bson:"schedule_id,omitempty" json:"schedule_id,omitempty"`
+	TemplateID              primitive.ObjectID `bson:"template_id,omitempty" json:"template_id,omitempty"`
+	// Метки, которые должны быть у сервера, выполняющего задачу (например, "gpu")
+	Requirements []string `bson:"requirements,omitempty" json:"requirements,omitempty"`
+	// SHA-256 загруженного входного файла и задача, результат которой переиспользован
+	InputSHA256     string             `bson:"input_sha256,omitempty" json:"input_sha256,omitempty"`
+	ReusedFromJobID primitive.ObjectID `bson:"reused_from_job_id,omitempty" json:"reused_from_job_id,omitempty"`
+	// Время завершения (успешного или с ошибкой), от которого отсчитываются сроки хранения
+	CompletedAt         time.Time `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+	MediaPurgedAt       time.Time `bson:"media_purged_at,omitempty" json:"media_purged_at,omitempty"`
+	TranscriptsPurgedAt time.Time `bson:"transcripts_purged_at,omitempty" json:"transcripts_purged_at,omitempty"`
+	// Длительность записи в секундах и приоритет (standard, express, urgent), от которых зависит цена
+	DurationSeconds float64 `bson:"duration_seconds,omitempty" json:"duration_seconds,omitempty"`
+	Priority        string  `bson:"priority,omitempty" json:"priority,omitempty"`
+	// Цена, рассчитанная при создании задачи; по ней создаётся платёж
+	Price *money.Money `bson:"price,omitempty" json:"price,omitempty"`
+	// Фактическая длительность записи, по которой задача оплачивается после выполнения
+	MediaSeconds float64 `bson:"media_seconds,omitempty" json:"media_seconds,omitempty"`
+	// Чем оплачена задача: списанным платежом или проводкой по кошельку
+	PaymentID           primitive.ObjectID `bson:"payment_id,omitempty" json:"payment_id,omitempty"`
+	LedgerTransactionID primitive.ObjectID `bson:"ledger_transaction_id,omitempty" json:"ledger_transaction_id,omitempty"`
+	PaidAt              time.Time          `bson:"paid_at,omitempty" json:"paid_at,omitempty"`
+	// Доплата за оплаченную задачу, запись которой оказалась длиннее заявленной: разница цен
+	// по фактической и заявленной длительности, ещё не списанная с кошелька
+	Surcharge *money.Money `bson:"surcharge,omitempty" json:"surcharge,omitempty"`
+}
+
+// PipelineStep - шаг конвейера. Каждый шаг выполняется отдельной дочерней задачей,
+// которая создаётся только после завершения предыдущего шага.
+type PipelineStep struct {
+	Type        string             `bson:"type" json:"type"`
+	Status      string             `bson:"status" json:"status"`
+	JobID       primitive.ObjectID `bson:"job_id,omitempty" json:"job_id,omitempty"`
+	InputFile   string             `bson:"input_file,omitempty" json:"input_file,omitempty"`
+	OutputFile  string             `bson:"output_file,omitempty" json:"output_file,omitempty"`
+	StartedAt   time.Time          `bson:"started_at,omitempty" json:"started_at,omitempty"`
+	CompletedAt time.Time          `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+}
+
+// Transcript - результат расшифровки задачи на одном языке.
+// Для исходного языка и для каждого языка перевода хранится отдельный документ.
+type Transcript struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	JobID     primitive.ObjectID `bson:"job_id" json:"job_id"`
+	Language  string             `bson:"language" json:"language"`
+	Original  bool               `bson:"original" json:"original"`
+	Segments  []Segment          `bson:"segments" json:"segments"`
+	Speakers  []Speaker          `bson:"speakers,omitempty" json:"speakers,omitempty"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// Segment - фрагмент расшифровки, время указывается в секундах от начала записи.
+// Speaker - идентификатор кластера говорящего (например, SPEAKER_1), если включена диаризация.
+type Segment struct {
+	Start   float64 `bson:"start" json:"start"`
+	End     float64 `bson:"end" json:"end"`
+	Text    string  `bson:"text" json:"text"`
+	Speaker string  `bson:"speaker,omitempty" json:"speaker,omitempty"`
+}
+
+// Speaker - кластер говорящего, найденный движком. Label - отображаемое имя,
+// по умолчанию совпадает с ID и может быть переименовано пользователем.
+type Speaker struct {
+	ID    string `bson:"id" json:"id"`
+	Label string `bson:"label" json:"label"`
+}
+
+// Glossary - именованный словарь пользователя. Термины передаются движку как подсказки,
+// а правила замены применяются к сегментам расшифровки после распознавания.
+type Glossary struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Name      string             `bson:"name" json:"name"`
+	Terms     []GlossaryTerm     `bson:"terms" json:"terms"`
+	Rules     []ReplacementRule  `bson:"rules" json:"rules"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// GlossaryTerm - термин словаря. Variants - варианты, в которых движок обычно
+// искажает термин; они заменяются на сам термин.
+type GlossaryTerm struct {
+	Term          string   `bson:"term" json:"term"`
+	Pronunciation string   `bson:"pronunciation,omitempty" json:"pronunciation,omitempty"`
+	Variants      []string `bson:"variants,omitempty" json:"variants,omitempty"`
+}
+
+// ReplacementRule - правило замены целого слова или фразы в расшифровке.
+type ReplacementRule struct {
+	From          string `bson:"from" json:"from"`
+	To            string `bson:"to" json:"to"`
+	CaseSensitive bool   `bson:"case_sensitive" json:"case_sensitive"`
+}
+
+// Webhook - адрес пользователя, на который отправляются события о задачах и платежах.
+type Webhook struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	URL       string             `bson:"url" json:"url"`
+	Events    []string           `bson:"events" json:"events"`
+	Secret    string             `bson:"secret" json:"-"`
+	Active    bool               `bson:"active" json:"active"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// WebhookDelivery - одна отправка события на webhook вместе с историей попыток.
+type WebhookDelivery struct {
+	ID               primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	WebhookID        primitive.ObjectID `bson:"webhook_id" json:"webhook_id"`
+	UserID           primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Event            string             `bson:"event" json:"event"`
+	Payload          string             `bson:"payload" json:"payload"`
+	Status           string             `bson:"status" json:"status"`
+	Attempts         int                `bson:"attempts" json:"attempts"`
+	LastResponseCode int                `bson:"last_response_code,omitempty" json:"last_response_code,omitempty"`
+	LastError        string             `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	NextAttemptAt    time.Time          `bson:"next_attempt_at,omitempty" json:"next_attempt_at,omitempty"`
+	DeliveredAt      time.Time          `bson:"delivered_at,omitempty" json:"delivered_at,omitempty"`
+	History          []WebhookAttempt   `bson:"history,omitempty" json:"history,omitempty"`
+	CreatedAt        time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt        time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// WebhookAttempt - одна попытка доставки; Manual - повторная отправка, запрошенная пользователем.
+type WebhookAttempt struct {
+	At           time.Time `bson:"at" json:"at"`
+	ResponseCode int       `bson:"response_code,omitempty" json:"response_code,omitempty"`
+	Error        string    `bson:"error,omitempty" json:"error,omitempty"`
+	Manual       bool      `bson:"manual,omitempty" json:"manual,omitempty"`
+}
+
+// JobSchedule - повторяющаяся задача: по cron-выражению (в часовом поясе Timezone)
+// из шаблона Job создаётся новая задача пользователя.
+type JobSchedule struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Name      string             `bson:"name" json:"name"`
+	Cron      string             `bson:"cron" json:"cron"`
+	Timezone  string             `bson:"timezone,omitempty" json:"timezone,omitempty"`
+	Job       Job                `bson:"job" json:"job"`
+	Active    bool               `bson:"active" json:"active"`
+	NextRunAt time.Time          `bson:"next_run_at,omitempty" json:"next_run_at,omitempty"`
+	LastRunAt time.Time          `bson:"last_run_at,omitempty" json:"last_run_at,omitempty"`
+	LastJobID primitive.ObjectID `bson:"last_job_id,omitempty" json:"last_job_id,omitempty"`
+	LastError string             `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// Upload - загруженный пользователем файл. Файлы хранятся по SHA-256 содержимого,
+// поэтому одинаковые файлы занимают место один раз.
+type Upload struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	FileName  string             `bson:"file_name" json:"file_name"`
+	Path      string             `bson:"path" json:"path"`
+	Size      int64              `bson:"size" json:"size"`
+	SHA256    string             `bson:"sha256" json:"sha256"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// JobTemplate - сохранённые значения полей задачи. Задача из шаблона получает
+// значения Defaults, поверх которых применяются переданные при создании поля.
+// Шаблон с Shared доступен всем пользователям организации владельца.
+type JobTemplate struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	UserID       primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Organization string             `bson:"organization,omitempty" json:"organization,omitempty"`
+	Name         string             `bson:"name" json:"name"`
+	Description  string             `bson:"description,omitempty" json:"description,omitempty"`
+	Shared       bool               `bson:"shared" json:"shared"`
+	Defaults     Job                `bson:"defaults" json:"defaults"`
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt    time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// TimelineEvent - запись журнала событий задачи (создание, назначение на сервер, прогресс,
+// завершение, оплата, скачивание). Журнал только пополняется.
+type TimelineEvent struct {
+	ID        primitive.ObjectID     `bson:"_id,omitempty" json:"id,omitempty"`
+	JobID     primitive.ObjectID     `bson:"job_id" json:"job_id"`
+	Type      string                 `bson:"type" json:"type"`
+	ServerID  primitive.ObjectID     `bson:"server_id,omitempty" json:"server_id,omitempty"`
+	Details   map[string]interface{} `bson:"details,omitempty" json:"details,omitempty"`
+	CreatedAt time.Time              `bson:"created_at" json:"created_at"`
+}
+
+// RetentionPolicy - через сколько дней после завершения задачи удаляются входной файл
+// и расшифровки. 0 - хранить бессрочно.
+type RetentionPolicy struct {
+	MediaDays      int `bson:"media_days" json:"media_days"`
+	TranscriptDays int `bson:"transcript_days" json:"transcript_days"`
+}
+
+// PriceRule - правило расчёта цены задачи. Цены указываются за начатую минуту записи и должны
+// быть в одной валюте. Правило с пустым Plan действует для планов, у которых нет своего правила.
+type PriceRule struct {
+	ID                   primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Plan                 string             `bson:"plan" json:"plan"`
+	PerMinute            money.Money        `bson:"per_minute" json:"per_minute"`
+	TranslationPerMinute money.Money        `bson:"translation_per_minute" json:"translation_per_minute"`
+	DiarizationPerMinute money.Money        `bson:"diarization_per_minute" json:"diarization_per_minute"`
+	Minimum              money.Money        `bson:"minimum" json:"minimum"`
+	// Надбавка в процентах за приоритет, например {"express": 50, "urgent": 100}
+	PriorityMarkups map[string]int64 `bson:"priority_markups,omitempty" json:"priority_markups,omitempty"`
+	CreatedAt       time.Time        `bson:"created_at" json:"created_at"`
+	UpdatedAt       time.Time        `bson:"updated_at" json:"updated_at"`
+}
+
+// Plan - тарифный план подписки. Имя плана совпадает с User.Plan и с планом правила цены.
+// Нулевые IncludedMinutes и MaxConcurrency означают отсутствие ограничения; PriorityTier -
+// приоритет задач плана по умолчанию; Retention - сроки хранения для пользователей плана без своих.
+// MonthlyPrice - справочная цена подписки: она показывается пользователю, но не выставляется
+// в счетах и не списывается.
+type Plan struct {
+	ID              primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Name            string             `bson:"name" json:"name"`
+	Description     string             `bson:"description,omitempty" json:"description,omitempty"`
+	MonthlyPrice    money.Money        `bson:"monthly_price" json:"monthly_price"`
+	IncludedMinutes int64              `bson:"included_minutes,omitempty" json:"included_minutes,omitempty"`
+	MaxConcurrency  int64              `bson:"max_concurrency,omitempty" json:"max_concurrency,omitempty"`
+	PriorityTier    string             `bson:"priority_tier,omitempty" json:"priority_tier,omitempty"`
+	Retention       *RetentionPolicy   `bson:"retention,omitempty" json:"retention,omitempty"`
+	CreatedAt       time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt       time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// Discount - промокод. Скидка либо в процентах (Percent), либо фиксированная (Amount) в валюте цены.
+// Нулевые MaxUses и MaxUsesPerUser означают отсутствие ограничения, пустой Plans - любой тарифный план.
+// Uses - число использований, учитывается вместе с записями discount_redemptions.
+type Discount struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Code           string             `bson:"code" json:"code"`
+	Description    string             `bson:"description,omitempty" json:"description,omitempty"`
+	Type           string             `bson:"type" json:"type"`
+	Percent        int64              `bson:"percent,omitempty" json:"percent,omitempty"`
+	Amount         *money.Money       `bson:"amount,omitempty" json:"amount,omitempty"`
+	ExpiresAt      time.Time          `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	MaxUses        int64              `bson:"max_uses,omitempty" json:"max_uses,omitempty"`
+	MaxUsesPerUser int64              `bson:"max_uses_per_user,omitempty" json:"max_uses_per_user,omitempty"`
+	Plans          []string           `bson:"plans,omitempty" json:"plans,omitempty"`
+	Active         bool               `bson:"active" json:"active"`
+	Uses           int64              `bson:"uses" json:"uses"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt      time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// DiscountRedemption - использование промокода при создании платежа. Удаляется, если платёж
+// не состоялся (failed или canceled), и тогда использование снова доступно.
+type DiscountRedemption struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	DiscountID primitive.ObjectID `bson:"discount_id" json:"discount_id"`
+	Code       string             `bson:"code" json:"code"`
+	UserID     primitive.ObjectID `bson:"user_id" json:"user_id"`
+	PaymentID  primitive.ObjectID `bson:"payment_id" json:"payment_id"`
+	JobID      primitive.ObjectID `bson:"job_id,omitempty" json:"job_id,omitempty"`
+	Amount     money.Money        `bson:"amount" json:"amount"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// AppliedDiscount - скидка по промокоду, учтённая в цене платежа.
+type AppliedDiscount struct {
+	DiscountID    primitive.ObjectID `bson:"discount_id" json:"discount_id"`
+	Code          string             `bson:"code" json:"code"`
+	Amount        money.Money        `bson:"amount" json:"amount"`
+	OriginalPrice money.Money        `bson:"original_price" json:"original_price"`
+}
+
+// BillingPolicy - когда пользователь платит за задачи: prepay - задача ждёт в статусе
+// awaiting_payment, пока платёж за неё не списан; postpay - задачи выполняются сразу;
+// credit_limit - сразу выполняются, пока сумма неоплаченных задач не превышает CreditLimit.
+type BillingPolicy struct {
+	Policy      string       `bson:"policy" json:"policy"`
+	CreditLimit *money.Money `bson:"credit_limit,omitempty" json:"credit_limit,omitempty"`
+}
+
+// Wallet - предоплаченный баланс пользователя в одной валюте. Баланс меняется только
+// вместе с записями журнала ledger_entries и должен совпадать с суммой записей кошелька.
+type Wallet struct {
+	Balance   money.Money `bson:"balance" json:"balance"`
+	UpdatedAt time.Time   `bson:"updated_at" json:"updated_at"`
+}
+
+// LedgerEntry - запись журнала двойной записи. Записи не меняются и не удаляются; записи
+// одной проводки (TransactionID) в сумме дают ноль. Amount положителен, если счёт увеличивается.
+type LedgerEntry struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	TransactionID primitive.ObjectID `bson:"transaction_id" json:"transaction_id"`
+	Account       string             `bson:"account" json:"account"`
+	UserID        primitive.ObjectID `bson:"user_id,omitempty" json:"user_id,omitempty"`
+	Type          string             `bson:"type" json:"type"`
+	Amount        money.Money        `bson:"amount" json:"amount"`
+	JobID         primitive.ObjectID `bson:"job_id,omitempty" json:"job_id,omitempty"`
+	PaymentID     primitive.ObjectID `bson:"payment_id,omitempty" json:"payment_id,omitempty"`
+	Description   string             `bson:"description,omitempty" json:"description,omitempty"`
+	// Ключ идемпотентности: проводка с тем же ключом не создаётся повторно
+	Key string `bson:"key,omitempty" json:"-"`
+	// Проводка, которую сторнирует запись: её не удалось провести до конца, и её ключ
+	// перенесён в reversed_key
+	ReversalOf primitive.ObjectID `bson:"reversal_of,omitempty" json:"reversal_of,omitempty"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// Invoice - счёт пользователя за расчётный период в одной валюте: выполненные задачи
+// (начисления) и списанные платежи. AmountDue = Charges - Payments, отрицательная сумма - переплата.
+type Invoice struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Number      string             `bson:"number,omitempty" json:"number"`
+	UserID      primitive.ObjectID `bson:"user_id" json:"user_id"`
+	PeriodStart time.Time          `bson:"period_start" json:"period_start"`
+	PeriodEnd   time.Time          `bson:"period_end" json:"period_end"`
+	Currency    string             `bson:"currency" json:"currency"`
+	Lines       []InvoiceLine      `bson:"lines" json:"lines"`
+	Charges     money.Money        `bson:"charges" json:"charges"`
+	Payments    money.Money        `bson:"payments" json:"payments"`
+	AmountDue   money.Money        `bson:"amount_due" json:"amount_due"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// InvoiceLine - строка счёта: задача (Type = job, Quantity - оплачиваемые минуты)
+// или платёж (Type = payment, сумма положительна и уменьшает сумму к оплате).
+type InvoiceLine struct {
+	Type        string             `bson:"type" json:"type"`
+	Date        time.Time          `bson:"date" json:"date"`
+	Description string             `bson:"description" json:"description"`
+	Quantity    float64            `bson:"quantity,omitempty" json:"quantity,omitempty"`
+	Amount      money.Money        `bson:"amount" json:"amount"`
+	JobID       primitive.ObjectID `bson:"job_id,omitempty" json:"job_id,omitempty"`
+	PaymentID   primitive.ObjectID `bson:"payment_id,omitempty" json:"payment_id,omitempty"`
+}
+
+// Notification - уведомление во входящих пользователя. EmailStatus показывает судьбу
+// письма: sent, failed или skipped (email отключён или SMTP не настроен).
+type Notification struct {
+	ID          primitive.ObjectID     `bson:"_id,omitempty" json:"id,omitempty"`
+	UserID      primitive.ObjectID     `bson:"user_id" json:"user_id"`
+	Type        string                 `bson:"type" json:"type"`
+	Title       string                 `bson:"title" json:"title"`
+	Body        string                 `bson:"body" json:"body"`
+	Data        map[string]interface{} `bson:"data,omitempty" json:"data,omitempty"`
+	Read        bool                   `bson:"read" json:"read"`
+	ReadAt      time.Time              `bson:"read_at,omitempty" json:"read_at,omitempty"`
+	EmailStatus string                 `bson:"email_status,omitempty" json:"email_status,omitempty"`
+	CreatedAt   time.Time              `bson:"created_at" json:"created_at"`
 }
 
 type Server struct {
@@ -57,4 +478,8 @@ type Server struct {
 	CPUInfo       string               `bson:"cpu_info" json:"cpu_info"`
 	GPUInfo       string               `bson:"gpu_info" json:"gpu_info"`
 	RAMSizeGB     int32                `bson:"ram_size_gb" json:"ram_size_gb"`
+	Languages     []string             `bson:"languages,omitempty" json:"languages,omitempty"`
+	Labels        []string             `bson:"labels,omitempty" json:"labels,omitempty"`
+	LastHeartbeat time.Time            `bson:"last_heartbeat_at,omitempty" json:"last_heartbeat_at,omitempty"`
+	Load          float64              `bson:"load" json:"load"`
 }
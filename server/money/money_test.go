@@ -0,0 +1,130 @@
+package money
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		value    string
+		currency string
+		want     Money
+		err      error
+	}{
+		{"100.00", "USD", New(10000, "USD"), nil},
+		{"100", "USD", New(10000, "USD"), nil},
+		{"0.5", "USD", New(50, "USD"), nil},
+		{" 12.34 ", "EUR", New(1234, "EUR"), nil},
+		{"-5", "USD", New(-500, "USD"), nil},
+		{"+5.01", "USD", New(501, "USD"), nil},
+		{"1500", "JPY", New(1500, "JPY"), nil},
+		{"1.234", "KWD", New(1234, "KWD"), nil},
+		{"1.5", "JPY", Money{}, ErrInvalidAmount},
+		{"0.001", "USD", Money{}, ErrInvalidAmount},
+		{"1.", "USD", Money{}, ErrInvalidAmount},
+		{".5", "USD", Money{}, ErrInvalidAmount},
+		{"1,00", "USD", Money{}, ErrInvalidAmount},
+		{"1e3", "USD", Money{}, ErrInvalidAmount},
+		{"", "USD", Money{}, ErrInvalidAmount},
+		{"$10", "USD", Money{}, ErrInvalidAmount},
+		{"99999999999999999999", "USD", Money{}, ErrOverflow},
+		{"10", "XXX", Money{}, ErrUnknownCurrency},
+		{"10", "usd", Money{}, ErrUnknownCurrency},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.value, tt.currency)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("Parse(%q, %s) error = %v, want %v", tt.value, tt.currency, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q, %s) = %v, want %v", tt.value, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	tests := []struct {
+		money Money
+		want  string
+	}{
+		{New(10000, "USD"), "100.00"},
+		{New(5, "USD"), "0.05"},
+		{New(0, "USD"), "0.00"},
+		{New(-150, "EUR"), "-1.50"},
+		{New(1500, "JPY"), "1500"},
+		{New(1, "KWD"), "0.001"},
+		{New(math.MinInt64, "USD"), "-92233720368547758.08"},
+	}
+	for _, tt := range tests {
+		if got := tt.money.Decimal(); got != tt.want {
+			t.Errorf("%#v.Decimal() = %q, want %q", tt.money, got, tt.want)
+		}
+	}
+	if got := New(12345, "USD").String(); got != "123.45 USD" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+func TestParseDecimalRoundTrip(t *testing.T) {
+	for _, m := range []Money{New(1, "USD"), New(-99999, "EUR"), New(7, "JPY"), New(1234567, "BHD")} {
+		parsed, err := Parse(m.Decimal(), m.Currency)
+		if err != nil || parsed != m {
+			t.Errorf("Parse(%q) = %v, %v; want %v", m.Decimal(), parsed, err, m)
+		}
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	usd := func(amount int64) Money { return New(amount, "USD") }
+	tests := []struct {
+		name string
+		op   func() (Money, error)
+		want Money
+		err  error
+	}{
+		{"add", func() (Money, error) { return usd(150).Add(usd(250)) }, usd(400), nil},
+		{"add negative", func() (Money, error) { return usd(150).Add(usd(-200)) }, usd(-50), nil},
+		{"add currency mismatch", func() (Money, error) { return usd(1).Add(New(1, "EUR")) }, Money{}, ErrCurrencyMismatch},
+		{"add overflow", func() (Money, error) { return usd(math.MaxInt64).Add(usd(1)) }, Money{}, ErrOverflow},
+		{"add underflow", func() (Money, error) { return usd(math.MinInt64).Add(usd(-1)) }, Money{}, ErrOverflow},
+		{"sub", func() (Money, error) { return usd(500).Sub(usd(120)) }, usd(380), nil},
+		{"sub currency mismatch", func() (Money, error) { return usd(1).Sub(New(1, "EUR")) }, Money{}, ErrCurrencyMismatch},
+		{"sub min int", func() (Money, error) { return usd(0).Sub(usd(math.MinInt64)) }, Money{}, ErrOverflow},
+		{"mul", func() (Money, error) { return usd(125).Mul(3) }, usd(375), nil},
+		{"mul zero", func() (Money, error) { return usd(math.MaxInt64).Mul(0) }, usd(0), nil},
+		{"mul negative", func() (Money, error) { return usd(125).Mul(-2) }, usd(-250), nil},
+		{"mul overflow", func() (Money, error) { return usd(math.MaxInt64 / 2).Mul(3) }, Money{}, ErrOverflow},
+		{"mul min int", func() (Money, error) { return usd(math.MinInt64).Mul(-1) }, Money{}, ErrOverflow},
+	}
+	for _, tt := range tests {
+		got, err := tt.op()
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPredicates(t *testing.T) {
+	if !New(0, "USD").IsZero() || New(1, "USD").IsZero() {
+		t.Error("IsZero")
+	}
+	if !New(1, "USD").IsPositive() || New(0, "USD").IsPositive() || New(-1, "USD").IsPositive() {
+		t.Error("IsPositive")
+	}
+	if New(-5, "USD").Neg() != New(5, "USD") {
+		t.Error("Neg")
+	}
+	if err := New(1, "USD").Validate(); err != nil {
+		t.Errorf("Validate(USD) = %v", err)
+	}
+	if err := New(1, "").Validate(); !errors.Is(err, ErrUnknownCurrency) {
+		t.Errorf("Validate(\"\") = %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package notifications
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/moevm/nosql2h24-transcribtion/config"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Sender отправляет письмо с текстом в кодировке UTF-8.
+type Sender interface {
+	Send(to, subject, body string) error
+}
+
+// Mailer - канал email-уведомлений. nil, если SMTP не настроен; тогда письма не отправляются.
+var Mailer Sender
+
+// SMTPMailer отправляет письма через SMTP-сервер. Для локальной проверки подойдёт
+// любой SMTP-приёмник (например, MailHog на localhost:1025).
+type SMTPMailer struct {
+	Addr string
+	Auth smtp.Auth
+	From string
+}
+
+// Configure включает email-канал, если в конфигурации задан SMTP_HOST.
+func Configure(cfg config.Config) {
+	if cfg.SMTPHost == "" {
+		return
+	}
+	port := cfg.SMTPPort
+	if port == "" {
+		port = "25"
+	}
+	from := cfg.SMTPFrom
+	if from == "" {
+		from = "noreply@" + cfg.SMTPHost
+	}
+	if _, err := mail.ParseAddress(from); err != nil {
+		log.Printf("Invalid SMTP_FROM %q, email notifications are disabled: %v", from, err)
+		return
+	}
+
+	mailer := &SMTPMailer{Addr: net.JoinHostPort(cfg.SMTPHost, port), From: from}
+	if cfg.SMTPUsername != "" {
+		mailer.Auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+	Mailer = mailer
+}
+
+// ParseAddress проверяет email-адрес: допускается только сам адрес, без имени и лишних символов,
+// поэтому его можно подставить в заголовок письма.
+func ParseAddress(address string) (*mail.Address, error) {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Name != "" || parsed.Address != strings.TrimSpace(address) {
+		return nil, errors.New("mail: expected a bare address")
+	}
+	return parsed, nil
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender address: %w", err)
+	}
+	recipient, err := ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("invalid recipient address: %w", err)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", recipient)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	msg.WriteString("\r\n")
+	msg.Write(bytes.ReplaceAll([]byte(body), []byte("\n"), []byte("\r\n")))
+
+	return smtp.SendMail(m.Addr, m.Auth, from.Address, []string{recipient.Address}, msg.Bytes())
+}
@@ -0,0 +1,156 @@
+package notifications
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+// smtpMessage - письмо, принятое тестовым SMTP-сервером.
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// startSMTP запускает минимальный SMTP-сервер на локальном порту, который принимает письма
+// без аутентификации и TLS и передаёт их в канал.
+func startSMTP(t *testing.T) (string, <-chan smtpMessage) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	messages := make(chan smtpMessage, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, messages)
+		}
+	}()
+	return listener.Addr().String(), messages
+}
+
+func serveSMTP(conn net.Conn, messages chan<- smtpMessage) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ESMTP test")
+	var msg smtpMessage
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			msg = smtpMessage{from: strings.Trim(line[len("MAIL FROM:"):], "<> ")}
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			msg.to = append(msg.to, strings.Trim(line[len("RCPT TO:"):], "<> "))
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(dataLine)
+			}
+			msg.data = data.String()
+			messages <- msg
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	addr, messages := startSMTP(t)
+	mailer := &SMTPMailer{Addr: addr, From: "noreply@transcribtion.local"}
+
+	if err := mailer.Send("user@example.com", "Задача готова", "first line\nsecond line\n"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	msg := <-messages
+	if msg.from != "noreply@transcribtion.local" || len(msg.to) != 1 || msg.to[0] != "user@example.com" {
+		t.Errorf("envelope from %q to %v", msg.from, msg.to)
+	}
+	for _, header := range []string{"To: <user@example.com>\r\n", "Subject: =?utf-8?q?", "Content-Type: text/plain; charset=utf-8\r\n"} {
+		if !strings.Contains(msg.data, header) {
+			t.Errorf("message has no %q:\n%s", header, msg.data)
+		}
+	}
+	if !strings.Contains(msg.data, "\r\n\r\nfirst line\r\nsecond line\r\n") {
+		t.Errorf("unexpected body:\n%s", msg.data)
+	}
+}
+
+func TestSMTPMailerRejectsHeaderInjection(t *testing.T) {
+	addr, messages := startSMTP(t)
+	mailer := &SMTPMailer{Addr: addr, From: "noreply@transcribtion.local"}
+
+	for _, to := range []string{
+		"user@example.com\r\nBcc: victim@example.com",
+		"user@example.com\nSubject: spoofed",
+		"Attacker <user@example.com>",
+		"not an address",
+	} {
+		if err := mailer.Send(to, "subject", "body"); err == nil {
+			t.Errorf("Send(%q) succeeded", to)
+		}
+	}
+	if err := mailer.Send("user@example.com", "subject\r\nBcc: victim@example.com", "body"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	msg := <-messages
+	if strings.Contains(msg.data, "\r\nBcc:") {
+		t.Errorf("subject injected a header:\n%s", msg.data)
+	}
+	select {
+	case extra := <-messages:
+		t.Errorf("unexpected message to %v", extra.to)
+	default:
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		valid   bool
+	}{
+		{"user@example.com", true},
+		{"  user@example.com ", true},
+		{"", false},
+		{"user", false},
+		{"User <user@example.com>", false},
+		{"user@example.com\r\nBcc: x@example.com", false},
+		{"user@example.com, other@example.com", false},
+	}
+	for _, tt := range tests {
+		_, err := ParseAddress(tt.address)
+		if (err == nil) != tt.valid {
+			t.Errorf("ParseAddress(%q) error = %v, want valid %v", tt.address, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package notifications
+
+import (
+	"context"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Типы уведомлений
+const (
+	TypeJobCompleted  = "job_completed"
+	TypeJobFailed     = "job_failed"
+	TypePaymentFailed = "payment_failed"
+)
+
+var Types = []string{TypeJobCompleted, TypeJobFailed, TypePaymentFailed}
+
+// Статусы отправки письма
+const (
+	EmailPending = "pending"
+	EmailSent    = "sent"
+	EmailFailed  = "failed"
+	EmailSkipped = "skipped"
+)
+
+// Data - значения, подставляемые в шаблон уведомления
+type Data map[string]interface{}
+
+// IsKnownType проверяет, что тип уведомления существует.
+func IsKnownType(notificationType string) bool {
+	for _, known := range Types {
+		if notificationType == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Preferences возвращает настройки уведомлений пользователя; по умолчанию включены оба канала.
+func Preferences(user models.User) models.NotificationPreferences {
+	if user.NotificationPreferences == nil {
+		return models.NotificationPreferences{InApp: true, Email: true}
+	}
+	return *user.NotificationPreferences
+}
+
+// Notify формирует уведомление по шаблону и доставляет его по каналам, включённым у пользователя:
+// сохраняет во входящие и отправляет письмо. Письмо уходит в фоне, его результат
+// записывается в уведомление.
+func Notify(usersCollection, notificationsCollection *mongo.Collection, userID primitive.ObjectID, notificationType string, data Data) error {
+	var user models.User
+	if err := usersCollection.FindOne(context.Background(), bson.M{"_id": userID}).Decode(&user); err != nil {
+		return err
+	}
+
+	prefs := Preferences(user)
+	for _, disabled := range prefs.DisabledTypes {
+		if disabled == notificationType {
+			return nil
+		}
+	}
+
+	title, body, err := render(notificationType, data)
+	if err != nil {
+		return err
+	}
+
+	notification := models.Notification{
+		ID:          primitive.NewObjectID(),
+		UserID:      userID,
+		Type:        notificationType,
+		Title:       title,
+		Body:        body,
+		Data:        data,
+		EmailStatus: EmailSkipped,
+		CreatedAt:   time.Now(),
+	}
+	sendEmail := prefs.Email && Mailer != nil && user.Email != ""
+	if sendEmail {
+		notification.EmailStatus = EmailPending
+	}
+
+	if prefs.InApp {
+		if _, err := notificationsCollection.InsertOne(context.Background(), notification); err != nil {
+			return err
+		}
+	}
+
+	if sendEmail {
+		go func() {
+			status := EmailSent
+			if err := Mailer.Send(user.Email, title, body); err != nil {
+				log.Printf("Error sending %s email to user %v: %v", notificationType, userID, err)
+				status = EmailFailed
+			}
+			if !prefs.InApp {
+				return
+			}
+			_, err := notificationsCollection.UpdateOne(context.Background(),
+				bson.M{"_id": notification.ID},
+				bson.M{"$set": bson.M{"email_status": status}},
+			)
+			if err != nil {
+				log.Printf("Error updating notification %v: %v", notification.ID, err)
+			}
+		}()
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package notifications
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+// Шаблоны заголовка (он же тема письма) и текста уведомлений по типам
+var templates = map[string]struct {
+	title *template.Template
+	body  *template.Template
+}{
+	TypeJobCompleted: {
+		title: template.Must(template.New("job_completed_title").Parse(`Job "{{.title}}" is completed`)),
+		body: template.Must(template.New("job_completed_body").Parse(
+			`Your transcription job "{{.title}}" has been completed.
+
+Transcripts are available at /jobs/{{.job_id}}/transcripts.
+`)),
+	},
+	TypeJobFailed: {
+		title: template.Must(template.New("job_failed_title").Parse(`Job "{{.title}}" has failed`)),
+		body: template.Must(template.New("job_failed_body").Parse(
+			`Unfortunately, your transcription job "{{.title}}" ({{.job_id}}) could not be processed.
+
+You can resubmit the file or contact support.
+`)),
+	},
+	TypePaymentFailed: {
+		title: template.Must(template.New("payment_failed_title").Parse(`Payment failed`)),
+		body: template.Must(template.New("payment_failed_body").Parse(
+			`Your payment of {{.price}}{{if .payment_method}} via {{.payment_method}}{{end}} could not be completed.
+{{- if .job_id}}
+
+The payment was made for job {{.job_id}}.{{end}}
+
+Please check your payment details and try again.
+`)),
+	},
+}
+
+func render(notificationType string, data Data) (string, string, error) {
+	tmpl, ok := templates[notificationType]
+	if !ok {
+		return "", "", fmt.Errorf("unknown notification type %q", notificationType)
+	}
+
+	var title, body bytes.Buffer
+	if err := tmpl.title.Execute(&title, data); err != nil {
+		return "", "", err
+	}
+	if err := tmpl.body.Execute(&body, data); err != nil {
+		return "", "", err
+	}
+	return title.String(), body.String(), nil
+}
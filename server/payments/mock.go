@@ -0,0 +1,130 @@
+package payments
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/money"
+	"github.com/moevm/nosql2h24-transcribtion/webhooks"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MockName - имя встроенного тестового провайдера
+const MockName = "mock"
+
+// Заголовки уведомлений тестового провайдера. Подпись считается так же, как у исходящих
+// webhook: HMAC-SHA256 секрета от строки "<timestamp>.<тело запроса>".
+const (
+	MockHeaderTimestamp = "X-Mock-Timestamp"
+	MockHeaderSignature = "X-Mock-Signature"
+)
+
+// mockSignatureTolerance - насколько старые уведомления ещё принимаются
+const mockSignatureTolerance = 5 * time.Minute
+
+// MockProvider - тестовый шлюз для локальной разработки. Он не хранит состояние и не списывает
+// деньги: каждое действие сразу отправляет подписанное уведомление на CallbackURL,
+// как это сделал бы настоящий провайдер.
+type MockProvider struct {
+	Secret      string
+	CallbackURL string
+	Client      *http.Client
+}
+
+func NewMockProvider(secret, callbackURL string) *MockProvider {
+	return &MockProvider{
+		Secret:      secret,
+		CallbackURL: callbackURL,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (m *MockProvider) Name() string {
+	return MockName
+}
+
+// CreateIntent выдаёт идентификатор намерения и адрес страницы подтверждения оплаты.
+func (m *MockProvider) CreateIntent(payment models.Payment) (Intent, error) {
+	id := "mock_pi_" + payment.ID.Hex()
+	return Intent{ID: id, CheckoutURL: "/payments/mock/" + id + "/confirm"}, nil
+}
+
+// Confirm имитирует покупателя на странице оплаты: approve - средства авторизованы, иначе отказ.
+func (m *MockProvider) Confirm(intentID string, amount money.Money, approve bool) error {
+	event := Event{IntentID: intentID, Status: StatusAuthorized, Amount: amount}
+	if !approve {
+		event.Status = StatusFailed
+		event.Reason = "card declined"
+	}
+	return m.notify(event)
+}
+
+func (m *MockProvider) Capture(intentID string, amount money.Money) error {
+	return m.notify(Event{IntentID: intentID, Status: StatusCaptured, Amount: amount})
+}
+
+func (m *MockProvider) Refund(intentID, refundID string, amount money.Money) error {
+	return m.notify(Event{IntentID: intentID, Status: StatusRefunded, Amount: amount, RefundID: refundID})
+}
+
+// ParseWebhook проверяет подпись и свежесть уведомления и разбирает его.
+func (m *MockProvider) ParseWebhook(r *http.Request) (Event, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return Event{}, err
+	}
+	timestamp, err := strconv.ParseInt(r.Header.Get(MockHeaderTimestamp), 10, 64)
+	if err != nil {
+		return Event{}, ErrInvalidSignature
+	}
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > mockSignatureTolerance || age < -mockSignatureTolerance {
+		return Event{}, ErrInvalidSignature
+	}
+	expected := webhooks.Sign(m.Secret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get(MockHeaderSignature))) {
+		return Event{}, ErrInvalidSignature
+	}
+
+	var event Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		return Event{}, err
+	}
+	if event.IntentID == "" || !strings.HasPrefix(event.IntentID, "mock_pi_") {
+		return Event{}, fmt.Errorf("invalid intent %q", event.IntentID)
+	}
+	return event, nil
+}
+
+func (m *MockProvider) notify(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequest(http.MethodPost, m.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(MockHeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(MockHeaderSignature, webhooks.Sign(m.Secret, timestamp, body))
+
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("callback returned %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package payments
+
+import (
+	"errors"
+	"fmt"
+	"github.com/moevm/nosql2h24-transcribtion/config"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/money"
+	"github.com/moevm/nosql2h24-transcribtion/webhooks"
+	"net/http"
+	"time"
+)
+
+// Коллекции платежей и возвратов
+const (
+	Collection        = "payments"
+	RefundsCollection = "refunds"
+)
+
+// Статусы платежа. Платёж создаётся в статусе pending, дальше статус меняется
+// по уведомлениям провайдера; неоплаченный платёж пользователь может отменить (canceled).
+const (
+	StatusPending           = "pending"
+	StatusAuthorized        = "authorized"
+	StatusCaptured          = "captured"
+	StatusRefunded          = "refunded"
+	StatusPartiallyRefunded = "partially_refunded"
+	StatusFailed            = "failed"
+	StatusCanceled          = "canceled"
+)
+
+// PendingTTL - время, за которое платёж должен быть оплачен; потом он отменяется
+const PendingTTL = 24 * time.Hour
+
+// OpenStatuses - статусы незавершённого платежа: по задаче может быть не больше одного такого
+var OpenStatuses = []string{StatusPending, StatusAuthorized}
+
+// Статусы возврата: предложенный возврат ждёт решения администратора, approved - предложение
+// одобрено и выполняется отдельным возвратом, pending - запрос отправлен провайдеру,
+// результат приходит уведомлением.
+const (
+	RefundProposed  = "proposed"
+	RefundApproved  = "approved"
+	RefundPending   = "pending"
+	RefundSucceeded = "succeeded"
+	RefundFailed    = "failed"
+	RefundRejected  = "rejected"
+)
+
+// Источники возврата
+const (
+	RefundSourceManual      = "manual"
+	RefundSourceJobFailed   = "job_failed"
+	RefundSourceJobCanceled = "job_canceled"
+	RefundSourceProvider    = "provider"
+)
+
+// transitions - допустимые переходы: из статуса в статусы
+var transitions = map[string][]string{
+	StatusPending:           {StatusAuthorized, StatusCaptured, StatusFailed, StatusCanceled},
+	StatusAuthorized:        {StatusCaptured, StatusFailed},
+	StatusCaptured:          {StatusPartiallyRefunded, StatusRefunded},
+	StatusPartiallyRefunded: {StatusPartiallyRefunded, StatusRefunded},
+}
+
+var (
+	ErrInvalidSignature  = errors.New("invalid webhook signature")
+	ErrInvalidTransition = errors.New("invalid payment status transition")
+	ErrUnknownProvider   = errors.New("unknown payment provider")
+)
+
+// Intent - намерение оплаты у провайдера. По CheckoutURL покупатель подтверждает оплату.
+type Intent struct {
+	ID          string
+	CheckoutURL string
+}
+
+// Event - уведомление провайдера о новом статусе платежа. Уведомление о возврате содержит
+// RefundID, переданный в Refund; Status тогда - refunded или failed, Amount - сумма возврата.
+type Event struct {
+	IntentID string      `json:"intent_id"`
+	Status   string      `json:"status"`
+	Amount   money.Money `json:"amount"`
+	Reason   string      `json:"reason,omitempty"`
+	RefundID string      `json:"refund_id,omitempty"`
+}
+
+// Provider - платёжный шлюз. Capture и Refund только отправляют запрос: результат
+// приходит позже уведомлением, которое разбирает и проверяет ParseWebhook.
+type Provider interface {
+	Name() string
+	CreateIntent(payment models.Payment) (Intent, error)
+	Capture(intentID string, amount money.Money) error
+	Refund(intentID, refundID string, amount money.Money) error
+	ParseWebhook(r *http.Request) (Event, error)
+}
+
+var providers = map[string]Provider{}
+
+// Default - провайдер, через который создаются новые платежи.
+var Default Provider
+
+// Register подключает провайдера.
+func Register(provider Provider) {
+	providers[provider.Name()] = provider
+}
+
+// Get возвращает провайдера по имени.
+func Get(name string) (Provider, bool) {
+	provider, ok := providers[name]
+	return provider, ok
+}
+
+// Configure подключает встроенный тестовый провайдер и выбирает провайдер по умолчанию.
+// Если секрет не задан, он генерируется при старте: тестовый провайдер работает в том же процессе.
+func Configure(cfg config.Config) error {
+	secret := cfg.PaymentWebhookSecret
+	if secret == "" {
+		var err error
+		if secret, err = webhooks.NewSecret(); err != nil {
+			return err
+		}
+	}
+	Register(NewMockProvider(secret, cfg.PaymentCallbackURL))
+
+	provider, ok := Get(cfg.PaymentProvider)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownProvider, cfg.PaymentProvider)
+	}
+	Default = provider
+	return nil
+}
+
+// CanTransition проверяет, может ли платёж перейти из статуса from в статус to.
+func CanTransition(from, to string) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Sources возвращает статусы, из которых платёж может перейти в статус to.
+func Sources(to string) []string {
+	sources := []string{}
+	for from := range transitions {
+		if CanTransition(from, to) {
+			sources = append(sources, from)
+		}
+	}
+	return sources
+}
@@ -0,0 +1,214 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/moevm/nosql2h24-transcribtion/engine"
+	"github.com/moevm/nosql2h24-transcribtion/events"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/scheduler"
+	"github.com/moevm/nosql2h24-transcribtion/timeline"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Типы шагов конвейера
+const (
+	StepTranscription = "transcription"
+	StepTranslation   = "translation"
+	StepSummarization = "summarization"
+)
+
+// Статусы шагов конвейера
+const (
+	StepWaiting    = "waiting"
+	StepInProgress = "in_progress"
+	StepCompleted  = "completed"
+	StepFailed     = "failed"
+)
+
+// StepDuration - оценка времени выполнения одного шага
+const StepDuration = 30 * time.Second
+
+// Validate проверяет описание конвейера, пришедшее от клиента.
+func Validate(steps []models.PipelineStep) error {
+	if len(steps) == 0 {
+		return errors.New("pipeline has no steps")
+	}
+	for i, step := range steps {
+		switch step.Type {
+		case StepTranscription, StepTranslation, StepSummarization:
+		default:
+			return fmt.Errorf("step %d: unknown type %q", i+1, step.Type)
+		}
+	}
+	return nil
+}
+
+// Prepare приводит родительскую задачу к исходному состоянию перед сохранением:
+// сама она на сервер не назначается, все шаги ожидают запуска.
+func Prepare(parent *models.Job) {
+	for i := range parent.Steps {
+		parent.Steps[i] = models.PipelineStep{Type: parent.Steps[i].Type, Status: StepWaiting}
+	}
+	parent.Status = "in_progress"
+	parent.HostID = primitive.NilObjectID
+	parent.EstimatedFinishDatetime = time.Now().Add(time.Duration(len(parent.Steps)) * StepDuration)
+}
+
+// Start запускает первый шаг конвейера.
+// Родительская задача должна быть уже сохранена в коллекции jobs.
+func Start(jobsCollection, serversCollection *mongo.Collection, parent *models.Job) error {
+	return startStep(jobsCollection, serversCollection, parent, 0, parent.InputFile)
+}
+
+// OnJobCompleted вызывается после завершения задачи. Если задача является шагом конвейера,
+// отмечает шаг выполненным и планирует следующий, передавая ему результат предыдущего шага.
+// После последнего шага завершается родительская задача - тогда она и возвращается.
+func OnJobCompleted(jobsCollection, serversCollection *mongo.Collection, child models.Job) (*models.Job, error) {
+	if child.ParentID.IsZero() {
+		return nil, nil
+	}
+
+	var parent models.Job
+	err := jobsCollection.FindOne(context.Background(), bson.M{"_id": child.ParentID}).Decode(&parent)
+	if err != nil {
+		return nil, err
+	}
+	if child.StepIndex >= len(parent.Steps) {
+		return nil, fmt.Errorf("job %s refers to missing step %d", child.ID.Hex(), child.StepIndex)
+	}
+
+	now := time.Now()
+	stepKey := fmt.Sprintf("steps.%d", child.StepIndex)
+	_, err = jobsCollection.UpdateOne(context.Background(),
+		bson.M{"_id": parent.ID},
+		bson.M{"$set": bson.M{
+			stepKey + ".status":       StepCompleted,
+			stepKey + ".completed_at": now,
+			"updated_at":              now,
+		}},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	next := child.StepIndex + 1
+	if next < len(parent.Steps) {
+		return nil, startStep(jobsCollection, serversCollection, &parent, next, child.OutputFile)
+	}
+
+	_, err = jobsCollection.UpdateOne(context.Background(),
+		bson.M{"_id": parent.ID},
+		bson.M{"$set": bson.M{
+			"status":       "completed",
+			"completed_at": now,
+			"updated_at":   now,
+		}},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	parent.Status = "completed"
+	parent.CompletedAt = now
+	events.PublishJob(parent)
+	return &parent, nil
+}
+
+// OnJobFailed вызывается после ошибки задачи. Если задача является шагом конвейера,
+// весь конвейер считается неудавшимся; родительская задача возвращается.
+func OnJobFailed(jobsCollection *mongo.Collection, child models.Job) (*models.Job, error) {
+	if child.ParentID.IsZero() {
+		return nil, nil
+	}
+
+	now := time.Now()
+	var parent models.Job
+	err := jobsCollection.FindOneAndUpdate(context.Background(),
+		bson.M{"_id": child.ParentID},
+		bson.M{"$set": bson.M{
+			fmt.Sprintf("steps.%d.status", child.StepIndex): StepFailed,
+			"status":       "failed",
+			"completed_at": now,
+			"updated_at":   now,
+		}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&parent)
+	if err != nil {
+		return nil, err
+	}
+
+	events.PublishJob(parent)
+	return &parent, nil
+}
+
+// startStep создаёт дочернюю задачу для шага index и назначает её на сервер.
+func startStep(jobsCollection, serversCollection *mongo.Collection, parent *models.Job, index int, inputFile string) error {
+	step := parent.Steps[index]
+	now := time.Now()
+
+	outputFile := parent.OutputFile
+	if index < len(parent.Steps)-1 {
+		outputFile = fmt.Sprintf("%s.step%d.%s", parent.OutputFile, index+1, step.Type)
+	}
+
+	child := models.Job{
+		ID:                      primitive.NewObjectID(),
+		UserID:                  parent.UserID,
+		Title:                   fmt.Sprintf("%s (step %d: %s)", parent.Title, index+1, step.Type),
+		Status:                  "pending",
+		SourceLanguage:          parent.SourceLanguage,
+		TargetLanguages:         parent.TargetLanguages,
+		GlossaryID:              parent.GlossaryID,
+		Diarization:             parent.Diarization,
+		Requirements:            parent.Requirements,
+		FileFormat:              parent.FileFormat,
+		Description:             parent.Description,
+		InputFile:               inputFile,
+		OutputFile:              outputFile,
+		CreatedAt:               now,
+		UpdatedAt:               now,
+		EstimatedFinishDatetime: now.Add(StepDuration),
+		Type:                    step.Type,
+		ParentID:                parent.ID,
+		StepIndex:               index,
+	}
+
+	// Если язык ещё не определён, сервер выбирается после первого прохода движка
+	if child.SourceLanguage == engine.AutoLanguage {
+		child.Status = "detecting_language"
+	} else if err := schedul.ScheduleJob(serversCollection, &child); err != nil {
+		return err
+	}
+	if _, err := jobsCollection.InsertOne(context.Background(), child); err != nil {
+		return err
+	}
+	events.PublishJob(child)
+	timeline.Record(child.ID, timeline.Created, primitive.NilObjectID, timeline.Details{"parent_id": parent.ID, "step": index + 1})
+	if !child.HostID.IsZero() {
+		timeline.Record(child.ID, timeline.Assigned, child.HostID, nil)
+	}
+	timeline.Record(parent.ID, timeline.StepStarted, child.HostID, timeline.Details{"step": index + 1, "type": step.Type, "job_id": child.ID})
+
+	step.Status = StepInProgress
+	step.JobID = child.ID
+	step.InputFile = child.InputFile
+	step.OutputFile = child.OutputFile
+	step.StartedAt = now
+	parent.Steps[index] = step
+
+	_, err := jobsCollection.UpdateOne(context.Background(),
+		bson.M{"_id": parent.ID},
+		bson.M{"$set": bson.M{
+			fmt.Sprintf("steps.%d", index): step,
+			"updated_at":                   now,
+		}},
+	)
+	return err
+}
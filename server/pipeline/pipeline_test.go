@@ -0,0 +1,51 @@
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		steps   []models.PipelineStep
+		wantErr bool
+	}{
+		{"empty", nil, true},
+		{"known steps", []models.PipelineStep{{Type: StepTranscription}, {Type: StepTranslation}, {Type: StepSummarization}}, false},
+		{"unknown step", []models.PipelineStep{{Type: StepTranscription}, {Type: "dubbing"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Validate(tt.steps); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	parent := models.Job{
+		Status: "pending",
+		HostID: primitive.NewObjectID(),
+		Steps: []models.PipelineStep{
+			{Type: StepTranscription, Status: StepCompleted, JobID: primitive.NewObjectID()},
+			{Type: StepTranslation, Status: StepFailed},
+		},
+	}
+	Prepare(&parent)
+
+	if parent.Status != "in_progress" || !parent.HostID.IsZero() {
+		t.Errorf("parent status %q host %v", parent.Status, parent.HostID)
+	}
+	for i, step := range parent.Steps {
+		if step.Status != StepWaiting || !step.JobID.IsZero() {
+			t.Errorf("step %d was not reset: %+v", i, step)
+		}
+	}
+	if parent.Steps[0].Type != StepTranscription || parent.Steps[1].Type != StepTranslation {
+		t.Error("step types changed")
+	}
+}
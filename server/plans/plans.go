@@ -0,0 +1,612 @@
+package plans
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/invoices"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/money"
+	"github.com/moevm/nosql2h24-transcribtion/pricing"
+	"log"
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Коллекции тарифных планов, счётчиков минут, занятых задачами пользователя в расчётном периоде,
+// и мест в лимите параллельных задач
+const (
+	Collection      = "plans"
+	UsageCollection = "plan_usage"
+	SlotsCollection = "plan_slots"
+)
+
+// SlotGrace - время, в течение которого место задачи не освобождается при очистке, даже если
+// задача ещё не сохранена или не отправлена в работу: место занимается раньше этих шагов
+const SlotGrace = time.Minute
+
+var (
+	ErrQuotaExceeded    = errors.New("monthly minute quota exceeded")
+	ErrConcurrencyLimit = errors.New("too many jobs in progress for the plan")
+)
+
+// Статусы задач, которые занимают лимит параллельных задач
+var activeStatuses = bson.A{"pending", "in_progress", "detecting_language"}
+
+// Статусы ещё не выполненных задач, минуты которых резервируются в квоте текущего периода
+var openStatuses = bson.A{"pending", "in_progress", "detecting_language", "scheduled", "awaiting_payment"}
+
+// Usage - использование плана за расчётный период (календарный месяц в UTC).
+// UsedMinutes - минуты выполненных задач, ReservedMinutes - заявленные минуты ещё не выполненных.
+type Usage struct {
+	Plan             string       `json:"plan,omitempty"`
+	PeriodStart      time.Time    `json:"period_start"`
+	PeriodEnd        time.Time    `json:"period_end"`
+	MonthlyPrice     *money.Money `json:"monthly_price,omitempty"`
+	IncludedMinutes  int64        `json:"included_minutes"`
+	UsedMinutes      int64        `json:"used_minutes"`
+	ReservedMinutes  int64        `json:"reserved_minutes"`
+	RemainingMinutes *int64       `json:"remaining_minutes,omitempty"`
+	ActiveJobs       int64        `json:"active_jobs"`
+	MaxConcurrency   int64        `json:"max_concurrency"`
+}
+
+// Validate проверяет тарифный план перед сохранением.
+func Validate(plan models.Plan) error {
+	if plan.Name == "" {
+		return errors.New("name is required")
+	}
+	if err := plan.MonthlyPrice.Validate(); err != nil {
+		return err
+	}
+	if plan.MonthlyPrice.Amount < 0 {
+		return errors.New("monthly_price must not be negative")
+	}
+	if plan.IncludedMinutes < 0 || plan.MaxConcurrency < 0 {
+		return errors.New("limits must not be negative")
+	}
+	if !pricing.IsKnownPriority(plan.PriorityTier) {
+		return fmt.Errorf("unknown priority tier %q", plan.PriorityTier)
+	}
+	if plan.Retention != nil && (plan.Retention.MediaDays < 0 || plan.Retention.TranscriptDays < 0) {
+		return errors.New("retention days must not be negative")
+	}
+	return nil
+}
+
+// Find возвращает план по имени. Для пустого имени и имени, которого нет в коллекции
+// (план, у которого есть только правило цены), возвращается nil.
+func Find(name string) (*models.Plan, error) {
+	if name == "" {
+		return nil, nil
+	}
+	var plan models.Plan
+	err := db.GetCollection(Collection).FindOne(context.Background(), bson.M{"name": name}).Decode(&plan)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// JobMinutes возвращает число начатых минут записи задачи: по фактической длительности,
+// а если её ещё нет - по заявленной.
+func JobMinutes(job models.Job) int64 {
+	seconds := job.MediaSeconds
+	if seconds == 0 {
+		seconds = job.DurationSeconds
+	}
+	return int64(math.Ceil(seconds / 60))
+}
+
+// UsageFor считает использование плана пользователем за период, в который попадает now.
+// Шаги конвейеров не учитываются - минуты считаются по родительской задаче.
+func UsageFor(user models.User, plan *models.Plan, now time.Time) (Usage, error) {
+	start, end := invoices.Period(now)
+	usage := Usage{Plan: user.Plan, PeriodStart: start, PeriodEnd: end}
+	if plan != nil {
+		usage.MonthlyPrice = &plan.MonthlyPrice
+		usage.IncludedMinutes = plan.IncludedMinutes
+		usage.MaxConcurrency = plan.MaxConcurrency
+	}
+
+	var err error
+	usage.UsedMinutes, err = sumMinutes(bson.M{
+		"user_id":      user.ID,
+		"status":       "completed",
+		"completed_at": bson.M{"$gte": start, "$lt": end},
+		"parent_id":    bson.M{"$exists": false},
+	})
+	if err != nil {
+		return Usage{}, err
+	}
+	usage.ReservedMinutes, err = sumMinutes(bson.M{
+		"user_id":   user.ID,
+		"status":    bson.M{"$in": openStatuses},
+		"parent_id": bson.M{"$exists": false},
+	})
+	if err != nil {
+		return Usage{}, err
+	}
+	usage.ActiveJobs, err = activeJobs(user.ID)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	if usage.IncludedMinutes > 0 {
+		remaining := usage.IncludedMinutes - usage.UsedMinutes - usage.ReservedMinutes
+		if remaining < 0 {
+			remaining = 0
+		}
+		usage.RemainingMinutes = &remaining
+	}
+	return usage, nil
+}
+
+// activeJobs считает задачи пользователя в работе, которые занимают лимит параллельных задач.
+func activeJobs(userID primitive.ObjectID) (int64, error) {
+	return db.GetCollection("jobs").CountDocuments(context.Background(), bson.M{
+		"user_id":   userID,
+		"status":    bson.M{"$in": activeStatuses},
+		"parent_id": bson.M{"$exists": false},
+	})
+}
+
+// sumMinutes складывает начатые минуты записи задач, подходящих под фильтр.
+func sumMinutes(filter bson.M) (int64, error) {
+	seconds := bson.M{"$cond": bson.A{
+		bson.M{"$gt": bson.A{bson.M{"$ifNull": bson.A{"$media_seconds", 0}}, 0}},
+		"$media_seconds",
+		bson.M{"$ifNull": bson.A{"$duration_seconds", 0}},
+	}}
+	cursor, err := db.GetCollection("jobs").Aggregate(context.Background(), mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{
+			"_id":     nil,
+			"minutes": bson.M{"$sum": bson.M{"$ceil": bson.M{"$divide": bson.A{seconds, 60}}}},
+		}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	var result []struct {
+		Minutes float64 `bson:"minutes"`
+	}
+	if err := cursor.All(context.Background(), &result); err != nil {
+		return 0, err
+	}
+	if len(result) == 0 {
+		return 0, nil
+	}
+	return int64(result[0].Minutes), nil
+}
+
+// Quota решает, можно ли создать новые задачи пользователя в рамках его плана: минуты задачи
+// вместе с выполненными и ещё не выполненными задачами периода должны укладываться в квоту,
+// а число задач в работе - в лимит параллельных задач. Минуты резервируются атомарно в счётчике
+// периода (коллекция plan_usage), места - в списке задач в работе (коллекция plan_slots),
+// поэтому параллельные запросы не могут вместе превысить квоту или лимит;
+// одну Quota можно использовать для пакета задач. После сохранения задач вызывается Release,
+// который снимает резервы задач, так и не попавших в базу.
+type Quota struct {
+	plan    *models.Plan
+	usage   Usage
+	userID  primitive.ObjectID
+	pending []models.Job
+}
+
+// NewQuota загружает план пользователя и его использование в текущем периоде.
+func NewQuota(user models.User, now time.Time) (*Quota, error) {
+	plan, err := Find(user.Plan)
+	if err != nil || plan == nil {
+		return &Quota{}, err
+	}
+	usage, err := UsageFor(user, plan, now)
+	if err != nil {
+		return nil, err
+	}
+	return &Quota{plan: plan, usage: usage, userID: user.ID}, nil
+}
+
+// Reserve проверяет новую задачу и учитывает её в использовании. Задача без длительности
+// проходит, пока квота не исчерпана; отложенная задача не занимает лимит параллельных задач.
+func (q *Quota) Reserve(job models.Job, now time.Time) error {
+	if q.plan == nil {
+		return nil
+	}
+	active := !job.NotBefore.After(now)
+	limited := active && q.plan.MaxConcurrency > 0
+	if limited {
+		reserved, err := reserveSlot(q.userID, job.ID, q.plan.MaxConcurrency, now)
+		if err != nil {
+			return err
+		}
+		if !reserved {
+			return fmt.Errorf("%w: limit %d", ErrConcurrencyLimit, q.plan.MaxConcurrency)
+		}
+	}
+	minutes := JobMinutes(job)
+	if q.plan.IncludedMinutes > 0 {
+		if err := q.reserveMinutes(job, minutes); err != nil {
+			if limited {
+				if releaseErr := ReleaseSlot(job); releaseErr != nil {
+					log.Printf("Error releasing concurrency slot of job %v: %v", job.ID, releaseErr)
+				}
+			}
+			return err
+		}
+	}
+	if limited || q.plan.IncludedMinutes > 0 {
+		q.pending = append(q.pending, job)
+	}
+
+	q.usage.ReservedMinutes += minutes
+	if active {
+		q.usage.ActiveJobs++
+	}
+	return nil
+}
+
+// reserveMinutes атомарно добавляет минуты задачи к счётчику периода, если они укладываются в квоту.
+// Счётчик создаётся при первом резерве периода с использованием, посчитанным по задачам.
+func (q *Quota) reserveMinutes(job models.Job, minutes int64) error {
+	ctx := context.Background()
+	collection := db.GetCollection(UsageCollection)
+	start, _ := invoices.Period(job.CreatedAt)
+	key := bson.M{"user_id": q.userID, "period_start": start}
+
+	_, err := collection.UpdateOne(ctx, key,
+		bson.M{"$setOnInsert": bson.M{"minutes": q.usage.UsedMinutes + q.usage.ReservedMinutes, "jobs": bson.A{}}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+
+	// Задача без длительности проходит, только пока квота не исчерпана
+	needed := minutes
+	if needed < 1 {
+		needed = 1
+	}
+	filter := bson.M{
+		"user_id":      q.userID,
+		"period_start": start,
+		"minutes":      bson.M{"$lte": q.plan.IncludedMinutes - needed},
+		"jobs.job_id":  bson.M{"$ne": job.ID},
+	}
+	result, err := collection.UpdateOne(ctx, filter, bson.M{
+		"$inc":  bson.M{"minutes": minutes},
+		"$push": bson.M{"jobs": bson.M{"job_id": job.ID, "minutes": minutes}},
+	})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount > 0 {
+		return nil
+	}
+
+	var counter struct {
+		Minutes int64 `bson:"minutes"`
+	}
+	if err := collection.FindOne(ctx, key).Decode(&counter); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %d of %d minutes used or reserved", ErrQuotaExceeded, counter.Minutes, q.plan.IncludedMinutes)
+}
+
+// Release снимает резервы задач, которые так и не были сохранены (отклонены после Reserve
+// или не вставились в базу). Резервы сохранённых задач остаются до их завершения.
+func (q *Quota) Release() {
+	if len(q.pending) == 0 {
+		return
+	}
+	ids := make([]primitive.ObjectID, 0, len(q.pending))
+	for _, job := range q.pending {
+		ids = append(ids, job.ID)
+	}
+	saved := map[primitive.ObjectID]bool{}
+	cursor, err := db.GetCollection("jobs").Find(context.Background(),
+		bson.M{"_id": bson.M{"$in": ids}},
+		options.Find().SetProjection(bson.M{"_id": 1}),
+	)
+	if err == nil {
+		var jobs []models.Job
+		if err = cursor.All(context.Background(), &jobs); err == nil {
+			for _, job := range jobs {
+				saved[job.ID] = true
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Error checking saved jobs of user %v: %v", q.userID, err)
+		return
+	}
+
+	for _, job := range q.pending {
+		if saved[job.ID] {
+			continue
+		}
+		if err := ReleaseJob(job); err != nil {
+			log.Printf("Error releasing quota of job %v: %v", job.ID, err)
+		}
+	}
+	q.pending = nil
+}
+
+// ReleaseJob возвращает в квоту минуты задачи, которая завершилась ошибкой или удалена
+// до выполнения, и освобождает её место в лимите параллельных задач. Повторный вызов
+// для той же задачи ничего не меняет.
+func ReleaseJob(job models.Job) error {
+	if err := ReleaseSlot(job); err != nil {
+		return err
+	}
+	return adjustMinutes(job, 0, false)
+}
+
+// SettleJob учитывает выполненную задачу по фактической длительности записи (MediaSeconds):
+// минуты её записи в счётчике периода заменяются фактическими, чтобы квота совпадала
+// с использованием в UsageFor, а место в лимите параллельных задач освобождается.
+// Повторный вызов для той же задачи ничего не меняет.
+func SettleJob(job models.Job) error {
+	if err := ReleaseSlot(job); err != nil {
+		return err
+	}
+	return adjustMinutes(job, JobMinutes(job), true)
+}
+
+// adjustMinutes меняет минуты записи задачи в счётчике периода на minutes: при keep запись
+// остаётся и помечается учтённой, иначе удаляется. Запись меняется одной операцией с условием,
+// поэтому разница применяется к счётчику один раз.
+func adjustMinutes(job models.Job, minutes int64, keep bool) error {
+	ctx := context.Background()
+	collection := db.GetCollection(UsageCollection)
+	start, _ := invoices.Period(job.CreatedAt)
+
+	filter := bson.M{"user_id": job.UserID, "period_start": start, "jobs.job_id": job.ID}
+	update := bson.M{"$pull": bson.M{"jobs": bson.M{"job_id": job.ID}}}
+	if keep {
+		delete(filter, "jobs.job_id")
+		filter["jobs"] = bson.M{"$elemMatch": bson.M{"job_id": job.ID, "settled": bson.M{"$ne": true}}}
+		update = bson.M{"$set": bson.M{"jobs.$.minutes": minutes, "jobs.$.settled": true}}
+	}
+	var counter struct {
+		Jobs []struct {
+			JobID   primitive.ObjectID `bson:"job_id"`
+			Minutes int64              `bson:"minutes"`
+		} `bson:"jobs"`
+	}
+	err := collection.FindOneAndUpdate(ctx, filter, update,
+		options.FindOneAndUpdate().SetProjection(bson.M{"jobs": bson.M{"$elemMatch": bson.M{"job_id": job.ID}}}),
+	).Decode(&counter)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(counter.Jobs) == 0 || counter.Jobs[0].Minutes == minutes {
+		return nil
+	}
+	_, err = collection.UpdateOne(ctx,
+		bson.M{"user_id": job.UserID, "period_start": start},
+		bson.M{"$inc": bson.M{"minutes": minutes - counter.Jobs[0].Minutes}},
+	)
+	return err
+}
+
+// reserveSlot атомарно занимает для задачи место в лимите параллельных задач пользователя:
+// задача добавляется в его список, только пока в списке меньше limit задач. Список создаётся
+// по задачам в работе; если мест нет, сначала освобождаются места задач, которые уже не в работе.
+func reserveSlot(userID, jobID primitive.ObjectID, limit int64, now time.Time) (bool, error) {
+	ctx := context.Background()
+	collection := db.GetCollection(SlotsCollection)
+
+	for cleaned := false; ; cleaned = true {
+		result, err := collection.UpdateOne(ctx, slotFilter(userID, jobID, limit), bson.M{
+			"$push": bson.M{"jobs": bson.M{"job_id": jobID, "reserved_at": now}},
+		})
+		if err != nil {
+			return false, err
+		}
+		if result.MatchedCount > 0 {
+			return true, nil
+		}
+
+		var slots slotList
+		err = collection.FindOne(ctx, bson.M{"user_id": userID}).Decode(&slots)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			if err := createSlots(userID, now); err != nil {
+				return false, err
+			}
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if slots.holds(jobID) {
+			return true, nil
+		}
+		if cleaned {
+			return false, nil
+		}
+		if err := cleanSlots(slots, now); err != nil {
+			return false, err
+		}
+	}
+}
+
+// slotList - места пользователя в лимите параллельных задач: задачи, которые их занимают.
+type slotList struct {
+	UserID primitive.ObjectID `bson:"user_id"`
+	Jobs   []slot             `bson:"jobs"`
+}
+
+type slot struct {
+	JobID      primitive.ObjectID `bson:"job_id"`
+	ReservedAt time.Time          `bson:"reserved_at"`
+}
+
+func (s slotList) holds(jobID primitive.ObjectID) bool {
+	for _, entry := range s.Jobs {
+		if entry.JobID == jobID {
+			return true
+		}
+	}
+	return false
+}
+
+// slotFilter выбирает список мест пользователя, в котором ещё нет задачи и меньше limit задач.
+func slotFilter(userID, jobID primitive.ObjectID, limit int64) bson.M {
+	return bson.M{
+		"user_id":                       userID,
+		"jobs.job_id":                   bson.M{"$ne": jobID},
+		fmt.Sprintf("jobs.%d", limit-1): bson.M{"$exists": false},
+	}
+}
+
+// createSlots создаёт список мест пользователя из его задач в работе.
+func createSlots(userID primitive.ObjectID, now time.Time) error {
+	ids, err := activeJobIDs(userID, nil)
+	if err != nil {
+		return err
+	}
+	jobs := bson.A{}
+	for _, id := range ids {
+		jobs = append(jobs, bson.M{"job_id": id, "reserved_at": now})
+	}
+	_, err = db.GetCollection(SlotsCollection).UpdateOne(context.Background(),
+		bson.M{"user_id": userID},
+		bson.M{"$setOnInsert": bson.M{"jobs": jobs}},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+// cleanSlots освобождает места задач, которые больше не в работе: завершённых, удалённых
+// или так и не сохранённых. Места, занятые меньше SlotGrace назад, не трогаются.
+func cleanSlots(slots slotList, now time.Time) error {
+	var candidates []primitive.ObjectID
+	for _, entry := range slots.Jobs {
+		if now.Sub(entry.ReservedAt) >= SlotGrace {
+			candidates = append(candidates, entry.JobID)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	active, err := activeJobIDs(slots.UserID, candidates)
+	if err != nil {
+		return err
+	}
+	stale := staleSlots(candidates, active)
+	if len(stale) == 0 {
+		return nil
+	}
+	_, err = db.GetCollection(SlotsCollection).UpdateOne(context.Background(),
+		bson.M{"user_id": slots.UserID},
+		bson.M{"$pull": bson.M{"jobs": bson.M{"job_id": bson.M{"$in": stale}}}},
+	)
+	return err
+}
+
+// staleSlots возвращает задачи из candidates, которых нет среди задач в работе.
+func staleSlots(candidates, active []primitive.ObjectID) []primitive.ObjectID {
+	running := map[primitive.ObjectID]bool{}
+	for _, id := range active {
+		running[id] = true
+	}
+	var stale []primitive.ObjectID
+	for _, id := range candidates {
+		if !running[id] {
+			stale = append(stale, id)
+		}
+	}
+	return stale
+}
+
+// activeJobIDs возвращает задачи пользователя в работе; непустой ids ограничивает выборку.
+func activeJobIDs(userID primitive.ObjectID, ids []primitive.ObjectID) ([]primitive.ObjectID, error) {
+	filter := bson.M{
+		"user_id":   userID,
+		"status":    bson.M{"$in": activeStatuses},
+		"parent_id": bson.M{"$exists": false},
+	}
+	if ids != nil {
+		filter["_id"] = bson.M{"$in": ids}
+	}
+	cursor, err := db.GetCollection("jobs").Find(context.Background(), filter,
+		options.Find().SetProjection(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []models.Job
+	if err := cursor.All(context.Background(), &jobs); err != nil {
+		return nil, err
+	}
+	result := make([]primitive.ObjectID, 0, len(jobs))
+	for _, job := range jobs {
+		result = append(result, job.ID)
+	}
+	return result, nil
+}
+
+// ReleaseSlot освобождает место задачи в лимите параллельных задач: задача завершена, удалена
+// или ждёт (оплаты или своего времени). Повторный вызов ничего не меняет.
+func ReleaseSlot(job models.Job) error {
+	_, err := db.GetCollection(SlotsCollection).UpdateOne(context.Background(),
+		bson.M{"user_id": job.UserID},
+		bson.M{"$pull": bson.M{"jobs": bson.M{"job_id": job.ID}}},
+	)
+	return err
+}
+
+// Dispatcher ограничивает лимитом параллельных задач плана отправку в работу отложенных задач
+// и задач, ждавших оплаты. Задачи сверх лимита остаются ждать, пока место не освободится.
+// Лимит плана читается один раз на пользователя, поэтому один Dispatcher используется
+// для одного прохода по задачам.
+type Dispatcher struct {
+	limits map[primitive.ObjectID]int64
+}
+
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{limits: map[primitive.ObjectID]int64{}}
+}
+
+// Allow возвращает true и атомарно занимает место задачи, если её можно отправить в работу.
+// Если задачу отправить не удалось, место освобождает ReleaseSlot.
+func (d *Dispatcher) Allow(job models.Job) (bool, error) {
+	limit, ok := d.limits[job.UserID]
+	if !ok {
+		var user models.User
+		err := db.GetCollection("users").FindOne(context.Background(), bson.M{"_id": job.UserID},
+			options.FindOne().SetProjection(bson.M{"plan": 1}),
+		).Decode(&user)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return false, err
+		}
+		plan, err := Find(user.Plan)
+		if err != nil {
+			return false, err
+		}
+		if plan != nil {
+			limit = plan.MaxConcurrency
+		}
+		d.limits[job.UserID] = limit
+	}
+	if limit <= 0 {
+		return true, nil
+	}
+	return reserveSlot(job.UserID, job.ID, limit, time.Now())
+}
@@ -0,0 +1,62 @@
+package plans
+
+import (
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestJobMinutes(t *testing.T) {
+	tests := []struct {
+		name string
+		job  models.Job
+		want int64
+	}{
+		{"no duration", models.Job{}, 0},
+		{"declared duration", models.Job{DurationSeconds: 61}, 2},
+		{"actual duration wins", models.Job{DurationSeconds: 600, MediaSeconds: 90}, 2},
+		{"whole minutes", models.Job{MediaSeconds: 120}, 2},
+	}
+	for _, tt := range tests {
+		if got := JobMinutes(tt.job); got != tt.want {
+			t.Errorf("%s: JobMinutes() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSlotFilter(t *testing.T) {
+	userID, jobID := primitive.NewObjectID(), primitive.NewObjectID()
+	// При лимите 3 задача добавляется, только пока в списке нет третьего элемента
+	want := bson.M{
+		"user_id":     userID,
+		"jobs.job_id": bson.M{"$ne": jobID},
+		"jobs.2":      bson.M{"$exists": false},
+	}
+	if got := slotFilter(userID, jobID, 3); !reflect.DeepEqual(got, want) {
+		t.Errorf("slotFilter() = %v, want %v", got, want)
+	}
+}
+
+func TestStaleSlots(t *testing.T) {
+	running, finished, deleted := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	got := staleSlots([]primitive.ObjectID{running, finished, deleted}, []primitive.ObjectID{running})
+	want := []primitive.ObjectID{finished, deleted}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("staleSlots() = %v, want %v", got, want)
+	}
+	if got := staleSlots([]primitive.ObjectID{running}, []primitive.ObjectID{running}); len(got) != 0 {
+		t.Errorf("staleSlots() = %v, want none", got)
+	}
+}
+
+func TestSlotListHolds(t *testing.T) {
+	held, other := primitive.NewObjectID(), primitive.NewObjectID()
+	slots := slotList{Jobs: []slot{{JobID: held, ReservedAt: time.Now()}}}
+	if !slots.holds(held) || slots.holds(other) {
+		t.Errorf("holds(%v) = %v, holds(%v) = %v; want true and false", held, slots.holds(held), other, slots.holds(other))
+	}
+}
@@ -0,0 +1,221 @@
+package pricing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/money"
+	"math"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Приоритеты задач
+const (
+	PriorityStandard = "standard"
+	PriorityExpress  = "express"
+	PriorityUrgent   = "urgent"
+)
+
+var Priorities = []string{PriorityStandard, PriorityExpress, PriorityUrgent}
+
+// Позиции расчёта
+const (
+	ItemTranscription = "transcription"
+	ItemTranslation   = "translation"
+	ItemDiarization   = "diarization"
+	ItemPriority      = "priority"
+	ItemMinimum       = "minimum"
+	ItemDiscount      = "discount"
+)
+
+// ErrUnknownDuration - у задачи не указана длительность записи, цену рассчитать нельзя.
+var ErrUnknownDuration = errors.New("job duration is unknown")
+
+// DefaultRule действует, если в коллекции price_rules нет ни правила плана, ни правила по умолчанию.
+var DefaultRule = models.PriceRule{
+	PerMinute:            money.New(10, "USD"),
+	TranslationPerMinute: money.New(5, "USD"),
+	DiarizationPerMinute: money.New(2, "USD"),
+	Minimum:              money.New(100, "USD"),
+	PriorityMarkups:      map[string]int64{PriorityExpress: 50, PriorityUrgent: 100},
+}
+
+// Quote - расчёт цены задачи по позициям.
+type Quote struct {
+	Plan     string              `json:"plan"`
+	RuleID   *primitive.ObjectID `json:"rule_id,omitempty"`
+	Priority string              `json:"priority"`
+	Minutes  int64               `json:"minutes"`
+	Lines    []Line              `json:"lines"`
+	Total    money.Money         `json:"total"`
+	// Промокод, скидка по которому учтена отдельной позицией
+	PromoCode string `json:"promo_code,omitempty"`
+}
+
+// Line - позиция расчёта. Quantity - число оплачиваемых минут (для перевода - минут на языки).
+// Сумма позиции скидки отрицательная.
+type Line struct {
+	Item     string      `json:"item"`
+	Quantity int64       `json:"quantity,omitempty"`
+	Amount   money.Money `json:"amount"`
+}
+
+// IsKnownPriority проверяет приоритет задачи. Пустой приоритет означает standard.
+func IsKnownPriority(priority string) bool {
+	if priority == "" {
+		return true
+	}
+	for _, known := range Priorities {
+		if priority == known {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateRule проверяет, что все цены правила в одной известной валюте и не отрицательны.
+func ValidateRule(rule models.PriceRule) error {
+	if err := rule.PerMinute.Validate(); err != nil {
+		return err
+	}
+	currency := rule.PerMinute.Currency
+	for name, price := range map[string]money.Money{
+		"per_minute":             rule.PerMinute,
+		"translation_per_minute": rule.TranslationPerMinute,
+		"diarization_per_minute": rule.DiarizationPerMinute,
+		"minimum":                rule.Minimum,
+	} {
+		if price.Currency != currency {
+			return fmt.Errorf("%s must be in %s", name, currency)
+		}
+		if price.Amount < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	for priority, markup := range rule.PriorityMarkups {
+		if priority == "" || !IsKnownPriority(priority) {
+			return fmt.Errorf("unknown priority %q", priority)
+		}
+		if markup < 0 {
+			return fmt.Errorf("markup for %s must not be negative", priority)
+		}
+	}
+	return nil
+}
+
+// RuleFor возвращает правило для тарифного плана: правило плана, иначе правило по умолчанию
+// из базы, иначе DefaultRule.
+func RuleFor(plan string) (models.PriceRule, error) {
+	rulesCollection := db.GetCollection("price_rules")
+	plans := []string{plan}
+	if plan != "" {
+		plans = append(plans, "")
+	}
+	for _, candidate := range plans {
+		var rule models.PriceRule
+		err := rulesCollection.FindOne(context.Background(), bson.M{"plan": candidate}).Decode(&rule)
+		if err == nil {
+			return rule, nil
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return models.PriceRule{}, err
+		}
+	}
+	return DefaultRule, nil
+}
+
+// QuoteJob рассчитывает цену задачи для пользователя по правилу его тарифного плана.
+func QuoteJob(user models.User, job models.Job) (Quote, error) {
+	rule, err := RuleFor(user.Plan)
+	if err != nil {
+		return Quote{}, err
+	}
+	quote, err := Calculate(rule, job)
+	if err != nil {
+		return Quote{}, err
+	}
+	quote.Plan = user.Plan
+	return quote, nil
+}
+
+// Calculate рассчитывает цену задачи по правилу. Оплачивается каждая начатая минута записи:
+// распознавание, перевод на каждый язык и диаризация; к сумме добавляется надбавка за приоритет
+// (с округлением до минимальной единицы валюты), итог не может быть меньше минимальной цены.
+func Calculate(rule models.PriceRule, job models.Job) (Quote, error) {
+	if job.DurationSeconds <= 0 {
+		return Quote{}, ErrUnknownDuration
+	}
+	priority := job.Priority
+	if priority == "" {
+		priority = PriorityStandard
+	}
+	if !IsKnownPriority(priority) {
+		return Quote{}, fmt.Errorf("unknown priority %q", priority)
+	}
+	if job.DurationSeconds > math.MaxInt32*60 {
+		return Quote{}, money.ErrOverflow
+	}
+
+	minutes := int64(math.Ceil(job.DurationSeconds / 60))
+	quote := Quote{
+		Priority: priority,
+		Minutes:  minutes,
+		Lines:    []Line{},
+		Total:    money.New(0, rule.PerMinute.Currency),
+	}
+	// У встроенного правила идентификатора нет
+	if !rule.ID.IsZero() {
+		quote.RuleID = &rule.ID
+	}
+
+	add := func(item string, quantity int64, price money.Money) error {
+		amount, err := price.Mul(quantity)
+		if err != nil {
+			return err
+		}
+		quote.Lines = append(quote.Lines, Line{Item: item, Quantity: quantity, Amount: amount})
+		quote.Total, err = quote.Total.Add(amount)
+		return err
+	}
+
+	if err := add(ItemTranscription, minutes, rule.PerMinute); err != nil {
+		return Quote{}, err
+	}
+	if len(job.TargetLanguages) > 0 {
+		if err := add(ItemTranslation, minutes*int64(len(job.TargetLanguages)), rule.TranslationPerMinute); err != nil {
+			return Quote{}, err
+		}
+	}
+	if job.Diarization {
+		if err := add(ItemDiarization, minutes, rule.DiarizationPerMinute); err != nil {
+			return Quote{}, err
+		}
+	}
+
+	if markup := rule.PriorityMarkups[priority]; markup > 0 {
+		scaled, err := quote.Total.Mul(markup)
+		if err != nil {
+			return Quote{}, err
+		}
+		amount := money.New((scaled.Amount+50)/100, scaled.Currency)
+		quote.Lines = append(quote.Lines, Line{Item: ItemPriority, Amount: amount})
+		if quote.Total, err = quote.Total.Add(amount); err != nil {
+			return Quote{}, err
+		}
+	}
+
+	if quote.Total.Amount < rule.Minimum.Amount {
+		amount, err := rule.Minimum.Sub(quote.Total)
+		if err != nil {
+			return Quote{}, err
+		}
+		quote.Lines = append(quote.Lines, Line{Item: ItemMinimum, Amount: amount})
+		quote.Total = rule.Minimum
+	}
+	return quote, nil
+}
@@ -0,0 +1,107 @@
+package pricing
+
+import (
+	"errors"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/money"
+	"math"
+	"testing"
+)
+
+func TestCalculate(t *testing.T) {
+	usd := func(amount int64) money.Money { return money.New(amount, "USD") }
+	// Правило без минимальной цены, чтобы было видно округление надбавки
+	cheap := models.PriceRule{
+		PerMinute:       usd(3),
+		Minimum:         usd(0),
+		PriorityMarkups: map[string]int64{PriorityExpress: 50, PriorityUrgent: 33},
+	}
+	tests := []struct {
+		name    string
+		rule    models.PriceRule
+		job     models.Job
+		minutes int64
+		total   money.Money
+		items   []string
+	}{
+		{"started minute is billed", cheap, models.Job{DurationSeconds: 61}, 2, usd(6), []string{ItemTranscription}},
+		{"whole minutes", cheap, models.Job{DurationSeconds: 120}, 2, usd(6), []string{ItemTranscription}},
+		{"markup rounds half up", cheap, models.Job{DurationSeconds: 60, Priority: PriorityExpress}, 1, usd(5), []string{ItemTranscription, ItemPriority}},
+		{"markup rounds down", cheap, models.Job{DurationSeconds: 60, Priority: PriorityUrgent}, 1, usd(4), []string{ItemTranscription, ItemPriority}},
+		{"minimum price", DefaultRule, models.Job{DurationSeconds: 30}, 1, usd(100), []string{ItemTranscription, ItemMinimum}},
+		{"all options", DefaultRule, models.Job{DurationSeconds: 600, TargetLanguages: []string{"en", "de"}, Diarization: true}, 10, usd(220), []string{ItemTranscription, ItemTranslation, ItemDiarization}},
+		{"all options express", DefaultRule, models.Job{DurationSeconds: 600, TargetLanguages: []string{"en", "de"}, Diarization: true, Priority: PriorityExpress}, 10, usd(330), []string{ItemTranscription, ItemTranslation, ItemDiarization, ItemPriority}},
+		{"other currency", models.PriceRule{PerMinute: money.New(1, "JPY"), Minimum: money.New(0, "JPY")}, models.Job{DurationSeconds: 90}, 2, money.New(2, "JPY"), []string{ItemTranscription}},
+	}
+	for _, tt := range tests {
+		quote, err := Calculate(tt.rule, tt.job)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if quote.Minutes != tt.minutes || quote.Total != tt.total {
+			t.Errorf("%s: minutes %d, total %v; want %d, %v", tt.name, quote.Minutes, quote.Total, tt.minutes, tt.total)
+		}
+		if len(quote.Lines) != len(tt.items) {
+			t.Errorf("%s: lines %+v, want %v", tt.name, quote.Lines, tt.items)
+			continue
+		}
+		sum := money.New(0, tt.total.Currency)
+		for i, line := range quote.Lines {
+			if line.Item != tt.items[i] {
+				t.Errorf("%s: line %d is %s, want %s", tt.name, i, line.Item, tt.items[i])
+			}
+			sum, _ = sum.Add(line.Amount)
+		}
+		if sum != quote.Total {
+			t.Errorf("%s: lines sum to %v, total %v", tt.name, sum, quote.Total)
+		}
+	}
+}
+
+func TestCalculateErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule models.PriceRule
+		job  models.Job
+		err  error
+	}{
+		{"unknown duration", DefaultRule, models.Job{}, ErrUnknownDuration},
+		{"negative duration", DefaultRule, models.Job{DurationSeconds: -1}, ErrUnknownDuration},
+		{"too long", DefaultRule, models.Job{DurationSeconds: math.MaxInt32 * 61}, money.ErrOverflow},
+		{"price overflow", models.PriceRule{PerMinute: money.New(math.MaxInt64/2, "USD")}, models.Job{DurationSeconds: 180}, money.ErrOverflow},
+	}
+	for _, tt := range tests {
+		if _, err := Calculate(tt.rule, tt.job); !errors.Is(err, tt.err) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+	if _, err := Calculate(DefaultRule, models.Job{DurationSeconds: 60, Priority: "asap"}); err == nil {
+		t.Error("unknown priority accepted")
+	}
+}
+
+func TestValidateRule(t *testing.T) {
+	if err := ValidateRule(DefaultRule); err != nil {
+		t.Errorf("DefaultRule: %v", err)
+	}
+	mismatch := DefaultRule
+	mismatch.Minimum = money.New(100, "EUR")
+	negative := DefaultRule
+	negative.DiarizationPerMinute = money.New(-1, "USD")
+	unknownPriority := DefaultRule
+	unknownPriority.PriorityMarkups = map[string]int64{"asap": 10}
+	negativeMarkup := DefaultRule
+	negativeMarkup.PriorityMarkups = map[string]int64{PriorityExpress: -10}
+	for name, rule := range map[string]models.PriceRule{
+		"currency mismatch": mismatch,
+		"negative price":    negative,
+		"unknown priority":  unknownPriority,
+		"negative markup":   negativeMarkup,
+		"unknown currency":  {PerMinute: money.New(1, "XXX")},
+	} {
+		if err := ValidateRule(rule); err == nil {
+			t.Errorf("%s: rule accepted", name)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package retention
+
+import (
+	"context"
+	"github.com/moevm/nosql2h24-transcribtion/config"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"github.com/moevm/nosql2h24-transcribtion/plans"
+	"github.com/moevm/nosql2h24-transcribtion/storage"
+	"github.com/moevm/nosql2h24-transcribtion/timeline"
+	"log"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Default - сроки хранения для пользователей без собственной политики
+var Default = models.RetentionPolicy{MediaDays: 7, TranscriptDays: 365}
+
+// DefaultInterval - период запуска очистки
+const DefaultInterval = time.Hour
+
+// Виды удаляемых данных
+const (
+	KindMedia       = "media"
+	KindTranscripts = "transcripts"
+)
+
+// Purge - запланированное удаление данных задачи.
+type Purge struct {
+	JobID   primitive.ObjectID `json:"job_id"`
+	UserID  primitive.ObjectID `json:"user_id"`
+	Title   string             `json:"title"`
+	Kind    string             `json:"kind"`
+	PurgeAt time.Time          `json:"purge_at"`
+}
+
+// Configure задаёт сроки хранения по умолчанию из конфигурации.
+func Configure(cfg config.Config) {
+	Default = models.RetentionPolicy{
+		MediaDays:      cfg.RetentionMediaDays,
+		TranscriptDays: cfg.RetentionTranscriptDays,
+	}
+}
+
+// For возвращает политику хранения пользователя: собственную, иначе политику его тарифного плана,
+// иначе политику по умолчанию.
+func For(user models.User) models.RetentionPolicy {
+	if user.Retention != nil {
+		return *user.Retention
+	}
+	plan, err := plans.Find(user.Plan)
+	if err != nil {
+		log.Printf("Error fetching plan %q of user %v: %v", user.Plan, user.ID, err)
+	}
+	if plan != nil && plan.Retention != nil {
+		return *plan.Retention
+	}
+	return Default
+}
+
+// Run периодически удаляет данные, срок хранения которых истёк.
+func Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if err := PurgeExpired(now); err != nil {
+			log.Printf("Error purging expired data: %v", err)
+		}
+	}
+}
+
+// PurgeExpired удаляет входные файлы и расшифровки задач, срок хранения которых истёк к моменту now.
+// Задача при этом не удаляется: в ней отмечается время удаления данных.
+func PurgeExpired(now time.Time) error {
+	users, err := allUsers()
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		policy := For(user)
+		if policy.MediaDays > 0 {
+			if err := purgeMedia(user.ID, now.AddDate(0, 0, -policy.MediaDays), now); err != nil {
+				log.Printf("Error purging media of user %v: %v", user.ID, err)
+			}
+		}
+		if policy.TranscriptDays > 0 {
+			if err := purgeTranscripts(user.ID, now.AddDate(0, 0, -policy.TranscriptDays), now); err != nil {
+				log.Printf("Error purging transcripts of user %v: %v", user.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Upcoming возвращает удаления, которые произойдут в ближайшие window (и просроченные, если
+// очистка ещё не успела их выполнить), в порядке наступления.
+func Upcoming(now time.Time, window time.Duration) ([]Purge, error) {
+	users, err := allUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	purges := []Purge{}
+	for _, user := range users {
+		policy := For(user)
+		for _, rule := range []struct {
+			kind, purgedField string
+			days              int
+		}{
+			{KindMedia, "media_purged_at", policy.MediaDays},
+			{KindTranscripts, "transcripts_purged_at", policy.TranscriptDays},
+		} {
+			if rule.days <= 0 {
+				continue
+			}
+			retention := time.Duration(rule.days) * 24 * time.Hour
+			jobs, err := expiredJobs(user.ID, rule.purgedField, now.Add(window).Add(-retention))
+			if err != nil {
+				return nil, err
+			}
+			for _, job := range jobs {
+				purges = append(purges, Purge{
+					JobID:   job.ID,
+					UserID:  user.ID,
+					Title:   job.Title,
+					Kind:    rule.kind,
+					PurgeAt: finishedAt(job).Add(retention),
+				})
+			}
+		}
+	}
+
+	sort.Slice(purges, func(i, j int) bool { return purges[i].PurgeAt.Before(purges[j].PurgeAt) })
+	return purges, nil
+}
+
+func purgeMedia(userID primitive.ObjectID, cutoff, now time.Time) error {
+	jobs, err := expiredJobs(userID, "media_purged_at", cutoff)
+	if err != nil {
+		return err
+	}
+	jobsCollection := db.GetCollection("jobs")
+
+	for _, job := range jobs {
+		// Отметка ставится только после удаления файла: при ошибке задача попадёт в следующий проход
+		if err := releaseMedia(userID, job.InputFile, cutoff, job.ID); err != nil {
+			return err
+		}
+		result, err := jobsCollection.UpdateOne(context.Background(),
+			bson.M{"_id": job.ID, "media_purged_at": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"media_purged_at": now}},
+		)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount == 0 {
+			continue
+		}
+		timeline.Record(job.ID, timeline.MediaPurged, primitive.NilObjectID, timeline.Details{"input_file": job.InputFile})
+	}
+
+	// Загрузки, так и не использованные в задачах
+	cursor, err := db.GetCollection("uploads").Find(context.Background(), bson.M{
+		"user_id":    userID,
+		"created_at": bson.M{"$lte": cutoff},
+	})
+	if err != nil {
+		return err
+	}
+	var uploads []models.Upload
+	if err := cursor.All(context.Background(), &uploads); err != nil {
+		return err
+	}
+	for _, upload := range uploads {
+		if err := releaseMedia(userID, upload.Path, cutoff, primitive.NilObjectID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseMedia удаляет старые загрузки пользователя с этим файлом, если он больше не нужен его
+// задачам, а сам файл - если на него не ссылается ни одна загрузка или задача. Одинаковые
+// файлы хранятся один раз, поэтому файл может использоваться и другими пользователями.
+// Задача purging - та, чьи входные данные сейчас удаляются: она файл уже не держит.
+func releaseMedia(userID primitive.ObjectID, path string, cutoff time.Time, purging primitive.ObjectID) error {
+	jobsCollection := db.GetCollection("jobs")
+	uploadsCollection := db.GetCollection("uploads")
+
+	inUse, err := jobsCollection.CountDocuments(context.Background(), bson.M{
+		"_id":             bson.M{"$ne": purging},
+		"user_id":         userID,
+		"input_file":      path,
+		"media_purged_at": bson.M{"$exists": false},
+	})
+	if err != nil || inUse > 0 {
+		return err
+	}
+	_, err = uploadsCollection.DeleteMany(context.Background(), bson.M{
+		"user_id":    userID,
+		"path":       path,
+		"created_at": bson.M{"$lte": cutoff},
+	})
+	if err != nil {
+		return err
+	}
+
+	uploads, err := uploadsCollection.CountDocuments(context.Background(), bson.M{"path": path})
+	if err != nil || uploads > 0 {
+		return err
+	}
+	jobs, err := jobsCollection.CountDocuments(context.Background(), bson.M{
+		"_id":             bson.M{"$ne": purging},
+		"input_file":      path,
+		"media_purged_at": bson.M{"$exists": false},
+	})
+	if err != nil || jobs > 0 {
+		return err
+	}
+	_, err = storage.Remove(path)
+	return err
+}
+
+func purgeTranscripts(userID primitive.ObjectID, cutoff, now time.Time) error {
+	jobs, err := expiredJobs(userID, "transcripts_purged_at", cutoff)
+	if err != nil {
+		return err
+	}
+	jobsCollection := db.GetCollection("jobs")
+	transcriptsCollection := db.GetCollection("transcripts")
+
+	for _, job := range jobs {
+		// Пока результат переиспользуют более новые задачи, он удаляется вместе с ними
+		reusers, err := jobsCollection.CountDocuments(context.Background(), bson.M{
+			"reused_from_job_id":    job.ID,
+			"transcripts_purged_at": bson.M{"$exists": false},
+		})
+		if err != nil {
+			return err
+		}
+		if reusers > 0 {
+			continue
+		}
+
+		deleted, err := transcriptsCollection.DeleteMany(context.Background(), bson.M{"job_id": job.ID})
+		if err != nil {
+			return err
+		}
+		_, err = jobsCollection.UpdateOne(context.Background(),
+			bson.M{"_id": job.ID},
+			bson.M{"$set": bson.M{"transcripts_purged_at": now}},
+		)
+		if err != nil {
+			return err
+		}
+		timeline.Record(job.ID, timeline.TranscriptsPurged, primitive.NilObjectID, timeline.Details{"deleted": deleted.DeletedCount})
+	}
+	return nil
+}
+
+// expiredJobs возвращает завершённые до cutoff задачи пользователя, у которых ещё не удалены
+// данные, отмечаемые полем purgedField. Для задач, завершённых до появления completed_at,
+// временем завершения считается updated_at.
+func expiredJobs(userID primitive.ObjectID, purgedField string, cutoff time.Time) ([]models.Job, error) {
+	filter := bson.M{
+		"user_id":   userID,
+		"status":    bson.M{"$in": []string{"completed", "failed"}},
+		purgedField: bson.M{"$exists": false},
+		"$or": []bson.M{
+			{"completed_at": bson.M{"$lte": cutoff}},
+			{"completed_at": bson.M{"$exists": false}, "updated_at": bson.M{"$lte": cutoff}},
+		},
+	}
+	cursor, err := db.GetCollection("jobs").Find(context.Background(), filter)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []models.Job
+	err = cursor.All(context.Background(), &jobs)
+	return jobs, err
+}
+
+func finishedAt(job models.Job) time.Time {
+	if !job.CompletedAt.IsZero() {
+		return job.CompletedAt
+	}
+	return job.UpdatedAt
+}
+
+func allUsers() ([]models.User, error) {
+	cursor, err := db.GetCollection("users").Find(context.Background(), bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var users []models.User
+	err = cursor.All(context.Background(), &users)
+	return users, err
+}
@@ -0,0 +1,11 @@
+package routes
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/moevm/nosql2h24-transcribtion/handlers"
+)
+
+func AdminRoutes(r chi.Router) {
+	r.Get("/admin/fleet/ws", handlers.FleetMonitor)
+	r.Get("/admin/purges/upcoming", handlers.GetUpcomingPurges)
+}
@@ -0,0 +1,15 @@
+package routes
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/moevm/nosql2h24-transcribtion/handlers"
+)
+
+func DiscountRoutes(r chi.Router) {
+	r.Get("/admin/discounts", handlers.GetDiscounts)
+	r.Post("/admin/discounts", handlers.CreateDiscount)
+	r.Get("/admin/discounts/{discount_id}", handlers.GetDiscount)
+	r.Put("/admin/discounts/{discount_id}", handlers.UpdateDiscount)
+	r.Delete("/admin/discounts/{discount_id}", handlers.DeleteDiscount)
+	r.Get("/admin/discounts/{discount_id}/redemptions", handlers.GetDiscountRedemptions)
+}
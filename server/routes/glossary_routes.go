@@ -0,0 +1,14 @@
+package routes
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/moevm/nosql2h24-transcribtion/handlers"
+)
+
+func GlossaryRoutes(r chi.Router) {
+	r.Get("/users/{id}/glossaries", handlers.GetUserGlossaries)
+	r.Post("/users/{id}/glossaries", handlers.CreateUserGlossary)
+	r.Get("/users/{id}/glossaries/{glossary_id}", handlers.GetUserGlossary)
+	r.Put("/users/{id}/glossaries/{glossary_id}", handlers.UpdateUserGlossary)
+	r.Delete("/users/{id}/glossaries/{glossary_id}", handlers.DeleteUserGlossary)
+}
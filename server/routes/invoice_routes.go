@@ -0,0 +1,12 @@
+package routes
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/moevm/nosql2h24-transcribtion/handlers"
+)
+
+func InvoiceRoutes(r chi.Router) {
+	r.Get("/users/{id}/invoices", handlers.GetUserInvoices)
+	r.Post("/users/{id}/invoices", handlers.GenerateUserInvoices)
+	r.Get("/users/{id}/invoices/{invoice_id}", handlers.GetUserInvoice)
+}
@@ -0,0 +1,17 @@
+package routes
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/moevm/nosql2h24-transcribtion/handlers"
+)
+
+func JobRoutes(r chi.Router) {
+	r.Get("/jobs/events", handlers.StreamJobsEvents)
+	r.Get("/jobs/{id}/events", handlers.StreamJobEvents)
+
+	r.Get("/jobs/{id}/transcripts", handlers.GetJobTranscripts)
+	r.Get("/jobs/{id}/transcripts/{language}", handlers.DownloadJobTranscript)
+	r.Get("/jobs/{id}/timeline", handlers.GetJobTimeline)
+	r.Get("/jobs/{id}/speakers", handlers.GetJobSpeakers)
+	r.Put("/jobs/{id}/speakers", handlers.RenameJobSpeakers)
+}
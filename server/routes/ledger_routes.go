@@ -0,0 +1,14 @@
+package routes
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/moevm/nosql2h24-transcribtion/handlers"
+)
+
+func LedgerRoutes(r chi.Router) {
+	r.Get("/users/{id}/balance", handlers.GetUserBalance)
+	r.Get("/users/{id}/ledger", handlers.GetUserLedger)
+	r.Post("/users/{id}/ledger/adjustments", handlers.AdjustUserBalance)
+
+	r.Get("/admin/ledger/reconcile", handlers.ReconcileLedger)
+}
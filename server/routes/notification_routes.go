@@ -0,0 +1,14 @@
+package routes
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/moevm/nosql2h24-transcribtion/handlers"
+)
+
+func NotificationRoutes(r chi.Router) {
+	r.Get("/users/{id}/notifications", handlers.GetUserNotifications)
+	r.Post("/users/{id}/notifications/read-all", handlers.MarkAllNotificationsRead)
+	r.Post("/users/{id}/notifications/{notification_id}/read", handlers.MarkNotificationRead)
+	r.Get("/users/{id}/notification-preferences", handlers.GetNotificationPreferences)
+	r.Put("/users/{id}/notification-preferences", handlers.UpdateNotificationPreferences)
+}
@@ -0,0 +1,19 @@
+package routes
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/moevm/nosql2h24-transcribtion/handlers"
+)
+
+func PaymentRoutes(r chi.Router) {
+	r.Get("/payments", handlers.GetPayments)
+
+	r.Get("/payments/{id}/refunds", handlers.GetPaymentRefunds)
+	r.Post("/payments/{id}/refunds", handlers.CreateRefund)
+	r.Get("/refunds", handlers.GetRefunds)
+	r.Post("/refunds/{refund_id}/approve", handlers.ApproveRefund)
+	r.Post("/refunds/{refund_id}/reject", handlers.RejectRefund)
+
+	r.Post("/payments/webhooks/{provider}", handlers.PaymentProviderWebhook)
+	r.Post("/payments/mock/{intent_id}/confirm", handlers.ConfirmMockPayment)
+}
@@ -0,0 +1,14 @@
+package routes
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/moevm/nosql2h24-transcribtion/handlers"
+)
+
+func PlanRoutes(r chi.Router) {
+	r.Get("/plans", handlers.GetPlans)
+
+	r.Post("/admin/plans", handlers.CreatePlan)
+	r.Put("/admin/plans/{plan_id}", handlers.UpdatePlan)
+	r.Delete("/admin/plans/{plan_id}", handlers.DeletePlan)
+}
@@ -0,0 +1,15 @@
+package routes
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/moevm/nosql2h24-transcribtion/handlers"
+)
+
+func PricingRoutes(r chi.Router) {
+	r.Post("/jobs/quote", handlers.QuoteJob)
+
+	r.Get("/admin/price-rules", handlers.GetPriceRules)
+	r.Post("/admin/price-rules", handlers.CreatePriceRule)
+	r.Put("/admin/price-rules/{rule_id}", handlers.UpdatePriceRule)
+	r.Delete("/admin/price-rules/{rule_id}", handlers.DeletePriceRule)
+}
@@ -12,7 +12,7 @@ func NewRouter() chi.Router {
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "X-User-ID", "Last-Event-ID"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: true,
 		MaxAge:           300,
@@ -21,6 +21,19 @@ func NewRouter() chi.Router {
 
 	UserRoutes(r)
 	ServerRoutes(r)
+	JobRoutes(r)
+	GlossaryRoutes(r)
+	ScheduleRoutes(r)
+	TemplateRoutes(r)
+	WebhookRoutes(r)
+	NotificationRoutes(r)
+	PricingRoutes(r)
+	DiscountRoutes(r)
+	PlanRoutes(r)
+	PaymentRoutes(r)
+	LedgerRoutes(r)
+	InvoiceRoutes(r)
+	AdminRoutes(r)
 	bdDumpRoutes(r)
 
 	return r
@@ -0,0 +1,14 @@
+package routes
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/moevm/nosql2h24-transcribtion/handlers"
+)
+
+func ScheduleRoutes(r chi.Router) {
+	r.Get("/users/{id}/schedules", handlers.GetUserSchedules)
+	r.Post("/users/{id}/schedules", handlers.CreateUserSchedule)
+	r.Get("/users/{id}/schedules/{schedule_id}", handlers.GetUserSchedule)
+	r.Put("/users/{id}/schedules/{schedule_id}", handlers.UpdateUserSchedule)
+	r.Delete("/users/{id}/schedules/{schedule_id}", handlers.DeleteUserSchedule)
+}
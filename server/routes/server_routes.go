@@ -12,6 +12,7 @@ func ServerRoutes(r chi.Router) {
 	r.Put("/servers/{id}", handlers.UpdateServer)
 	r.Patch("/servers/{id}", handlers.PatchServer)
 	r.Delete("/servers/{id}", handlers.DeleteServer)
+	r.Post("/servers/{id}/heartbeat", handlers.ServerHeartbeat)
 
 	r.Get("/servers/{id}/currentJobs", handlers.GetServerCurrentJobs)
 	r.Get("/servers/{id}/completedJobs", handlers.GetServerCompletedJobs)
@@ -0,0 +1,15 @@
+package routes
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/moevm/nosql2h24-transcribtion/handlers"
+)
+
+func TemplateRoutes(r chi.Router) {
+	r.Get("/users/{id}/templates", handlers.GetUserTemplates)
+	r.Post("/users/{id}/templates", handlers.CreateUserTemplate)
+	r.Get("/users/{id}/templates/{template_id}", handlers.GetUserTemplate)
+	r.Put("/users/{id}/templates/{template_id}", handlers.UpdateUserTemplate)
+	r.Delete("/users/{id}/templates/{template_id}", handlers.DeleteUserTemplate)
+	r.Post("/users/{id}/templates/{template_id}/jobs", handlers.CreateJobFromTemplate)
+}
@@ -17,8 +17,22 @@ func UserRoutes(r chi.Router) {
 
 	r.Get("/users/{id}/jobs", handlers.GetUserJobs)
 	r.Post("/users/{id}/jobs", handlers.AddUserJob)
+	r.Post("/users/{id}/jobs/batch", handlers.AddUserJobsBatch)
 	r.Delete("/users/{id}/jobs/{jobId}", handlers.DeleteUserJob)
 
+	r.Get("/users/{id}/retention", handlers.GetUserRetention)
+	r.Put("/users/{id}/retention", handlers.UpdateUserRetention)
+
+	r.Get("/users/{id}/uploads", handlers.GetUserUploads)
+	r.Post("/users/{id}/uploads", handlers.UploadUserFile)
+
+	r.Get("/users/{id}/billing", handlers.GetUserBilling)
+	r.Put("/users/{id}/billing", handlers.UpdateUserBilling)
+
+	r.Put("/users/{id}/plan", handlers.UpdateUserPlan)
+	r.Get("/users/{id}/usage", handlers.GetUserUsage)
+
+	r.Get("/users/{id}/payments", handlers.GetUserPayments)
 	r.Post("/users/{id}/payments", handlers.AddPayment)
 	r.Delete("/users/{id}/payments/{payment_id}", handlers.DeletePayment)
 }
@@ -0,0 +1,16 @@
+package routes
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/moevm/nosql2h24-transcribtion/handlers"
+)
+
+func WebhookRoutes(r chi.Router) {
+	r.Get("/users/{id}/webhooks", handlers.GetUserWebhooks)
+	r.Post("/users/{id}/webhooks", handlers.CreateUserWebhook)
+	r.Put("/users/{id}/webhooks/{webhook_id}", handlers.UpdateUserWebhook)
+	r.Delete("/users/{id}/webhooks/{webhook_id}", handlers.DeleteUserWebhook)
+
+	r.Get("/users/{id}/webhooks/{webhook_id}/deliveries", handlers.GetWebhookDeliveries)
+	r.Post("/users/{id}/webhooks/{webhook_id}/deliveries/{delivery_id}/redeliver", handlers.RedeliverWebhookDelivery)
+}
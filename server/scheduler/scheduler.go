@@ -3,13 +3,16 @@ package schedul
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/moevm/nosql2h24-transcribtion/models"
 	"math/rand"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func GetServers(serversCollection *mongo.Collection) ([]models.Server, error) {
@@ -55,3 +58,176 @@ func AddJobToServer(serversCollection *mongo.Collection, serverID primitive.Obje
 	)
 	return err
 }
+
+// FilterServersByLanguage оставляет серверы, которые умеют обрабатывать язык.
+// Сервер без списка языков считается универсальным.
+func FilterServersByLanguage(servers []models.Server, language string) []models.Server {
+	var suitable []models.Server
+	for _, server := range servers {
+		if len(server.Languages) == 0 {
+			suitable = append(suitable, server)
+			continue
+		}
+		for _, supported := range server.Languages {
+			if strings.EqualFold(supported, language) {
+				suitable = append(suitable, server)
+				break
+			}
+		}
+	}
+	return suitable
+}
+
+// FilterServersByLabels оставляет серверы, у которых есть все требуемые метки.
+func FilterServersByLabels(servers []models.Server, required []string) []models.Server {
+	if len(required) == 0 {
+		return servers
+	}
+	var suitable []models.Server
+	for _, server := range servers {
+		if hasAllLabels(server, required) {
+			suitable = append(suitable, server)
+		}
+	}
+	return suitable
+}
+
+func hasAllLabels(server models.Server, required []string) bool {
+	for _, label := range required {
+		found := false
+		for _, serverLabel := range server.Labels {
+			if serverLabel == label {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// ScheduleJob выбирает среди серверов, поддерживающих язык задачи и имеющих требуемые
+// метки, сервер с наименьшим числом задач и закрепляет за ним задачу.
+func ScheduleJob(serversCollection *mongo.Collection, job *models.Job) error {
+	servers, err := GetServers(serversCollection)
+	if err != nil {
+		return err
+	}
+
+	servers = FilterServersByLanguage(servers, job.SourceLanguage)
+	if len(servers) == 0 {
+		return fmt.Errorf("no servers support language %q", job.SourceLanguage)
+	}
+	servers = FilterServersByLabels(servers, job.Requirements)
+	if len(servers) == 0 {
+		return fmt.Errorf("no servers with labels %v support language %q", job.Requirements, job.SourceLanguage)
+	}
+
+	selectedServer, err := SelectServerWithMinJobs(servers)
+	if err != nil {
+		return err
+	}
+
+	job.HostID = selectedServer.ID
+	return AddJobToServer(serversCollection, selectedServer.ID, job.ID)
+}
+
+// Planner распределяет пачку задач по серверам в памяти: список серверов читается один раз,
+// а каждая следующая задача учитывает задачи, уже назначенные этой пачкой, поэтому
+// нагрузка распределяется равномерно. Назначения сохраняются одной операцией в Commit.
+type Planner struct {
+	servers  []models.Server
+	assigned map[primitive.ObjectID][]primitive.ObjectID
+}
+
+func NewPlanner(servers []models.Server) *Planner {
+	return &Planner{servers: servers, assigned: map[primitive.ObjectID][]primitive.ObjectID{}}
+}
+
+// Assign выбирает для задачи сервер, поддерживающий её язык и имеющий требуемые метки,
+// с наименьшим числом задач.
+func (p *Planner) Assign(job *models.Job) error {
+	var suitable []int
+	minJobs := int(^uint(0) >> 1)
+	for i, server := range p.servers {
+		if len(FilterServersByLanguage([]models.Server{server}, job.SourceLanguage)) == 0 || !hasAllLabels(server, job.Requirements) {
+			continue
+		}
+		switch {
+		case len(server.CurrentJobs) < minJobs:
+			minJobs = len(server.CurrentJobs)
+			suitable = []int{i}
+		case len(server.CurrentJobs) == minJobs:
+			suitable = append(suitable, i)
+		}
+	}
+	if len(suitable) == 0 {
+		return fmt.Errorf("no servers with labels %v support language %q", job.Requirements, job.SourceLanguage)
+	}
+
+	server := &p.servers[suitable[rand.Intn(len(suitable))]]
+	server.CurrentJobs = append(server.CurrentJobs, job.ID)
+	job.HostID = server.ID
+	p.assigned[server.ID] = append(p.assigned[server.ID], job.ID)
+	return nil
+}
+
+// Commit добавляет назначенные задачи в current_jobs серверов одной пакетной записью.
+func (p *Planner) Commit(serversCollection *mongo.Collection) error {
+	var writes []mongo.WriteModel
+	for serverID, jobs := range p.assigned {
+		if len(jobs) == 0 {
+			continue
+		}
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": serverID}).
+			SetUpdate(bson.M{"$push": bson.M{"current_jobs": bson.M{"$each": jobs}}}))
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+	_, err := serversCollection.BulkWrite(context.Background(), writes)
+	return err
+}
+
+// RemoveJobsFromServers убирает задачи из current_jobs их серверов, например если назначения
+// уже сохранены в Commit, а сами задачи сохранить не удалось. Задачи без сервера пропускаются.
+func RemoveJobsFromServers(serversCollection *mongo.Collection, jobs []models.Job) error {
+	byServer := map[primitive.ObjectID][]primitive.ObjectID{}
+	for _, job := range jobs {
+		if !job.HostID.IsZero() {
+			byServer[job.HostID] = append(byServer[job.HostID], job.ID)
+		}
+	}
+	var writes []mongo.WriteModel
+	for serverID, jobIDs := range byServer {
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": serverID}).
+			SetUpdate(bson.M{"$pull": bson.M{"current_jobs": bson.M{"$in": jobIDs}}}))
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+	_, err := serversCollection.BulkWrite(context.Background(), writes, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// FinishJobOnServer освобождает место завершённой задачи на её сервере: задача убирается
+// из current_jobs, а выполненная переносится в completed_jobs.
+func FinishJobOnServer(serversCollection *mongo.Collection, job models.Job, completed bool) error {
+	if job.HostID.IsZero() {
+		return nil
+	}
+	_, err := serversCollection.UpdateOne(context.Background(), bson.M{"_id": job.HostID}, finishUpdate(job.ID, completed))
+	return err
+}
+
+func finishUpdate(jobID primitive.ObjectID, completed bool) bson.M {
+	update := bson.M{"$pull": bson.M{"current_jobs": jobID}}
+	if completed {
+		update["$addToSet"] = bson.M{"completed_jobs": jobID}
+	}
+	return update
+}
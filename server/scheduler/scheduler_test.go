@@ -0,0 +1,64 @@
+package schedul
+
+import (
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestFinishUpdate(t *testing.T) {
+	jobID := primitive.NewObjectID()
+	tests := []struct {
+		name      string
+		completed bool
+		want      bson.M
+	}{
+		{
+			name:      "completed",
+			completed: true,
+			want: bson.M{
+				"$pull":     bson.M{"current_jobs": jobID},
+				"$addToSet": bson.M{"completed_jobs": jobID},
+			},
+		},
+		{
+			name: "failed",
+			want: bson.M{"$pull": bson.M{"current_jobs": jobID}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := finishUpdate(jobID, tt.completed); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("finishUpdate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlannerAssignPrefersLeastLoaded(t *testing.T) {
+	busy := models.Server{ID: primitive.NewObjectID(), CurrentJobs: []primitive.ObjectID{primitive.NewObjectID(), primitive.NewObjectID()}}
+	idle := models.Server{ID: primitive.NewObjectID()}
+	gpu := models.Server{ID: primitive.NewObjectID(), Labels: []string{"gpu"}}
+	planner := NewPlanner([]models.Server{busy, idle, gpu})
+
+	counts := map[primitive.ObjectID]int{}
+	for i := 0; i < 4; i++ {
+		job := models.Job{ID: primitive.NewObjectID()}
+		if err := planner.Assign(&job); err != nil {
+			t.Fatalf("Assign: %v", err)
+		}
+		counts[job.HostID]++
+	}
+	// Четыре задачи выравнивают нагрузку: по две на свободные серверы, занятому - ни одной
+	if counts[busy.ID] != 0 || counts[idle.ID] != 2 || counts[gpu.ID] != 2 {
+		t.Errorf("assignments busy %d, idle %d, gpu %d; want 0, 2, 2", counts[busy.ID], counts[idle.ID], counts[gpu.ID])
+	}
+
+	job := models.Job{ID: primitive.NewObjectID(), Requirements: []string{"gpu"}}
+	if err := planner.Assign(&job); err != nil || job.HostID != gpu.ID {
+		t.Errorf("job requiring gpu assigned to %v (%v), want %v", job.HostID, err, gpu.ID)
+	}
+}
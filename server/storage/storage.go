@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Dir - каталог, в котором хранятся загруженные файлы
+var Dir = "uploads"
+
+// Configure задаёт каталог хранения, если он указан в конфигурации.
+func Configure(dir string) {
+	if dir != "" {
+		Dir = dir
+	}
+}
+
+// Save сохраняет содержимое r, одновременно вычисляя его SHA-256. Файл хранится под именем
+// "<sha256><расширение исходного имени>", так что одинаковое содержимое сохраняется один раз.
+// Возвращает путь к файлу, размер и хеш.
+func Save(r io.Reader, name string) (string, int64, string, error) {
+	if err := os.MkdirAll(Dir, 0o755); err != nil {
+		return "", 0, "", err
+	}
+
+	tmp, err := os.CreateTemp(Dir, "upload-*")
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	path := filepath.Join(Dir, sum+strings.ToLower(filepath.Ext(name)))
+	if _, err := os.Stat(path); err == nil {
+		return path, size, sum, nil
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", 0, "", err
+	}
+	return path, size, sum, nil
+}
+
+// Remove удаляет сохранённый файл. Пути вне каталога хранения не трогаются:
+// входным файлом задачи может быть и файл, который сервис не загружал.
+// Возвращает true, если файл принадлежал хранилищу.
+func Remove(path string) (bool, error) {
+	if !Owns(path) {
+		return false, nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	return true, nil
+}
+
+// Owns проверяет, что путь указывает на файл внутри каталога хранения.
+func Owns(path string) bool {
+	dir, err := filepath.Abs(Dir)
+	if err != nil {
+		return false
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, abs)
+	return err == nil && rel != "." && !strings.HasPrefix(rel, "..")
+}
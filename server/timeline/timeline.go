@@ -0,0 +1,57 @@
+package timeline
+
+import (
+	"context"
+	"github.com/moevm/nosql2h24-transcribtion/db"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Collection - коллекция журнала событий задач. Записи только добавляются.
+const Collection = "job_events"
+
+// Типы событий журнала
+const (
+	Created           = "created"
+	Scheduled         = "scheduled"
+	AwaitingPayment   = "awaiting_payment"
+	Released          = "released"
+	Reused            = "reused"
+	LanguageDetected  = "language_detected"
+	Assigned          = "assigned"
+	Reassigned        = "reassigned"
+	Started           = "started"
+	Progress          = "progress"
+	StepStarted       = "step_started"
+	Completed         = "completed"
+	Failed            = "failed"
+	PaymentLinked     = "payment_linked"
+	PaymentUpdated    = "payment_updated"
+	RefundProposed    = "refund_proposed"
+	Charged           = "charged"
+	Downloaded        = "downloaded"
+	MediaPurged       = "media_purged"
+	TranscriptsPurged = "transcripts_purged"
+)
+
+// Details - дополнительные сведения о событии
+type Details map[string]interface{}
+
+// Record добавляет событие в журнал задачи. Журнал вспомогательный, поэтому ошибка
+// записи только логируется и не прерывает основную операцию.
+func Record(jobID primitive.ObjectID, eventType string, serverID primitive.ObjectID, details Details) {
+	event := models.TimelineEvent{
+		ID:        primitive.NewObjectID(),
+		JobID:     jobID,
+		Type:      eventType,
+		ServerID:  serverID,
+		Details:   details,
+		CreatedAt: time.Now(),
+	}
+	if _, err := db.GetCollection(Collection).InsertOne(context.Background(), event); err != nil {
+		log.Printf("Error recording %s event for job %v: %v", eventType, jobID, err)
+	}
+}
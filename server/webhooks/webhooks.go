@@ -0,0 +1,367 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// События, на которые можно подписать webhook
+const (
+	EventJobCompleted     = "job.completed"
+	EventJobFailed        = "job.failed"
+	EventPaymentSucceeded = "payment.succeeded"
+	EventPaymentRefunded  = "payment.refunded"
+)
+
+var Events = []string{EventJobCompleted, EventJobFailed, EventPaymentSucceeded, EventPaymentRefunded}
+
+// Статусы доставки
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// Параметры повторных попыток: после неудачи n-я попытка откладывается на BaseBackoff * 2^(n-1).
+const (
+	MaxAttempts   = 6
+	BaseBackoff   = 30 * time.Second
+	RetryInterval = 10 * time.Second
+)
+
+// Заголовки запроса. Подпись - HMAC-SHA256 секрета webhook от строки "<timestamp>.<тело запроса>".
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// Client - HTTP-клиент для отправки. Он подключается только к публичным адресам (см. allowedIP),
+// в том числе после перенаправлений и повторного разрешения имени. В тестах его можно заменить
+// клиентом локального стенда.
+var Client = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 5 * time.Second, Control: checkDial}).DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	},
+}
+
+// ErrForbiddenAddress - адрес webhook указывает во внутреннюю сеть или на сам сервис.
+var ErrForbiddenAddress = errors.New("webhook address is not public")
+
+// ValidateURL проверяет адрес webhook: схема http или https и публичный узел. Имя узла
+// разрешается, и все его адреса должны быть публичными; при отправке адрес проверяется снова.
+func ValidateURL(raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return errors.New("webhook URL must be an absolute http or https URL")
+	}
+	host := strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrForbiddenAddress
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !allowedIP(ip) {
+			return ErrForbiddenAddress
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("webhook host %s cannot be resolved", host)
+	}
+	for _, addr := range addrs {
+		if !allowedIP(addr.IP) {
+			return ErrForbiddenAddress
+		}
+	}
+	return nil
+}
+
+// allowedIP запрещает адреса, через которые webhook мог бы обратиться к внутренним сервисам:
+// loopback, частные сети, link-local (в том числе метаданные облака 169.254.169.254),
+// неуказанный адрес и multicast.
+func allowedIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// checkDial проверяет уже разрешённый адрес перед подключением, поэтому имя, которое после
+// регистрации стало указывать во внутреннюю сеть, тоже отклоняется.
+func checkDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !allowedIP(ip) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+	}
+	return nil
+}
+
+// IsKnownEvent проверяет, что на событие можно подписаться.
+func IsKnownEvent(event string) bool {
+	for _, known := range Events {
+		if event == known {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSecret генерирует секрет для подписи запросов.
+func NewSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Sign вычисляет подпись тела запроса для заголовка X-Webhook-Signature.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Backoff возвращает задержку перед следующей попыткой после attempts неудачных.
+func Backoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	return BaseBackoff * time.Duration(1<<(attempts-1))
+}
+
+// Dispatch создаёт доставки события для всех активных webhook пользователя,
+// подписанных на него, и сразу пытается их отправить в фоне.
+func Dispatch(webhooksCollection, deliveriesCollection *mongo.Collection, userID primitive.ObjectID, event string, data interface{}) error {
+	cursor, err := webhooksCollection.Find(context.Background(), bson.M{
+		"user_id": userID,
+		"active":  true,
+		"events":  event,
+	})
+	if err != nil {
+		return err
+	}
+	var hooks []models.Webhook
+	if err := cursor.All(context.Background(), &hooks); err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		now := time.Now()
+		delivery := models.WebhookDelivery{
+			ID:            primitive.NewObjectID(),
+			WebhookID:     hook.ID,
+			UserID:        hook.UserID,
+			Event:         event,
+			Status:        StatusPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		}
+
+		payload, err := json.Marshal(map[string]interface{}{
+			"id":         delivery.ID,
+			"event":      event,
+			"created_at": now,
+			"data":       data,
+		})
+		if err != nil {
+			return err
+		}
+		delivery.Payload = string(payload)
+
+		if _, err := deliveriesCollection.InsertOne(context.Background(), delivery); err != nil {
+			return err
+		}
+
+		go func(hook models.Webhook, delivery models.WebhookDelivery) {
+			if _, err := Attempt(deliveriesCollection, hook, delivery); err != nil {
+				log.Printf("Error delivering webhook %v: %v", delivery.ID, err)
+			}
+		}(hook, delivery)
+	}
+	return nil
+}
+
+// Attempt выполняет одну попытку доставки и сохраняет её результат.
+// Успехом считается любой ответ 2xx. После MaxAttempts неудач доставка помечается failed.
+func Attempt(deliveriesCollection *mongo.Collection, hook models.Webhook, delivery models.WebhookDelivery) (models.WebhookDelivery, error) {
+	return attempt(deliveriesCollection, hook, delivery, false)
+}
+
+// Redeliver повторно отправляет доставку по запросу пользователя, в том числе успешную или
+// исчерпавшую попытки. Отправка записывается в историю как ещё одна попытка; неудача не меняет
+// статус завершённой доставки и не возобновляет автоматические повторы.
+func Redeliver(deliveriesCollection *mongo.Collection, hook models.Webhook, delivery models.WebhookDelivery) (models.WebhookDelivery, error) {
+	return attempt(deliveriesCollection, hook, delivery, true)
+}
+
+func attempt(deliveriesCollection *mongo.Collection, hook models.Webhook, delivery models.WebhookDelivery, manual bool) (models.WebhookDelivery, error) {
+	code, sendErr := send(hook, delivery)
+	delivery = record(delivery, code, sendErr, manual, time.Now())
+	entry := delivery.History[len(delivery.History)-1]
+
+	set := bson.M{
+		"status":             delivery.Status,
+		"attempts":           delivery.Attempts,
+		"last_response_code": delivery.LastResponseCode,
+		"last_error":         delivery.LastError,
+		"updated_at":         delivery.UpdatedAt,
+	}
+	update := bson.M{"$set": set, "$push": bson.M{"history": entry}}
+	if delivery.NextAttemptAt.IsZero() {
+		update["$unset"] = bson.M{"next_attempt_at": ""}
+	} else {
+		set["next_attempt_at"] = delivery.NextAttemptAt
+	}
+	if !delivery.DeliveredAt.IsZero() {
+		set["delivered_at"] = delivery.DeliveredAt
+	}
+
+	_, err := deliveriesCollection.UpdateOne(context.Background(), bson.M{"_id": delivery.ID}, update)
+	return delivery, err
+}
+
+// record учитывает результат попытки в доставке: статус, время следующей попытки и историю.
+func record(delivery models.WebhookDelivery, code int, sendErr error, manual bool, now time.Time) models.WebhookDelivery {
+	delivery.Attempts++
+	delivery.LastResponseCode = code
+	delivery.LastError = ""
+	delivery.UpdatedAt = now
+	entry := models.WebhookAttempt{At: now, ResponseCode: code, Manual: manual}
+
+	switch {
+	case sendErr == nil:
+		delivery.Status = StatusSucceeded
+		delivery.DeliveredAt = now
+		delivery.NextAttemptAt = time.Time{}
+	case manual && delivery.Status != StatusPending:
+		delivery.LastError = sendErr.Error()
+	case delivery.Attempts >= MaxAttempts:
+		delivery.Status = StatusFailed
+		delivery.LastError = sendErr.Error()
+		delivery.NextAttemptAt = time.Time{}
+	default:
+		delivery.Status = StatusPending
+		delivery.LastError = sendErr.Error()
+		delivery.NextAttemptAt = now.Add(Backoff(delivery.Attempts))
+	}
+	entry.Error = delivery.LastError
+
+	delivery.History = append(delivery.History, entry)
+	return delivery
+}
+
+// RunRetries периодически повторяет отправку доставок, время следующей попытки которых наступило.
+func RunRetries(webhooksCollection, deliveriesCollection *mongo.Collection, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := retryDue(webhooksCollection, deliveriesCollection); err != nil {
+			log.Printf("Error retrying webhook deliveries: %v", err)
+		}
+	}
+}
+
+func retryDue(webhooksCollection, deliveriesCollection *mongo.Collection) error {
+	// Первую попытку Dispatch делает сам; если сервис упал раньше, доставка подхватывается через минуту
+	now := time.Now()
+	filter := bson.M{
+		"status":          StatusPending,
+		"next_attempt_at": bson.M{"$lte": now},
+		"$or": []bson.M{
+			{"attempts": bson.M{"$gt": 0}},
+			{"created_at": bson.M{"$lte": now.Add(-time.Minute)}},
+		},
+	}
+	cursor, err := deliveriesCollection.Find(context.Background(), filter, options.Find().SetLimit(100))
+	if err != nil {
+		return err
+	}
+	var deliveries []models.WebhookDelivery
+	if err := cursor.All(context.Background(), &deliveries); err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		var hook models.Webhook
+		err := webhooksCollection.FindOne(context.Background(), bson.M{"_id": delivery.WebhookID}).Decode(&hook)
+		if err != nil || !hook.Active {
+			// webhook удалён или отключён - дальше не пытаемся
+			_, err = deliveriesCollection.UpdateOne(context.Background(),
+				bson.M{"_id": delivery.ID},
+				bson.M{"$set": bson.M{"status": StatusFailed, "last_error": "webhook is not active", "updated_at": time.Now()}},
+			)
+			if err != nil {
+				log.Printf("Error updating webhook delivery %v: %v", delivery.ID, err)
+			}
+			continue
+		}
+		if _, err := Attempt(deliveriesCollection, hook, delivery); err != nil {
+			log.Printf("Error saving webhook delivery %v: %v", delivery.ID, err)
+		}
+	}
+	return nil
+}
+
+func send(hook models.Webhook, delivery models.WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, delivery.Event)
+	req.Header.Set(HeaderDelivery, delivery.ID.Hex())
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(hook.Secret, timestamp, body))
+
+	resp, err := Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,224 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"errors"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// receiver - тестовый получатель webhook, который проверяет подпись и отвечает заданными статусами.
+type receiver struct {
+	secret   string
+	statuses []int
+	requests int
+	verified int
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	timestamp, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+	if err == nil && hmac.Equal([]byte(r.Header.Get(HeaderSignature)), []byte(Sign(rc.secret, timestamp, body))) {
+		rc.verified++
+	}
+	status := http.StatusOK
+	if rc.requests < len(rc.statuses) {
+		status = rc.statuses[rc.requests]
+	}
+	rc.requests++
+	w.WriteHeader(status)
+}
+
+// localServer запускает тестового получателя и на время теста разрешает отправку на него:
+// обычный Client к loopback не подключается.
+func localServer(t *testing.T, rc *receiver) *httptest.Server {
+	server := httptest.NewServer(rc)
+	client := Client
+	Client = server.Client()
+	t.Cleanup(func() {
+		Client = client
+		server.Close()
+	})
+	return server
+}
+
+func newDelivery() models.WebhookDelivery {
+	return models.WebhookDelivery{
+		ID:      primitive.NewObjectID(),
+		Event:   EventJobCompleted,
+		Payload: `{"event":"job.completed"}`,
+		Status:  StatusPending,
+	}
+}
+
+func TestSendSignature(t *testing.T) {
+	rc := &receiver{secret: "right"}
+	server := localServer(t, rc)
+
+	delivery := newDelivery()
+	if _, err := send(models.Webhook{URL: server.URL, Secret: "right"}, delivery); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if _, err := send(models.Webhook{URL: server.URL, Secret: "wrong"}, delivery); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if rc.requests != 2 || rc.verified != 1 {
+		t.Errorf("requests %d, verified %d; want 2 and 1", rc.requests, rc.verified)
+	}
+}
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"a":1}`)
+	if Sign("s", 1, body) != Sign("s", 1, body) {
+		t.Error("signature is not deterministic")
+	}
+	for name, other := range map[string]string{
+		"secret":    Sign("t", 1, body),
+		"timestamp": Sign("s", 2, body),
+		"body":      Sign("s", 1, []byte(`{"a":2}`)),
+	} {
+		if other == Sign("s", 1, body) {
+			t.Errorf("signature does not depend on the %s", name)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, BaseBackoff},
+		{1, BaseBackoff},
+		{2, 2 * BaseBackoff},
+		{3, 4 * BaseBackoff},
+		{5, 16 * BaseBackoff},
+	}
+	for _, tt := range tests {
+		if got := Backoff(tt.attempts); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestRetriesUntilSuccess(t *testing.T) {
+	rc := &receiver{secret: "s", statuses: []int{http.StatusInternalServerError, http.StatusBadGateway}}
+	server := localServer(t, rc)
+	hook := models.Webhook{URL: server.URL, Secret: "s"}
+
+	delivery := newDelivery()
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i, want := range []int{http.StatusInternalServerError, http.StatusBadGateway} {
+		code, err := send(hook, delivery)
+		delivery = record(delivery, code, err, false, now)
+		if delivery.Status != StatusPending || delivery.LastResponseCode != want {
+			t.Fatalf("attempt %d: status %s, code %d", i+1, delivery.Status, delivery.LastResponseCode)
+		}
+		if !delivery.NextAttemptAt.Equal(now.Add(Backoff(i + 1))) {
+			t.Errorf("attempt %d: next attempt at %v", i+1, delivery.NextAttemptAt)
+		}
+	}
+
+	code, err := send(hook, delivery)
+	delivery = record(delivery, code, err, false, now)
+	if delivery.Status != StatusSucceeded || !delivery.DeliveredAt.Equal(now) || !delivery.NextAttemptAt.IsZero() {
+		t.Errorf("after success: %+v", delivery)
+	}
+	if delivery.Attempts != 3 || len(delivery.History) != 3 {
+		t.Errorf("attempts %d, history %d; want 3", delivery.Attempts, len(delivery.History))
+	}
+	if delivery.History[0].ResponseCode != http.StatusInternalServerError || delivery.History[0].Error == "" {
+		t.Errorf("first attempt not logged: %+v", delivery.History[0])
+	}
+	if rc.verified != 3 {
+		t.Errorf("verified %d requests, want 3", rc.verified)
+	}
+}
+
+func TestGivesUpAfterMaxAttempts(t *testing.T) {
+	delivery := newDelivery()
+	now := time.Now()
+	for i := 0; i < MaxAttempts; i++ {
+		delivery = record(delivery, http.StatusInternalServerError, errors.New("unexpected response status 500"), false, now)
+	}
+	if delivery.Status != StatusFailed || !delivery.NextAttemptAt.IsZero() {
+		t.Errorf("status %s, next attempt %v; want failed without retries", delivery.Status, delivery.NextAttemptAt)
+	}
+}
+
+func TestRedeliverKeepsHistory(t *testing.T) {
+	delivery := newDelivery()
+	now := time.Now()
+	for i := 0; i < MaxAttempts; i++ {
+		delivery = record(delivery, 0, errors.New("connection refused"), false, now)
+	}
+
+	delivery = record(delivery, http.StatusServiceUnavailable, errors.New("unexpected response status 503"), true, now)
+	if delivery.Status != StatusFailed || !delivery.NextAttemptAt.IsZero() {
+		t.Errorf("failed redelivery resumed retries: %+v", delivery)
+	}
+
+	delivery = record(delivery, http.StatusOK, nil, true, now)
+	if delivery.Status != StatusSucceeded {
+		t.Errorf("status %s, want succeeded", delivery.Status)
+	}
+	if delivery.Attempts != MaxAttempts+2 || len(delivery.History) != MaxAttempts+2 {
+		t.Errorf("attempts %d, history %d; want %d", delivery.Attempts, len(delivery.History), MaxAttempts+2)
+	}
+	last := delivery.History[len(delivery.History)-1]
+	if !last.Manual || delivery.History[0].Manual {
+		t.Error("manual attempts are not marked in the history")
+	}
+}
+
+func TestSendRejectsInternalAddress(t *testing.T) {
+	rc := &receiver{secret: "s"}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	_, err := send(models.Webhook{URL: server.URL, Secret: "s"}, newDelivery())
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("send to %s: error %v, want %v", server.URL, err, ErrForbiddenAddress)
+	}
+	if rc.requests != 0 {
+		t.Errorf("receiver got %d requests, want 0", rc.requests)
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"https://93.184.216.34/hooks", false},
+		{"http://[2606:2800:220:1:248:1893:25c8:1946]:8080/hooks", false},
+		{"ftp://93.184.216.34/hooks", true},
+		{"/hooks", true},
+		{"https://", true},
+		{"http://localhost:8080/hooks", true},
+		{"http://api.localhost/hooks", true},
+		{"http://127.0.0.1/hooks", true},
+		{"http://10.0.0.5/hooks", true},
+		{"http://172.16.1.1/hooks", true},
+		{"http://192.168.1.10/hooks", true},
+		{"http://169.254.169.254/latest/meta-data", true},
+		{"http://0.0.0.0/hooks", true},
+		{"http://[::1]/hooks", true},
+		{"http://[fd00::1]/hooks", true},
+		{"http://[fe80::1]/hooks", true},
+		{"http://[::ffff:127.0.0.1]/hooks", true},
+	}
+	for _, tt := range tests {
+		err := ValidateURL(tt.url)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ValidateURL(%q) = %v, wantErr %v", tt.url, err, tt.wantErr)
+		}
+	}
+}
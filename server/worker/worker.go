@@ -0,0 +1,156 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/moevm/nosql2h24-transcribtion/engine"
+	"github.com/moevm/nosql2h24-transcribtion/glossary"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Движок и переводчик, которыми пользуется воркер. По умолчанию - детерминированные заглушки.
+var (
+	Engine     engine.Engine     = engine.StubEngine{}
+	Translator engine.Translator = engine.StubTranslator{}
+)
+
+// Process выполняет задачу: расшифровывает запись и переводит её на целевые языки.
+// Расшифровки шагов конвейера сохраняются от имени родительской задачи, поэтому
+// пользователь скачивает результат по идентификатору конвейера.
+func Process(ctx context.Context, transcriptsCollection *mongo.Collection, job models.Job, g *models.Glossary) error {
+	var previous *models.Transcript
+	if job.Type == "translation" {
+		// Переводится расшифровка, полученная на предыдущем шаге конвейера
+		var original models.Transcript
+		err := transcriptsCollection.FindOne(ctx, bson.M{"job_id": rootJobID(job), "original": true}).Decode(&original)
+		if err != nil {
+			return fmt.Errorf("no transcript to translate: %w", err)
+		}
+		previous = &original
+	}
+
+	transcripts, err := Transcribe(ctx, job, g, previous)
+	if err != nil {
+		return err
+	}
+	for _, transcript := range transcripts {
+		if err := saveTranscript(ctx, transcriptsCollection, transcript); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Transcribe выполняет задачу движком и переводчиком, ничего не сохраняя, и возвращает
+// расшифровки для сохранения: исходную (для распознавания) и переводы на целевые языки.
+// previous - исходная расшифровка предыдущего шага, нужна шагу translation.
+// Если задан словарь, его термины передаются движку как подсказки, а правила
+// замены применяются к каждой расшифровке.
+func Transcribe(ctx context.Context, job models.Job, g *models.Glossary, previous *models.Transcript) ([]models.Transcript, error) {
+	rootID := rootJobID(job)
+	transcripts := []models.Transcript{}
+
+	var original models.Transcript
+	switch job.Type {
+	case "", "transcription":
+		request := engine.Request{
+			InputFile:   job.InputFile,
+			Language:    job.SourceLanguage,
+			Diarization: job.Diarization,
+		}
+		if g != nil {
+			request.Hints = glossary.Hints(*g)
+		}
+		result, err := Engine.Transcribe(ctx, request)
+		if err != nil {
+			return nil, fmt.Errorf("transcription failed: %w", err)
+		}
+		segments := result.Segments
+		if g != nil {
+			segments = glossary.Apply(*g, segments)
+		}
+		original = models.Transcript{
+			JobID:    rootID,
+			Language: result.Language,
+			Original: true,
+			Segments: segments,
+			Speakers: result.Speakers,
+		}
+		transcripts = append(transcripts, original)
+	case "translation":
+		if previous == nil {
+			return nil, errors.New("no transcript to translate")
+		}
+		original = *previous
+	default:
+		return transcripts, nil
+	}
+
+	// Внутри конвейера перевод выполняется отдельным шагом
+	if job.Type == "transcription" && !job.ParentID.IsZero() {
+		return transcripts, nil
+	}
+
+	for _, language := range job.TargetLanguages {
+		if language == original.Language {
+			continue
+		}
+		segments, err := Translator.Translate(ctx, original.Segments, original.Language, language)
+		if err != nil {
+			return nil, fmt.Errorf("translation to %s failed: %w", language, err)
+		}
+		if g != nil {
+			segments = glossary.Apply(*g, segments)
+		}
+		transcripts = append(transcripts, models.Transcript{
+			JobID:    rootID,
+			Language: language,
+			Segments: segments,
+			Speakers: original.Speakers,
+		})
+	}
+	return transcripts, nil
+}
+
+// rootJobID возвращает задачу, от имени которой сохраняются расшифровки: конвейер для его шагов.
+func rootJobID(job models.Job) primitive.ObjectID {
+	if !job.ParentID.IsZero() {
+		return job.ParentID
+	}
+	return job.ID
+}
+
+// saveTranscript сохраняет расшифровку, заменяя предыдущую для той же задачи и языка.
+func saveTranscript(ctx context.Context, transcriptsCollection *mongo.Collection, transcript models.Transcript) error {
+	now := time.Now()
+	_, err := transcriptsCollection.UpdateOne(ctx,
+		bson.M{"job_id": transcript.JobID, "language": transcript.Language},
+		bson.M{
+			"$set": bson.M{
+				"original":   transcript.Original,
+				"segments":   transcript.Segments,
+				"speakers":   transcript.Speakers,
+				"updated_at": now,
+			},
+			"$setOnInsert": bson.M{"created_at": now},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// DetectLanguage выполняет облегчённый первый проход движка, определяющий язык записи.
+func DetectLanguage(ctx context.Context, job models.Job) (engine.Detection, error) {
+	detection, err := Engine.DetectLanguage(ctx, engine.Request{InputFile: job.InputFile})
+	if err != nil {
+		return engine.Detection{}, fmt.Errorf("language detection failed: %w", err)
+	}
+	return detection, nil
+}
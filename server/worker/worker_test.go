@@ -0,0 +1,125 @@
+package worker
+
+import (
+	"context"
+	"testing"
+
+	"github.com/moevm/nosql2h24-transcribtion/engine"
+	"github.com/moevm/nosql2h24-transcribtion/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestTranscribe(t *testing.T) {
+	jobID := primitive.NewObjectID()
+	parentID := primitive.NewObjectID()
+
+	tests := []struct {
+		name      string
+		job       models.Job
+		glossary  *models.Glossary
+		languages []string
+		firstText string
+	}{
+		{
+			name:      "transcription only",
+			job:       models.Job{ID: jobID, InputFile: "talk.mp3", SourceLanguage: "en"},
+			languages: []string{"en"},
+			firstText: "talk.mp3, part 1.",
+		},
+		{
+			name:      "translations skip source language",
+			job:       models.Job{ID: jobID, InputFile: "talk.mp3", SourceLanguage: "en", TargetLanguages: []string{"es", "en", "de"}},
+			languages: []string{"en", "es", "de"},
+			firstText: "talk.mp3, part 1.",
+		},
+		{
+			name:      "pipeline transcription step leaves translation to the next step",
+			job:       models.Job{ID: jobID, ParentID: parentID, Type: "transcription", InputFile: "talk.mp3", SourceLanguage: "en", TargetLanguages: []string{"es"}},
+			languages: []string{"en"},
+			firstText: "talk.mp3, part 1.",
+		},
+		{
+			name: "glossary applies to original and translations",
+			job:  models.Job{ID: jobID, InputFile: "talk.mp3", SourceLanguage: "en", TargetLanguages: []string{"fr"}},
+			glossary: &models.Glossary{Rules: []models.ReplacementRule{
+				{From: "part", To: "chunk"},
+			}},
+			languages: []string{"en", "fr"},
+			firstText: "talk.mp3, chunk 1.",
+		},
+		{
+			name:      "summarization produces nothing",
+			job:       models.Job{ID: jobID, ParentID: parentID, Type: "summarization", InputFile: "talk.mp3"},
+			languages: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transcripts, err := Transcribe(context.Background(), tt.job, tt.glossary, nil)
+			if err != nil {
+				t.Fatalf("Transcribe: %v", err)
+			}
+			if len(transcripts) != len(tt.languages) {
+				t.Fatalf("got %d transcripts, want %v", len(transcripts), tt.languages)
+			}
+			for i, transcript := range transcripts {
+				if transcript.Language != tt.languages[i] {
+					t.Errorf("transcript %d language = %q, want %q", i, transcript.Language, tt.languages[i])
+				}
+				if transcript.JobID != rootJobID(tt.job) {
+					t.Errorf("transcript %d saved for %v, want %v", i, transcript.JobID, rootJobID(tt.job))
+				}
+				if transcript.Original != (i == 0) {
+					t.Errorf("transcript %d original = %v", i, transcript.Original)
+				}
+			}
+			if len(transcripts) > 0 && transcripts[0].Segments[0].Text != tt.firstText {
+				t.Errorf("first segment = %q, want %q", transcripts[0].Segments[0].Text, tt.firstText)
+			}
+		})
+	}
+}
+
+// Конвейер из распознавания и перевода: результат первого шага - вход второго
+func TestTranscribePipeline(t *testing.T) {
+	parentID := primitive.NewObjectID()
+	step := func(kind string) models.Job {
+		return models.Job{
+			ID:              primitive.NewObjectID(),
+			ParentID:        parentID,
+			Type:            kind,
+			InputFile:       "meeting_de.wav",
+			SourceLanguage:  "de",
+			TargetLanguages: []string{"en", "ru"},
+			Diarization:     true,
+		}
+	}
+
+	first, err := Transcribe(context.Background(), step("transcription"), nil, nil)
+	if err != nil || len(first) != 1 {
+		t.Fatalf("transcription step: %v, %d transcripts", err, len(first))
+	}
+	second, err := Transcribe(context.Background(), step("translation"), nil, &first[0])
+	if err != nil {
+		t.Fatalf("translation step: %v", err)
+	}
+	if len(second) != 2 {
+		t.Fatalf("got %d translations, want 2", len(second))
+	}
+	for i, language := range []string{"en", "ru"} {
+		translation := second[i]
+		if translation.Language != language || translation.Original || translation.JobID != parentID {
+			t.Errorf("translation %d = %s original=%v job=%v", i, translation.Language, translation.Original, translation.JobID)
+		}
+		if want := "[" + language + "] " + first[0].Segments[0].Text; translation.Segments[0].Text != want {
+			t.Errorf("translation %d text = %q, want %q", i, translation.Segments[0].Text, want)
+		}
+		if len(translation.Speakers) != engine.StubSpeakerCount {
+			t.Errorf("translation %d lost speakers", i)
+		}
+	}
+
+	if _, err := Transcribe(context.Background(), step("translation"), nil, nil); err == nil {
+		t.Error("translation step without a transcript must fail")
+	}
+}